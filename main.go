@@ -1,16 +1,22 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/alecthomas/kong"
+	"github.com/paulmach/orb"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	"github.com/protomaps/go-pmtiles/pmtiles"
@@ -46,45 +52,142 @@ var cli struct {
 
 	Cluster struct {
 		Input           string `arg:"" help:"Input archive" type:"existingfile"`
+		Output          string `arg:"" optional:"" help:"Output archive, instead of rewriting the input in place" type:"path"`
 		NoDeduplication bool   `help:"Don't attempt to deduplicate tiles"`
+		Force           bool   `help:"Rewrite an archive that is already clustered"`
+		Tmpdir          string `help:"An optional path to a folder for temporary files" type:"existingdir"`
 	} `cmd:"" help:"Cluster an unclustered local archive, optimizing the size and layout"`
 
+	Compact struct {
+		Input       string `arg:"" help:"Input local archive" type:"existingfile"`
+		Output      string `arg:"" help:"Output archive" type:"path"`
+		Deduplicate bool   `help:"Store identical tile contents once, also when the input stores them several times"`
+		Tmpdir      string `help:"An optional path to a folder for temporary files" type:"existingdir"`
+	} `cmd:"" help:"Remove zero-length tile entries from a local archive"`
+
 	Edit struct {
 		Input      string `arg:"" help:"Input archive" type:"existingfile"`
 		HeaderJson string `help:"Input header JSON file (written by show --header-json)" type:"existingfile"`
 		Metadata   string `help:"Input metadata JSON (written by show --metadata)" type:"existingfile"`
 	} `cmd:"" help:"Edit JSON metadata or parts of the header"`
 
+	Fix struct {
+		Input  string `arg:"" help:"Input local archive" type:"existingfile"`
+		Bounds bool   `help:"Also recompute the bounds from the extent of the tiles at the maximum zoom level"`
+		DryRun bool   `help:"Print the changes to the header without writing them"`
+	} `cmd:"" help:"Recompute the tile counts and zoom levels in the header of a local archive from its directories"`
+
 	Extract struct {
-		Input           string  `arg:"" help:"Input local or remote archive"`
-		Output          string  `arg:"" help:"Output archive" type:"path"`
-		Bucket          string  `help:"Remote bucket of input archive"`
-		Region          string  `help:"local GeoJSON Polygon or MultiPolygon file for area of interest" type:"existingfile"`
-		Bbox            string  `help:"bbox area of interest: min_lon,min_lat,max_lon,max_lat" type:"string"`
-		Minzoom         int8    `default:"-1" help:"Minimum zoom level, inclusive"`
-		Maxzoom         int8    `default:"-1" help:"Maximum zoom level, inclusive"`
-		DownloadThreads int     `default:"4" help:"Number of download threads"`
-		DryRun          bool    `help:"Calculate tiles to extract, but don't download them"`
-		Overfetch       float32 `default:"0.05" help:"What ratio of extra data to download to minimize # requests; 0.2 is 20%"`
+		Input           string        `arg:"" help:"Input local or remote archive"`
+		Output          string        `arg:"" optional:"" help:"Output archive, or none with --output-template" type:"path"`
+		Bucket          string        `help:"Remote bucket of input archive"`
+		Region          string        `help:"local GeoJSON Polygon or MultiPolygon file for area of interest, or with --output-template a FeatureCollection of regions" type:"existingfile"`
+		OutputTemplate  string        `help:"Extract an archive for each feature of the --region FeatureCollection in one pass, named like out-{id}.pmtiles"`
+		IdProperty      string        `help:"Feature property replacing {id} in --output-template; empty uses the feature id"`
+		Bbox            string        `help:"bbox area of interest: min_lon,min_lat,max_lon,max_lat" type:"string"`
+		RegionName      string        `help:"Name of the area of interest in --boundaries, matched ignoring case"`
+		Boundaries      string        `help:"GeoJSON FeatureCollection or FlatGeobuf file or URL of the areas named by --region-name"`
+		RegionProperty  string        `default:"name" help:"Feature property of --boundaries matched against --region-name, such as ISO_A2"`
+		Minzoom         int8          `default:"-1" help:"Minimum zoom level, inclusive"`
+		Maxzoom         int8          `default:"-1" help:"Maximum zoom level, inclusive"`
+		DownloadThreads int           `default:"4" help:"Number of download threads"`
+		DryRun          bool          `help:"Calculate tiles to extract, but don't download them"`
+		Format          string        `default:"table" enum:"table,json" help:"Output format of the --dry-run estimate without --output-template: table or json"`
+		Overfetch       float32       `default:"0.05" help:"What ratio of extra data to download to minimize # requests; 0.2 is 20%"`
+		Retries         int           `default:"3" help:"Number of times a failed range request is attempted again, 0 to not retry"`
+		RetryBaseDelay  time.Duration `default:"100ms" help:"Wait before the first retry of a range request, doubled after every attempt"`
+		MaxBandwidth    int64         `help:"Largest average number of bytes per second read from the input, shared by all download threads; 0 for no limit"`
+		MaxRequestRate  float64       `name:"max-requests-per-second" help:"Largest average number of range requests per second to the input; 0 for no limit"`
 	} `cmd:"" help:"Create an archive from a larger archive for a subset of zoom levels or geographic region"`
 
 	Merge struct {
-		Output string   `arg:"" help:"Output archive" type:"path"`
-		Input  []string `arg:"" help:"Input archives"`
+		Output          string   `arg:"" help:"Output archive" type:"path"`
+		Input           []string `arg:"" help:"Input archives"`
+		NoDeduplication bool     `help:"Don't attempt to deduplicate tiles"`
+		OnConflict      string   `help:"What to do with a tile in several inputs: keep the first or last, or fail unless identical" enum:"first,last,error" default:"last"`
+		MetadataJSON    string   `name:"metadata-json" help:"Path to a JSON object of metadata keys to set on the merged archive" type:"existingfile"`
+		Tmpdir          string   `help:"An optional path to a folder for temporary files" type:"existingdir"`
 	} `cmd:"" help:"Merge multiple archives into a single archive"`
 
+	Split struct {
+		Input          string `arg:"" help:"Input local archive" type:"existingfile"`
+		ByZoom         string `help:"Comma-separated zoom ranges, one output per range, e.g. 0-8,9-12,13-15" required:""`
+		OutputTemplate string `help:"Output path with {range}, or {min} and {max}, replaced by the zoom range" default:"out-z{range}.pmtiles"`
+		Tmpdir         string `help:"An optional path to a folder for temporary files" type:"existingdir"`
+	} `cmd:"" help:"Split a local archive into one archive per zoom range"`
+
 	Convert struct {
-		Input           string `arg:"" help:"Input archive" type:"existingfile"`
-		Output          string `arg:"" help:"Output archive" type:"path"`
-		Force           bool   `help:"Force removal"`
-		NoDeduplication bool   `help:"Don't attempt to deduplicate tiles"`
-		Tmpdir          string `help:"An optional path to a folder for temporary files" type:"existingdir"`
-	} `cmd:"" help:"Convert an MBTiles or older spec version to PMTiles"`
+		Input               string        `arg:"" help:"Input archive or Z/X/Y tile directory, or the URL of a remote archive to extract to a directory"`
+		Output              string        `arg:"" help:"Output archive, or - to write the archive to stdout" type:"path"`
+		Force               bool          `help:"Overwrite an existing output archive"`
+		NoDeduplication     bool          `help:"Don't attempt to deduplicate tiles"`
+		Tmpdir              string        `help:"An optional path to a folder for temporary files" type:"existingdir"`
+		Compression         string        `default:"gzip" enum:"gzip,zstd,brotli" help:"Compression for directories and metadata, and vector tiles unless --tile-compression is set: gzip, zstd or brotli"`
+		TileCompression     string        `help:"Compression for vector tiles: gzip, zstd, brotli or none"`
+		InternalCompression string        `help:"Compression for directories and metadata: gzip, zstd, brotli or none; defaults to --compression"`
+		RootDirSize         int           `help:"Largest root directory in bytes before entries move to leaf directories; defaults to 16384 less the header, a larger root suits archives served from local disk"`
+		NoLeafDirs          bool          `help:"Put every entry in the root directory"`
+		CompressionLevel    int           `default:"9" help:"Gzip compression level for vector tiles, from 1 (fastest) to 9 (smallest)"`
+		NoRecompress        bool          `help:"Store source tiles byte-for-byte, for inputs whose tiles already use the tile compression"`
+		Recompress          bool          `help:"Decompress and compress again every vector tile of MBTiles and older PMTiles input"`
+		Scheme              string        `default:"xyz" enum:"xyz,tms" help:"Row numbering of an input tile directory, or of a directory extracted from a PMTiles archive: xyz or tms"`
+		TileType            string        `help:"Tile type of an input tile directory instead of detecting it from file extensions: mvt, png, jpg, webp or avif"`
+		Minzoom             int8          `default:"-1" help:"Minimum zoom level to convert, inclusive"`
+		Maxzoom             int8          `default:"-1" help:"Maximum zoom level to convert, inclusive"`
+		Workers             int           `help:"Number of parallel tile readers and compressors for MBTiles and older PMTiles input, or of directory creators and tile writers when extracting to a directory; 0 uses all CPUs"`
+		DedupeInput         bool          `help:"Keep the first of duplicated tiles in older PMTiles input instead of failing"`
+		NoTmpfile           bool          `help:"Write tile data directly into the output instead of a temporary file, placing leaf directories after the tiles"`
+		DedupIndex          string        `default:"memory" enum:"memory,disk" help:"Where to index tile contents for deduplication: memory, or disk to bound memory use for very large archives at the cost of speed"`
+		DedupMemory         int64         `default:"256" help:"Memory budget in MB of the disk deduplication index"`
+		Hash                string        `default:"xxh3" enum:"xxh3,fnv" help:"Hash function for deduplicating tiles: xxh3, or fnv as in earlier versions"`
+		MetadataSet         []string      `help:"Set a metadata key, as key=value, replacing the value from the input; repeatable" sep:"none"`
+		MetadataJson        string        `help:"Path to a JSON object of metadata keys replacing those from the input" type:"existingfile"`
+		InferVectorLayers   bool          `help:"Infer vector_layers metadata of MVT input from a sample of tiles at the maximum zoom level when it is missing"`
+		TrustTileData       bool          `help:"Use the tile type detected from MBTiles tile data when it disagrees with the format in the metadata, instead of failing"`
+		OnTileError         string        `default:"abort" enum:"abort,skip,log" help:"What to do with a tile that cannot be read: abort the conversion, skip it, or log it to the tile error log and skip it"`
+		TileErrorLog        string        `help:"JSON lines file of tiles skipped with --on-tile-error=log; defaults to errors.jsonl next to the output" type:"path"`
+		Resume              bool          `help:"Save progress of an MBTiles conversion to the temp folder, and continue from it when run again with the same arguments; when extracting a PMTiles archive to a directory, skip tiles already extracted"`
+		Progress            string        `help:"Progress output on stderr: bar, json for newline-delimited events and a final summary, or none; defaults to bar if stderr is a terminal and none otherwise"`
+		ProgressInterval    int           `default:"10" help:"Seconds between events of --progress=json"`
+		TilejsonBaseUrl     string        `help:"Base URL of the tiles in the tilejson.json of a PMTiles archive extracted to a directory; defaults to URLs relative to the directory"`
+		Decompress          bool          `help:"Write the tiles of a PMTiles archive extracted to a directory without their tile compression" xor:"decompress"`
+		KeepCompression     bool          `help:"Write the tiles of a PMTiles archive extracted to a directory as stored, the default" xor:"decompress"`
+		Extension           string        `help:"File extension of the tiles of a PMTiles archive extracted to a directory, such as pbf; defaults to one for the tile type"`
+		Overwrite           bool          `help:"Replace existing tile files when extracting a PMTiles archive to a directory, which otherwise fails if the directory has tiles"`
+		SkipExisting        bool          `help:"Keep existing tile files when extracting a PMTiles archive to a directory, writing only the missing ones"`
+		OnWriteError        string        `default:"abort" enum:"abort,skip" help:"What to do with a tile that cannot be written when extracting a PMTiles archive to a directory: abort, or skip it and fail at the end"`
+		PathTemplate        string        `help:"Path of each tile of a PMTiles archive extracted to a directory, with {z}, {x}, {y} and {ext} placeholders, such as tiles/{z}-{x}-{y}.{ext}; defaults to {z}/{x}/{y}.{ext}"`
+		PrecreateDirs       bool          `help:"Create every column directory up to the maximum zoom level when extracting a PMTiles archive to a directory, not only those of the tiles"`
+		StatsOut            string        `help:"Write a JSON report of deduplication, per-zoom tile counts and sizes, the largest tiles and section sizes to this path" type:"path"`
+		Layer               string        `help:"Tile table of a GeoPackage input with several tile layers"`
+		Bbox                string        `help:"Only convert the tiles overlapping a min_lon,min_lat,max_lon,max_lat bounding box"`
+		OptimizeRle         bool          `help:"Merge adjacent entries with the same contents into longer runs before writing the directories"`
+		Stream              bool          `help:"Convert MBTiles in a single pass, sorting tiles through temporary files instead of collecting all tile IDs in memory first"`
+		StreamMemory        int           `default:"512" help:"Megabytes of tiles sorted in memory by --stream before writing them to a temporary file"`
+		DownloadThreads     int           `default:"4" help:"Number of range requests made at once when extracting a remote archive to a directory"`
+		Retries             int           `default:"3" help:"Number of times a failed range request to a remote archive is attempted again, 0 to not retry"`
+		RetryBaseDelay      time.Duration `default:"100ms" help:"Wait before the first retry of a range request to a remote archive, doubled after every attempt"`
+		MaxBandwidth        int64         `help:"Largest average number of bytes per second read from a remote archive, shared by all download threads; 0 for no limit"`
+		MaxRequestRate      float64       `name:"max-requests-per-second" help:"Largest average number of range requests per second to a remote archive; 0 for no limit"`
+		ReadBuffer          int           `default:"4" help:"Megabytes of adjacent tile data read at once when extracting to a directory or bundle, 0 to read every tile separately"`
+		FixBounds           bool          `help:"Set the bounds in the header of a PMTiles output to the extent of its tiles at all zoom levels"`
+	} `cmd:"" help:"Convert an MBTiles, GeoPackage, CSV, older spec version or Z/X/Y tile directory to PMTiles, or PMTiles to MBTiles"`
 
 	Verify struct {
 		Input string `arg:"" help:"Input archive" type:"existingfile"`
 	} `cmd:"" help:"Verify the correctness of an archive structure, without verifying individual tile contents"`
 
+	Count struct {
+		Input   string `arg:"" help:"Input archive" type:"existingfile"`
+		Recount bool   `help:"Count tiles from the directories instead of the header, warning if they differ"`
+	} `cmd:"" help:"Print the tile counts of a local archive"`
+
+	Benchmark struct {
+		Input      string `arg:"" help:"Input archive" type:"existingfile"`
+		Tiles      int    `default:"10000" help:"Number of tiles to read"`
+		Sequential bool   `help:"Read the first tiles in tile ID order instead of random tile IDs"`
+	} `cmd:"" help:"Measure the tile read throughput and latency of a local archive, printed as JSON"`
+
 	Makesync struct {
 		Input        string `arg:"" type:"existingfile"`
 		BlockSizeKb  int    `default:"20" help:"The approximate block size, in kilobytes; 0 means 1 tile = 1 block"`
@@ -99,7 +202,7 @@ var cli struct {
 	} `cmd:"" help:"" hidden:""`
 
 	Serve struct {
-		Path      string `arg:"" help:"Local path or bucket prefix"`
+		Path      string `arg:"" help:"Local path or bucket prefix, or a local archive to serve at /{z}/{x}/{y}, / and /tilejson.json"`
 		Interface string `default:"0.0.0.0"`
 		Port      int    `default:"8080"`
 		AdminPort int    `default:"-1"`
@@ -107,6 +210,8 @@ var cli struct {
 		CacheSize int    `default:"64" help:"Size of cache in megabytes"`
 		Bucket    string `help:"Remote bucket"`
 		PublicURL string `help:"Public base URL of tile endpoint for TileJSON e.g. https://example.com/tiles/"`
+
+		DisableTranscoding bool `help:"Serve gzipped vector tiles as stored even to clients not accepting gzip"`
 	} `cmd:"" help:"Run an HTTP proxy server for Z/X/Y tiles"`
 
 	Upload struct {
@@ -140,11 +245,25 @@ func main() {
 			logger.Fatalf("Failed to show tile, %v", err)
 		}
 	case "serve <path>":
+		if info, err := os.Stat(cli.Serve.Path); cli.Serve.Bucket == "" && err == nil && info.Mode().IsRegular() {
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+			opts := pmtiles.ServerOptions{PublicURL: cli.Serve.PublicURL, DisableTranscoding: cli.Serve.DisableTranscoding}
+			if cli.Serve.Cors != "" {
+				opts.CorsOrigins = strings.Split(cli.Serve.Cors, ",")
+			}
+			err := pmtiles.ListenAndServeArchive(ctx, logger, cli.Serve.Interface+":"+strconv.Itoa(cli.Serve.Port), cli.Serve.Path, opts)
+			if err != nil {
+				logger.Fatalf("Failed to serve %s, %v", cli.Serve.Path, err)
+			}
+			break
+		}
 		server, err := pmtiles.NewServer(cli.Serve.Bucket, cli.Serve.Path, logger, cli.Serve.CacheSize, cli.Serve.PublicURL)
 
 		if err != nil {
 			logger.Fatalf("Failed to create new server, %v", err)
 		}
+		server.DisableTranscoding = cli.Serve.DisableTranscoding
 
 		pmtiles.SetBuildInfo(version, commit, date)
 		server.Start()
@@ -174,36 +293,106 @@ func main() {
 		} else {
 			logger.Fatal(startHTTPServer(cli.Serve.Interface+":"+strconv.Itoa(cli.Serve.Port), mux))
 		}
+	case "extract <input>":
+		if cli.Extract.OutputTemplate == "" && cli.Extract.DryRun {
+			estimateExtract(logger)
+			break
+		}
+		if cli.Extract.OutputTemplate == "" || cli.Extract.Region == "" {
+			logger.Fatalf("Extracting without an output needs --output-template and --region")
+		}
+		_, err := pmtiles.ExtractRegions(logger, cli.Extract.Bucket, cli.Extract.Input, cli.Extract.Minzoom, cli.Extract.Maxzoom, cli.Extract.Region, cli.Extract.IdProperty, cli.Extract.OutputTemplate, cli.Extract.DownloadThreads, cli.Extract.Overfetch, extractRetry(), extractRateLimit(), cli.Extract.DryRun)
+		if err != nil {
+			logger.Fatalf("Failed to extract, %v", err)
+		}
 	case "extract <input> <output>":
-		err := pmtiles.Extract(logger, cli.Extract.Bucket, cli.Extract.Input, cli.Extract.Minzoom, cli.Extract.Maxzoom, cli.Extract.Region, cli.Extract.Bbox, cli.Extract.Output, cli.Extract.DownloadThreads, cli.Extract.Overfetch, cli.Extract.DryRun)
+		if cli.Extract.OutputTemplate != "" {
+			logger.Fatalf("--output-template replaces the output argument")
+		}
+		if cli.Extract.DryRun {
+			estimateExtract(logger)
+			break
+		}
+		err := pmtiles.ExtractGeometry(logger, cli.Extract.Bucket, cli.Extract.Input, cli.Extract.Minzoom, cli.Extract.Maxzoom, extractRegion(logger), cli.Extract.Output, cli.Extract.DownloadThreads, cli.Extract.Overfetch, extractRetry(), extractRateLimit(), cli.Extract.DryRun)
 		if err != nil {
 			logger.Fatalf("Failed to extract, %v", err)
 		}
-	case "cluster <input>":
-		err := pmtiles.Cluster(logger, cli.Cluster.Input, !cli.Cluster.NoDeduplication)
+	case "cluster <input>", "cluster <input> <output>":
+		err := pmtiles.ClusterWithOptions(logger, cli.Cluster.Input, pmtiles.ClusterOptions{
+			Output:      cli.Cluster.Output,
+			Deduplicate: !cli.Cluster.NoDeduplication,
+			Force:       cli.Cluster.Force,
+			TmpDir:      cli.Cluster.Tmpdir,
+		})
 		if err != nil {
 			logger.Fatalf("Failed to cluster, %v", err)
 		}
+	case "compact <input> <output>":
+		tmpfile, err := os.CreateTemp(cli.Compact.Tmpdir, "pmtiles")
+		if err != nil {
+			logger.Fatalf("Failed to create temp file, %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+		result, err := pmtiles.CompactWithOptions(logger, cli.Compact.Input, cli.Compact.Output, tmpfile, pmtiles.CompactOptions{
+			Deduplicate: cli.Compact.Deduplicate,
+		})
+		if err != nil {
+			logger.Fatalf("Failed to compact, %v", err)
+		}
+		fmt.Printf("removed %d empty entries, reclaimed %d bytes\n", result.RemovedEntries, result.ReclaimedBytes)
+	case "fix <input>":
+		before, after, err := pmtiles.FixHeader(cli.Fix.Input, cli.Fix.Bounds, cli.Fix.DryRun)
+		if err != nil {
+			logger.Fatalf("Failed to fix header, %v", err)
+		}
+		changes := pmtiles.HeaderChanges(before, after)
+		for _, change := range changes {
+			fmt.Println(change)
+		}
+		if len(changes) == 0 {
+			fmt.Println("header is already correct")
+		}
 	case "convert <input> <output>":
 		path := cli.Convert.Input
 		output := cli.Convert.Output
 
+		if output == "-" {
+			if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+				logger.Fatalf("Refusing to write an archive to a terminal, redirect stdout to a file or pipe")
+			}
+			// keep stdout for the archive
+			logger.SetOutput(os.Stderr)
+		}
+
+		if cli.Convert.FixBounds && output == "-" {
+			logger.Fatalf("--fix-bounds needs an output file")
+		}
+
 		var tmpfile *os.File
 
-		if cli.Convert.Tmpdir == "" {
+		absTemproot := ""
+		if cli.Convert.Tmpdir != "" {
 			var err error
-			tmpfile, err = os.CreateTemp("", "pmtiles")
+			absTemproot, err = filepath.Abs(cli.Convert.Tmpdir)
 
 			if err != nil {
-				logger.Fatalf("Failed to create temp file, %v", err)
+				logger.Fatalf("Failed to derive absolute path for %s, %v", cli.Convert.Tmpdir, err)
 			}
-		} else {
-			absTemproot, err := filepath.Abs(cli.Convert.Tmpdir)
+		}
 
-			if err != nil {
-				logger.Fatalf("Failed to derive absolute path for %s, %v", cli.Convert.Tmpdir, err)
+		if cli.Convert.Resume {
+			// a resumed conversion must find the tmpfile of the interrupted one
+			if absTemproot == "" {
+				absTemproot = os.TempDir()
 			}
+			var err error
+			tmpfile, err = os.OpenFile(filepath.Join(absTemproot, filepath.Base(output)+".tmp"), os.O_RDWR|os.O_CREATE, 0666)
 
+			if err != nil {
+				logger.Fatalf("Failed to open temp file, %v", err)
+			}
+		} else {
+			var err error
 			tmpfile, err = os.CreateTemp(absTemproot, "pmtiles")
 
 			if err != nil {
@@ -212,11 +401,163 @@ func main() {
 		}
 
 		defer os.Remove(tmpfile.Name())
-		err := pmtiles.Convert(logger, path, output, !cli.Convert.NoDeduplication, tmpfile)
+		compression := pmtiles.Compression(pmtiles.Gzip)
+		switch cli.Convert.Compression {
+		case "zstd":
+			compression = pmtiles.Zstd
+		case "brotli":
+			compression = pmtiles.Brotli
+		}
+		tileCompression := pmtiles.UnknownCompression
+		switch cli.Convert.TileCompression {
+		case "gzip":
+			tileCompression = pmtiles.Gzip
+		case "zstd":
+			tileCompression = pmtiles.Zstd
+		case "brotli":
+			tileCompression = pmtiles.Brotli
+		case "none":
+			tileCompression = pmtiles.NoCompression
+		case "":
+		default:
+			logger.Fatalf("Unknown tile compression %s, must be gzip, zstd, brotli or none", cli.Convert.TileCompression)
+		}
+		internalCompression := pmtiles.UnknownCompression
+		switch cli.Convert.InternalCompression {
+		case "gzip":
+			internalCompression = pmtiles.Gzip
+		case "zstd":
+			internalCompression = pmtiles.Zstd
+		case "brotli":
+			internalCompression = pmtiles.Brotli
+		case "none":
+			internalCompression = pmtiles.NoCompression
+		case "":
+		default:
+			logger.Fatalf("Unknown internal compression %s, must be gzip, zstd, brotli or none", cli.Convert.InternalCompression)
+		}
+		tileType := pmtiles.UnknownTileType
+		switch cli.Convert.TileType {
+		case "mvt":
+			tileType = pmtiles.Mvt
+		case "png":
+			tileType = pmtiles.Png
+		case "jpg":
+			tileType = pmtiles.Jpeg
+		case "webp":
+			tileType = pmtiles.Webp
+		case "avif":
+			tileType = pmtiles.Avif
+		case "":
+		default:
+			logger.Fatalf("Unknown tile type %s, must be mvt, png, jpg, webp or avif", cli.Convert.TileType)
+		}
+
+		metadata, err := pmtiles.ParseMetadataOverrides(cli.Convert.MetadataJson, cli.Convert.MetadataSet)
+		if err != nil {
+			logger.Fatalf("Failed to parse metadata, %v", err)
+		}
+
+		readBuffer := int64(cli.Convert.ReadBuffer) << 20
+		if readBuffer == 0 {
+			readBuffer = -1
+		}
+
+		err = pmtiles.Convert(logger, path, output, pmtiles.ConvertOptions{
+			Deduplicate:         !cli.Convert.NoDeduplication,
+			Force:               cli.Convert.Force,
+			Compression:         compression,
+			TileCompression:     tileCompression,
+			InternalCompression: internalCompression,
+			RootDirSize:         cli.Convert.RootDirSize,
+			NoLeafDirs:          cli.Convert.NoLeafDirs,
+			CompressionLevel:    cli.Convert.CompressionLevel,
+			NoRecompress:        cli.Convert.NoRecompress,
+			Recompress:          cli.Convert.Recompress,
+			Scheme:              cli.Convert.Scheme,
+			TileType:            tileType,
+			MinZoom:             cli.Convert.Minzoom,
+			MaxZoom:             cli.Convert.Maxzoom,
+			Workers:             cli.Convert.Workers,
+			DedupeInput:         cli.Convert.DedupeInput,
+			NoTmpfile:           cli.Convert.NoTmpfile,
+			DedupIndex:          cli.Convert.DedupIndex,
+			DedupMemory:         cli.Convert.DedupMemory << 20,
+			Hash:                cli.Convert.Hash,
+			Metadata:            metadata,
+			InferVectorLayers:   cli.Convert.InferVectorLayers,
+			TrustTileData:       cli.Convert.TrustTileData,
+			OnTileError:         cli.Convert.OnTileError,
+			TileErrorLog:        cli.Convert.TileErrorLog,
+			Resume:              cli.Convert.Resume,
+			Progress:            cli.Convert.Progress,
+			ProgressInterval:    time.Duration(cli.Convert.ProgressInterval) * time.Second,
+			TileJSONBaseURL:     cli.Convert.TilejsonBaseUrl,
+			PrecreateDirs:       cli.Convert.PrecreateDirs,
+			Decompress:          cli.Convert.Decompress,
+			Extension:           cli.Convert.Extension,
+			PathTemplate:        cli.Convert.PathTemplate,
+			Overwrite:           cli.Convert.Overwrite,
+			SkipExisting:        cli.Convert.SkipExisting,
+			OnWriteError:        cli.Convert.OnWriteError,
+			StatsOut:            cli.Convert.StatsOut,
+			Layer:               cli.Convert.Layer,
+			Bbox:                cli.Convert.Bbox,
+			OptimizeRLE:         cli.Convert.OptimizeRle,
+			Stream:              cli.Convert.Stream,
+			StreamMemory:        int64(cli.Convert.StreamMemory) << 20,
+			ReadBuffer:          readBuffer,
+			DownloadThreads:     cli.Convert.DownloadThreads,
+			Retries:             retries(cli.Convert.Retries),
+			RetryDelay:          cli.Convert.RetryBaseDelay,
+			MaxBandwidth:        cli.Convert.MaxBandwidth,
+			MaxRequestRate:      cli.Convert.MaxRequestRate,
+		}, tmpfile)
 
 		if err != nil {
 			logger.Fatalf("Failed to convert %s, %v", path, err)
 		}
+		if cli.Convert.FixBounds {
+			minLon, minLat, maxLon, maxLat, err := pmtiles.CalculateBounds(output)
+			if err != nil {
+				logger.Fatalf("Failed to calculate bounds of %s, %v", output, err)
+			}
+			before, after, err := pmtiles.SetBounds(output, minLon, minLat, maxLon, maxLat)
+			if err != nil {
+				logger.Fatalf("Failed to fix bounds, %v", err)
+			}
+			for _, change := range pmtiles.HeaderChanges(before, after) {
+				logger.Println(change)
+			}
+		}
+	case "merge <output> <input>":
+		tmpfile, err := os.CreateTemp(cli.Merge.Tmpdir, "pmtiles")
+		if err != nil {
+			logger.Fatalf("Failed to create temp file, %v", err)
+		}
+		defer os.Remove(tmpfile.Name())
+
+		metadata, err := pmtiles.ParseMetadataOverrides(cli.Merge.MetadataJSON, nil)
+		if err != nil {
+			logger.Fatalf("Failed to parse metadata, %v", err)
+		}
+		err = pmtiles.MergeWithOptions(logger, cli.Merge.Input, cli.Merge.Output, tmpfile, pmtiles.MergeOptions{
+			Deduplicate: !cli.Merge.NoDeduplication,
+			OnConflict:  cli.Merge.OnConflict,
+			Metadata:    metadata,
+		})
+		if err != nil {
+			logger.Fatalf("Failed to merge, %v", err)
+		}
+	case "split <input>":
+		ranges, err := pmtiles.ParseZoomRanges(cli.Split.ByZoom)
+		if err != nil {
+			logger.Fatalf("Failed to parse zoom ranges, %v", err)
+		}
+		err = pmtiles.SplitByZoom(logger, cli.Split.Input, ranges, cli.Split.OutputTemplate, cli.Split.Tmpdir)
+		if err != nil {
+			logger.Fatalf("Failed to split, %v", err)
+		}
 	case "upload <input-pmtiles> <remote-pmtiles>":
 		err := pmtiles.Upload(logger, cli.Upload.InputPmtiles, cli.Upload.Bucket, cli.Upload.RemotePmtiles, cli.Upload.MaxConcurrency)
 
@@ -228,6 +569,31 @@ func main() {
 		if err != nil {
 			logger.Fatalf("Failed to verify archive, %v", err)
 		}
+	case "count <input>":
+		addressed, unique, entries, err := pmtiles.CountTiles(cli.Count.Input)
+		if err != nil {
+			logger.Fatalf("Failed to count tiles, %v", err)
+		}
+		if cli.Count.Recount {
+			recounted, recountedUnique, recountedEntries, err := pmtiles.RecountTiles(cli.Count.Input)
+			if err != nil {
+				logger.Fatalf("Failed to recount tiles, %v", err)
+			}
+			if recounted != addressed || recountedUnique != unique || recountedEntries != entries {
+				logger.Printf("WARNING: header counts %d addressed tiles, %d tile contents and %d tile entries", addressed, unique, entries)
+			}
+			addressed, unique, entries = recounted, recountedUnique, recountedEntries
+		}
+		fmt.Printf("addressed tiles count: %d\n", addressed)
+		fmt.Printf("tile entries count: %d\n", entries)
+		fmt.Printf("tile contents count: %d\n", unique)
+	case "benchmark <input>":
+		result, err := pmtiles.BenchmarkArchive(cli.Benchmark.Input, cli.Benchmark.Tiles, cli.Benchmark.Sequential)
+		if err != nil {
+			logger.Fatalf("Failed to benchmark archive, %v", err)
+		}
+		out, _ := json.MarshalIndent(result, "", "  ")
+		fmt.Println(string(out))
 	case "edit <input>":
 		err := pmtiles.Edit(logger, cli.Edit.Input, cli.Edit.HeaderJson, cli.Edit.Metadata)
 		if err != nil {
@@ -250,6 +616,63 @@ func main() {
 	}
 
 }
+
+// extractRegion is the area of interest of the extract command from --region, --bbox or --region-name,
+// or nil for all tiles.
+func extractRegion(logger *log.Logger) orb.MultiPolygon {
+	if cli.Extract.RegionName == "" {
+		region, err := pmtiles.LoadRegion(cli.Extract.Region, cli.Extract.Bbox)
+		if err != nil {
+			logger.Fatalf("Failed to read region, %v", err)
+		}
+		return region
+	}
+	if cli.Extract.Region != "" || cli.Extract.Bbox != "" {
+		logger.Fatalf("Only one of --region, --bbox and --region-name can be specified")
+	}
+	if cli.Extract.Boundaries == "" {
+		logger.Fatalf("--region-name needs --boundaries")
+	}
+	boundaries, err := pmtiles.ReadBoundaries(cli.Extract.Boundaries)
+	if err != nil {
+		logger.Fatalf("Failed to read boundaries, %v", err)
+	}
+	region, err := pmtiles.FindRegion(boundaries, cli.Extract.RegionProperty, cli.Extract.RegionName)
+	if err != nil {
+		logger.Fatalf("Failed to find region, %v", err)
+	}
+	return region
+}
+
+// retries maps a --retries flag, where 0 doesn't retry, to the Retries of the library, where 0 is the default.
+func retries(n int) int {
+	if n == 0 {
+		return -1
+	}
+	return n
+}
+
+// extractRetry is how the extract command retries failed range requests.
+func extractRetry() pmtiles.RetryOptions {
+	return pmtiles.RetryOptions{Retries: retries(cli.Extract.Retries), BaseDelay: cli.Extract.RetryBaseDelay}
+}
+
+// extractRateLimit is how the extract command paces its range requests.
+func extractRateLimit() pmtiles.RateLimit {
+	return pmtiles.RateLimit{BytesPerSecond: cli.Extract.MaxBandwidth, RequestsPerSecond: cli.Extract.MaxRequestRate}
+}
+
+// estimateExtract prints what the extract command would transfer, fetching only directories.
+func estimateExtract(logger *log.Logger) {
+	estimate, err := pmtiles.EstimateExtract(cli.Extract.Bucket, cli.Extract.Input, cli.Extract.Minzoom, cli.Extract.Maxzoom, extractRegion(logger), cli.Extract.Overfetch, extractRetry(), extractRateLimit())
+	if err != nil {
+		logger.Fatalf("Failed to estimate extract, %v", err)
+	}
+	if err := pmtiles.WriteExtractEstimate(os.Stdout, estimate, cli.Extract.Format); err != nil {
+		logger.Fatalf("Failed to write estimate, %v", err)
+	}
+}
+
 func startHTTPServer(addr string, handler http.Handler) error {
 	server := &http.Server{
 		ReadTimeout:       10 * time.Second,
@@ -0,0 +1,336 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+
+	"github.com/paulmach/orb/maptile"
+)
+
+// appendInPlaceRatio is the largest number of appended tiles, relative to the tile entries of an archive,
+// written at the end of the archive instead of rebuilding it.
+const appendInPlaceRatio = 0.1
+
+// appendMinRootLen is the smallest space for a root directory of leaf pointers when appending in place.
+const appendMinRootLen = 256
+
+// TileInput is a tile added by AppendTiles.
+type TileInput struct {
+	Z    uint8
+	X, Y uint32
+	Data []byte
+}
+
+// AppendTiles adds tiles to the clustered local archive at path, replacing existing tiles with the same coordinates;
+// of tiles repeated in the input, the last one is kept, and empty tiles are skipped.
+// Vector tiles are compressed with the tile compression of the archive unless they already are.
+// A few tiles following all existing tiles are written at the end of the archive, after which only the directories
+// are rewritten, deduplicating the new tiles among themselves if deduplicate is set. Otherwise the archive is rebuilt
+// with the new tiles in tile ID order, deduplicating all contents if deduplicate is set.
+func AppendTiles(path string, tiles []TileInput, deduplicate bool) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("Failed to lock %s, %w", path, err)
+	}
+	defer unlockFile(file)
+
+	buf := make([]byte, HeaderV3LenBytes)
+	if _, err := io.ReadFull(file, buf); err != nil {
+		return fmt.Errorf("Failed to read header, %w", err)
+	}
+	header, err := DeserializeHeader(buf)
+	if err != nil {
+		return fmt.Errorf("Failed to parse header, %w", err)
+	}
+	if !header.Clustered {
+		return fmt.Errorf("archive is not clustered, cluster it before appending tiles")
+	}
+
+	added, err := sortTileInputs(tiles)
+	if err != nil {
+		return err
+	}
+	if len(added) == 0 {
+		return nil
+	}
+
+	entries := make([]EntryV3, 0, header.TileEntriesCount)
+	var entryErr error
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		if entryErr != nil {
+			return
+		}
+		if entryErr = checkEntryTileIDs(e); entryErr != nil {
+			return
+		}
+		entries = append(entries, e)
+	})
+	if err == nil {
+		err = entryErr
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to read directories, %w", err)
+	}
+
+	compression := Compression(NoCompression)
+	if header.TileType == Mvt && header.TileCompression != UnknownCompression {
+		compression = header.TileCompression
+	}
+	resolve := newResolver(deduplicate, compression)
+	defer resolve.close()
+
+	if len(entries) > 0 && float64(len(added)) <= float64(len(entries))*appendInPlaceRatio {
+		last := entries[len(entries)-1]
+		if ZxyToID(added[0].Z, added[0].X, added[0].Y) >= last.TileID+uint64(last.RunLength) {
+			appended, err := appendTilesInPlace(file, header, entries, added, resolve)
+			if err != nil || appended {
+				return err
+			}
+		}
+	}
+	return rebuildWithTiles(file, path, header, entries, added, resolve)
+}
+
+// sortTileInputs validates tiles and sorts them by tile ID, keeping the last of repeated tiles.
+func sortTileInputs(tiles []TileInput) ([]TileInput, error) {
+	sorted := make([]TileInput, 0, len(tiles))
+	for _, t := range tiles {
+		if err := ValidateTileCoord(t.Z, t.X, t.Y); err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, t)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return ZxyToID(sorted[i].Z, sorted[i].X, sorted[i].Y) < ZxyToID(sorted[j].Z, sorted[j].X, sorted[j].Y)
+	})
+	unique := sorted[:0]
+	for _, t := range sorted {
+		if len(unique) > 0 && ZxyToID(t.Z, t.X, t.Y) == ZxyToID(unique[len(unique)-1].Z, unique[len(unique)-1].X, unique[len(unique)-1].Y) {
+			unique[len(unique)-1] = t
+		} else {
+			unique = append(unique, t)
+		}
+	}
+	result := unique[:0]
+	for _, t := range unique {
+		if len(t.Data) > 0 {
+			result = append(result, t)
+		}
+	}
+	return result, nil
+}
+
+// addTileInput compresses and adds a new tile to resolve, writing its contents to w if they are new.
+func addTileInput(resolve *resolver, w io.Writer, t TileInput) error {
+	tileID := ZxyToID(t.Z, t.X, t.Y)
+	// hash the stored bytes, as for the existing tiles
+	data := resolve.compressTile(resolve.compressor, t.Data)
+	isNew, newData, err := resolve.addTile(tileID, data, 1, func() []byte { return data })
+	if err != nil {
+		return tileOrderError(tileID, err)
+	}
+	if isNew {
+		if _, err := w.Write(newData); err != nil {
+			return fmt.Errorf("Failed to write tile data, %w", err)
+		}
+	}
+	return nil
+}
+
+// appendTilesInPlace writes tiles following all existing entries after the tile data of the archive in file,
+// followed by new leaf directories, and rewrites its root directory and header.
+// It returns false without modifying the archive if the tile data is not followed only by the leaf directories,
+// or if there is not enough space for the new root directory.
+func appendTilesInPlace(file *os.File, header HeaderV3, entries []EntryV3, tiles []TileInput, resolve *resolver) (bool, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	tileEnd := header.TileDataOffset + header.TileDataLength
+	leavesAfterTiles := header.LeafDirectoryOffset == tileEnd && tileEnd+header.LeafDirectoryLength == uint64(info.Size())
+	if uint64(info.Size()) != tileEnd && !leavesAfterTiles {
+		return false, nil
+	}
+	// the root is rewritten in place, growing into any padding before the next section,
+	// or into the old leaf directories if they precede the tile data within the first 16 KiB
+	rootSpace := header.MetadataOffset
+	for _, offset := range []uint64{header.LeafDirectoryOffset, header.TileDataOffset} {
+		if offset > header.RootOffset && offset < rootSpace {
+			rootSpace = offset
+		}
+	}
+	rootSpace -= header.RootOffset
+	var leafSpace uint64
+	if !leavesAfterTiles && header.LeafDirectoryOffset+header.LeafDirectoryLength <= 16384 {
+		leafSpace = header.LeafDirectoryLength
+	}
+	if rootSpace < appendMinRootLen && leafSpace < appendMinRootLen {
+		return false, nil
+	}
+
+	// the new tiles are stored after the existing tile data
+	resolve.Offset = header.TileDataLength
+	resolve.Entries = make([]EntryV3, 0, len(tiles))
+	var newData []byte
+	for _, t := range tiles {
+		if err := addTileInput(resolve, byteWriter{&newData}, t); err != nil {
+			return false, err
+		}
+	}
+	all := append(entries, resolve.Entries...)
+	rootBytes, leavesBytes, _ := optimizeDirectories(all, int(max(rootSpace, leafSpace)), header.InternalCompression)
+	rootOffset := header.RootOffset
+	if uint64(len(rootBytes)) > rootSpace {
+		rootOffset = header.LeafDirectoryOffset
+	}
+
+	if _, err := file.WriteAt(append(newData, leavesBytes...), int64(tileEnd)); err != nil {
+		return false, fmt.Errorf("Failed to write tile data, %w", err)
+	}
+	if err := file.Truncate(int64(tileEnd) + int64(len(newData)) + int64(len(leavesBytes))); err != nil {
+		return false, err
+	}
+	if _, err := file.WriteAt(rootBytes, int64(rootOffset)); err != nil {
+		return false, fmt.Errorf("Failed to write root directory, %w", err)
+	}
+
+	header.RootOffset = rootOffset
+	header.RootLength = uint64(len(rootBytes))
+	header.LeafDirectoryOffset = tileEnd + uint64(len(newData))
+	header.LeafDirectoryLength = uint64(len(leavesBytes))
+	header.TileDataLength += uint64(len(newData))
+	header.AddressedTilesCount += uint64(len(resolve.Entries))
+	for _, e := range resolve.Entries {
+		header.AddressedTilesCount += uint64(e.RunLength) - 1
+	}
+	header.TileEntriesCount = uint64(len(all))
+	header.TileContentsCount += resolve.NumContents()
+	setAppendedExtent(&header, all, tiles)
+	if _, err := file.WriteAt(SerializeHeader(header), 0); err != nil {
+		return false, fmt.Errorf("Failed to write header, %w", err)
+	}
+	return true, file.Sync()
+}
+
+// byteWriter appends the bytes written to it to a slice.
+type byteWriter struct {
+	b *[]byte
+}
+
+func (w byteWriter) Write(p []byte) (int, error) {
+	*w.b = append(*w.b, p...)
+	return len(p), nil
+}
+
+// rebuildWithTiles writes a new archive at path with the existing entries of the archive in file and tiles,
+// which replace the existing tiles with the same IDs.
+func rebuildWithTiles(file *os.File, path string, header HeaderV3, entries []EntryV3, tiles []TileInput, resolve *resolver) error {
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata, %w", err)
+	}
+
+	tmpfile, err := os.CreateTemp(os.TempDir(), "pmtiles")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file, %w", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	// contents already copied, by their offset in the input
+	copied := make(map[uint64]offsetLen)
+	addRun := func(tileID uint64, e EntryV3, runLength uint32) error {
+		if found, ok := copied[e.Offset]; ok {
+			if err := resolve.addExistingTile(tileID, found, runLength); err != nil {
+				return tileOrderError(tileID, err)
+			}
+			return nil
+		}
+		data := make([]byte, e.Length)
+		if _, err := file.ReadAt(data, int64(header.TileDataOffset+e.Offset)); err != nil {
+			return fmt.Errorf("Failed to read tile data, %w", err)
+		}
+		isNew, newData, err := resolve.addTile(tileID, data, runLength, func() []byte { return data })
+		if err != nil {
+			return tileOrderError(tileID, err)
+		}
+		if isNew {
+			if _, err := tmpfile.Write(newData); err != nil {
+				return fmt.Errorf("Failed to write to tempfile, %w", err)
+			}
+		}
+		last := resolve.Entries[len(resolve.Entries)-1]
+		copied[e.Offset] = offsetLen{last.Offset, last.Length}
+		return nil
+	}
+
+	i := 0
+	tileID := func() uint64 {
+		return ZxyToID(tiles[i].Z, tiles[i].X, tiles[i].Y)
+	}
+	for _, e := range entries {
+		start := e.TileID
+		end := e.TileID + uint64(e.RunLength)
+		for start < end {
+			// new tiles before the rest of the run, replacing those within it
+			for i < len(tiles) && tileID() <= start {
+				if err := addTileInput(resolve, tmpfile, tiles[i]); err != nil {
+					return err
+				}
+				if tileID() == start {
+					start++
+				}
+				i++
+			}
+			if start >= end {
+				break
+			}
+			runEnd := end
+			if i < len(tiles) && tileID() < end {
+				runEnd = tileID()
+			}
+			if err := addRun(start, e, uint32(runEnd-start)); err != nil {
+				return err
+			}
+			start = runEnd
+		}
+	}
+	for ; i < len(tiles); i++ {
+		if err := addTileInput(resolve, tmpfile, tiles[i]); err != nil {
+			return err
+		}
+	}
+
+	setAppendedExtent(&header, resolve.Entries, tiles)
+	_, err = finalize(log.New(io.Discard, "", 0), resolve, header, tmpfile, path, metadata)
+	return err
+}
+
+// setAppendedExtent sets the zoom levels of header to those of the entries of an archive with tiles appended,
+// and widens its bounds to include the appended tiles.
+func setAppendedExtent(header *HeaderV3, entries []EntryV3, tiles []TileInput) {
+	last := entries[len(entries)-1]
+	header.MinZoom, _, _ = IDToZxy(entries[0].TileID)
+	header.MaxZoom, _, _ = IDToZxy(last.TileID + uint64(last.RunLength) - 1)
+	E7 := 10000000.0
+	for _, t := range tiles {
+		if len(t.Data) == 0 {
+			continue
+		}
+		bound := maptile.New(t.X, t.Y, maptile.Zoom(t.Z)).Bound()
+		header.MinLonE7 = min(header.MinLonE7, int32(math.Round(bound.Min.Lon()*E7)))
+		header.MinLatE7 = min(header.MinLatE7, int32(math.Round(bound.Min.Lat()*E7)))
+		header.MaxLonE7 = max(header.MaxLonE7, int32(math.Round(bound.Max.Lon()*E7)))
+		header.MaxLatE7 = max(header.MaxLatE7, int32(math.Round(bound.Max.Lat()*E7)))
+	}
+}
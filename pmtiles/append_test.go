@@ -0,0 +1,84 @@
+package pmtiles
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAppendTilesInPlace(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "in.pmtiles")
+	var tiles []testTile
+	for i := uint64(0); i < 20000; i++ {
+		z, x, y := IDToZxy(i)
+		tiles = append(tiles, testTile{z, x, y, fmt.Sprint(i)})
+	}
+	writeTestArchive(t, path, NoCompression, Mvt, map[string]interface{}{"name": "test"}, tiles)
+	before, _, _ := readTestArchiveTiles(t, path)
+	assert.Greater(t, before.LeafDirectoryLength, uint64(0))
+
+	z, x, y := IDToZxy(20000)
+	z2, x2, y2 := IDToZxy(20005)
+	err := AppendTiles(path, []TileInput{
+		{Z: z2, X: x2, Y: y2, Data: []byte("b")},
+		{Z: z, X: x, Y: y, Data: []byte("a")},
+		{Z: z2, X: x2, Y: y2, Data: []byte("a")},
+	}, true)
+	assert.Nil(t, err)
+
+	header, metadata, result := readTestArchiveTiles(t, path)
+	assert.Equal(t, before.TileDataOffset, header.TileDataOffset)
+	assert.Equal(t, before.TileDataLength+1, header.TileDataLength)
+	assert.Equal(t, uint64(20002), header.AddressedTilesCount)
+	assert.Equal(t, uint64(20002), header.TileEntriesCount)
+	assert.Equal(t, uint64(20001), header.TileContentsCount)
+	assert.True(t, header.Clustered)
+	assert.Equal(t, "test", metadata["name"])
+	assert.Equal(t, 20002, len(result))
+	assert.Equal(t, "19999", result[19999])
+	assert.Equal(t, "a", result[20000])
+	assert.Equal(t, "a", result[20005])
+	// the leaf directories were moved after the new tile data
+	assert.Equal(t, header.TileDataOffset+header.TileDataLength, header.LeafDirectoryOffset)
+}
+
+func TestAppendTilesRebuild(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "in.pmtiles")
+	writeTestArchive(t, path, Gzip, Mvt, map[string]interface{}{"name": "test"}, []testTile{
+		{0, 0, 0, "0"},
+		{1, 0, 0, "1"},
+		{1, 0, 1, "1"},
+		{1, 1, 1, "1"},
+		{1, 1, 0, "1"},
+	})
+
+	err := AppendTiles(path, []TileInput{
+		{Z: 1, X: 0, Y: 1, Data: []byte("2")},
+		{Z: 2, X: 0, Y: 0, Data: []byte("1")},
+		{Z: 1, X: 1, Y: 0, Data: nil},
+	}, true)
+	assert.Nil(t, err)
+
+	header, metadata, result := readTestArchiveTiles(t, path)
+	assert.Equal(t, map[uint64]string{
+		ZxyToID(0, 0, 0): "0",
+		ZxyToID(1, 0, 0): "1",
+		ZxyToID(1, 0, 1): "2",
+		ZxyToID(1, 1, 1): "1",
+		ZxyToID(1, 1, 0): "1",
+		ZxyToID(2, 0, 0): "1",
+	}, result)
+	assert.Equal(t, uint64(6), header.AddressedTilesCount)
+	assert.Equal(t, uint64(3), header.TileContentsCount)
+	assert.Equal(t, uint8(0), header.MinZoom)
+	assert.Equal(t, uint8(2), header.MaxZoom)
+	assert.True(t, header.Clustered)
+	assert.Equal(t, Compression(Gzip), header.TileCompression)
+	assert.Equal(t, "test", metadata["name"])
+
+	assert.Error(t, AppendTiles(path, []TileInput{{Z: 1, X: 2, Y: 0, Data: []byte("x")}}, true))
+}
@@ -0,0 +1,306 @@
+package pmtiles
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// archiveLeafCacheSize is the number of leaf directories an Archive keeps in memory.
+const archiveLeafCacheSize = 64
+
+// ErrTileNotFound is returned by Archive.GetTile and Archive.GetTileRaw for a tile the archive does not contain.
+var ErrTileNotFound = errors.New("tile not found")
+
+// Archive reads individual tiles from an archive, caching its header and root directory,
+// and the most recently used leaf directories, so repeated lookups mostly read only tile data.
+// An Archive is safe for concurrent use if its reader is, as *os.File and *RemoteArchive are;
+// reads hold a read lock on the reader, so Close waits for them and later reads fail.
+type Archive struct {
+	r      io.ReaderAt
+	closer io.Closer
+	header HeaderV3
+	root   []EntryV3
+
+	readMu sync.RWMutex
+	closed bool
+
+	mu        sync.Mutex
+	leaves    map[uint64]*list.Element
+	evictList *list.List
+}
+
+type archiveLeaf struct {
+	offset  uint64
+	entries []EntryV3
+}
+
+// OpenArchive opens the local archive at path. Close the Archive to close the file.
+func OpenArchive(path string) (*Archive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s, %w", path, err)
+	}
+	a, err := NewArchive(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	a.closer = file
+	return a, nil
+}
+
+// NewArchive reads the header and root directory of the archive in r.
+// Closing the Archive does not close r.
+func NewArchive(r io.ReaderAt) (*Archive, error) {
+	headerBytes := make([]byte, HeaderV3LenBytes)
+	if _, err := r.ReadAt(headerBytes, 0); err != nil {
+		return nil, fmt.Errorf("Failed to read header, %w", err)
+	}
+	header, err := DeserializeHeader(headerBytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse header, %w", err)
+	}
+
+	a := &Archive{r: r, header: header, leaves: make(map[uint64]*list.Element), evictList: list.New()}
+	a.root, err = a.readDirectory(header.RootOffset, header.RootLength)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read root directory, %w", err)
+	}
+	return a, nil
+}
+
+// Header returns the header of the archive.
+func (a *Archive) Header() HeaderV3 {
+	return a.header
+}
+
+// MetadataBytes returns the decompressed JSON metadata of the archive.
+func (a *Archive) MetadataBytes() ([]byte, error) {
+	b := make([]byte, a.header.MetadataLength)
+	if err := a.readAt(b, a.header.MetadataOffset); err != nil {
+		return nil, fmt.Errorf("Failed to read metadata, %w", err)
+	}
+	metadata, err := DeserializeMetadataBytes(bytes.NewReader(b), a.header.InternalCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata, %w", err)
+	}
+	return metadata, nil
+}
+
+// Extract returns the tile at z, x, y, or nil if the archive does not contain it.
+// The tile is returned as stored unless decompress is set,
+// in which case it is decompressed with the tile compression of the archive.
+func (a *Archive) Extract(z uint8, x uint32, y uint32, decompress bool) ([]byte, error) {
+	if err := ValidateTileCoord(z, x, y); err != nil {
+		return nil, err
+	}
+	entry, ok, err := a.findEntry(ZxyToID(z, x, y))
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	data := make([]byte, entry.Length)
+	if err := a.readAt(data, a.header.TileDataOffset+entry.Offset); err != nil {
+		return nil, fmt.Errorf("Failed to read tile %d/%d/%d, %w", z, x, y, err)
+	}
+	if decompress && a.header.TileCompression != NoCompression && a.header.TileCompression != UnknownCompression {
+		data, err = decompressBytes(data, a.header.TileCompression)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress tile %d/%d/%d, %w", z, x, y, err)
+		}
+	}
+	return data, nil
+}
+
+// GetTileRaw returns the tile at z, x, y exactly as stored, or ErrTileNotFound if the archive does not contain it.
+func (a *Archive) GetTileRaw(z uint8, x uint32, y uint32) ([]byte, error) {
+	return a.getTile(z, x, y, false)
+}
+
+// GetTile returns the tile at z, x, y decompressed with the tile compression of the archive,
+// or ErrTileNotFound if the archive does not contain it.
+func (a *Archive) GetTile(z uint8, x uint32, y uint32) ([]byte, error) {
+	return a.getTile(z, x, y, true)
+}
+
+func (a *Archive) getTile(z uint8, x uint32, y uint32, decompress bool) ([]byte, error) {
+	data, err := a.Extract(z, x, y, decompress)
+	if err == nil && data == nil {
+		return nil, ErrTileNotFound
+	}
+	return data, err
+}
+
+// TileExists returns whether the archive contains the tile at z, x, y.
+// Only directories are read, never tile data.
+func (a *Archive) TileExists(z uint8, x uint32, y uint32) (bool, error) {
+	if err := ValidateTileCoord(z, x, y); err != nil {
+		return false, err
+	}
+	_, ok, err := a.findEntry(ZxyToID(z, x, y))
+	return ok, err
+}
+
+// Close closes the file opened by OpenArchive, after waiting for reads in progress.
+func (a *Archive) Close() error {
+	a.readMu.Lock()
+	defer a.readMu.Unlock()
+	if a.closed {
+		return nil
+	}
+	a.closed = true
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
+
+// readAt fills b from offset of the reader, failing once the Archive is closed.
+func (a *Archive) readAt(b []byte, offset uint64) error {
+	a.readMu.RLock()
+	defer a.readMu.RUnlock()
+	if a.closed {
+		return fmt.Errorf("archive is closed")
+	}
+	_, err := a.r.ReadAt(b, int64(offset))
+	return err
+}
+
+// findEntry navigates from the root directory to the tile entry containing tileID.
+func (a *Archive) findEntry(tileID uint64) (EntryV3, bool, error) {
+	directory := a.root
+	for depth := 0; depth <= 3; depth++ {
+		entry, ok := findTile(directory, tileID)
+		if !ok {
+			return EntryV3{}, false, nil
+		}
+		if entry.RunLength > 0 {
+			return entry, true, nil
+		}
+		var err error
+		directory, err = a.readLeaf(a.header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+		if err != nil {
+			return EntryV3{}, false, fmt.Errorf("Failed to read leaf directory, %w", err)
+		}
+	}
+	return EntryV3{}, false, nil
+}
+
+// readLeaf returns the leaf directory at offset, from the cache if it was read recently.
+// Concurrent misses for the same leaf may both read it.
+func (a *Archive) readLeaf(offset uint64, length uint64) ([]EntryV3, error) {
+	a.mu.Lock()
+	if elem, ok := a.leaves[offset]; ok {
+		a.evictList.MoveToFront(elem)
+		a.mu.Unlock()
+		return elem.Value.(*archiveLeaf).entries, nil
+	}
+	a.mu.Unlock()
+
+	entries, err := a.readDirectory(offset, length)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, ok := a.leaves[offset]; ok {
+		a.evictList.MoveToFront(elem)
+		return entries, nil
+	}
+	a.leaves[offset] = a.evictList.PushFront(&archiveLeaf{offset, entries})
+	for a.evictList.Len() > archiveLeafCacheSize {
+		elem := a.evictList.Back()
+		a.evictList.Remove(elem)
+		delete(a.leaves, elem.Value.(*archiveLeaf).offset)
+	}
+	return entries, nil
+}
+
+func (a *Archive) readDirectory(offset uint64, length uint64) ([]EntryV3, error) {
+	b := make([]byte, length)
+	if err := a.readAt(b, offset); err != nil {
+		return nil, err
+	}
+	return DeserializeEntries(bytes.NewBuffer(b), a.header.InternalCompression), nil
+}
+
+// Prefetch reads the leaf directories needed to look up the tiles at coords into the leaf cache,
+// making at most concurrency reads at once, so that later lookups of those tiles read only tile data.
+// Tiles the archive does not contain are skipped, and no tile data is read.
+// Only as many leaf directories as the cache holds remain cached.
+// Cancelling ctx stops prefetching with the context's error.
+func (a *Archive) Prefetch(ctx context.Context, coords []Zxy, concurrency int) error {
+	tileIDs := make([]uint64, 0, len(coords))
+	for _, c := range coords {
+		if err := ValidateTileCoord(c.Z, c.X, c.Y); err != nil {
+			return err
+		}
+		tileIDs = append(tileIDs, ZxyToID(c.Z, c.X, c.Y))
+	}
+
+	// a directory and the tile IDs to look up in it
+	type lookup struct {
+		directory []EntryV3
+		tileIDs   []uint64
+	}
+	lookups := []lookup{{a.root, tileIDs}}
+	for depth := 0; depth < 3 && len(lookups) > 0; depth++ {
+		// the tile IDs in each leaf directory referenced at this depth, read once each
+		leaves := make(map[[2]uint64][]uint64)
+		for _, l := range lookups {
+			for _, tileID := range l.tileIDs {
+				entry, ok := findTile(l.directory, tileID)
+				if ok && entry.RunLength == 0 {
+					leaf := [2]uint64{a.header.LeafDirectoryOffset + entry.Offset, uint64(entry.Length)}
+					leaves[leaf] = append(leaves[leaf], tileID)
+				}
+			}
+		}
+
+		var mu sync.Mutex
+		next := make([]lookup, 0, len(leaves))
+		g, gctx := errgroup.WithContext(ctx)
+		g.SetLimit(max(concurrency, 1))
+		for leaf, ids := range leaves {
+			g.Go(func() error {
+				if err := gctx.Err(); err != nil {
+					return err
+				}
+				entries, err := a.readLeaf(leaf[0], leaf[1])
+				if err != nil {
+					return fmt.Errorf("Failed to read leaf directory, %w", err)
+				}
+				mu.Lock()
+				next = append(next, lookup{entries, ids})
+				mu.Unlock()
+				return nil
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return err
+		}
+		lookups = next
+	}
+	return nil
+}
+
+// ExtractTile returns the tile at z, x, y of the local archive at path as stored,
+// or nil if the archive does not contain it.
+// Use OpenArchive to look up several tiles without reading the root directory each time.
+func ExtractTile(path string, z uint8, x uint32, y uint32) ([]byte, error) {
+	a, err := OpenArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer a.Close()
+	return a.Extract(z, x, y, false)
+}
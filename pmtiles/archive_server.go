@@ -0,0 +1,497 @@
+package pmtiles
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ServerOptions configures an ArchiveServer or MultiServer.
+type ServerOptions struct {
+	// MaxAge is the max-age in seconds of the Cache-Control header of responses; 0 omits the header.
+	MaxAge int
+	// CorsOrigins are the origins allowed to make cross-origin requests, "*" meaning any;
+	// empty disables CORS headers.
+	CorsOrigins []string
+	// DisableTranscoding serves gzip-compressed vector tiles as stored even to clients that do not send
+	// Accept-Encoding: gzip, saving the decompression for deployments whose clients all accept gzip.
+	// Brotli-compressed tiles are always decompressed for clients that do not accept br.
+	DisableTranscoding bool
+	// WatchInterval is how often the archive file is polled; when it is replaced or its modification time
+	// or size change, the archive is reopened and later requests are served from the new file.
+	// 0 disables watching.
+	WatchInterval time.Duration
+	// Logger receives the errors of reopening a watched archive; nil means the standard logger.
+	Logger *log.Logger
+	// PublicURL is the base URL of the tiles in the TileJSON of an ArchiveServer, such as https://example.com/tiles;
+	// empty means the scheme and host of each request.
+	PublicURL string
+}
+
+// ArchiveServer is an http.Handler for the tiles and metadata of a single local archive.
+// Unlike Server, it needs no bucket, cache or Start call, so it can be mounted in any mux:
+// tiles are served at /{z}/{x}/{y}, with an optional extension matching the tile type,
+// the metadata JSON at / and a TileJSON at /tilejson.json.
+type ArchiveServer struct {
+	mu      sync.Mutex // guards path and failed, and serializes replacing the archive
+	path    string
+	failed  os.FileInfo // the file that last failed to reopen, logged once
+	state   atomic.Pointer[archiveState]
+	opts    ServerOptions
+	handler http.Handler
+	done    chan struct{}
+	watcher sync.WaitGroup
+}
+
+// archiveState is an open archive with its metadata. A replaced state is closed
+// once the requests still using it are finished.
+type archiveState struct {
+	archive  *Archive
+	metadata []byte
+	info     os.FileInfo
+	refs     atomic.Int64
+	retired  atomic.Bool
+	once     sync.Once
+}
+
+func openArchiveState(path string) (*archiveState, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := OpenArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	metadata, err := archive.MetadataBytes()
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+	return &archiveState{archive: archive, metadata: metadata, info: info}, nil
+}
+
+// release ends a use of the state, closing it if it was the last use of a retired state.
+func (s *archiveState) release() {
+	if s.refs.Add(-1) == 0 && s.retired.Load() {
+		s.close()
+	}
+}
+
+func (s *archiveState) close() (err error) {
+	s.once.Do(func() { err = s.archive.Close() })
+	return err
+}
+
+var archiveTilePattern = regexp.MustCompile(`^/(\d+)/(\d+)/(\d+)(\.[a-z]+)?$`)
+
+// NewArchiveServer opens the local archive at archivePath and reads its metadata.
+// Close the ArchiveServer to close the archive.
+func NewArchiveServer(archivePath string, opts ServerOptions) (*ArchiveServer, error) {
+	state, err := openArchiveState(archivePath)
+	if err != nil {
+		return nil, err
+	}
+
+	server := &ArchiveServer{path: archivePath, opts: opts, done: make(chan struct{})}
+	server.state.Store(state)
+	server.handler = http.HandlerFunc(server.serve)
+	if len(opts.CorsOrigins) > 0 {
+		server.handler = NewCors(strings.Join(opts.CorsOrigins, ",")).Handler(server.handler)
+	}
+	if opts.WatchInterval > 0 {
+		server.watcher.Add(1)
+		go server.watch()
+	}
+	return server, nil
+}
+
+// Close stops watching the archive file and closes the archive.
+func (server *ArchiveServer) Close() error {
+	close(server.done)
+	server.watcher.Wait()
+	state := server.state.Load()
+	state.retired.Store(true)
+	return state.close()
+}
+
+// watch polls the archive file until the server is closed, reloading it when it changes.
+// A file that cannot be opened, for example because it is still being written,
+// is retried on the next poll while the previous archive keeps being served.
+func (server *ArchiveServer) watch() {
+	defer server.watcher.Done()
+	ticker := time.NewTicker(server.opts.WatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-server.done:
+			return
+		case <-ticker.C:
+			server.reload()
+		}
+	}
+}
+
+// reload swaps in the archive file if it was replaced or its modification time or size changed.
+// Replacements are detected by file identity, as a file renamed over the archive may have the same size
+// and a modification time within the resolution of the file system.
+func (server *ArchiveServer) reload() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	old := server.state.Load()
+	info, err := os.Stat(server.path)
+	if err != nil || sameFileVersion(info, old.info) {
+		return
+	}
+	state, err := openArchiveState(server.path)
+	if err != nil {
+		if server.failed == nil || !sameFileVersion(info, server.failed) {
+			server.logger().Printf("Failed to reload %s, %v", server.path, err)
+		}
+		server.failed = info
+		return
+	}
+	server.failed = nil
+	server.replace(state)
+}
+
+// sameFileVersion reports whether a and b describe the same file with the same modification time and size.
+func sameFileVersion(a os.FileInfo, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+func (server *ArchiveServer) logger() *log.Logger {
+	if server.opts.Logger != nil {
+		return server.opts.Logger
+	}
+	return log.Default()
+}
+
+// switchTo serves later requests from the archive at path, which is watched from then on.
+// The current archive keeps being served if path cannot be opened.
+func (server *ArchiveServer) switchTo(path string) error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	state, err := openArchiveState(path)
+	if err != nil {
+		return err
+	}
+	server.path = path
+	server.failed = nil
+	server.replace(state)
+	return nil
+}
+
+// replace serves later requests from state, closing the previous state once the requests using it are finished.
+func (server *ArchiveServer) replace(state *archiveState) {
+	old := server.state.Swap(state)
+	old.retired.Store(true)
+	if old.refs.Load() == 0 {
+		old.close()
+	}
+}
+
+// acquire returns the current archive state, which stays open until it is released.
+func (server *ArchiveServer) acquire() *archiveState {
+	for {
+		state := server.state.Load()
+		state.refs.Add(1)
+		if server.state.Load() == state {
+			return state
+		}
+		// swapped before the reference was taken, so the state may already be closed
+		state.release()
+	}
+}
+
+// ServeHTTP serves a tile or the metadata of the archive.
+func (server *ArchiveServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.handler.ServeHTTP(w, r)
+}
+
+func (server *ArchiveServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(405)
+		return
+	}
+
+	state := server.acquire()
+	defer state.release()
+
+	if r.URL.Path == "/" {
+		w.Header().Set("Content-Type", "application/json")
+		server.serveContent(w, r, state.metadata)
+		return
+	}
+	if r.URL.Path == "/tilejson.json" {
+		server.serveTileJSON(w, r, state)
+		return
+	}
+
+	res := archiveTilePattern.FindStringSubmatch(r.URL.Path)
+	if res == nil {
+		http.Error(w, "Path not found", 404)
+		return
+	}
+	header := state.archive.Header()
+	z, errZ := strconv.ParseUint(res[1], 10, 8)
+	x, errX := strconv.ParseUint(res[2], 10, 32)
+	y, errY := strconv.ParseUint(res[3], 10, 32)
+	if errZ != nil || errX != nil || errY != nil || ValidateTileCoord(uint8(z), uint32(x), uint32(y)) != nil ||
+		uint8(z) < header.MinZoom || uint8(z) > header.MaxZoom {
+		http.Error(w, "Tile not found", 404)
+		return
+	}
+	if ext := res[4]; ext != "" && ext != headerExt(header) {
+		http.Error(w, "path mismatch: archive is type "+strings.TrimPrefix(headerExt(header), "."), 400)
+		return
+	}
+
+	data, err := state.archive.Extract(uint8(z), uint32(x), uint32(y), false)
+	if err != nil {
+		http.Error(w, "I/O error", 500)
+		return
+	}
+	if data == nil {
+		http.Error(w, "Tile not found", 404)
+		return
+	}
+
+	if contentType, ok := headerContentType(header); ok {
+		w.Header().Set("Content-Type", contentType)
+	}
+	encoding, encoded := compressionToString(header.TileCompression)
+	if header.TileCompression == Brotli || (!server.opts.DisableTranscoding && header.TileType == Mvt && header.TileCompression == Gzip) {
+		w.Header().Set("Vary", "Accept-Encoding")
+		if !acceptsEncoding(r, encoding) {
+			data, err = decompressBytes(data, header.TileCompression)
+			if err != nil {
+				http.Error(w, "I/O error", 500)
+				return
+			}
+			encoded = false
+		}
+	}
+	if encoded {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+	server.serveContent(w, r, data)
+}
+
+// serveTileJSON writes the TileJSON of the archive, with tile URLs under ServerOptions.PublicURL or the request host.
+func (server *ArchiveServer) serveTileJSON(w http.ResponseWriter, r *http.Request, state *archiveState) {
+	baseURL := server.opts.PublicURL
+	if baseURL == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		baseURL = scheme + "://" + r.Host
+	}
+	header := state.archive.Header()
+	data, err := json.Marshal(tileJSON(header, state.metadata, strings.TrimSuffix(baseURL, "/")+"/{z}/{x}/{y}"+headerExt(header)))
+	if err != nil {
+		http.Error(w, "I/O error", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	server.serveContent(w, r, data)
+}
+
+// serveContent writes data with its ETag and the cache headers,
+// answering conditional requests with 304 Not Modified.
+func (server *ArchiveServer) serveContent(w http.ResponseWriter, r *http.Request, data []byte) {
+	w.Header().Set("ETag", generateEtag(data))
+	if server.opts.MaxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(server.opts.MaxAge))
+	}
+	http.ServeContent(
+		w, r,
+		"",                // name used to infer content-type, but we've already set that
+		time.UnixMilli(0), // ignore setting last-modified time and handling if-modified-since headers
+		bytes.NewReader(data),
+	)
+}
+
+// MultiServer is an http.Handler for several local archives, each served under the URL prefix of its dataset name
+// like a single ArchiveServer: tiles at /{dataset}/{z}/{x}/{y} and the metadata JSON at /{dataset}/metadata.json.
+type MultiServer struct {
+	mu       sync.RWMutex
+	datasets map[string]*ArchiveServer
+	handler  http.Handler
+}
+
+// NewMultiServer opens the local archive of each dataset in routes, which maps dataset names or URL prefixes
+// such as "/streets/" to archive paths. Close the MultiServer to close the archives.
+func NewMultiServer(routes map[string]string, opts ServerOptions) (*MultiServer, error) {
+	server := &MultiServer{datasets: make(map[string]*ArchiveServer)}
+	// CORS headers are added once for all datasets
+	datasetOpts := opts
+	datasetOpts.CorsOrigins = nil
+	for prefix, path := range routes {
+		name := strings.Trim(prefix, "/")
+		if name == "" || strings.Contains(name, "/") {
+			server.Close()
+			return nil, fmt.Errorf("invalid dataset prefix %q, must be a single path segment", prefix)
+		}
+		if _, ok := server.datasets[name]; ok {
+			server.Close()
+			return nil, fmt.Errorf("dataset %s is routed more than once", name)
+		}
+		dataset, err := NewArchiveServer(path, datasetOpts)
+		if err != nil {
+			server.Close()
+			return nil, fmt.Errorf("Failed to open %s for dataset %s, %w", path, name, err)
+		}
+		server.datasets[name] = dataset
+	}
+	server.handler = http.HandlerFunc(server.serve)
+	if len(opts.CorsOrigins) > 0 {
+		server.handler = NewCors(strings.Join(opts.CorsOrigins, ",")).Handler(server.handler)
+	}
+	return server, nil
+}
+
+// Reload atomically replaces the archive of dataset with the one at newPath.
+// Requests already using the previous archive are finished before it is closed.
+// The previous archive keeps being served if newPath cannot be opened.
+func (server *MultiServer) Reload(dataset, newPath string) error {
+	server.mu.RLock()
+	archiveServer, ok := server.datasets[strings.Trim(dataset, "/")]
+	server.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("unknown dataset %s", dataset)
+	}
+	return archiveServer.switchTo(newPath)
+}
+
+// Close closes the archives of all datasets.
+func (server *MultiServer) Close() error {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	var firstErr error
+	for name, dataset := range server.datasets {
+		if err := dataset.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(server.datasets, name)
+	}
+	return firstErr
+}
+
+// ServeHTTP serves a tile or the metadata of a dataset.
+func (server *MultiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.handler.ServeHTTP(w, r)
+}
+
+func (server *MultiServer) serve(w http.ResponseWriter, r *http.Request) {
+	name, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	server.mu.RLock()
+	dataset, ok := server.datasets[name]
+	server.mu.RUnlock()
+	if !ok {
+		http.Error(w, "Dataset not found", 404)
+		return
+	}
+
+	path := "/" + rest
+	if path == "/metadata.json" {
+		path = "/"
+	} else if !archiveTilePattern.MatchString(path) {
+		http.Error(w, "Path not found", 404)
+		return
+	}
+	datasetRequest := r.Clone(r.Context())
+	datasetRequest.URL.Path = path
+	dataset.ServeHTTP(w, datasetRequest)
+}
+
+// acceptsEncoding returns whether the Accept-Encoding header of r allows the content coding,
+// such as "gzip" or "br".
+func acceptsEncoding(r *http.Request, coding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if name != coding && name != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if value, err := strconv.ParseFloat(q, 64); err == nil && value == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// Serve serves the local archive at archivePath over HTTP on port of all interfaces like ListenAndServeArchive,
+// until the process receives SIGINT or SIGTERM. cors is a comma-separated list of allowed origins, or empty.
+func Serve(logger *log.Logger, archivePath string, port int, cors string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var opts ServerOptions
+	if cors != "" {
+		opts.CorsOrigins = strings.Split(cors, ",")
+	}
+	return ListenAndServeArchive(ctx, logger, ":"+strconv.Itoa(port), archivePath, opts)
+}
+
+// ListenAndServeArchive serves the tiles, metadata and TileJSON of the local archive at archivePath on addr
+// with an ArchiveServer, logging the status and duration of each request.
+// Once ctx is done, the server stops accepting connections and waits up to 10 seconds
+// for the requests in progress before closing the archive.
+func ListenAndServeArchive(ctx context.Context, logger *log.Logger, addr string, archivePath string, opts ServerOptions) error {
+	if opts.Logger == nil {
+		opts.Logger = logger
+	}
+	archiveServer, err := NewArchiveServer(archivePath, opts)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s, %w", archivePath, err)
+	}
+	defer archiveServer.Close()
+
+	server := &http.Server{
+		ReadTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       30 * time.Second,
+		Addr:              addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			lrw := &loggingResponseWriter{w, 200}
+			archiveServer.ServeHTTP(lrw, r)
+			logger.Printf("served %d %s in %s", lrw.statusCode, url.PathEscape(r.URL.Path), time.Since(start))
+		}),
+	}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	logger.Printf("Serving %s on %s\n", archivePath, addr)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+	logger.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("Failed to shut down server, %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,314 @@
+package pmtiles
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestArchiveServer(t *testing.T, header HeaderV3, tiles map[Zxy][]byte, opts ServerOptions) *ArchiveServer {
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	archive := fakeArchive(t, header, map[string]interface{}{"name": "test"}, tiles, false, Gzip)
+	assert.Nil(t, os.WriteFile(path, archive, 0666))
+	server, err := NewArchiveServer(path, opts)
+	assert.Nil(t, err)
+	t.Cleanup(func() { server.Close() })
+	return server
+}
+
+func serveTestRequest(server http.Handler, path string, headers map[string]string) *http.Response {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestArchiveServerTile(t *testing.T) {
+	server := newTestArchiveServer(t, HeaderV3{TileType: Png}, map[Zxy][]byte{
+		{0, 0, 0}: {0, 1, 2, 3},
+		{1, 1, 1}: {4, 5},
+	}, ServerOptions{MaxAge: 3600})
+
+	res := serveTestRequest(server, "/1/1/1", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, []byte{4, 5}, body)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, "public, max-age=3600", res.Header.Get("Cache-Control"))
+	assert.Equal(t, generateEtag([]byte{4, 5}), res.Header.Get("ETag"))
+
+	res = serveTestRequest(server, "/0/0/0.png", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	res = serveTestRequest(server, "/0/0/0.mvt", nil)
+	assert.Equal(t, 400, res.StatusCode)
+
+	res = serveTestRequest(server, "/1/0/1", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	res = serveTestRequest(server, "/1/2/0", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	res = serveTestRequest(server, "/5/0/0", nil)
+	assert.Equal(t, 404, res.StatusCode)
+	res = serveTestRequest(server, "/tiles", nil)
+	assert.Equal(t, 404, res.StatusCode)
+}
+
+func TestArchiveServerNotModified(t *testing.T) {
+	server := newTestArchiveServer(t, HeaderV3{TileType: Png}, map[Zxy][]byte{{0, 0, 0}: {0, 1, 2, 3}}, ServerOptions{})
+
+	res := serveTestRequest(server, "/0/0/0", map[string]string{"If-None-Match": generateEtag([]byte{0, 1, 2, 3})})
+	assert.Equal(t, 304, res.StatusCode)
+	res = serveTestRequest(server, "/0/0/0", map[string]string{"If-None-Match": generateEtag([]byte{1})})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Cache-Control"))
+}
+
+func TestArchiveServerMetadata(t *testing.T) {
+	server := newTestArchiveServer(t, HeaderV3{TileType: Png}, map[Zxy][]byte{{0, 0, 0}: {0, 1, 2, 3}}, ServerOptions{})
+
+	res := serveTestRequest(server, "/", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(res.Body)
+	assert.JSONEq(t, `{"name":"test"}`, string(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, 405, w.Code)
+}
+
+func TestArchiveServerTileJSON(t *testing.T) {
+	server := newTestArchiveServer(t, HeaderV3{TileType: Png}, map[Zxy][]byte{{0, 0, 0}: {0, 1, 2, 3}}, ServerOptions{})
+
+	res := serveTestRequest(server, "/tilejson.json", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "application/json", res.Header.Get("Content-Type"))
+	var tilejson map[string]interface{}
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&tilejson))
+	assert.Equal(t, []interface{}{"http://example.com/{z}/{x}/{y}.png"}, tilejson["tiles"])
+	assert.Equal(t, "test", tilejson["name"])
+
+	server = newTestArchiveServer(t, HeaderV3{TileType: Png}, map[Zxy][]byte{{0, 0, 0}: {0, 1, 2, 3}}, ServerOptions{PublicURL: "https://tiles.example.com/base/"})
+	res = serveTestRequest(server, "/tilejson.json", nil)
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&tilejson))
+	assert.Equal(t, []interface{}{"https://tiles.example.com/base/{z}/{x}/{y}.png"}, tilejson["tiles"])
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a logger.
+type syncBuffer struct {
+	mu sync.Mutex
+	b  bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.b.String()
+}
+
+func TestListenAndServeArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	assert.Nil(t, os.WriteFile(path, fakeArchive(t, HeaderV3{TileType: Png}, map[string]interface{}{"name": "test"}, map[Zxy][]byte{{0, 0, 0}: {0, 1, 2, 3}}, false, Gzip), 0666))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := listener.Addr().String()
+	listener.Close()
+
+	var logs syncBuffer
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServeArchive(ctx, log.New(&logs, "", 0), addr, path, ServerOptions{CorsOrigins: []string{"*"}})
+	}()
+
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/0/0/0.png", nil)
+		req.Header.Set("Origin", "https://example.com")
+		if res, err = http.DefaultClient.Do(req); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Nil(t, err)
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	assert.Equal(t, []byte{0, 1, 2, 3}, body)
+	assert.Equal(t, "image/png", res.Header.Get("Content-Type"))
+	assert.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"))
+
+	cancel()
+	assert.Nil(t, <-done)
+	assert.Contains(t, logs.String(), "served 200 %2F0%2F0%2F0.png in")
+}
+
+func TestArchiveServerDecompress(t *testing.T) {
+	compressor, err := newCompressor(Gzip, 0)
+	assert.Nil(t, err)
+	gzipped, err := compressor.Compress([]byte("tile"))
+	assert.Nil(t, err)
+	tile := append([]byte{}, gzipped...)
+	server := newTestArchiveServer(t, HeaderV3{TileType: Mvt}, map[Zxy][]byte{{0, 0, 0}: tile}, ServerOptions{})
+
+	res := serveTestRequest(server, "/0/0/0.mvt", map[string]string{"Accept-Encoding": "gzip, deflate"})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "application/vnd.mapbox-vector-tile", res.Header.Get("Content-Type"))
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, tile, body)
+
+	res = serveTestRequest(server, "/0/0/0.mvt", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, []byte("tile"), body)
+
+	server = newTestArchiveServer(t, HeaderV3{TileType: Mvt}, map[Zxy][]byte{{0, 0, 0}: tile}, ServerOptions{DisableTranscoding: true})
+	res = serveTestRequest(server, "/0/0/0.mvt", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "gzip", res.Header.Get("Content-Encoding"))
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, tile, body)
+}
+
+func TestArchiveServerCors(t *testing.T) {
+	server := newTestArchiveServer(t, HeaderV3{TileType: Png}, map[Zxy][]byte{{0, 0, 0}: {0, 1, 2, 3}}, ServerOptions{CorsOrigins: []string{"https://example.com"}})
+
+	res := serveTestRequest(server, "/0/0/0", map[string]string{"Origin": "https://example.com"})
+	assert.Equal(t, "https://example.com", res.Header.Get("Access-Control-Allow-Origin"))
+	res = serveTestRequest(server, "/0/0/0", map[string]string{"Origin": "https://other.com"})
+	assert.Empty(t, res.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestArchiveServerBrotli(t *testing.T) {
+	compressor, err := newCompressor(Brotli, 0)
+	assert.Nil(t, err)
+	compressed, err := compressor.Compress([]byte("tile"))
+	assert.Nil(t, err)
+	tile := append([]byte{}, compressed...)
+	server := newTestArchiveServer(t, HeaderV3{TileType: Mvt, TileCompression: Brotli}, map[Zxy][]byte{{0, 0, 0}: tile}, ServerOptions{})
+
+	res := serveTestRequest(server, "/0/0/0.mvt", map[string]string{"Accept-Encoding": "gzip, br"})
+	assert.Equal(t, "br", res.Header.Get("Content-Encoding"))
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, tile, body)
+
+	res = serveTestRequest(server, "/0/0/0.mvt", map[string]string{"Accept-Encoding": "gzip"})
+	assert.Empty(t, res.Header.Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header.Get("Vary"))
+	body, _ = io.ReadAll(res.Body)
+	assert.Equal(t, []byte("tile"), body)
+}
+
+func TestArchiveServerWatch(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.pmtiles")
+	assert.Nil(t, os.WriteFile(path, fakeArchive(t, HeaderV3{TileType: Png}, map[string]interface{}{"name": "before"}, map[Zxy][]byte{{0, 0, 0}: {0, 1}}, false, Gzip), 0666))
+	server, err := NewArchiveServer(path, ServerOptions{WatchInterval: 10 * time.Millisecond})
+	assert.Nil(t, err)
+	defer server.Close()
+
+	// hold a reference to the first archive like an in-flight request
+	inflight := server.acquire()
+
+	replacement := filepath.Join(dir, "replacement.pmtiles")
+	assert.Nil(t, os.WriteFile(replacement, fakeArchive(t, HeaderV3{TileType: Png}, map[string]interface{}{"name": "after"}, map[Zxy][]byte{{0, 0, 0}: {2, 3, 4}}, false, Gzip), 0666))
+	assert.Nil(t, os.Rename(replacement, path))
+
+	assert.Eventually(t, func() bool {
+		body, _ := io.ReadAll(serveTestRequest(server, "/0/0/0", nil).Body)
+		return bytes.Equal([]byte{2, 3, 4}, body)
+	}, 5*time.Second, 10*time.Millisecond)
+	body, _ := io.ReadAll(serveTestRequest(server, "/", nil).Body)
+	assert.JSONEq(t, `{"name":"after"}`, string(body))
+
+	data, err := inflight.archive.Extract(0, 0, 0, false)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0, 1}, data)
+	inflight.release()
+	_, err = inflight.archive.Extract(0, 0, 0, false)
+	assert.Error(t, err)
+}
+
+func TestMultiServer(t *testing.T) {
+	dir := t.TempDir()
+	streets := filepath.Join(dir, "streets.pmtiles")
+	assert.Nil(t, os.WriteFile(streets, fakeArchive(t, HeaderV3{TileType: Png}, map[string]interface{}{"name": "streets"}, map[Zxy][]byte{{0, 0, 0}: {0, 1}}, false, Gzip), 0666))
+	terrain := filepath.Join(dir, "terrain.pmtiles")
+	assert.Nil(t, os.WriteFile(terrain, fakeArchive(t, HeaderV3{TileType: Webp}, map[string]interface{}{"name": "terrain"}, map[Zxy][]byte{{1, 1, 1}: {2, 3}}, false, Gzip), 0666))
+
+	server, err := NewMultiServer(map[string]string{"/streets/": streets, "terrain": terrain}, ServerOptions{CorsOrigins: []string{"*"}})
+	assert.Nil(t, err)
+	defer server.Close()
+
+	res := serveTestRequest(server, "/streets/0/0/0.png", map[string]string{"Origin": "https://example.com"})
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "*", res.Header.Get("Access-Control-Allow-Origin"))
+	body, _ := io.ReadAll(res.Body)
+	assert.Equal(t, []byte{0, 1}, body)
+	res = serveTestRequest(server, "/terrain/1/1/1", nil)
+	assert.Equal(t, 200, res.StatusCode)
+	assert.Equal(t, "image/webp", res.Header.Get("Content-Type"))
+	body, _ = io.ReadAll(serveTestRequest(server, "/terrain/metadata.json", nil).Body)
+	assert.JSONEq(t, `{"name":"terrain"}`, string(body))
+
+	assert.Equal(t, 404, serveTestRequest(server, "/satellite/0/0/0", nil).StatusCode)
+	assert.Equal(t, 404, serveTestRequest(server, "/streets/1/0/0", nil).StatusCode)
+	assert.Equal(t, 404, serveTestRequest(server, "/streets/", nil).StatusCode)
+	assert.Equal(t, 404, serveTestRequest(server, "/", nil).StatusCode)
+
+	assert.Nil(t, server.Reload("streets", terrain))
+	body, _ = io.ReadAll(serveTestRequest(server, "/streets/metadata.json", nil).Body)
+	assert.JSONEq(t, `{"name":"terrain"}`, string(body))
+	assert.Error(t, server.Reload("streets", filepath.Join(dir, "missing.pmtiles")))
+	assert.Equal(t, 200, serveTestRequest(server, "/streets/1/1/1", nil).StatusCode)
+	assert.Error(t, server.Reload("satellite", streets))
+
+	_, err = NewMultiServer(map[string]string{"streets": filepath.Join(dir, "missing.pmtiles")}, ServerOptions{})
+	assert.Error(t, err)
+	_, err = NewMultiServer(map[string]string{"a/b": streets}, ServerOptions{})
+	assert.Error(t, err)
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for header, expected := range map[string]bool{
+		"":                  false,
+		"gzip":              true,
+		"deflate, gzip;q=1": true,
+		"br, *":             true,
+		"gzip;q=0":          false,
+		"identity":          false,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Encoding", header)
+		assert.Equal(t, expected, acceptsEncoding(req, "gzip"), header)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br;q=0.5")
+	assert.True(t, acceptsEncoding(req, "br"))
+	req.Header.Set("Accept-Encoding", "gzip")
+	assert.False(t, acceptsEncoding(req, "br"))
+}
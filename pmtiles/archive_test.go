@@ -0,0 +1,194 @@
+package pmtiles
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArchiveExtract(t *testing.T) {
+	header := HeaderV3{TileType: Png}
+	tiles := map[Zxy][]byte{
+		{0, 0, 0}: {0, 1, 2, 3},
+		{4, 1, 2}: {1, 2, 3},
+		{4, 3, 7}: {4, 5},
+	}
+	archive, err := NewArchive(bytes.NewReader(fakeArchive(t, header, map[string]interface{}{}, tiles, true, Gzip)))
+	assert.Nil(t, err)
+	defer archive.Close()
+	assert.Equal(t, uint8(4), archive.Header().MaxZoom)
+
+	for zxy, expected := range tiles {
+		data, err := archive.Extract(zxy.Z, zxy.X, zxy.Y, false)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, data)
+	}
+
+	data, err := archive.Extract(4, 2, 2, false)
+	assert.Nil(t, err)
+	assert.Nil(t, data)
+
+	_, err = archive.Extract(4, 16, 2, false)
+	assert.Error(t, err)
+	_, err = archive.TileExists(40, 0, 0)
+	assert.Error(t, err)
+}
+
+func TestArchiveExtractDecompress(t *testing.T) {
+	original, _, tiles := readTestArchiveTiles(t, "fixtures/test_fixture_1.pmtiles")
+	assert.Equal(t, Compression(Gzip), original.TileCompression)
+
+	archive, err := OpenArchive("fixtures/test_fixture_1.pmtiles")
+	assert.Nil(t, err)
+	defer archive.Close()
+
+	for tileID, expected := range tiles {
+		z, x, y := IDToZxy(tileID)
+		raw, err := archive.Extract(z, x, y, false)
+		assert.Nil(t, err)
+		assert.Equal(t, Compression(Gzip), detectCompression(raw))
+
+		data, err := archive.Extract(z, x, y, true)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+}
+
+func TestExtractTile(t *testing.T) {
+	_, _, tiles := readTestArchiveTiles(t, "fixtures/test_fixture_1.pmtiles")
+	for tileID := range tiles {
+		z, x, y := IDToZxy(tileID)
+		data, err := ExtractTile("fixtures/test_fixture_1.pmtiles", z, x, y)
+		assert.Nil(t, err)
+		assert.NotEmpty(t, data)
+	}
+
+	_, err := ExtractTile("fixtures/does_not_exist.pmtiles", 0, 0, 0)
+	assert.Error(t, err)
+}
+
+// countingReaderAt records the reads of an archive.
+type countingReaderAt struct {
+	r      *bytes.Reader
+	reads  atomic.Int64
+	maxEnd atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads.Add(1)
+	for end := off + int64(len(p)); ; {
+		current := c.maxEnd.Load()
+		if end <= current || c.maxEnd.CompareAndSwap(current, end) {
+			break
+		}
+	}
+	return c.r.ReadAt(p, off)
+}
+
+func TestArchiveTileExists(t *testing.T) {
+	tiles := map[Zxy][]byte{
+		{0, 0, 0}: {0, 1, 2, 3},
+		{4, 1, 2}: {1, 2, 3},
+		{4, 3, 7}: {4, 5},
+	}
+	archiveBytes := fakeArchive(t, HeaderV3{TileType: Png}, map[string]interface{}{}, tiles, true, Gzip)
+	r := &countingReaderAt{r: bytes.NewReader(archiveBytes)}
+	archive, err := NewArchive(r)
+	assert.Nil(t, err)
+	header := archive.Header()
+	assert.NotZero(t, header.LeafDirectoryLength)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for zxy := range tiles {
+				exists, err := archive.TileExists(zxy.Z, zxy.X, zxy.Y)
+				assert.Nil(t, err)
+				assert.True(t, exists)
+			}
+			exists, err := archive.TileExists(4, 2, 2)
+			assert.Nil(t, err)
+			assert.False(t, exists)
+		}()
+	}
+	wg.Wait()
+	// no tile data was read
+	assert.LessOrEqual(t, r.maxEnd.Load(), int64(header.TileDataOffset))
+
+	// leaf directories are cached
+	reads := r.reads.Load()
+	exists, err := archive.TileExists(4, 1, 2)
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, reads, r.reads.Load())
+}
+
+func TestArchivePrefetch(t *testing.T) {
+	tiles := map[Zxy][]byte{
+		{0, 0, 0}: {0, 1, 2, 3},
+		{4, 1, 2}: {1, 2, 3},
+		{4, 3, 7}: {4, 5},
+	}
+	archiveBytes := fakeArchive(t, HeaderV3{TileType: Png}, map[string]interface{}{}, tiles, true, Gzip)
+	r := &countingReaderAt{r: bytes.NewReader(archiveBytes)}
+	archive, err := NewArchive(r)
+	assert.Nil(t, err)
+	header := archive.Header()
+
+	// a missing tile is not an error
+	coords := []Zxy{{0, 0, 0}, {4, 1, 2}, {4, 3, 7}, {4, 2, 2}}
+	assert.Nil(t, archive.Prefetch(context.Background(), coords, 2))
+	assert.NotZero(t, r.reads.Load())
+	assert.LessOrEqual(t, r.maxEnd.Load(), int64(header.TileDataOffset))
+
+	reads := r.reads.Load()
+	for zxy := range tiles {
+		exists, err := archive.TileExists(zxy.Z, zxy.X, zxy.Y)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+	}
+	assert.Equal(t, reads, r.reads.Load())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	archive, err = NewArchive(r)
+	assert.Nil(t, err)
+	assert.ErrorIs(t, archive.Prefetch(ctx, coords, 2), context.Canceled)
+	assert.Error(t, archive.Prefetch(context.Background(), []Zxy{{1, 2, 0}}, 2))
+}
+
+func TestArchiveGetTile(t *testing.T) {
+	_, _, tiles := readTestArchiveTiles(t, "fixtures/test_fixture_1.pmtiles")
+	archive, err := OpenArchive("fixtures/test_fixture_1.pmtiles")
+	assert.Nil(t, err)
+
+	for tileID, expected := range tiles {
+		z, x, y := IDToZxy(tileID)
+		raw, err := archive.GetTileRaw(z, x, y)
+		assert.Nil(t, err)
+		assert.Equal(t, Compression(Gzip), detectCompression(raw))
+		data, err := archive.GetTile(z, x, y)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+
+	_, err = archive.GetTile(10, 0, 0)
+	assert.ErrorIs(t, err, ErrTileNotFound)
+	_, err = archive.GetTileRaw(10, 0, 0)
+	assert.ErrorIs(t, err, ErrTileNotFound)
+
+	assert.Nil(t, archive.Close())
+	for tileID := range tiles {
+		z, x, y := IDToZxy(tileID)
+		_, err = archive.GetTile(z, x, y)
+		assert.Error(t, err)
+		assert.NotErrorIs(t, err, ErrTileNotFound)
+	}
+	assert.Nil(t, archive.Close())
+}
@@ -0,0 +1,138 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// BenchmarkResult is the read throughput and latency of BenchmarkArchive.
+type BenchmarkResult struct {
+	Sequential bool `json:"sequential"`
+	// Tiles is the number of tiles requested, and Found the number present in the archive.
+	Tiles int `json:"tiles"`
+	Found int `json:"found"`
+	// Bytes is the total length of the tiles read, as stored.
+	Bytes          uint64  `json:"bytes"`
+	TotalSeconds   float64 `json:"total_s"`
+	TilesPerSecond float64 `json:"tiles_per_s"`
+	BytesPerSecond float64 `json:"bytes_per_s"`
+	// Latencies of a single tile request in milliseconds, including directory lookups.
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+	// RootHits counts the requests answered by the cached root directory alone.
+	// The others needed a leaf directory: LeafCacheHits from the leaf cache, LeafReads from storage.
+	RootHits      int `json:"root_hits"`
+	LeafCacheHits int `json:"leaf_cache_hits"`
+	LeafReads     int `json:"leaf_reads"`
+}
+
+// leafCountingReader counts the reads of the leaf directory section of an archive.
+type leafCountingReader struct {
+	io.ReaderAt
+	header HeaderV3
+	reads  atomic.Int64
+}
+
+func (r *leafCountingReader) ReadAt(p []byte, off int64) (int, error) {
+	if uint64(off) >= r.header.LeafDirectoryOffset && uint64(off) < r.header.LeafDirectoryOffset+r.header.LeafDirectoryLength {
+		r.reads.Add(1)
+	}
+	return r.ReaderAt.ReadAt(p, off)
+}
+
+// BenchmarkArchive reads n tiles of the local archive at path one at a time and measures their throughput and latency:
+// the first n addressed tiles in tile ID order if sequential is set, or otherwise n random tile IDs between the
+// minimum and maximum zoom levels of the header, some of which may not be in the archive.
+// The header and root directory are read before timing starts, as a server would cache them.
+func BenchmarkArchive(path string, n int, sequential bool) (*BenchmarkResult, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("number of tiles must be positive")
+	}
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tileIDs []uint64
+	if sequential {
+		tileIDs = make([]uint64, 0, n)
+		err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+			for i := uint64(0); i < uint64(e.RunLength) && len(tileIDs) < n; i++ {
+				tileIDs = append(tileIDs, e.TileID+i)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+		}
+	} else {
+		if header.MinZoom > header.MaxZoom || header.MaxZoom >= MaxTileZoom {
+			return nil, fmt.Errorf("invalid zoom levels %d to %d in header of %s", header.MinZoom, header.MaxZoom, path)
+		}
+		first := ZxyToID(header.MinZoom, 0, 0)
+		span := ZxyToID(header.MaxZoom+1, 0, 0) - first
+		tileIDs = make([]uint64, n)
+		for i := range tileIDs {
+			tileIDs[i] = first + uint64(rand.Int63n(int64(span)))
+		}
+	}
+
+	reader := &leafCountingReader{ReaderAt: file, header: header}
+	archive, err := NewArchive(reader)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, %w", path, err)
+	}
+
+	result := &BenchmarkResult{Sequential: sequential, Tiles: len(tileIDs)}
+	latencies := make([]time.Duration, len(tileIDs))
+	start := time.Now()
+	for i, tileID := range tileIDs {
+		if entry, ok := findTile(archive.root, tileID); !ok || entry.RunLength > 0 {
+			result.RootHits++
+		}
+		z, x, y := IDToZxy(tileID)
+		tileStart := time.Now()
+		data, err := archive.Extract(z, x, y, false)
+		latencies[i] = time.Since(tileStart)
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			result.Found++
+			result.Bytes += uint64(len(data))
+		}
+	}
+	elapsed := time.Since(start)
+
+	result.LeafReads = int(reader.reads.Load())
+	// a lookup through nested leaf directories may read more than one
+	result.LeafCacheHits = max(result.Tiles-result.RootHits-result.LeafReads, 0)
+	result.TotalSeconds = elapsed.Seconds()
+	if elapsed > 0 {
+		result.TilesPerSecond = float64(result.Tiles) / elapsed.Seconds()
+		result.BytesPerSecond = float64(result.Bytes) / elapsed.Seconds()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.P50Ms = latencyPercentile(latencies, 0.5)
+	result.P95Ms = latencyPercentile(latencies, 0.95)
+	result.P99Ms = latencyPercentile(latencies, 0.99)
+	return result, nil
+}
+
+// latencyPercentile returns the p-th quantile of the sorted latencies in milliseconds, by the nearest rank.
+func latencyPercentile(sorted []time.Duration, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return float64(sorted[rank].Microseconds()) / 1000
+}
@@ -0,0 +1,50 @@
+package pmtiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBenchmarkArchive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bench.pmtiles")
+	var tiles []testTile
+	for i := uint64(0); i < 20000; i++ {
+		z, x, y := IDToZxy(i)
+		tiles = append(tiles, testTile{z, x, y, fmt.Sprint(i)})
+	}
+	writeTestArchive(t, path, NoCompression, Png, nil, tiles)
+
+	result, err := BenchmarkArchive(path, 100, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 100, result.Tiles)
+	assert.Equal(t, 100, result.Found)
+	assert.Equal(t, uint64(190), result.Bytes)
+	// the first tiles are all in the first leaf directory
+	assert.Equal(t, 0, result.RootHits)
+	assert.Equal(t, 1, result.LeafReads)
+	assert.Equal(t, 99, result.LeafCacheHits)
+	assert.LessOrEqual(t, result.P50Ms, result.P95Ms)
+	assert.LessOrEqual(t, result.P95Ms, result.P99Ms)
+	_, err = json.Marshal(result)
+	assert.Nil(t, err)
+
+	result, err = BenchmarkArchive(path, 50, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 50, result.Tiles)
+	assert.LessOrEqual(t, result.Found, 50)
+
+	_, err = BenchmarkArchive(path, 0, false)
+	assert.Error(t, err)
+}
+
+func TestLatencyPercentile(t *testing.T) {
+	latencies := []time.Duration{time.Millisecond, 2 * time.Millisecond, 3 * time.Millisecond, 4 * time.Millisecond}
+	assert.Equal(t, 2.0, latencyPercentile(latencies, 0.5))
+	assert.Equal(t, 4.0, latencyPercentile(latencies, 0.99))
+	assert.Equal(t, 0.0, latencyPercentile(nil, 0.5))
+}
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
@@ -185,7 +186,7 @@ func (b HTTPBucket) NewRangeReaderEtag(ctx context.Context, key string, offset,
 
 	resp, err := b.client.Do(req)
 	if err != nil {
-		return nil, "", resp.StatusCode, err
+		return nil, "", 500, err
 	}
 
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
@@ -193,7 +194,7 @@ func (b HTTPBucket) NewRangeReaderEtag(ctx context.Context, key string, offset,
 		if isRefreshRequiredCode(resp.StatusCode) {
 			err = &RefreshRequiredError{resp.StatusCode}
 		} else {
-			err = fmt.Errorf("HTTP error: %d", resp.StatusCode)
+			err = &httpStatusError{resp.StatusCode, parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
 		}
 		return nil, "", resp.StatusCode, err
 	}
@@ -205,6 +206,17 @@ func (b HTTPBucket) Close() error {
 	return nil
 }
 
+// httpStatusError is the error of an HTTP response with an unexpected status,
+// with the wait requested by its Retry-After header if any.
+type httpStatusError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("HTTP error: %d", e.status)
+}
+
 func isRefreshRequiredCode(code int) bool {
 	return code == http.StatusPreconditionFailed || code == http.StatusRequestedRangeNotSatisfiable
 }
@@ -317,6 +329,18 @@ func NormalizeBucketKey(bucket string, prefix string, key string) (string, strin
 			}
 			return u.Scheme + "://" + u.Host + dir, file, nil
 		}
+		if strings.Contains(key, "://") && !strings.HasPrefix(key, "file://") {
+			// a full cloud storage URL such as s3://bucket/dir/key.pmtiles?region=us-east-1
+			u, err := url.Parse(key)
+			if err != nil {
+				return "", "", err
+			}
+			bucketURL := u.Scheme + "://" + u.Host
+			if u.RawQuery != "" {
+				bucketURL += "?" + u.RawQuery
+			}
+			return bucketURL, strings.TrimPrefix(u.Path, "/"), nil
+		}
 		fileprotocol := "file://"
 		if string(os.PathSeparator) != "/" {
 			fileprotocol += "/"
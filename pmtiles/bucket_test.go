@@ -44,6 +44,12 @@ func TestNormalizeHttp(t *testing.T) {
 	assert.Equal(t, "http://example.com/foo", bucket)
 }
 
+func TestNormalizeCloudStorageURL(t *testing.T) {
+	bucket, key, _ := NormalizeBucketKey("", "", "s3://tiles/foo/bar.pmtiles?region=us-east-1")
+	assert.Equal(t, "foo/bar.pmtiles", key)
+	assert.Equal(t, "s3://tiles?region=us-east-1", bucket)
+}
+
 func TestNormalizePathPrefixServer(t *testing.T) {
 	bucket, key, _ := NormalizeBucketKey("", "../foo", "")
 	assert.Equal(t, "", key)
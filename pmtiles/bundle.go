@@ -0,0 +1,216 @@
+package pmtiles
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// bundleFormat returns the format of a tar or zip output path: "tar", "tar.gz" or "zip", or "" for any other path.
+func bundleFormat(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".tar"):
+		return "tar"
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return "tar.gz"
+	case strings.HasSuffix(path, ".zip"):
+		return "zip"
+	}
+	return ""
+}
+
+// isPmtilesV3 returns whether the file at path starts with the magic bytes of a PMTiles version 3 archive.
+func isPmtilesV3(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic[0:7]) == "PMTiles" && magic[7] == 3
+}
+
+// bundleWriter adds files to a tar or zip archive.
+type bundleWriter interface {
+	add(name string, data []byte, compressed bool) error
+	Close() error
+}
+
+type tarBundle struct {
+	tw *tar.Writer
+	gz *gzip.Writer
+}
+
+func (b *tarBundle) add(name string, data []byte, _ bool) error {
+	// a fixed time keeps the output identical for identical input
+	header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: time.Unix(0, 0), Typeflag: tar.TypeReg}
+	if err := b.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tw.Write(data)
+	return err
+}
+
+func (b *tarBundle) Close() error {
+	if err := b.tw.Close(); err != nil {
+		return err
+	}
+	if b.gz != nil {
+		return b.gz.Close()
+	}
+	return nil
+}
+
+type zipBundle struct {
+	zw *zip.Writer
+}
+
+func (b *zipBundle) add(name string, data []byte, compressed bool) error {
+	// compressed tiles are stored as-is, as deflating them again gains nothing
+	method := zip.Deflate
+	if compressed {
+		method = zip.Store
+	}
+	w, err := b.zw.CreateHeader(&zip.FileHeader{Name: name, Method: method})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+func (b *zipBundle) Close() error {
+	return b.zw.Close()
+}
+
+func newBundleWriter(w io.Writer, format string) (bundleWriter, error) {
+	switch format {
+	case "tar":
+		return &tarBundle{tw: tar.NewWriter(w)}, nil
+	case "tar.gz":
+		gz, err := newGzipWriter(w, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		return &tarBundle{tw: tar.NewWriter(gz), gz: gz}, nil
+	case "zip":
+		return &zipBundle{zip.NewWriter(w)}, nil
+	}
+	return nil, fmt.Errorf("unknown bundle format %s", format)
+}
+
+// convertToBundleFile extracts a PMTiles archive like convertToDirectory, into a tar, tar.gz or zip file at output.
+func convertToBundleFile(logger *log.Logger, input string, output string, format string, opts ConvertOptions) error {
+	outfile, err := createAtomic(output)
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+	if err := convertToBundle(logger, input, outfile, format, opts); err != nil {
+		return err
+	}
+	return outfile.commit()
+}
+
+// convertToBundle extracts the tiles of a PMTiles archive to w as members of a tar, tar.gz or zip archive
+// named like the files of convertToDirectory, followed by metadata.json and tilejson.json. Every tile of a run is a separate member.
+// Tile data is read in a separate goroutine while members are written in order.
+func convertToBundle(logger *log.Logger, input string, w io.Writer, format string, opts ConvertOptions) error {
+	start := time.Now()
+	file, header, err := openLocalHeader(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadataBytes, err := DeserializeMetadataBytes(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata: %w", err)
+	}
+	paths := newTilePaths(header, opts)
+	decompress := opts.Decompress && header.TileCompression != NoCompression && header.TileCompression != UnknownCompression
+	compressed := header.TileCompression != NoCompression && !decompress
+
+	var entries []EntryV3
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		entries = append(entries, e)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to iterate through tiles: %w", err)
+	}
+
+	bundle, err := newBundleWriter(w, format)
+	if err != nil {
+		return err
+	}
+	bar := newProgress(opts, "tiles", int64(header.AddressedTilesCount), "Extracting tiles")
+
+	type tileTask struct {
+		entry    EntryV3
+		tileData []byte
+	}
+	taskCh := make(chan tileTask, 64)
+	g, ctx := errgroup.WithContext(opts.context())
+	g.Go(func() error {
+		defer close(taskCh)
+		return readCoalesced(file, header.TileDataOffset, entries, opts.ReadBuffer, 1, func(entry EntryV3, tileData []byte) error {
+			if decompress {
+				tileData = decompressExtractedTile(logger, entry.TileID, tileData, header.TileCompression)
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case taskCh <- tileTask{entry, tileData}:
+				return nil
+			}
+		})
+	})
+
+	var tiles uint64
+	g.Go(func() error {
+		for task := range taskCh {
+			for i := uint32(0); i < task.entry.RunLength; i++ {
+				z, x, y := IDToZxy(task.entry.TileID + uint64(i))
+				if err := bundle.add(paths.path(z, x, y), task.tileData, compressed); err != nil {
+					return fmt.Errorf("Failed to write tile %d/%d/%d: %w", z, x, y, err)
+				}
+				bar.Add(1)
+				tiles++
+			}
+		}
+		return nil
+	})
+	if err := g.Wait(); err != nil {
+		return err
+	}
+	bar.Finish()
+
+	if header.MetadataLength > 0 {
+		if err := bundle.add("metadata.json", metadataBytes, false); err != nil {
+			return fmt.Errorf("Failed to write metadata.json: %w", err)
+		}
+	}
+	if tilejsonBytes, err := directoryTileJSON(header, metadataBytes, opts.TileJSONBaseURL, paths); err != nil {
+		logger.Printf("WARNING: not writing tilejson.json, %v", err)
+	} else if err := bundle.add("tilejson.json", tilejsonBytes, false); err != nil {
+		return fmt.Errorf("Failed to write tilejson.json: %w", err)
+	}
+	if err := bundle.Close(); err != nil {
+		return fmt.Errorf("Failed to finish %s archive: %w", format, err)
+	}
+
+	logger.Printf("Extracted %d tiles in %v", tiles, time.Since(start))
+	return reportSummary(opts, header, progressSummary{AddressedTiles: tiles}, start)
+}
@@ -0,0 +1,83 @@
+package pmtiles
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readTarMembers(t *testing.T, r io.Reader) map[string]string {
+	members := make(map[string]string)
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		data, err := io.ReadAll(tr)
+		assert.Nil(t, err)
+		members[header.Name] = string(data)
+	}
+	return members
+}
+
+func TestConvertToBundle(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}, {1, 0, 1, "b"}}
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{"name": "bundle"}, tiles)
+
+	check := func(members map[string]string) {
+		assert.Equal(t, "a", members["0/0/0.png"])
+		assert.Equal(t, "b", members["1/0/0.png"])
+		assert.Equal(t, "b", members["1/0/1.png"])
+		assert.Contains(t, members["metadata.json"], "bundle")
+		assert.Contains(t, members["tilejson.json"], "{z}/{x}/{y}.png")
+	}
+
+	output := filepath.Join(dir, "out.tar")
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{}, nil))
+	f, err := os.Open(output)
+	assert.Nil(t, err)
+	check(readTarMembers(t, f))
+	f.Close()
+	assert.Error(t, Convert(logger, input, output, ConvertOptions{}, nil))
+
+	output = filepath.Join(dir, "out.tar.gz")
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{}, nil))
+	f, err = os.Open(output)
+	assert.Nil(t, err)
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	check(readTarMembers(t, gz))
+	f.Close()
+
+	output = filepath.Join(dir, "out.zip")
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{}, nil))
+	zr, err := zip.OpenReader(output)
+	assert.Nil(t, err)
+	members := make(map[string]string)
+	for _, file := range zr.File {
+		r, err := file.Open()
+		assert.Nil(t, err)
+		data, err := io.ReadAll(r)
+		assert.Nil(t, err)
+		members[file.Name] = string(data)
+		r.Close()
+	}
+	zr.Close()
+	check(members)
+
+	var b bytes.Buffer
+	assert.Nil(t, ConvertToWriter(logger, input, &b, ConvertOptions{}, nil))
+	check(readTarMembers(t, &b))
+}
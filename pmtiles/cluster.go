@@ -2,17 +2,39 @@ package pmtiles
 
 import (
 	"fmt"
-	"github.com/schollz/progressbar/v3"
 	"io"
 	"log"
 	"os"
 )
 
-func Cluster(logger *log.Logger, InputPMTiles string, deduplicate bool) error {
+// ClusterOptions are the options of ClusterWithOptions.
+type ClusterOptions struct {
+	// Output is the path of the clustered archive; empty means rewriting the input in place.
+	Output string
+	// Deduplicate stores identical tile contents once.
+	Deduplicate bool
+	// Force rewrites an archive that is already clustered, such as to deduplicate it.
+	Force bool
+	// TmpDir is the folder for the temporary file of tile data, or the OS default if empty.
+	TmpDir string
+}
+
+func Cluster(logger *log.Logger, InputPMTiles string, deduplicate bool, progress ...ProgressReporter) error {
+	return ClusterWithOptions(logger, InputPMTiles, ClusterOptions{Deduplicate: deduplicate}, progress...)
+}
+
+// ClusterWithOptions rewrites the tile data of an archive in tile ID order, streaming it through a temporary file,
+// and marks it as clustered. It fails on an archive that is already clustered unless opts.Force is set.
+func ClusterWithOptions(logger *log.Logger, InputPMTiles string, opts ClusterOptions, progress ...ProgressReporter) error {
+	output := opts.Output
+	if output == "" {
+		output = InputPMTiles
+	}
 	file, err := os.OpenFile(InputPMTiles, os.O_RDONLY, 0666)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	buf := make([]byte, 127)
 	_, err = file.Read(buf)
@@ -25,7 +47,7 @@ func Cluster(logger *log.Logger, InputPMTiles string, deduplicate bool) error {
 		return err
 	}
 
-	if header.Clustered {
+	if header.Clustered && !opts.Force {
 		return fmt.Errorf("archive is already clustered")
 	}
 
@@ -34,22 +56,35 @@ func Cluster(logger *log.Logger, InputPMTiles string, deduplicate bool) error {
 	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
 
 	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata, %w", err)
+	}
 
-	resolver := newResolver(deduplicate, false)
-	tmpfile, err := os.CreateTemp("", "pmtiles")
+	resolver := newResolver(opts.Deduplicate, NoCompression)
+	defer resolver.close()
+	tmpfile, err := os.CreateTemp(opts.TmpDir, "pmtiles")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
 
-	bar := progressbar.Default(int64(header.TileEntriesCount))
+	bar := newStepProgress(progress, int64(header.TileEntriesCount))
+	var addErr error
 
 	err = IterateEntries(header,
-		func(offset uint64, length uint64) ([]byte, error) {
-			return io.ReadAll(io.NewSectionReader(file, int64(offset), int64(length)))
-		},
+		ReaderAtFetcher(file),
 		func(e EntryV3) {
+			if addErr != nil {
+				return
+			}
 			data, _ := io.ReadAll(io.NewSectionReader(file, int64(header.TileDataOffset+e.Offset), int64(e.Length)))
-			if isNew, newData := resolver.AddTileIsNew(e.TileID, data, e.RunLength); isNew {
+			isNew, newData, err := resolver.AddTileIsNew(e.TileID, data, e.RunLength)
+			if err != nil {
+				addErr = tileOrderError(e.TileID, err)
+				return
+			}
+			if isNew {
 				tmpfile.Write(newData)
 			}
 			bar.Add(1)
@@ -58,11 +93,15 @@ func Cluster(logger *log.Logger, InputPMTiles string, deduplicate bool) error {
 	if err != nil {
 		return err
 	}
+	if addErr != nil {
+		return addErr
+	}
 
 	file.Close()
 
 	header.Clustered = true
-	newHeader, err := finalize(logger, resolver, header, tmpfile, InputPMTiles, metadata)
+	header.InternalCompression = Gzip
+	newHeader, err := finalize(logger, resolver, header, tmpfile, output, metadata)
 	if err != nil {
 		return err
 	}
@@ -3,6 +3,7 @@ package pmtiles
 import (
 	"github.com/stretchr/testify/assert"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -21,3 +22,21 @@ func TestCluster(t *testing.T) {
 	header, _ := DeserializeHeader(buf)
 	assert.True(t, header.Clustered)
 }
+
+func TestClusterToOutput(t *testing.T) {
+	input := makeFixtureCopy(t, "unclustered", "cluster")
+	output := filepath.Join(t.TempDir(), "clustered.pmtiles")
+
+	err := ClusterWithOptions(logger, input, ClusterOptions{Output: output, Deduplicate: true})
+	assert.Nil(t, err)
+	header, _, tiles := readTestArchiveTiles(t, output)
+	assert.True(t, header.Clustered)
+	assert.Nil(t, Verify(logger, output))
+
+	inputHeader, _, inputTiles := readTestArchiveTiles(t, input)
+	assert.False(t, inputHeader.Clustered)
+	assert.Equal(t, inputTiles, tiles)
+
+	assert.Error(t, ClusterWithOptions(logger, output, ClusterOptions{Deduplicate: true}))
+	assert.Nil(t, ClusterWithOptions(logger, output, ClusterOptions{Deduplicate: true, Force: true}))
+}
@@ -0,0 +1,130 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// CompactOptions are the options of CompactWithOptions.
+type CompactOptions struct {
+	// Deduplicate stores identical tile contents once, also when they are stored several times in the input.
+	Deduplicate bool
+}
+
+// CompactResult describes what CompactWithOptions removed from an archive.
+type CompactResult struct {
+	// RemovedEntries is the number of zero-length tile entries removed.
+	RemovedEntries int
+	// RemovedTiles is the number of tiles addressed by the removed entries.
+	RemovedTiles uint64
+	// ReclaimedBytes is the size of the input less that of the output.
+	ReclaimedBytes int64
+}
+
+// Compact writes a local archive to output without its zero-length tile entries, as CompactWithOptions.
+func Compact(logger *log.Logger, input string, output string, tmpfile *os.File) error {
+	_, err := CompactWithOptions(logger, input, output, tmpfile, CompactOptions{})
+	return err
+}
+
+// CompactWithOptions writes a local archive to output without its zero-length tile entries,
+// which some tools write as placeholders for missing tiles. The remaining tiles are rewritten
+// in tile ID order through tmpfile, and the header counts are those of the output.
+// Tiles sharing contents in the input still share them in the output.
+func CompactWithOptions(logger *log.Logger, input string, output string, tmpfile *os.File, opts CompactOptions, progress ...ProgressReporter) (CompactResult, error) {
+	start := time.Now()
+	var result CompactResult
+
+	file, err := os.Open(input)
+	if err != nil {
+		return result, fmt.Errorf("Failed to open %s, %w", input, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return result, fmt.Errorf("Failed to stat %s, %w", input, err)
+	}
+
+	headerBytes := make([]byte, HeaderV3LenBytes)
+	if _, err := io.ReadFull(file, headerBytes); err != nil {
+		return result, fmt.Errorf("Failed to read header of %s, %w", input, err)
+	}
+	header, err := DeserializeHeader(headerBytes)
+	if err != nil {
+		return result, fmt.Errorf("Failed to parse header of %s, %w", input, err)
+	}
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return result, fmt.Errorf("Failed to read metadata of %s, %w", input, err)
+	}
+
+	// tiles are stored as they are, so the tile compression of the header is kept
+	resolve := newResolver(opts.Deduplicate, NoCompression)
+	defer resolve.close()
+	// contents already written, by their offset in the input
+	written := make(map[uint64]offsetLen)
+	bar := newStepProgress(progress, int64(header.TileEntriesCount))
+	var addErr error
+
+	err = IterateEntries(header,
+		ReaderAtFetcher(file),
+		func(e EntryV3) {
+			bar.Add(1)
+			if addErr != nil {
+				return
+			}
+			if e.Length == 0 {
+				result.RemovedEntries++
+				result.RemovedTiles += uint64(e.RunLength)
+				return
+			}
+			if found, ok := written[e.Offset]; ok {
+				if err := resolve.addExistingTile(e.TileID, found, e.RunLength); err != nil {
+					addErr = tileOrderError(e.TileID, err)
+				}
+				return
+			}
+			data := make([]byte, e.Length)
+			if _, err := file.ReadAt(data, int64(header.TileDataOffset+e.Offset)); err != nil {
+				addErr = fmt.Errorf("Failed to read tile data, %w", err)
+				return
+			}
+			isNew, newData, err := resolve.addTile(e.TileID, data, e.RunLength, func() []byte {
+				return data
+			})
+			if err != nil {
+				addErr = tileOrderError(e.TileID, err)
+				return
+			}
+			if isNew {
+				if _, err := tmpfile.Write(newData); err != nil {
+					addErr = fmt.Errorf("Failed to write to tempfile, %w", err)
+					return
+				}
+			}
+			added := resolve.Entries[len(resolve.Entries)-1]
+			written[e.Offset] = offsetLen{added.Offset, added.Length}
+		})
+	if err != nil {
+		return result, fmt.Errorf("Failed to iterate through tiles of %s, %w", input, err)
+	}
+	if addErr != nil {
+		return result, addErr
+	}
+
+	if _, err := finalize(logger, resolve, header, tmpfile, output, metadata); err != nil {
+		return result, err
+	}
+	outputInfo, err := os.Stat(output)
+	if err != nil {
+		return result, fmt.Errorf("Failed to stat %s, %w", output, err)
+	}
+	result.ReclaimedBytes = info.Size() - outputInfo.Size()
+	logger.Printf("Removed %d empty entries addressing %d tiles, reclaiming %d bytes", result.RemovedEntries, result.RemovedTiles, result.ReclaimedBytes)
+	logger.Println("Finished in ", time.Since(start))
+	return result, nil
+}
@@ -0,0 +1,58 @@
+package pmtiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompact(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := map[Zxy][]byte{
+		{0, 0, 0}: []byte("root"),
+		{1, 0, 0}: {},
+		{1, 0, 1}: []byte("same"),
+		{1, 1, 1}: {},
+		{1, 1, 0}: []byte("same"),
+	}
+	header := HeaderV3{
+		TileType:        Png,
+		TileCompression: NoCompression,
+		MinLonE7:        -1800000000,
+		MinLatE7:        -850000000,
+		MaxLonE7:        1800000000,
+		MaxLatE7:        850000000,
+	}
+	archive := fakeArchive(t, header, map[string]interface{}{"name": "compacted"}, tiles, false, Gzip)
+	assert.Nil(t, os.WriteFile(input, archive, 0644))
+
+	for _, deduplicate := range []bool{false, true} {
+		output := filepath.Join(dir, "out.pmtiles")
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		result, err := CompactWithOptions(logger, input, output, tmpfile, CompactOptions{Deduplicate: deduplicate})
+		tmpfile.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, 2, result.RemovedEntries)
+		assert.Equal(t, uint64(2), result.RemovedTiles)
+		info, err := os.Stat(output)
+		assert.Nil(t, err)
+		assert.Equal(t, int64(len(archive))-info.Size(), result.ReclaimedBytes)
+		assert.True(t, result.ReclaimedBytes > 0)
+
+		header, metadata, compacted := readTestArchiveTiles(t, output)
+		assert.Equal(t, map[uint64]string{0: "root", 2: "same", 4: "same"}, compacted)
+		assert.Equal(t, "compacted", metadata["name"])
+		assert.Equal(t, uint64(3), header.AddressedTilesCount)
+		if deduplicate {
+			assert.Equal(t, uint64(2), header.TileContentsCount)
+			assert.Equal(t, uint64(8), header.TileDataLength)
+		} else {
+			assert.Equal(t, uint64(12), header.TileDataLength)
+		}
+		assert.Nil(t, Verify(logger, output))
+	}
+}
@@ -0,0 +1,177 @@
+package pmtiles
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressor compresses individual tiles, reusing its internal state between calls.
+// The returned slice is only valid until the next call to Compress.
+type compressor interface {
+	Compress(data []byte) ([]byte, error)
+}
+
+// newGzipWriter returns a gzip writer whose stream header has no modification time and an unknown OS,
+// so the same data always compresses to the same bytes, whatever the platform.
+func newGzipWriter(w io.Writer, level int) (*gzip.Writer, error) {
+	gw, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	gw.ModTime = time.Time{}
+	gw.OS = 255
+	return gw, nil
+}
+
+type gzipCompressor struct {
+	buf    *bytes.Buffer
+	writer *gzip.Writer
+}
+
+func (c *gzipCompressor) Compress(data []byte) ([]byte, error) {
+	c.buf.Reset()
+	c.writer.Reset(c.buf)
+	if _, err := c.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+type brotliCompressor struct {
+	buf    *bytes.Buffer
+	writer *brotli.Writer
+}
+
+func (c *brotliCompressor) Compress(data []byte) ([]byte, error) {
+	c.buf.Reset()
+	c.writer.Reset(c.buf)
+	if _, err := c.writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := c.writer.Close(); err != nil {
+		return nil, err
+	}
+	return c.buf.Bytes(), nil
+}
+
+type zstdCompressor struct {
+	buf     []byte
+	encoder *zstd.Encoder
+}
+
+func (c *zstdCompressor) Compress(data []byte) ([]byte, error) {
+	c.buf = c.encoder.EncodeAll(data, c.buf[:0])
+	return c.buf, nil
+}
+
+var errUnsupportedCompression = errors.New("compression not supported")
+
+type nopCompressor struct{}
+
+func (nopCompressor) Compress(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// newCompressor returns a compressor for the given compression.
+// level is the gzip compression level, 0 meaning gzip.BestCompression.
+func newCompressor(compression Compression, level int) (compressor, error) {
+	switch compression {
+	case NoCompression:
+		return nopCompressor{}, nil
+	case Gzip:
+		if level == 0 {
+			level = gzip.BestCompression
+		}
+		b := new(bytes.Buffer)
+		w, err := newGzipWriter(b, level)
+		if err != nil {
+			return nil, err
+		}
+		return &gzipCompressor{b, w}, nil
+	case Zstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdCompressor{encoder: enc}, nil
+	case Brotli:
+		b := new(bytes.Buffer)
+		return &brotliCompressor{b, brotli.NewWriterLevel(b, brotli.BestCompression)}, nil
+	default:
+		return nil, errUnsupportedCompression
+	}
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (w *nopWriteCloser) Close() error { return nil }
+
+// newCompressWriter returns a writer that compresses everything written to w.
+// The caller must Close it to flush the compressed stream.
+func newCompressWriter(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case NoCompression:
+		return &nopWriteCloser{w}, nil
+	case Gzip:
+		return newGzipWriter(w, gzip.BestCompression)
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	case Brotli:
+		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+	default:
+		return nil, errUnsupportedCompression
+	}
+}
+
+// newDecompressReader returns a reader of the decompressed contents of r.
+func newDecompressReader(r io.Reader, compression Compression) (io.ReadCloser, error) {
+	switch compression {
+	case NoCompression:
+		return io.NopCloser(r), nil
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	case Brotli:
+		return io.NopCloser(brotli.NewReader(r)), nil
+	default:
+		return nil, errUnsupportedCompression
+	}
+}
+
+// detectCompression inspects the magic bytes of data, returning NoCompression if
+// it is not a recognized gzip or zstd stream. Brotli streams have no magic bytes,
+// so they are never detected.
+func detectCompression(data []byte) Compression {
+	if len(data) >= 2 && data[0] == 0x1f && data[1] == 0x8b {
+		return Gzip
+	}
+	if len(data) >= 4 && data[0] == 0x28 && data[1] == 0xb5 && data[2] == 0x2f && data[3] == 0xfd {
+		return Zstd
+	}
+	return NoCompression
+}
+
+func decompressBytes(data []byte, compression Compression) ([]byte, error) {
+	r, err := newDecompressReader(bytes.NewReader(data), compression)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
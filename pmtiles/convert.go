@@ -2,29 +2,34 @@ package pmtiles
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
 	"hash/fnv"
 	"io"
+	"io/fs"
 	"log"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/RoaringBitmap/roaring/roaring64"
-	"github.com/schollz/progressbar/v3"
+	"github.com/dustin/go-humanize"
+	"github.com/zeebo/xxh3"
 	"golang.org/x/sync/errgroup"
 	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 type offsetLen struct {
@@ -32,89 +37,909 @@ type offsetLen struct {
 	Length uint32
 }
 
+// contentHash is the deduplication key of tile contents: the hash sum,
+// zero-padded or truncated to 16 bytes so it can be used as a map key without allocating.
+type contentHash [16]byte
+
+// xxh3Hash is a hash.Hash returning the 128-bit xxh3 sum.
+type xxh3Hash struct {
+	*xxh3.Hasher
+}
+
+func (h xxh3Hash) Size() int {
+	return 16
+}
+
+func (h xxh3Hash) Sum(b []byte) []byte {
+	sum := h.Sum128()
+	b = binary.BigEndian.AppendUint64(b, sum.Hi)
+	return binary.BigEndian.AppendUint64(b, sum.Lo)
+}
+
+// newDedupHash returns the hash function named by ConvertOptions.Hash:
+// "fnv" for FNV-128a, used by earlier versions, or xxh3-128 otherwise.
+func newDedupHash(name string) hash.Hash {
+	if name == "fnv" {
+		return fnv.New128a()
+	}
+	return xxh3Hash{xxh3.New()}
+}
+
 type resolver struct {
 	deduplicate    bool
-	compress       bool
+	compression    Compression
+	decompress     bool // with NoCompression, decompress tiles instead of storing them as-is
+	passthrough    bool // store tiles as-is without inspecting their compression
+	recompress     bool // decompress compressed tiles before deduplication and compression
+	brotliInput    bool // input tiles without gzip or zstd magic bytes are Brotli streams
+	level          int  // gzip compression level, 0 meaning gzip.BestCompression
 	Entries        []EntryV3
 	Offset         uint64
-	OffsetMap      map[string]offsetLen
+	index          dedupIndex
 	AddressedTiles uint64 // none of them can be empty
-	compressor     *gzip.Writer
-	compressTmp    *bytes.Buffer
+	nextID         uint64 // the tile ID following the last entry added
+	compressor     compressor
 	hashfunc       hash.Hash
+	sum            [64]byte      // scratch space for hash sums
+	stats          *convertStats // statistics of added tiles, if a conversion report is requested
+	rootDirSize    int           // largest root directory in bytes, 0 meaning 16384 less the header
+	noLeafDirs     bool          // put every entry in the root directory
 }
 
 func (r *resolver) NumContents() uint64 {
 	if r.deduplicate {
-		return uint64(len(r.OffsetMap))
+		return r.index.len()
 	}
 	return r.AddressedTiles
 }
 
+// DeduplicationRatio returns the share of addressed tiles whose contents were already added,
+// 0 without deduplication or before any tile is added.
+func (r *resolver) DeduplicationRatio() float64 {
+	if r.AddressedTiles == 0 {
+		return 0
+	}
+	return 1 - float64(r.NumContents())/float64(r.AddressedTiles)
+}
+
+// must be called in increasing tile_id order, uniquely;
+// returns an error if tileID is not after the last tile or run added.
+func (r *resolver) AddTileIsNew(tileID uint64, data []byte, runLength uint32) (bool, []byte, error) {
+	return r.addTile(tileID, data, runLength, func() []byte {
+		return r.compressTile(r.compressor, data)
+	})
+}
+
+// checkOrder returns an error if tileID is not after the last tile or run added, or past the last tile of MaxTileZoom.
+func (r *resolver) checkOrder(tileID uint64) error {
+	if tileID >= tileIDLimit {
+		return fmt.Errorf("tile id %d is past zoom level %d", tileID, MaxTileZoom)
+	}
+	if len(r.Entries) > 0 && tileID < r.nextID {
+		return fmt.Errorf("tile id %d is not greater than the last added id %d", tileID, r.nextID-1)
+	}
+	return nil
+}
+
+// addTile records a tile whose uncompressed contents are data, calling encode
+// only if the contents are new to get the bytes to store.
 // must be called in increasing tile_id order, uniquely
-func (r *resolver) AddTileIsNew(tileID uint64, data []byte, runLength uint32) (bool, []byte) {
-	r.AddressedTiles++
+func (r *resolver) addTile(tileID uint64, data []byte, runLength uint32, encode func() []byte) (bool, []byte, error) {
+	if err := r.checkOrder(tileID); err != nil {
+		return false, nil, err
+	}
+	r.AddressedTiles += uint64(runLength)
 	var found offsetLen
 	var ok bool
-	var sumString string
+	var sum contentHash
 	if r.deduplicate {
 		r.hashfunc.Reset()
 		r.hashfunc.Write(data)
-		var tmp []byte
-		sumString = string(r.hashfunc.Sum(tmp))
-		found, ok = r.OffsetMap[sumString]
+		copy(sum[:], r.hashfunc.Sum(r.sum[:0]))
+		var err error
+		found, ok, err = r.index.get(sum)
+		if err != nil {
+			return false, nil, err
+		}
 	}
 
 	if r.deduplicate && ok {
-		lastEntry := r.Entries[len(r.Entries)-1]
-		if tileID == lastEntry.TileID+uint64(lastEntry.RunLength) && lastEntry.Offset == found.Offset {
-			// RLE
-			if lastEntry.RunLength+runLength > math.MaxUint32 {
-				panic("Maximum 32-bit run length exceeded")
-			}
-			r.Entries[len(r.Entries)-1].RunLength += runLength
+		r.addEntry(tileID, found, runLength)
+		if r.stats != nil {
+			r.stats.add(tileID, runLength, found.Length, false)
+		}
+		return false, nil, nil
+	}
+	newData := encode()
+
+	if r.deduplicate {
+		if err := r.index.put(sum, offsetLen{r.Offset, uint32(len(newData))}); err != nil {
+			return false, nil, err
+		}
+	}
+	r.Entries = append(r.Entries, EntryV3{tileID, r.Offset, uint32(len(newData)), runLength})
+	r.Offset += uint64(len(newData))
+	r.nextID = tileID + uint64(runLength)
+	if r.stats != nil {
+		r.stats.add(tileID, runLength, uint32(len(newData)), true)
+	}
+	return true, newData, nil
+}
+
+// addExistingTile records a tile whose contents were already added at found,
+// without hashing them again.
+// must be called in increasing tile_id order, uniquely
+func (r *resolver) addExistingTile(tileID uint64, found offsetLen, runLength uint32) error {
+	if err := r.checkOrder(tileID); err != nil {
+		return err
+	}
+	r.AddressedTiles += uint64(runLength)
+	r.addEntry(tileID, found, runLength)
+	if r.stats != nil {
+		r.stats.add(tileID, runLength, found.Length, false)
+	}
+	return nil
+}
+
+// minRootDirSize is the smallest ConvertOptions.RootDirSize, which must hold a few leaf directory entries.
+const minRootDirSize = 1024
+
+// directories serializes the entries of r into a root directory of at most rootDirSize bytes,
+// 16384 less the header if unset, and leaf directories, or into a root directory only if noLeafDirs is set.
+func (r *resolver) directories(compression Compression) ([]byte, []byte, int) {
+	if r.noLeafDirs {
+		return SerializeEntries(r.Entries, compression), make([]byte, 0), 0
+	}
+	rootDirSize := r.rootDirSize
+	if rootDirSize == 0 {
+		rootDirSize = 16384 - HeaderV3LenBytes
+	}
+	return optimizeDirectories(r.Entries, rootDirSize, compression)
+}
+
+// coalesceEntries merges each entry into the previous one if it continues its run with the same contents,
+// returning the number of entries removed. Runs are already extended as tiles are added,
+// so this only finds runs whose entries were added or changed otherwise.
+func (r *resolver) coalesceEntries() int {
+	if len(r.Entries) == 0 {
+		return 0
+	}
+	merged := r.Entries[:1]
+	for _, e := range r.Entries[1:] {
+		last := &merged[len(merged)-1]
+		if e.TileID == last.TileID+uint64(last.RunLength) && e.Offset == last.Offset && e.Length == last.Length &&
+			last.RunLength > 0 && uint64(last.RunLength)+uint64(e.RunLength) <= math.MaxUint32 {
+			last.RunLength += e.RunLength
 		} else {
-			r.Entries = append(r.Entries, EntryV3{tileID, found.Offset, found.Length, runLength})
+			merged = append(merged, e)
+		}
+	}
+	removed := len(r.Entries) - len(merged)
+	r.Entries = merged
+	return removed
+}
+
+// addEntry appends an entry for existing contents, extending the last entry if possible.
+func (r *resolver) addEntry(tileID uint64, found offsetLen, runLength uint32) {
+	r.nextID = tileID + uint64(runLength)
+	lastEntry := &r.Entries[len(r.Entries)-1]
+	if tileID == lastEntry.TileID+uint64(lastEntry.RunLength) && lastEntry.Offset == found.Offset {
+		// RLE
+		room := math.MaxUint32 - lastEntry.RunLength
+		if runLength <= room {
+			lastEntry.RunLength += runLength
+			return
 		}
+		// a run longer than a 32-bit run length continues in a new entry for the same contents
+		lastEntry.RunLength = math.MaxUint32
+		tileID += uint64(room)
+		runLength -= room
+	}
+	r.Entries = append(r.Entries, EntryV3{tileID, found.Offset, found.Length, runLength})
+}
 
-		return false, nil
+// compressTile encodes data with the resolver's compression using c.
+// It only reads immutable resolver state, so it is safe to call from several goroutines,
+// each with its own compressor.
+func (r *resolver) compressTile(c compressor, data []byte) []byte {
+	if r.passthrough {
+		return data
 	}
-	var newData []byte
-	if !r.compress || (len(data) >= 2 && data[0] == 31 && data[1] == 139) {
+	existing := r.detectTileCompression(data)
+	if (r.compression == NoCompression && !r.decompress) || existing == r.compression {
 		// the tile is already compressed
-		newData = data
-	} else {
-		r.compressTmp.Reset()
-		r.compressor.Reset(r.compressTmp)
-		r.compressor.Write(data)
-		r.compressor.Close()
-		newData = r.compressTmp.Bytes()
+		return data
 	}
+	if existing != NoCompression {
+		// compressed with a different algorithm, so decompress first
+		if decompressed, err := decompressBytes(data, existing); err == nil {
+			data = decompressed
+		}
+	}
+	newData, _ := c.Compress(data)
+	return newData
+}
 
-	if r.deduplicate {
-		r.OffsetMap[sumString] = offsetLen{r.Offset, uint32(len(newData))}
+// detectTileCompression returns the compression of an input tile.
+// Brotli has no magic bytes, so it is only assumed if the input declares it.
+func (r *resolver) detectTileCompression(data []byte) Compression {
+	existing := detectCompression(data)
+	if existing == NoCompression && r.brotliInput {
+		return Brotli
 	}
-	r.Entries = append(r.Entries, EntryV3{tileID, r.Offset, uint32(len(newData)), runLength})
-	r.Offset += uint64(len(newData))
-	return true, newData
+	return existing
+}
+
+// decompressTile returns the uncompressed contents of a compressed tile if the resolver recompresses tiles,
+// so that identical tiles compressed with different settings are deduplicated.
+func (r *resolver) decompressTile(data []byte) ([]byte, error) {
+	if !r.recompress {
+		return data, nil
+	}
+	existing := r.detectTileCompression(data)
+	if existing == NoCompression {
+		return data, nil
+	}
+	return decompressBytes(data, existing)
+}
+
+// close releases the deduplication index of the resolver.
+func (r *resolver) close() error {
+	return r.index.close()
+}
+
+// tileOrderError describes a tile the resolver rejected by its Z/X/Y coordinates,
+// or by its ID if it is past the last tile of MaxTileZoom.
+func tileOrderError(tileID uint64, err error) error {
+	if tileID >= tileIDLimit {
+		return fmt.Errorf("Failed to add tile %d, %w", tileID, err)
+	}
+	z, x, y := IDToZxy(tileID)
+	return fmt.Errorf("Failed to add tile %d/%d/%d, %w", z, x, y, err)
+}
+
+// newResolver creates a resolver that compresses tiles with the given compression.
+// NoCompression stores tiles as-is. Contents are deduplicated by their xxh3-128 sum.
+func newResolver(deduplicate bool, compression Compression) *resolver {
+	return newResolverWithHash(deduplicate, compression, newDedupHash("xxh3"))
+}
+
+// newResolverWithHash creates a resolver that deduplicates contents by their sum with hashFunc.
+// Only the first 16 bytes of longer sums are compared.
+func newResolverWithHash(deduplicate bool, compression Compression, hashFunc hash.Hash) *resolver {
+	compressor, err := newCompressor(compression, 0)
+	if err != nil {
+		panic(err)
+	}
+	return &resolver{
+		deduplicate: deduplicate,
+		compression: compression,
+		Entries:     make([]EntryV3, 0),
+		index:       make(memoryIndex),
+		compressor:  compressor,
+		hashfunc:    hashFunc,
+	}
+}
+
+// ConvertOptions configures Convert.
+type ConvertOptions struct {
+	// Deduplicate identical tile contents so they are stored only once.
+	Deduplicate bool
+	// Compression of internal directories and metadata, Gzip, Zstd or Brotli; UnknownCompression means Gzip.
+	Compression Compression
+	// TileCompression of vector tiles, NoCompression, Gzip, Zstd or Brotli; UnknownCompression means the same as Compression.
+	TileCompression Compression
+	// InternalCompression of directories and metadata, NoCompression, Gzip, Zstd or Brotli;
+	// UnknownCompression means the same as Compression.
+	InternalCompression Compression
+	// RootDirSize is the largest size in bytes of the root directory, beyond which entries are moved to leaf directories;
+	// 0 means 16384 bytes less the header, the first read of a remote client. A larger root suits local archives.
+	RootDirSize int
+	// NoLeafDirs puts every entry in the root directory, whatever its size.
+	NoLeafDirs bool
+	// CompressionLevel of gzip tiles, from 1 (fastest) to 9 (smallest); 0 means 9.
+	CompressionLevel int
+	// NoRecompress stores source tiles byte-for-byte without inspecting their compression,
+	// for inputs whose tiles are known to be compressed with TileCompression already.
+	NoRecompress bool
+	// Recompress decompresses every compressed vector tile of an MBTiles or older PMTiles input
+	// and compresses it again, even if it already uses TileCompression.
+	Recompress bool
+	// Scheme is the row numbering of a tile directory input, or of the tiles of a PMTiles archive
+	// extracted to a directory, "xyz" or "tms"; empty means "xyz".
+	Scheme string
+	// TileType of a tile directory input, overriding detection from file extensions.
+	// With UnknownTileType, only files with a known tile extension are converted.
+	TileType TileType
+	// MinZoom and MaxZoom limit conversion to the tiles in a zoom range, inclusive.
+	// A negative value means no limit.
+	MinZoom int8
+	MaxZoom int8
+	// Metadata keys replace those of the input metadata when converting to PMTiles. The bounds and center keys set the header instead,
+	// in the "lon,lat,lon,lat" and "lon,lat,zoom" formats of MBTiles metadata or as JSON arrays,
+	// and minzoom and maxzoom limit the converted zoom levels where MinZoom or MaxZoom are negative.
+	Metadata map[string]interface{}
+	// InferVectorLayers adds vector_layers to the metadata of MVT archives that lack it, from the layers and
+	// attribute types of up to 1000 tiles at the maximum zoom level; existing vector_layers are validated instead.
+	InferVectorLayers bool
+	// TrustTileData sets the tile type of an MBTiles input from the magic bytes of its tiles
+	// when they disagree with the format in its metadata; otherwise Convert fails.
+	TrustTileData bool
+	// Workers is the number of parallel tile readers and compressors for MBTiles and older PMTiles inputs,
+	// and of goroutines creating directories and, separately, writing tiles when extracting to a directory;
+	// 0 uses all CPUs.
+	Workers int
+	// DedupeInput keeps the first occurrence of a tile listed more than once in an older PMTiles input
+	// and logs the skipped duplicates, instead of failing.
+	DedupeInput bool
+	// Force overwrites an existing PMTiles output; otherwise Convert fails if it exists.
+	Force bool
+	// NoTmpfile writes tile data directly into the output instead of the tmpfile,
+	// halving disk I/O and needing no free space beyond the output. The leaf directories follow the tile data,
+	// and the root directory is padded to 16384 bytes. Convert then accepts a nil tmpfile.
+	NoTmpfile bool
+	// DedupIndex is where the hashes of deduplicated contents are kept, "memory" or "disk"; empty means "memory".
+	// The disk index bounds memory use for archives with hundreds of millions of unique tiles,
+	// at the cost of a slower conversion, as finding repeated contents may read temporary files.
+	DedupIndex string
+	// DedupMemory is the approximate memory in bytes the disk index buffers before writing to disk;
+	// 0 means DefaultDedupMemory.
+	DedupMemory int64
+	// Hash is the hash function identifying duplicate contents, "xxh3" or "fnv"; empty means "xxh3".
+	// Both are only used during conversion and give the same archive unless two contents collide.
+	Hash string
+	// OnTileError is what to do with a tile that cannot be read or decompressed: "abort" the conversion,
+	// "skip" the tile, or "log" it to TileErrorLog and skip it; empty means "abort".
+	OnTileError string
+	// TileErrorLog is the path of the JSON lines file recording tiles skipped with OnTileError "log";
+	// empty means errors.jsonl in the directory of the output, or the working directory for a stream.
+	TileErrorLog string
+	// Resume continues an interrupted conversion of an MBTiles input. Progress is saved every few minutes
+	// to a state file next to the tmpfile, which must be the same file, with the same input and options,
+	// when resuming; without a state file the conversion starts over. The state file is removed once the
+	// conversion completes. The tmpfile is not truncated until the state is checked.
+	// When extracting a PMTiles archive to a directory, Resume skips the tiles whose files already exist
+	// with the size of the tile, and rewrites the others.
+	Resume bool
+	// Progress is how progress is reported on standard error: "bar", "json" for newline-delimited JSON events
+	// and a final summary, or "none". Empty shows a bar only if standard error is a terminal.
+	Progress string
+	// ProgressInterval is the time between JSON progress events; 0 means 10 seconds.
+	ProgressInterval time.Duration
+	// ProgressReporter receives the progress of each phase of the conversion instead of Progress, if it is set.
+	ProgressReporter ProgressReporter
+	// ProgressFunc is called with the progress of each phase of the conversion instead of Progress, if it is set
+	// and ProgressReporter is not, at most every ProgressFuncInterval and when the phase is finished.
+	ProgressFunc ProgressFunc
+	// ProgressFuncInterval is the least time between calls of ProgressFunc; 0 means 250 milliseconds.
+	ProgressFuncInterval time.Duration
+	// TileJSONBaseURL is the URL under which the tiles of a PMTiles archive extracted to a directory are served,
+	// used in its tilejson.json; empty means tile URLs relative to the directory.
+	TileJSONBaseURL string
+	// PrecreateDirs creates every possible column directory up to the maximum zoom level before extracting
+	// a PMTiles archive to a directory, instead of only the directories of the tiles written.
+	PrecreateDirs bool
+	// Decompress writes the tiles of a PMTiles archive extracted to a directory without their tile compression,
+	// such as raw protocol buffers instead of gzip; tiles failing to decompress are written as stored.
+	Decompress bool
+	// Extension is the file extension of the tiles of a PMTiles archive extracted to a directory, such as "pbf";
+	// empty means the extension of the tile type.
+	Extension string
+	// PathTemplate is the path of each tile of a PMTiles archive extracted to a directory, relative to it,
+	// such as "tiles/{z}-{x}-{y}.mvt" or "{z}/{x}/{y}@2x.{ext}", where {ext} is the extension without its dot;
+	// it must contain {z}, {x} and {y}. Empty means {z}/{x}/{y} followed by the extension.
+	PathTemplate string
+	// Overwrite replaces the existing files of tiles of a PMTiles archive extracted to a directory without checking for them.
+	// Without Overwrite, SkipExisting or Resume, the extraction fails if the directory already contains tiles.
+	Overwrite bool
+	// SkipExisting keeps the existing files of tiles of a PMTiles archive extracted to a directory,
+	// writing only the missing ones.
+	SkipExisting bool
+	// OnWriteError is what to do with a tile of a PMTiles archive extracted to a directory that cannot be written:
+	// "abort" the extraction, or "skip" it and fail once the other tiles are written; empty means "abort".
+	OnWriteError string
+	// StatsOut is the path of a JSON report of the conversion written after the archive: tile, entry and content counts,
+	// tiles and bytes per zoom level, the largest tile contents, and the sizes of the archive sections.
+	// A resumed conversion only counts the tiles added since resuming.
+	StatsOut string
+	// Layer is the tile table of a GeoPackage input to convert; empty means its only tile layer.
+	Layer string
+	// OptimizeRLE merges adjacent entries with the same contents into longer runs before writing the directories,
+	// logging how many entries were coalesced.
+	OptimizeRLE bool
+	// Stream converts an MBTiles input in a single pass, sorting its tiles through temporary files next to the tmpfile
+	// instead of first collecting the set of all tile IDs, which may not fit in memory for hundreds of millions of tiles.
+	Stream bool
+	// StreamMemory is the number of bytes of tiles sorted in memory by Stream before they are written to a temporary file;
+	// 0 means 512 MB.
+	StreamMemory int64
+	// ReadBuffer is the number of bytes of tile data read at once when extracting to a directory or bundle:
+	// tiles stored within that many bytes of each other are fetched in a single read. 0 means 4 MB,
+	// and a negative value reads every tile separately.
+	ReadBuffer int64
+	// DownloadThreads is the number of range requests made at once to read the tile data of a remote archive
+	// extracted to a directory; 0 means 4.
+	DownloadThreads int
+	// Retries is the number of times a failed range request to a remote archive is attempted again;
+	// 0 means 3 and a negative value disables retries.
+	Retries int
+	// RetryDelay is the wait before the first retry of a range request to a remote archive, doubled after every attempt;
+	// 0 means 100 milliseconds.
+	RetryDelay time.Duration
+	// MaxBandwidth is the largest average number of bytes per second read from a remote archive,
+	// shared by all DownloadThreads; 0 means no limit.
+	MaxBandwidth int64
+	// MaxRequestRate is the largest average number of range requests per second to a remote archive; 0 means no limit.
+	MaxRequestRate float64
+	// Bbox limits conversion to PMTiles, and extraction of a PMTiles archive to a directory, to the tiles sharing an area
+	// with a "min_lon,min_lat,max_lon,max_lat" rectangle, which also limits the bounds in the header.
+	Bbox string
+
+	// Input and Output are the paths converted by ConvertWithOptions, as with Convert.
+	Input  string
+	Output string
+	// OutputWriter receives the archive of ConvertWithOptions instead of Output, if it is set.
+	OutputWriter io.Writer
+	// TmpDir is where ConvertWithOptions creates its tmpfile; empty means the default directory for temporary files.
+	TmpDir string
+	// Logger receives the log of ConvertWithOptions; nil discards it.
+	Logger *log.Logger
+
+	ctx    context.Context // of a conversion started by ConvertWithOptions
+	result *ConvertResult  // filled in when a conversion started by ConvertWithOptions completes
 }
 
-func newResolver(deduplicate bool, compress bool) *resolver {
-	b := new(bytes.Buffer)
-	compressor, _ := gzip.NewWriterLevel(b, gzip.BestCompression)
-	r := resolver{deduplicate, compress, make([]EntryV3, 0), 0, make(map[string]offsetLen), 0, compressor, b, fnv.New128a()}
-	return &r
+// ConvertResult describes a conversion completed by ConvertWithOptions.
+type ConvertResult struct {
+	// Header of the archive written, with its tile counts and section sizes,
+	// or of the input archive when extracting it to MBTiles or a tile directory.
+	Header HeaderV3
+	// Elapsed is the duration of the conversion.
+	Elapsed time.Duration
+}
+
+// context returns the context of a conversion started by ConvertWithOptions, or the background context.
+func (opts ConvertOptions) context() context.Context {
+	if opts.ctx == nil {
+		return context.Background()
+	}
+	return opts.ctx
+}
+
+// convertOutput is where a conversion writes its archive: the file at path, or writer if it is set.
+type convertOutput struct {
+	path   string
+	writer io.Writer
+}
+
+// normalizeConvertOptions fills in the defaults of opts and validates them.
+func normalizeConvertOptions(opts *ConvertOptions) error {
+	if opts.Compression == UnknownCompression {
+		opts.Compression = Gzip
+	}
+	if opts.Compression != Gzip && opts.Compression != Zstd && opts.Compression != Brotli {
+		return fmt.Errorf("compression must be gzip, zstd or brotli")
+	}
+	if opts.TileCompression == UnknownCompression {
+		opts.TileCompression = opts.Compression
+	}
+	if opts.InternalCompression == UnknownCompression {
+		opts.InternalCompression = opts.Compression
+	}
+	if opts.InternalCompression != NoCompression && opts.InternalCompression != Gzip && opts.InternalCompression != Zstd && opts.InternalCompression != Brotli {
+		return fmt.Errorf("internal compression must be none, gzip, zstd or brotli")
+	}
+	if opts.RootDirSize < 0 || (opts.RootDirSize > 0 && opts.RootDirSize < minRootDirSize) {
+		return fmt.Errorf("root directory size must be at least %d bytes", minRootDirSize)
+	}
+	if opts.NoTmpfile && (opts.NoLeafDirs || opts.RootDirSize > 16384-HeaderV3LenBytes) {
+		return fmt.Errorf("the root directory of a conversion without tmpfile must fit in %d bytes", 16384-HeaderV3LenBytes)
+	}
+	if opts.TileCompression != NoCompression && opts.TileCompression != Gzip && opts.TileCompression != Zstd && opts.TileCompression != Brotli {
+		return fmt.Errorf("tile compression must be none, gzip, zstd or brotli")
+	}
+	if opts.NoRecompress && opts.Recompress {
+		return fmt.Errorf("recompress and no-recompress cannot be combined")
+	}
+	if opts.CompressionLevel < 0 || opts.CompressionLevel > 9 {
+		return fmt.Errorf("compression level must be between 1 and 9")
+	}
+	if opts.Scheme == "" {
+		opts.Scheme = "xyz"
+	}
+	if opts.Scheme != "xyz" && opts.Scheme != "tms" {
+		return fmt.Errorf("scheme must be xyz or tms")
+	}
+	if opts.PathTemplate != "" {
+		if err := validatePathTemplate(opts.PathTemplate); err != nil {
+			return err
+		}
+		if opts.PrecreateDirs {
+			return fmt.Errorf("precreate dirs cannot be combined with a path template")
+		}
+	}
+	if opts.DedupIndex == "" {
+		opts.DedupIndex = "memory"
+	}
+	if opts.DedupIndex != "memory" && opts.DedupIndex != "disk" {
+		return fmt.Errorf("dedup index must be memory or disk")
+	}
+	if opts.Hash == "" {
+		opts.Hash = "xxh3"
+	}
+	if opts.Hash != "xxh3" && opts.Hash != "fnv" {
+		return fmt.Errorf("hash must be xxh3 or fnv")
+	}
+	if opts.OnTileError == "" {
+		opts.OnTileError = "abort"
+	}
+	if opts.OnTileError != "abort" && opts.OnTileError != "skip" && opts.OnTileError != "log" {
+		return fmt.Errorf("on tile error must be abort, skip or log")
+	}
+	if opts.OnWriteError == "" {
+		opts.OnWriteError = "abort"
+	}
+	if opts.OnWriteError != "abort" && opts.OnWriteError != "skip" {
+		return fmt.Errorf("on write error must be abort or skip")
+	}
+	if opts.Progress != "" && opts.Progress != "bar" && opts.Progress != "json" && opts.Progress != "none" {
+		return fmt.Errorf("progress must be bar, json or none")
+	}
+	if opts.Bbox != "" {
+		if _, err := parseBboxFilter(opts.Bbox); err != nil {
+			return err
+		}
+	}
+	if opts.Stream && (opts.Resume || opts.InferVectorLayers) {
+		return fmt.Errorf("stream cannot be combined with resume or inferring vector layers")
+	}
+	if opts.StreamMemory < 0 {
+		return fmt.Errorf("stream memory must not be negative")
+	}
+	if opts.DownloadThreads < 0 {
+		return fmt.Errorf("download threads must not be negative")
+	}
+	if opts.MaxBandwidth < 0 || opts.MaxRequestRate < 0 {
+		return fmt.Errorf("bandwidth and request rate limits must not be negative")
+	}
+	if opts.ReadBuffer == 0 {
+		opts.ReadBuffer = defaultReadBuffer
+	}
+	if opts.Resume && (opts.NoTmpfile || opts.DedupIndex == "disk") {
+		return fmt.Errorf("resume cannot be combined with no-tmpfile or the disk dedup index")
+	}
+	if err := applyMetadataOverrides(&HeaderV3{}, map[string]interface{}{}, opts.Metadata); err != nil {
+		return err
+	}
+	if err := overrideZoomRange(opts); err != nil {
+		return err
+	}
+	if opts.MinZoom >= 0 && opts.MaxZoom >= 0 && opts.MinZoom > opts.MaxZoom {
+		return fmt.Errorf("minzoom %d is greater than maxzoom %d", opts.MinZoom, opts.MaxZoom)
+	}
+	return nil
 }
 
 // Convert an existing archive on disk to a new PMTiles specification version 3 archive.
-func Convert(logger *log.Logger, input string, output string, deduplicate bool, tmpfile *os.File) error {
+// The input may be an MBTiles file, a GeoPackage tile layer, a CSV file of tiles, an older PMTiles archive,
+// or a {z}/{x}/{y} tile directory.
+// An output of "-" writes the archive to standard output, which need not be seekable.
+// A PMTiles version 3 input is instead converted to an MBTiles database if output ends in .mbtiles,
+// extracted to a tar, gzipped tar or zip file of {z}/{x}/{y} tiles if it ends in .tar, .tar.gz, .tgz or .zip,
+// to a tar stream on standard output for "-", or to a {z}/{x}/{y} tile directory otherwise.
+// An archive extracted to a directory may also be remote, at an https:// or bucket URL such as s3://, and is then
+// read with range requests.
+// A PMTiles output is byte-identical for identical input and options, whatever the number of workers.
+func Convert(logger *log.Logger, input string, output string, opts ConvertOptions, tmpfile *os.File) error {
+	// a nil *os.File is not a nil io.ReadWriteSeeker
+	var tmp io.ReadWriteSeeker
+	if tmpfile != nil {
+		tmp = tmpfile
+	}
+	if output == "-" {
+		return convert(logger, input, convertOutput{writer: os.Stdout}, opts, tmp)
+	}
+	return convert(logger, input, convertOutput{path: output}, opts, tmp)
+}
+
+// ConvertToWriter converts an MBTiles file, a GeoPackage tile layer, an older PMTiles archive or a {z}/{x}/{y} tile directory
+// to a PMTiles specification version 3 archive written to output, which need not be seekable.
+// A PMTiles version 3 input is instead extracted to a tar stream of {z}/{x}/{y} tiles, without tmpfile.
+// Tile data is gathered in tmpfile before the archive is written, so NoTmpfile is not supported;
+// tmpfile may be in memory, in which case temporary files of the disk deduplication index use the default directory.
+func ConvertToWriter(logger *log.Logger, input string, output io.Writer, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
+	return convert(logger, input, convertOutput{writer: output}, opts, tmpfile)
+}
+
+// ConvertWithOptions converts opts.Input to opts.Output as Convert does, or to opts.OutputWriter if it is set,
+// with a tmpfile created in opts.TmpDir unless NoTmpfile is set. A resumed conversion keeps its tmpfile,
+// named after the output, until it completes.
+// Cancelling ctx aborts the conversion and removes a partial PMTiles or MBTiles output,
+// but not the tiles already extracted to a directory.
+func ConvertWithOptions(ctx context.Context, opts ConvertOptions) (ConvertResult, error) {
+	var result ConvertResult
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+	output := convertOutput{path: opts.Output, writer: opts.OutputWriter}
+	if output.writer == nil && opts.Output == "-" {
+		output.writer = os.Stdout
+	}
+	if output.writer == nil && output.path == "" {
+		return result, fmt.Errorf("no output to convert to")
+	}
+
+	var tmp io.ReadWriteSeeker
+	var err error
+	if !opts.NoTmpfile {
+		var tmpfile *os.File
+		if opts.Resume {
+			// a resumed conversion must find the tmpfile of the interrupted one
+			tmpdir := opts.TmpDir
+			if tmpdir == "" {
+				tmpdir = os.TempDir()
+			}
+			tmpfile, err = os.OpenFile(filepath.Join(tmpdir, filepath.Base(opts.Output)+".tmp"), os.O_RDWR|os.O_CREATE, 0666)
+		} else {
+			tmpfile, err = os.CreateTemp(opts.TmpDir, "pmtiles")
+		}
+		if err != nil {
+			return result, fmt.Errorf("Failed to create temp file, %w", err)
+		}
+		tmp = tmpfile
+		defer func() {
+			tmpfile.Close()
+			if !opts.Resume || err == nil {
+				os.Remove(tmpfile.Name())
+			}
+		}()
+	}
+
+	opts.ctx = ctx
+	opts.result = &result
+	err = convert(logger, opts.Input, output, opts, tmp)
+	return result, err
+}
+
+// convert routes a conversion to the converter of the input, or of the output for PMTiles version 3 inputs.
+func convert(logger *log.Logger, input string, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
+	if err := normalizeConvertOptions(&opts); err != nil {
+		return err
+	}
+	if isRemoteInput(input) {
+		// only extraction to a directory needs no more than range requests
+		if output.writer != nil || strings.HasSuffix(output.path, ".pmtiles") || strings.HasSuffix(output.path, ".mbtiles") || bundleFormat(output.path) != "" {
+			return fmt.Errorf("a remote archive can only be extracted to a directory")
+		}
+		return convertToDirectory(logger, input, output.path, opts.TileJSONBaseURL, opts)
+	}
+	info, err := os.Stat(input)
+	isDir := err == nil && info.IsDir()
+	if output.writer != nil {
+		if strings.HasSuffix(input, ".pmtiles") && isPmtilesV3(input) {
+			return convertToBundle(logger, input, output.writer, "tar", opts)
+		}
+		if opts.NoTmpfile || tmpfile == nil {
+			return fmt.Errorf("cannot write tile data directly to a stream, it needs a tmpfile")
+		}
+		switch {
+		case isDir:
+			return convertDirectory(logger, input, output, opts, tmpfile)
+		case strings.HasSuffix(input, ".csv"):
+			return convertCSV(logger, input, output, opts, tmpfile)
+		case isGpkg(input):
+			return convertGpkg(logger, input, output, opts, tmpfile)
+		case strings.HasSuffix(input, ".pmtiles"):
+			return convertPmtilesV2(logger, input, output, opts, tmpfile)
+		}
+		return convertMbtiles(logger, input, output, opts, tmpfile)
+	}
+
+	toPmtiles := isDir || !strings.HasSuffix(input, ".pmtiles") || strings.HasSuffix(output.path, ".pmtiles")
+	if _, err := os.Stat(output.path); err == nil && (toPmtiles || bundleFormat(output.path) != "") && !opts.Force {
+		return fmt.Errorf("output %s already exists", output.path)
+	}
+	if isDir {
+		return convertDirectory(logger, input, output, opts, tmpfile)
+	}
+	if strings.HasSuffix(input, ".csv") {
+		return convertCSV(logger, input, output, opts, tmpfile)
+	}
+	if isGpkg(input) {
+		return convertGpkg(logger, input, output, opts, tmpfile)
+	}
 	if strings.HasSuffix(input, ".pmtiles") {
-		if strings.HasSuffix(output, ".pmtiles") {
-			return convertPmtilesV2(logger, input, output, deduplicate, tmpfile)
+		if strings.HasSuffix(output.path, ".pmtiles") {
+			return convertPmtilesV2(logger, input, output, opts, tmpfile)
+		}
+		if strings.HasSuffix(output.path, ".mbtiles") {
+			return convertToMbtiles(logger, input, output.path, false, opts)
+		}
+		if format := bundleFormat(output.path); format != "" {
+			return convertToBundleFile(logger, input, output.path, format, opts)
+		}
+		return convertToDirectory(logger, input, output.path, opts.TileJSONBaseURL, opts)
+	}
+	return convertMbtiles(logger, input, output, opts, tmpfile)
+}
+
+// zoomRange limits conversion to the tiles between min and max inclusive.
+// A negative bound means no limit.
+type zoomRange struct {
+	min int8
+	max int8
+}
+
+func (r zoomRange) active() bool {
+	return r.min >= 0 || r.max >= 0
+}
+
+// tileIDs returns the half-open range of TileIDs within the zoom range,
+// as TileIDs are ordered by zoom level.
+func (r zoomRange) tileIDs() (uint64, uint64) {
+	start := uint64(0)
+	end := uint64(math.MaxUint64)
+	if r.min >= 0 {
+		start = ZxyToID(uint8(r.min), 0, 0)
+	}
+	if r.max >= 0 {
+		end = ZxyToID(uint8(r.max)+1, 0, 0)
+	}
+	return start, end
+}
+
+func (r zoomRange) filter(tileset *roaring64.Bitmap) {
+	start, end := r.tileIDs()
+	tileset.RemoveRange(0, start)
+	tileset.RemoveRange(end, math.MaxUint64)
+}
+
+// apply sets the header and metadata zoom levels to those of the remaining tiles,
+// from firstID to lastID.
+func (r zoomRange) apply(header *HeaderV3, jsonMetadata map[string]interface{}, firstID uint64, lastID uint64) {
+	header.MinZoom, _, _ = IDToZxy(firstID)
+	header.MaxZoom, _, _ = IDToZxy(lastID)
+	if header.CenterZoom != 0 || header.CenterLonE7 != 0 || header.CenterLatE7 != 0 {
+		header.CenterZoom = min(max(header.CenterZoom, header.MinZoom), header.MaxZoom)
+	}
+
+	setMetadataZooms(jsonMetadata, header.MinZoom, header.MaxZoom)
+}
+
+// setMetadataZooms replaces the minzoom and maxzoom of jsonMetadata, where present, keeping their number or string type.
+func setMetadataZooms(jsonMetadata map[string]interface{}, minZoom uint8, maxZoom uint8) {
+	for key, zoom := range map[string]uint8{"minzoom": minZoom, "maxzoom": maxZoom} {
+		switch jsonMetadata[key].(type) {
+		case nil:
+		case float64:
+			jsonMetadata[key] = float64(zoom)
+		default:
+			jsonMetadata[key] = strconv.Itoa(int(zoom))
+		}
+	}
+}
+
+// newConvertResolver creates a resolver for converting the tiles of the input described by header:
+// vector tiles are stored with the tile compression of opts, where NoCompression decompresses them,
+// and images are stored as-is. Vector tiles of a Brotli input are assumed to be Brotli streams. A disk deduplication index is created in tmpdir;
+// close the resolver to remove it.
+// bboxFilter limits conversion to the tiles sharing an area with a lon/lat rectangle.
+type bboxFilter struct {
+	minLonE7, minLatE7, maxLonE7, maxLatE7 int32
+	ranges                                 [MaxTileZoom + 1][4]uint32 // min x, min y, max x, max y of each zoom level
+	empty                                  [MaxTileZoom + 1]bool      // zoom levels without tiles in the rectangle
+}
+
+// parseBboxFilter parses a "min_lon,min_lat,max_lon,max_lat" rectangle.
+func parseBboxFilter(bbox string) (*bboxFilter, error) {
+	minLon, minLat, maxLon, maxLat, err := parseBounds(bbox)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse bbox, %w", err)
+	}
+	if minLon >= maxLon || minLat >= maxLat {
+		return nil, fmt.Errorf("bbox %s has no area", bbox)
+	}
+	f := &bboxFilter{minLonE7: minLon, minLatE7: minLat, maxLonE7: maxLon, maxLatE7: maxLat}
+	E7 := 10000000.0
+	for z := range f.ranges {
+		minX, minY, maxX, maxY, ok := bboxTileRange(uint8(z), float64(minLon)/E7, float64(minLat)/E7, float64(maxLon)/E7, float64(maxLat)/E7)
+		f.ranges[z] = [4]uint32{minX, minY, maxX, maxY}
+		f.empty[z] = !ok
+	}
+	return f, nil
+}
+
+// contains reports whether a tile shares an area with the rectangle.
+func (f *bboxFilter) contains(tileID uint64) bool {
+	z, x, y := IDToZxy(tileID)
+	r := f.ranges[z]
+	return !f.empty[z] && x >= r[0] && y >= r[1] && x <= r[2] && y <= r[3]
+}
+
+// filter removes the tiles outside of the rectangle from tileset.
+func (f *bboxFilter) filter(tileset *roaring64.Bitmap) {
+	outside := roaring64.New()
+	i := tileset.Iterator()
+	for i.HasNext() {
+		if id := i.Next(); !f.contains(id) {
+			outside.Add(id)
+		}
+	}
+	tileset.AndNot(outside)
+}
+
+// apply limits the header bounds to the rectangle, and moves the center into them if it is outside.
+func (f *bboxFilter) apply(header *HeaderV3) {
+	if header.MinLonE7 >= header.MaxLonE7 || header.MinLatE7 >= header.MaxLatE7 ||
+		header.MaxLonE7 <= f.minLonE7 || header.MinLonE7 >= f.maxLonE7 || header.MaxLatE7 <= f.minLatE7 || header.MinLatE7 >= f.maxLatE7 {
+		header.MinLonE7, header.MinLatE7, header.MaxLonE7, header.MaxLatE7 = f.minLonE7, f.minLatE7, f.maxLonE7, f.maxLatE7
+	} else {
+		header.MinLonE7, header.MinLatE7 = max(header.MinLonE7, f.minLonE7), max(header.MinLatE7, f.minLatE7)
+		header.MaxLonE7, header.MaxLatE7 = min(header.MaxLonE7, f.maxLonE7), min(header.MaxLatE7, f.maxLatE7)
+	}
+	if header.CenterLonE7 < header.MinLonE7 || header.CenterLonE7 > header.MaxLonE7 || header.CenterLatE7 < header.MinLatE7 || header.CenterLatE7 > header.MaxLatE7 {
+		header.CenterLonE7 = (header.MinLonE7 + header.MaxLonE7) / 2
+		header.CenterLatE7 = (header.MinLatE7 + header.MaxLatE7) / 2
+	}
+}
+
+// filterTileset applies the zoom range and bbox of opts to tileset, and to the header and metadata.
+func filterTileset(opts ConvertOptions, tileset *roaring64.Bitmap, header *HeaderV3, jsonMetadata map[string]interface{}) error {
+	zooms := zoomRange{opts.MinZoom, opts.MaxZoom}
+	if zooms.active() {
+		zooms.filter(tileset)
+		if tileset.GetCardinality() == 0 {
+			return fmt.Errorf("no tiles in zoom range %d-%d", zooms.min, zooms.max)
+		}
+	}
+	if opts.Bbox != "" {
+		bbox, err := parseBboxFilter(opts.Bbox)
+		if err != nil {
+			return err
 		}
-		return convertToDirectory(logger, input, output)
+		bbox.filter(tileset)
+		if tileset.GetCardinality() == 0 {
+			return fmt.Errorf("no tiles in bbox %s", opts.Bbox)
+		}
+		bbox.apply(header)
+	}
+	if zooms.active() || opts.Bbox != "" {
+		zooms.apply(header, jsonMetadata, tileset.Minimum(), tileset.Maximum())
+	}
+	return nil
+}
+
+func newConvertResolver(opts ConvertOptions, header HeaderV3, tmpdir string) (*resolver, error) {
+	compression := Compression(NoCompression)
+	if header.TileType == Mvt {
+		compression = opts.TileCompression
+	}
+	r := newResolverWithHash(opts.Deduplicate, compression, newDedupHash(opts.Hash))
+	r.rootDirSize = opts.RootDirSize
+	r.noLeafDirs = opts.NoLeafDirs
+	if opts.StatsOut != "" {
+		r.stats = newConvertStats()
 	}
-	return convertMbtiles(logger, input, output, deduplicate, tmpfile)
+	if opts.Deduplicate && opts.DedupIndex == "disk" {
+		index, err := newDiskIndex(tmpdir, opts.DedupMemory)
+		if err != nil {
+			return nil, err
+		}
+		r.index = index
+	}
+	if header.TileType != Mvt {
+		return r, nil
+	}
+	r.brotliInput = header.TileCompression == Brotli
+	r.decompress = opts.TileCompression == NoCompression
+	r.passthrough = opts.NoRecompress
+	r.recompress = opts.Recompress
+	if opts.CompressionLevel != 0 {
+		r.level = opts.CompressionLevel
+		r.compressor, _ = newCompressor(r.compression, r.level)
+	}
+	return r, nil
 }
 
 func addDirectoryV2Entries(dir directoryV2, entries *[]EntryV3, f *os.File) {
@@ -130,7 +955,15 @@ func addDirectoryV2Entries(dir directoryV2, entries *[]EntryV3, f *os.File) {
 		unique[rng.Offset] = uint32(rng.Length)
 	}
 
-	for offset, length := range unique {
+	// visit leaves in file order, so the first occurrence of a duplicated tile is well defined
+	offsets := make([]uint64, 0, len(unique))
+	for offset := range unique {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	for _, offset := range offsets {
+		length := unique[offset]
 		f.Seek(int64(offset), 0)
 		leafBytes := make([]byte, length)
 		f.Read(leafBytes)
@@ -142,7 +975,8 @@ func addDirectoryV2Entries(dir directoryV2, entries *[]EntryV3, f *os.File) {
 func setZoomCenterDefaults(header *HeaderV3, entries []EntryV3) {
 	minZ, _, _ := IDToZxy(entries[0].TileID)
 	header.MinZoom = minZ
-	maxZ, _, _ := IDToZxy(entries[len(entries)-1].TileID)
+	last := entries[len(entries)-1]
+	maxZ, _, _ := IDToZxy(last.TileID + uint64(last.RunLength) - 1)
 	header.MaxZoom = maxZ
 
 	if header.CenterZoom == 0 && header.CenterLonE7 == 0 && header.CenterLatE7 == 0 {
@@ -152,8 +986,12 @@ func setZoomCenterDefaults(header *HeaderV3, entries []EntryV3) {
 	}
 }
 
-func convertPmtilesV2(logger *log.Logger, input string, output string, deduplicate bool, tmpfile *os.File) error {
+func convertPmtilesV2(logger *log.Logger, input string, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
 	start := time.Now()
+	if opts.Resume {
+		return fmt.Errorf("resume is only supported for MBTiles input")
+	}
+	zooms := zoomRange{opts.MinZoom, opts.MaxZoom}
 	f, err := os.Open(input)
 	if err != nil {
 		return fmt.Errorf("Failed to open file: %w", err)
@@ -167,7 +1005,7 @@ func convertPmtilesV2(logger *log.Logger, input string, output string, deduplica
 
 	v2JsonBytes, dir := parseHeaderV2(bytes.NewReader(buffer))
 
-	var v2metadata map[string]interface{}
+	v2metadata := make(map[string]interface{})
 	json.Unmarshal(v2JsonBytes, &v2metadata)
 
 	// get the first 4 bytes at offset 512000 to attempt tile type detection
@@ -184,62 +1022,139 @@ func convertPmtilesV2(logger *log.Logger, input string, output string, deduplica
 	if err != nil {
 		return fmt.Errorf("Failed to convert v2 to header JSON, %w", err)
 	}
+	if err := applyMetadataOverrides(&header, jsonMetadata, opts.Metadata); err != nil {
+		return err
+	}
+	logMetadataWarnings(logger, jsonMetadata)
 
 	entries := make([]EntryV3, 0)
 	addDirectoryV2Entries(dir, &entries, f)
 
-	// sort
-	sort.Slice(entries, func(i, j int) bool {
+	// sort, keeping duplicates of a tile in the order they were found
+	sort.SliceStable(entries, func(i, j int) bool {
 		return entries[i].TileID < entries[j].TileID
 	})
 
-	// re-use resolve, because even if archives are de-duplicated we may need to recompress.
-	resolve := newResolver(deduplicate, header.TileType == Mvt)
+	if opts.DedupeInput {
+		deduped := entries[:0]
+		for _, entry := range entries {
+			if len(deduped) > 0 && deduped[len(deduped)-1].TileID == entry.TileID {
+				z, x, y := IDToZxy(entry.TileID)
+				logger.Printf("Skipping duplicate tile %d/%d/%d", z, x, y)
+				continue
+			}
+			deduped = append(deduped, entry)
+		}
+		entries = deduped
+	}
 
-	bar := progressbar.Default(int64(len(entries)))
-	for _, entry := range entries {
-		if entry.Length == 0 {
-			continue
+	if zooms.active() {
+		start, end := zooms.tileIDs()
+		filtered := entries[:0]
+		for _, entry := range entries {
+			if entry.TileID >= start && entry.TileID < end {
+				filtered = append(filtered, entry)
+			}
 		}
-		_, err := f.Seek(int64(entry.Offset), 0)
-		if err != nil {
-			return fmt.Errorf("Failed to seek at offset %d, %w", entry.Offset, err)
+		entries = filtered
+		if len(entries) == 0 {
+			return fmt.Errorf("no tiles in zoom range %d-%d", zooms.min, zooms.max)
 		}
-		buf := make([]byte, entry.Length)
-		_, err = f.Read(buf)
+	}
+	if opts.Bbox != "" {
+		bbox, err := parseBboxFilter(opts.Bbox)
 		if err != nil {
-			if err != io.EOF {
-				return fmt.Errorf("Failed to read buffer, %w", err)
-			}
+			return err
 		}
-		// TODO: enforce sorted order
-		if isNew, newData := resolve.AddTileIsNew(entry.TileID, buf, 1); isNew {
-			_, err = tmpfile.Write(newData)
-			if err != nil {
-				return fmt.Errorf("Failed to write to tempfile, %w", err)
+		filtered := entries[:0]
+		for _, entry := range entries {
+			if bbox.contains(entry.TileID) {
+				filtered = append(filtered, entry)
 			}
 		}
-		bar.Add(1)
+		entries = filtered
+		if len(entries) == 0 {
+			return fmt.Errorf("no tiles in bbox %s", opts.Bbox)
+		}
+		bbox.apply(&header)
+	}
+	if zooms.active() || opts.Bbox != "" {
+		zooms.apply(&header, jsonMetadata, entries[0].TileID, entries[len(entries)-1].TileID)
+	}
+
+	if opts.InferVectorLayers && header.TileType == Mvt {
+		minZoom, _, _ := IDToZxy(entries[0].TileID)
+		maxZoom, _, _ := IDToZxy(entries[len(entries)-1].TileID)
+		err := inferVectorLayers(logger, jsonMetadata, header.TileCompression, minZoom, maxZoom,
+			sampleEntries(entries, vectorLayerSamples), fileTileReader{f}.ReadTile)
+		if err != nil {
+			return err
+		}
 	}
 
-	_, err = finalize(logger, resolve, header, tmpfile, output, jsonMetadata)
+	// re-use resolve, because even if archives are de-duplicated we may need to recompress.
+	header.InternalCompression = opts.InternalCompression
+	resolve, err := newConvertResolver(opts, header, convertTmpDir(tmpfile))
 	if err != nil {
 		return err
 	}
-
-	logger.Println("Finished in ", time.Since(start))
-	return nil
-}
-
-func convertMbtiles(logger *log.Logger, input string, output string, deduplicate bool, tmpfile *os.File) error {
-	start := time.Now()
-	conn, err := sqlite.OpenConn(input, sqlite.OpenReadOnly)
+	defer resolve.close()
+	sink, err := newTileSink(opts, tmpfile, output, header.InternalCompression, jsonMetadata)
 	if err != nil {
-		return fmt.Errorf("Failed to create database connection, %w", err)
+		return err
 	}
-	defer conn.Close()
-
-	mbtilesMetadata := make([]string, 0)
+	defer sink.close()
+
+	tileErrors := newTileErrorHandler(logger, opts, output)
+	defer tileErrors.close()
+	i := 0
+	bar := newProgress(opts, "tiles", int64(len(entries)))
+	err = addTiles(opts.context(), resolve, sink, opts.Workers, bar,
+		func() (EntryV3, bool) {
+			for i < len(entries) && entries[i].Length == 0 {
+				i++
+			}
+			if i == len(entries) {
+				return EntryV3{}, false
+			}
+			i++
+			return entries[i-1], true
+		},
+		func() (tileReader, error) {
+			return fileTileReader{f}, nil
+		},
+		tileErrors.handle, nil)
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+	if err := tileErrors.close(); err != nil {
+		return err
+	}
+
+	header, err = sink.finalize(logger, resolve, header, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	if opts.StatsOut != "" {
+		if err := writeConvertReport(opts.StatsOut, resolve, header); err != nil {
+			return err
+		}
+	}
+
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, archiveSummary(header, output), start)
+}
+
+func convertMbtiles(logger *log.Logger, input string, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
+	start := time.Now()
+	conn, err := openMbtilesReader(input)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	mbtilesMetadata := make([]string, 0)
 	{
 		stmt, _, err := conn.PrepareTransient("SELECT name, value FROM metadata")
 		if err != nil {
@@ -269,12 +1184,36 @@ func convertMbtiles(logger *log.Logger, input string, output string, deduplicate
 	if err != nil {
 		return fmt.Errorf("Failed to convert MBTiles to header JSON, %w", err)
 	}
+	if err := applyMetadataOverrides(&header, jsonMetadata, opts.Metadata); err != nil {
+		return err
+	}
+	logMetadataWarnings(logger, jsonMetadata)
+
+	split, err := detectMbtilesSplitSchema(conn)
+	if err != nil {
+		return err
+	}
+	grids, err := detectMbtilesGrids(conn)
+	if err != nil {
+		return err
+	}
+	if len(grids) > 0 {
+		logger.Printf("WARNING: UTFGrid interaction data in %s cannot be represented in PMTiles and will be dropped\n", strings.Join(grids, ", "))
+	}
+	if opts.Stream {
+		return convertMbtilesStream(logger, conn, output, opts, tmpfile, header, jsonMetadata, start)
+	}
+	coordinateTable := "tiles"
+	if split != nil {
+		logger.Printf("Reading split schema tables %s and %s\n", split.mapTable, split.dataTable)
+		coordinateTable = split.mapTable
+	}
 
 	logger.Println("Pass 1: Assembling TileID set")
 	// assemble a sorted set of all TileIds
 	tileset := roaring64.New()
 	{
-		stmt, _, err := conn.PrepareTransient("SELECT zoom_level, tile_column, tile_row FROM tiles")
+		stmt, _, err := conn.PrepareTransient("SELECT zoom_level, tile_column, tile_row FROM " + coordinateTable)
 		if err != nil {
 			return fmt.Errorf("Failed to create statement, %w", err)
 		}
@@ -288,9 +1227,15 @@ func convertMbtiles(logger *log.Logger, input string, output string, deduplicate
 			if !row {
 				break
 			}
+			if err := opts.context().Err(); err != nil {
+				return err
+			}
 			z := uint8(stmt.ColumnInt64(0))
 			x := uint32(stmt.ColumnInt64(1))
 			y := uint32(stmt.ColumnInt64(2))
+			if err := ValidateTileCoord(z, x, y); err != nil {
+				return err
+			}
 			flippedY := (1 << z) - 1 - y
 			id := ZxyToID(z, x, flippedY)
 			tileset.Add(id)
@@ -301,101 +1246,904 @@ func convertMbtiles(logger *log.Logger, input string, output string, deduplicate
 		return fmt.Errorf("no tiles in MBTiles archive")
 	}
 
+	if err := filterTileset(opts, tileset, &header, jsonMetadata); err != nil {
+		return err
+	}
+
+	newReader := func() (tileReader, error) {
+		if split != nil {
+			return newMbtilesSplitTileReader(input, *split)
+		}
+		return newMbtilesTileReader(input)
+	}
+
 	logger.Println("Pass 2: writing tiles")
-	resolve := newResolver(deduplicate, header.TileType == Mvt)
-	{
-		bar := progressbar.Default(int64(tileset.GetCardinality()))
-		i := tileset.Iterator()
-		stmt := conn.Prep("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?")
+	if err := checkTileFormat(logger, &header, jsonMetadata, tileset, newReader, opts.TrustTileData); err != nil {
+		return err
+	}
+	if opts.InferVectorLayers && header.TileType == Mvt {
+		// before any tiles are written, as the output may start with the metadata
+		reader, err := newReader()
+		if err != nil {
+			return err
+		}
+		minZoom, _, _ := IDToZxy(tileset.Minimum())
+		maxZoom, _, _ := IDToZxy(tileset.Maximum())
+		err = inferVectorLayers(logger, jsonMetadata, header.TileCompression, minZoom, maxZoom,
+			sampleTileset(tileset, vectorLayerSamples), reader.ReadTile)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	header.InternalCompression = opts.InternalCompression
+	resolve, err := newConvertResolver(opts, header, convertTmpDir(tmpfile))
+	if err != nil {
+		return err
+	}
+	defer resolve.close()
+	sink, err := newTileSink(opts, tmpfile, output, header.InternalCompression, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	defer sink.close()
+	tileErrors := newTileErrorHandler(logger, opts, output)
+	defer tileErrors.close()
+	i := tileset.Iterator()
+	count := tileset.GetCardinality()
+	var resume *resumer
+	var checkpoint func(uint64) error
+	if opts.Resume {
+		resume, err = newResumer(input, opts, tmpfile)
+		if err != nil {
+			return err
+		}
+		lastID, resumed, err := resume.restore(resolve)
+		if err != nil {
+			return err
+		}
+		if resumed {
+			z, x, y := IDToZxy(lastID)
+			logger.Printf("Resuming after tile %d/%d/%d\n", z, x, y)
+			i.AdvanceIfNeeded(lastID + 1)
+			count -= tileset.Rank(lastID)
+		}
+		checkpoint = func(id uint64) error {
+			return resume.checkpoint(resolve, id)
+		}
+	}
+	bar := newProgress(opts, "tiles", int64(count))
+	err = addTiles(opts.context(), resolve, sink, opts.Workers, bar,
+		func() (EntryV3, bool) {
+			if !i.HasNext() {
+				return EntryV3{}, false
+			}
+			return EntryV3{TileID: i.Next()}, true
+		},
+		newReader,
+		tileErrors.handle, checkpoint)
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+	if err := tileErrors.close(); err != nil {
+		return err
+	}
+	header, err = sink.finalize(logger, resolve, header, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	if opts.StatsOut != "" {
+		if err := writeConvertReport(opts.StatsOut, resolve, header); err != nil {
+			return err
+		}
+	}
+	if resume != nil {
+		if err := resume.remove(); err != nil {
+			return err
+		}
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, archiveSummary(header, output), start)
+}
 
-		var rawTileTmp bytes.Buffer
+// convertMbtilesStream converts the tiles of an MBTiles database in a single pass over the tiles table,
+// sorting them by tile ID through temporary files within the StreamMemory budget of opts
+// instead of collecting a set of all tile IDs first.
+func convertMbtilesStream(logger *log.Logger, conn *sqlite.Conn, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker, header HeaderV3, jsonMetadata map[string]interface{}, start time.Time) error {
+	budget := opts.StreamMemory
+	if budget <= 0 {
+		budget = defaultStreamMemory
+	}
+	sorter := newTileSorter(convertTmpDir(tmpfile), budget)
+	defer sorter.close()
+
+	var bbox *bboxFilter
+	if opts.Bbox != "" {
+		var err error
+		if bbox, err = parseBboxFilter(opts.Bbox); err != nil {
+			return err
+		}
+	}
+	zooms := zoomRange{opts.MinZoom, opts.MaxZoom}
+	firstZoomID, endZoomID := zooms.tileIDs()
+
+	logger.Println("Pass 1: Sorting tiles")
+	// the first tiles in input order are kept to check the tile format
+	samples := make(memoryTileReader)
+	sampleIDs := roaring64.New()
+	var count, minID, maxID uint64
+	{
+		// tiles is a view joining the tables of a split schema, with NULL rows for UTFGrids
+		stmt, _, err := conn.PrepareTransient("SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles")
+		if err != nil {
+			return fmt.Errorf("Failed to create statement, %w", err)
+		}
+		defer stmt.Finalize()
 
-		for i.HasNext() {
-			id := i.Next()
-			z, x, y := IDToZxy(id)
+		for {
+			row, err := stmt.Step()
+			if err != nil {
+				return fmt.Errorf("Failed to step statement, %w", err)
+			}
+			if !row {
+				break
+			}
+			if err := opts.context().Err(); err != nil {
+				return err
+			}
+			z := uint8(stmt.ColumnInt64(0))
+			x := uint32(stmt.ColumnInt64(1))
+			y := uint32(stmt.ColumnInt64(2))
+			if err := ValidateTileCoord(z, x, y); err != nil {
+				return err
+			}
 			flippedY := (1 << z) - 1 - y
+			id := ZxyToID(z, x, flippedY)
+			if id < firstZoomID || id >= endZoomID || (bbox != nil && !bbox.contains(id)) {
+				continue
+			}
+			data := make([]byte, stmt.ColumnLen(3))
+			stmt.ColumnBytes(3, data)
+			if len(data) == 0 {
+				continue
+			}
+			if len(samples) < tileFormatSamples {
+				samples[id] = data
+				sampleIDs.Add(id)
+			}
+			if err := sorter.add(id, data); err != nil {
+				return err
+			}
+			if count == 0 || id < minID {
+				minID = id
+			}
+			maxID = max(maxID, id)
+			count++
+		}
+	}
 
-			stmt.BindInt64(1, int64(z))
-			stmt.BindInt64(2, int64(x))
-			stmt.BindInt64(3, int64(flippedY))
+	if count == 0 {
+		return fmt.Errorf("no tiles in MBTiles archive")
+	}
+	if bbox != nil {
+		bbox.apply(&header)
+	}
+	if zooms.active() || bbox != nil {
+		zooms.apply(&header, jsonMetadata, minID, maxID)
+	}
 
-			hasRow, err := stmt.Step()
+	logger.Println("Pass 2: writing tiles")
+	if err := checkTileFormat(logger, &header, jsonMetadata, sampleIDs, func() (tileReader, error) { return samples, nil }, opts.TrustTileData); err != nil {
+		return err
+	}
+	tiles, err := sorter.sorted()
+	if err != nil {
+		return err
+	}
+	header.InternalCompression = opts.InternalCompression
+	resolve, err := newConvertResolver(opts, header, convertTmpDir(tmpfile))
+	if err != nil {
+		return err
+	}
+	defer resolve.close()
+	sink, err := newTileSink(opts, tmpfile, output, header.InternalCompression, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	defer sink.close()
+	tileErrors := newTileErrorHandler(logger, opts, output)
+	defer tileErrors.close()
+
+	// sorted tiles are handed to the readers of addTiles by tile ID, as they are only read once
+	var pending sync.Map
+	var nextErr error
+	var lastID uint64
+	var added uint64
+	bar := newProgress(opts, "tiles", int64(count))
+	err = addTiles(opts.context(), resolve, sink, opts.Workers, bar,
+		func() (EntryV3, bool) {
+			id, data, ok, err := tiles.next()
+			if err == nil && ok && added > 0 && id == lastID {
+				z, x, y := IDToZxy(id)
+				err = fmt.Errorf("duplicate tile %d/%d/%d in MBTiles archive", z, x, y)
+			}
 			if err != nil {
-				return fmt.Errorf("Failed to step statement, %w", err)
+				nextErr = err
+				return EntryV3{}, false
 			}
-			if !hasRow {
-				return fmt.Errorf("Missing row")
+			if !ok {
+				return EntryV3{}, false
 			}
+			lastID = id
+			added++
+			pending.Store(id, data)
+			return EntryV3{TileID: id, RunLength: 1}, true
+		},
+		func() (tileReader, error) { return pendingTileReader{&pending}, nil },
+		tileErrors.handle, nil)
+	if err != nil {
+		return err
+	}
+	if nextErr != nil {
+		return nextErr
+	}
+	bar.Finish()
+	if err := tileErrors.close(); err != nil {
+		return err
+	}
+	header, err = sink.finalize(logger, resolve, header, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	if opts.StatsOut != "" {
+		if err := writeConvertReport(opts.StatsOut, resolve, header); err != nil {
+			return err
+		}
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, archiveSummary(header, output), start)
+}
 
-			reader := stmt.ColumnReader(0)
-			rawTileTmp.Reset()
-			rawTileTmp.ReadFrom(reader)
-			data := rawTileTmp.Bytes()
+// memoryTileReader reads tiles held in memory by tile ID.
+type memoryTileReader map[uint64][]byte
 
-			if len(data) > 0 {
-				if isNew, newData := resolve.AddTileIsNew(id, data, 1); isNew {
-					_, err := tmpfile.Write(newData)
-					if err != nil {
-						return fmt.Errorf("Failed to write to tempfile: %s", err)
+func (m memoryTileReader) ReadTile(entry EntryV3) ([]byte, error) {
+	return m[entry.TileID], nil
+}
+
+func (m memoryTileReader) Close() error {
+	return nil
+}
+
+// pendingTileReader reads tiles stored by tile ID in a map, removing them as each is only read once.
+type pendingTileReader struct {
+	pending *sync.Map
+}
+
+func (p pendingTileReader) ReadTile(entry EntryV3) ([]byte, error) {
+	data, ok := p.pending.LoadAndDelete(entry.TileID)
+	if !ok {
+		return nil, fmt.Errorf("Missing tile")
+	}
+	return data.([]byte), nil
+}
+
+func (p pendingTileReader) Close() error {
+	return nil
+}
+
+// tileReader reads the raw contents of tiles for one worker of addTiles.
+type tileReader interface {
+	ReadTile(entry EntryV3) ([]byte, error)
+	Close() error
+}
+
+// keyedTileReader is a tileReader for sources that identify tile contents by a key,
+// so that contents shared by several tiles are only read and hashed once.
+type keyedTileReader interface {
+	tileReader
+	TileKey(entry EntryV3) (string, error)
+	ReadKey(key string) ([]byte, error)
+}
+
+// tileJob is a tile read and compressed by a worker.
+// The result is delivered on done so that jobs can be consumed in tile ID order.
+type tileJob struct {
+	entry      EntryV3
+	key        string
+	known      bool
+	data       []byte
+	inputSize  int // length of the tile as read from the input
+	compressed []byte
+	err        error
+	done       chan struct{}
+}
+
+// tileErrorHandler applies ConvertOptions.OnTileError to tiles that cannot be read or decompressed.
+// It is only used by the goroutine adding tiles in order.
+type tileErrorHandler struct {
+	logger  *log.Logger
+	mode    string
+	path    string
+	file    *os.File
+	encoder *json.Encoder
+	skipped uint64
+	closed  bool
+}
+
+func newTileErrorHandler(logger *log.Logger, opts ConvertOptions, output convertOutput) *tileErrorHandler {
+	path := opts.TileErrorLog
+	if path == "" {
+		path = "errors.jsonl"
+		if output.writer == nil {
+			path = filepath.Join(filepath.Dir(output.path), path)
+		}
+	}
+	return &tileErrorHandler{logger: logger, mode: opts.OnTileError, path: path}
+}
+
+// handle returns err for the tile of entry if the conversion must abort, or nil to skip the tile.
+func (h *tileErrorHandler) handle(entry EntryV3, err error) error {
+	z, x, y := IDToZxy(entry.TileID)
+	if h.mode == "abort" {
+		return fmt.Errorf("Failed to read tile %d/%d/%d, %w", z, x, y, err)
+	}
+	h.skipped++
+	if h.mode != "log" {
+		return nil
+	}
+	if h.file == nil {
+		file, err := os.Create(h.path)
+		if err != nil {
+			return fmt.Errorf("Failed to create %s, %w", h.path, err)
+		}
+		h.file = file
+		h.encoder = json.NewEncoder(file)
+		h.logger.Printf("Logging unreadable tiles to %s\n", h.path)
+	}
+	record := struct {
+		Z     uint8  `json:"z"`
+		X     uint32 `json:"x"`
+		Y     uint32 `json:"y"`
+		Error string `json:"error"`
+	}{z, x, y, err.Error()}
+	if err := h.encoder.Encode(record); err != nil {
+		return fmt.Errorf("Failed to write to %s, %w", h.path, err)
+	}
+	return nil
+}
+
+// close logs the number of skipped tiles and closes the error log; later calls do nothing.
+func (h *tileErrorHandler) close() error {
+	if h.closed {
+		return nil
+	}
+	h.closed = true
+	if h.skipped > 0 {
+		h.logger.Printf("Skipped %d tiles that could not be read\n", h.skipped)
+	}
+	if h.file == nil {
+		return nil
+	}
+	return h.file.Close()
+}
+
+// readTile reads the tile of entry. For a keyedTileReader it also returns the key of the contents,
+// and skips reading contents whose key is in known, returning true instead.
+func readTile(reader tileReader, entry EntryV3, known *sync.Map) (string, bool, []byte, error) {
+	keyed, ok := reader.(keyedTileReader)
+	if !ok || known == nil {
+		data, err := reader.ReadTile(entry)
+		return "", false, data, err
+	}
+	key, err := keyed.TileKey(entry)
+	if err != nil {
+		return "", false, nil, err
+	}
+	if _, ok := known.Load(key); ok {
+		return key, true, nil, nil
+	}
+	data, err := keyed.ReadKey(key)
+	return key, false, data, err
+}
+
+// addTiles reads the tiles returned by next, in increasing tile ID order, and adds them to the resolver
+// and tmpfile. Reading and compression are split across the given number of workers, 0 meaning all CPUs,
+// each with its own reader from newReader; a single writer builds the index in tile ID order, counting tiles on bar.
+// With one worker, or GOMAXPROCS set to 1, tiles are processed sequentially.
+// When deduplicating with a keyedTileReader, contents are only read and hashed the first time their key is seen.
+// Tiles that cannot be read or decompressed are passed to onError, and skipped if it returns nil.
+// If checkpoint is not nil, it is called with the ID of each tile once it has been added or skipped.
+// Cancelling ctx stops reading tiles and returns its error.
+func addTiles(ctx context.Context, resolve *resolver, tmpfile io.Writer, workers int, bar progressTracker, next func() (EntryV3, bool), newReader func() (tileReader, error), onError func(EntryV3, error) error, checkpoint func(uint64) error) error {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+
+	// the contents of each key added so far, unless memory is bounded by a disk index
+	var known *sync.Map
+	if _, onDisk := resolve.index.(*diskIndex); resolve.deduplicate && !onDisk {
+		known = &sync.Map{}
+	}
+	// add records a read tile in the resolver and tmpfile; must be called in tile ID order
+	add := func(job *tileJob, encode func() []byte) error {
+		if resolve.stats != nil {
+			resolve.stats.inputBytes += uint64(job.inputSize)
+		}
+		if job.known {
+			found, _ := known.Load(job.key)
+			if err := resolve.addExistingTile(job.entry.TileID, found.(offsetLen), 1); err != nil {
+				return tileOrderError(job.entry.TileID, err)
+			}
+			return nil
+		}
+		if len(job.data) == 0 {
+			return nil
+		}
+		isNew, newData, err := resolve.addTile(job.entry.TileID, job.data, 1, encode)
+		if err != nil {
+			return tileOrderError(job.entry.TileID, err)
+		}
+		if isNew {
+			if _, err := tmpfile.Write(newData); err != nil {
+				return fmt.Errorf("Failed to write to tempfile: %s", err)
+			}
+		}
+		if job.key != "" {
+			last := resolve.Entries[len(resolve.Entries)-1]
+			known.Store(job.key, offsetLen{last.Offset, last.Length})
+		}
+		return nil
+	}
+
+	if workers == 1 || runtime.GOMAXPROCS(0) == 1 {
+		reader, err := newReader()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		for entry, ok := next(); ok; entry, ok = next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			job := &tileJob{entry: entry}
+			job.key, job.known, job.data, err = readTile(reader, entry, known)
+			job.inputSize = len(job.data)
+			if err == nil {
+				job.data, err = resolve.decompressTile(job.data)
+				if err != nil {
+					err = fmt.Errorf("Failed to decompress tile, %w", err)
+				}
+			}
+			if err != nil {
+				if err := onError(entry, err); err != nil {
+					return err
+				}
+			} else if err := add(job, func() []byte { return resolve.compressTile(resolve.compressor, job.data) }); err != nil {
+				return err
+			}
+			if checkpoint != nil {
+				if err := checkpoint(entry.TileID); err != nil {
+					return err
+				}
+			}
+			bar.Add(1)
+		}
+		return nil
+	}
+
+	jobs := make(chan *tileJob, workers*4)
+	ordered := make(chan *tileJob, workers*4)
+	g, ctx := errgroup.WithContext(ctx)
+
+	// dispatch tiles to the workers and the writer in the same order
+	g.Go(func() error {
+		defer close(jobs)
+		defer close(ordered)
+		for entry, ok := next(); ok; entry, ok = next() {
+			job := &tileJob{entry: entry, done: make(chan struct{})}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case ordered <- job:
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case jobs <- job:
+			}
+		}
+		return nil
+	})
+
+	for range workers {
+		g.Go(func() error {
+			reader, err := newReader()
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			compressor, err := newCompressor(resolve.compression, resolve.level)
+			if err != nil {
+				return err
+			}
+
+			for job := range jobs {
+				job.key, job.known, job.data, job.err = readTile(reader, job.entry, known)
+				job.inputSize = len(job.data)
+				if job.err == nil {
+					job.data, job.err = resolve.decompressTile(job.data)
+					if job.err != nil {
+						job.err = fmt.Errorf("Failed to decompress tile, %w", job.err)
 					}
 				}
+				if job.err == nil && len(job.data) > 0 {
+					// copy, since the compressor reuses its buffer
+					job.compressed = bytes.Clone(resolve.compressTile(compressor, job.data))
+				}
+				close(job.done)
 			}
+			return nil
+		})
+	}
 
-			stmt.ClearBindings()
-			stmt.Reset()
+	g.Go(func() error {
+		for job := range ordered {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-job.done:
+			}
+			if job.err != nil {
+				if err := onError(job.entry, job.err); err != nil {
+					return err
+				}
+			} else if err := add(job, func() []byte { return job.compressed }); err != nil {
+				return err
+			}
+			if checkpoint != nil {
+				if err := checkpoint(job.entry.TileID); err != nil {
+					return err
+				}
+			}
 			bar.Add(1)
 		}
+		return nil
+	})
+
+	return g.Wait()
+}
+
+// openMbtilesReader opens an MBTiles database for reading with memory-mapped I/O,
+// so that the connections of parallel readers share pages instead of each copying them.
+// The journal mode is left as is: enabling WAL would modify the input,
+// and readers do not block each other in either mode.
+func openMbtilesReader(input string) (*sqlite.Conn, error) {
+	conn, err := sqlite.OpenConn(input, sqlite.OpenReadOnly)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create database connection, %w", err)
+	}
+	if err := sqlitex.ExecuteTransient(conn, "PRAGMA mmap_size = 268435456", nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to configure database connection, %w", err)
 	}
-	_, err = finalize(logger, resolve, header, tmpfile, output, jsonMetadata)
+	return conn, nil
+}
+
+// mbtilesTileReader reads tiles from an MBTiles database with its own connection.
+type mbtilesTileReader struct {
+	conn *sqlite.Conn
+	stmt *sqlite.Stmt
+}
+
+func newMbtilesTileReader(input string) (tileReader, error) {
+	conn, err := openMbtilesReader(input)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	logger.Println("Finished in ", time.Since(start))
-	return nil
+	// tiles may be a view joining grids, with NULL rows next to those with data
+	stmt := conn.Prep("SELECT tile_data FROM tiles WHERE zoom_level = ? AND tile_column = ? AND tile_row = ? ORDER BY tile_data IS NULL LIMIT 1")
+	return &mbtilesTileReader{conn, stmt}, nil
 }
 
-func finalize(logger *log.Logger, resolve *resolver, header HeaderV3, tmpfile *os.File, output string, jsonMetadata map[string]interface{}) (HeaderV3, error) {
-	logger.Println("# of addressed tiles: ", resolve.AddressedTiles)
-	logger.Println("# of tile entries (after RLE): ", len(resolve.Entries))
-	logger.Println("# of tile contents: ", resolve.NumContents())
+func (m *mbtilesTileReader) ReadTile(entry EntryV3) ([]byte, error) {
+	z, x, y := IDToZxy(entry.TileID)
+	flippedY := (1 << z) - 1 - y
 
-	header.AddressedTilesCount = resolve.AddressedTiles
-	header.TileEntriesCount = uint64(len(resolve.Entries))
-	header.TileContentsCount = resolve.NumContents()
+	m.stmt.BindInt64(1, int64(z))
+	m.stmt.BindInt64(2, int64(x))
+	m.stmt.BindInt64(3, int64(flippedY))
+	defer m.stmt.Reset()
+	defer m.stmt.ClearBindings()
 
-	// assemble the final file
-	outfile, err := os.Create(output)
+	hasRow, err := m.stmt.Step()
 	if err != nil {
-		return header, fmt.Errorf("Failed to create %s, %w", output, err)
+		return nil, fmt.Errorf("Failed to step statement, %w", err)
+	}
+	if !hasRow {
+		return nil, fmt.Errorf("Missing row")
 	}
-	defer outfile.Close()
 
-	rootBytes, leavesBytes, numLeaves := optimizeDirectories(resolve.Entries, 16384-HeaderV3LenBytes, Gzip)
+	var rawTile bytes.Buffer
+	rawTile.ReadFrom(m.stmt.ColumnReader(0))
+	return rawTile.Bytes(), nil
+}
 
-	if numLeaves > 0 {
-		logger.Println("Root dir bytes: ", len(rootBytes))
-		logger.Println("Leaves dir bytes: ", len(leavesBytes))
-		logger.Println("Num leaf dirs: ", numLeaves)
-		logger.Println("Total dir bytes: ", len(rootBytes)+len(leavesBytes))
-		logger.Println("Average leaf dir bytes: ", len(leavesBytes)/numLeaves)
-		logger.Printf("Average bytes per addressed tile: %.2f\n", float64(len(rootBytes)+len(leavesBytes))/float64(resolve.AddressedTiles))
-	} else {
-		logger.Println("Total dir bytes: ", len(rootBytes))
-		logger.Printf("Average bytes per addressed tile: %.2f\n", float64(len(rootBytes))/float64(resolve.AddressedTiles))
+func (m *mbtilesTileReader) Close() error {
+	return m.conn.Close()
+}
+
+// mbtilesSplitSchema describes an MBTiles database that stores tile coordinates and
+// tile contents in separate tables, joined by a key, with tiles being a view over both.
+type mbtilesSplitSchema struct {
+	mapTable      string
+	keyColumn     string
+	dataTable     string
+	dataKeyColumn string
+}
+
+var mbtilesSplitSchemas = []mbtilesSplitSchema{
+	{"map", "tile_id", "images", "tile_id"},
+	{"tiles_shallow", "tile_data_id", "tiles_data", "tile_data_id"},
+}
+
+// detectMbtilesSplitSchema returns the split schema of the database, or nil if tiles are stored in a plain table.
+func detectMbtilesSplitSchema(conn *sqlite.Conn) (*mbtilesSplitSchema, error) {
+	stmt, _, err := conn.PrepareTransient("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name IN (?, ?)")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create statement, %w", err)
+	}
+	defer stmt.Finalize()
+
+	for _, schema := range mbtilesSplitSchemas {
+		stmt.BindText(1, schema.mapTable)
+		stmt.BindText(2, schema.dataTable)
+		_, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to step statement, %w", err)
+		}
+		count := stmt.ColumnInt64(0)
+		stmt.Reset()
+		if count == 2 {
+			return &schema, nil
+		}
 	}
+	return nil, nil
+}
 
-	metadataBytes, err := SerializeMetadata(jsonMetadata, Gzip)
+// mbtilesGridTables are the tables and views of UTFGrid interaction data in MBTiles databases.
+var mbtilesGridTables = []string{"grids", "grid_data", "grid_utfgrid", "grid_key", "keymap"}
 
+// detectMbtilesGrids returns the UTFGrid tables and views of the database.
+func detectMbtilesGrids(conn *sqlite.Conn) ([]string, error) {
+	stmt, _, err := conn.PrepareTransient("SELECT name FROM sqlite_master WHERE type IN ('table', 'view') AND name IN (?, ?, ?, ?, ?) ORDER BY name")
 	if err != nil {
-		return header, fmt.Errorf("Failed to marshal metadata, %w", err)
+		return nil, fmt.Errorf("Failed to create statement, %w", err)
+	}
+	defer stmt.Finalize()
+	for i, name := range mbtilesGridTables {
+		stmt.BindText(i+1, name)
 	}
 
-	setZoomCenterDefaults(&header, resolve.Entries)
+	var grids []string
+	for {
+		row, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to step statement, %w", err)
+		}
+		if !row {
+			return grids, nil
+		}
+		grids = append(grids, stmt.ColumnText(0))
+	}
+}
 
-	header.Clustered = true
-	header.InternalCompression = Gzip
-	if header.TileType == Mvt {
-		header.TileCompression = Gzip
+// mbtilesSplitTileReader reads tiles from an MBTiles database with a split schema,
+// identifying tile contents by their key in the data table.
+type mbtilesSplitTileReader struct {
+	conn     *sqlite.Conn
+	keyStmt  *sqlite.Stmt
+	dataStmt *sqlite.Stmt
+}
+
+func newMbtilesSplitTileReader(input string, schema mbtilesSplitSchema) (tileReader, error) {
+	conn, err := openMbtilesReader(input)
+	if err != nil {
+		return nil, err
+	}
+	keyStmt := conn.Prep(fmt.Sprintf("SELECT %[1]s FROM %[2]s WHERE zoom_level = ? AND tile_column = ? AND tile_row = ? ORDER BY %[1]s IS NULL LIMIT 1", schema.keyColumn, schema.mapTable))
+	dataStmt := conn.Prep(fmt.Sprintf("SELECT tile_data FROM %s WHERE %s = ?", schema.dataTable, schema.dataKeyColumn))
+	return &mbtilesSplitTileReader{conn, keyStmt, dataStmt}, nil
+}
+
+func (m *mbtilesSplitTileReader) TileKey(entry EntryV3) (string, error) {
+	z, x, y := IDToZxy(entry.TileID)
+	flippedY := (1 << z) - 1 - y
+
+	m.keyStmt.BindInt64(1, int64(z))
+	m.keyStmt.BindInt64(2, int64(x))
+	m.keyStmt.BindInt64(3, int64(flippedY))
+	defer m.keyStmt.Reset()
+	defer m.keyStmt.ClearBindings()
+
+	hasRow, err := m.keyStmt.Step()
+	if err != nil {
+		return "", fmt.Errorf("Failed to step statement, %w", err)
+	}
+	if !hasRow {
+		return "", fmt.Errorf("Missing row")
+	}
+	if m.keyStmt.ColumnType(0) == sqlite.TypeNull {
+		// a map row with only a grid
+		return "", nil
+	}
+	return m.keyStmt.ColumnText(0), nil
+}
+
+// ReadKey returns the tile data for key, or no data for the empty key of a tile without contents.
+func (m *mbtilesSplitTileReader) ReadKey(key string) ([]byte, error) {
+	if key == "" {
+		return nil, nil
+	}
+	m.dataStmt.BindText(1, key)
+	defer m.dataStmt.Reset()
+	defer m.dataStmt.ClearBindings()
+
+	hasRow, err := m.dataStmt.Step()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to step statement, %w", err)
+	}
+	if !hasRow {
+		return nil, fmt.Errorf("Missing tile data for key %s", key)
+	}
+
+	var rawTile bytes.Buffer
+	rawTile.ReadFrom(m.dataStmt.ColumnReader(0))
+	return rawTile.Bytes(), nil
+}
+
+func (m *mbtilesSplitTileReader) ReadTile(entry EntryV3) ([]byte, error) {
+	key, err := m.TileKey(entry)
+	if err != nil {
+		return nil, err
+	}
+	return m.ReadKey(key)
+}
+
+func (m *mbtilesSplitTileReader) Close() error {
+	return m.conn.Close()
+}
+
+// fileTileReader reads tiles at the absolute offsets of their entries in a file.
+type fileTileReader struct {
+	file *os.File
+}
+
+func (f fileTileReader) ReadTile(entry EntryV3) ([]byte, error) {
+	buf := make([]byte, entry.Length)
+	// an entry past the end of the file is corrupt, but a read ending at it may also return io.EOF
+	if n, err := f.file.ReadAt(buf, int64(entry.Offset)); n < len(buf) {
+		return nil, fmt.Errorf("Failed to read buffer, %w", err)
+	}
+	return buf, nil
+}
+
+func (f fileTileReader) Close() error {
+	return nil
+}
+
+// atomicFile is an output written under a temporary sibling name and renamed into place by commit,
+// so an interrupted or failed write never leaves a partial file at the output path.
+type atomicFile struct {
+	*os.File
+	path      string
+	committed bool
+}
+
+// The temporary name is randomized so it never collides with a tmpfile named after the output,
+// such as the one kept for resuming a conversion.
+func createAtomic(path string) (*atomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create temporary file for %s, %w", path, err)
+	}
+	// os.CreateTemp creates files readable only by their owner
+	if err := file.Chmod(0644); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, fmt.Errorf("Failed to set permissions of %s, %w", file.Name(), err)
+	}
+	return &atomicFile{File: file, path: path}, nil
+}
+
+// commit flushes the file to disk and renames it to its output path.
+func (f *atomicFile) commit() error {
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync %s, %w", f.Name(), err)
+	}
+	if err := f.File.Close(); err != nil {
+		return fmt.Errorf("Failed to close %s, %w", f.Name(), err)
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("Failed to rename %s to %s, %w", f.Name(), f.path, err)
+	}
+	f.committed = true
+	return syncDir(filepath.Dir(f.path))
+}
+
+// Close removes the temporary file unless it was committed.
+func (f *atomicFile) Close() error {
+	if f.committed {
+		return nil
+	}
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// syncDir flushes a rename in dir to disk.
+// Directories cannot be synced on Windows, where a rename is durable once it returns.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s, %w", dir, err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync %s, %w", dir, err)
+	}
+	return nil
+}
+
+// finalize writes the archive to output from the resolver state and the tile data in tmpfile.
+// The archive is written to a temporary file next to output and only renamed to output once complete.
+func finalize(logger *log.Logger, resolve *resolver, header HeaderV3, tmpfile io.ReadSeeker, output string, jsonMetadata map[string]interface{}) (HeaderV3, error) {
+	outfile, err := createAtomic(output)
+	if err != nil {
+		return header, err
+	}
+	defer outfile.Close()
+
+	header, err = finalizeWriter(logger, resolve, header, tmpfile, outfile, jsonMetadata)
+	if err != nil {
+		return header, err
+	}
+	return header, outfile.commit()
+}
+
+// finalizeWriter writes the archive to w from the resolver state and the tile data in tmpfile,
+// which stages the tile data section as w need not be seekable, such as standard output or an upload stream.
+func finalizeWriter(logger *log.Logger, resolve *resolver, header HeaderV3, tmpfile io.ReadSeeker, w io.Writer, jsonMetadata map[string]interface{}) (HeaderV3, error) {
+	return writeArchive(logger, resolve, finalTileHeader(logger, resolve, header), tmpfile, w, jsonMetadata)
+}
+
+// finalTileHeader logs the tile counts of a conversion and sets the tile compression of the resolver in header.
+func finalTileHeader(logger *log.Logger, resolve *resolver, header HeaderV3) HeaderV3 {
+	logger.Println("# of addressed tiles: ", resolve.AddressedTiles)
+	logger.Println("# of tile entries (after RLE): ", len(resolve.Entries))
+	logger.Println("# of tile contents: ", resolve.NumContents())
+
+	if header.TileType == Mvt && (resolve.compression != NoCompression || resolve.decompress) {
+		header.TileCompression = resolve.compression
+	}
+	return header
+}
+
+// writeArchive assembles a clustered archive from the resolver state and the tile data
+// previously written to tmpfile, writing header, directories, metadata and tiles to outfile.
+// Directories and metadata use header.InternalCompression, or Gzip if it is unset.
+func writeArchive(logger *log.Logger, resolve *resolver, header HeaderV3, tmpfile io.ReadSeeker, outfile io.Writer, jsonMetadata map[string]interface{}) (HeaderV3, error) {
+	header, rootBytes, leavesBytes := archiveDirectories(logger, resolve, header)
+
+	metadataBytes, err := SerializeMetadata(jsonMetadata, header.InternalCompression)
+
+	if err != nil {
+		return header, fmt.Errorf("Failed to marshal metadata, %w", err)
 	}
 
 	header.RootOffset = HeaderV3LenBytes
@@ -437,6 +2185,127 @@ func finalize(logger *log.Logger, resolve *resolver, header HeaderV3, tmpfile *o
 	return header, nil
 }
 
+// archiveDirectories sets the counts and layout-independent fields of the header of a clustered archive
+// from the resolver state, and serializes its root and leaf directories.
+func archiveDirectories(logger *log.Logger, resolve *resolver, header HeaderV3) (HeaderV3, []byte, []byte) {
+	header.AddressedTilesCount = resolve.AddressedTiles
+	header.TileEntriesCount = uint64(len(resolve.Entries))
+	header.TileContentsCount = resolve.NumContents()
+
+	if header.InternalCompression == UnknownCompression {
+		header.InternalCompression = Gzip
+	}
+
+	rootBytes, leavesBytes, numLeaves := resolve.directories(header.InternalCompression)
+
+	if numLeaves > 0 {
+		logger.Println("Root dir bytes: ", len(rootBytes))
+		logger.Println("Leaves dir bytes: ", len(leavesBytes))
+		logger.Println("Num leaf dirs: ", numLeaves)
+		logger.Println("Total dir bytes: ", len(rootBytes)+len(leavesBytes))
+		logger.Println("Average leaf dir bytes: ", len(leavesBytes)/numLeaves)
+		logger.Printf("Average bytes per addressed tile: %.2f\n", float64(len(rootBytes)+len(leavesBytes))/float64(resolve.AddressedTiles))
+	} else {
+		logger.Println("Total dir bytes: ", len(rootBytes))
+		logger.Printf("Average bytes per addressed tile: %.2f\n", float64(len(rootBytes))/float64(resolve.AddressedTiles))
+	}
+
+	setZoomCenterDefaults(&header, resolve.Entries)
+
+	header.SpecVersion = 3
+	header.Clustered = true
+
+	return header, rootBytes, leavesBytes
+}
+
+// tileSink receives the tile data of a conversion: the tmpfile, copied into the output by finalize,
+// or with ConvertOptions.NoTmpfile the output file itself.
+// A streamed output reserves 16384 bytes for the header and root directory, followed by the metadata;
+// tiles are written after the metadata and the leaf directories after the tiles,
+// so that no directory size has to be estimated in advance.
+type tileSink struct {
+	io.Writer
+	tmpfile       io.ReadWriteSeeker
+	outfile       *atomicFile
+	metadataBytes []byte
+	optimizeRLE   bool
+}
+
+func newTileSink(opts ConvertOptions, tmpfile io.ReadWriteSeeker, output convertOutput, compression Compression, jsonMetadata map[string]interface{}) (*tileSink, error) {
+	if !opts.NoTmpfile {
+		return &tileSink{Writer: tmpfile, tmpfile: tmpfile, optimizeRLE: opts.OptimizeRLE}, nil
+	}
+	metadataBytes, err := SerializeMetadata(jsonMetadata, compression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal metadata, %w", err)
+	}
+	outfile, err := createAtomic(output.path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := outfile.WriteAt(metadataBytes, 16384); err != nil {
+		outfile.Close()
+		return nil, fmt.Errorf("Failed to write metadata to outfile, %w", err)
+	}
+	if _, err := outfile.Seek(16384+int64(len(metadataBytes)), io.SeekStart); err != nil {
+		outfile.Close()
+		return nil, fmt.Errorf("Failed to seek outfile, %w", err)
+	}
+	return &tileSink{Writer: outfile, outfile: outfile, metadataBytes: metadataBytes, optimizeRLE: opts.OptimizeRLE}, nil
+}
+
+// finalize writes the archive, from the tmpfile or around the tiles already in the output.
+func (s *tileSink) finalize(logger *log.Logger, resolve *resolver, header HeaderV3, output convertOutput, jsonMetadata map[string]interface{}) (HeaderV3, error) {
+	if s.optimizeRLE {
+		logger.Printf("Coalesced %d entries into longer runs", resolve.coalesceEntries())
+	}
+	if s.outfile == nil && output.writer != nil {
+		return finalizeWriter(logger, resolve, header, s.tmpfile, output.writer, jsonMetadata)
+	}
+	if s.outfile == nil {
+		return finalize(logger, resolve, header, s.tmpfile, output.path, jsonMetadata)
+	}
+	header = finalTileHeader(logger, resolve, header)
+	header, rootBytes, leavesBytes := archiveDirectories(logger, resolve, header)
+
+	header.RootOffset = HeaderV3LenBytes
+	header.RootLength = uint64(len(rootBytes))
+	header.MetadataOffset = 16384
+	header.MetadataLength = uint64(len(s.metadataBytes))
+	header.TileDataOffset = header.MetadataOffset + header.MetadataLength
+	header.TileDataLength = resolve.Offset
+	header.LeafDirectoryOffset = header.TileDataOffset + header.TileDataLength
+	header.LeafDirectoryLength = uint64(len(leavesBytes))
+
+	if _, err := s.outfile.WriteAt(leavesBytes, int64(header.LeafDirectoryOffset)); err != nil {
+		return header, fmt.Errorf("Failed to write leaf directories to outfile, %w", err)
+	}
+	// zero the padding after the root directory
+	first := make([]byte, 16384)
+	copy(first, SerializeHeader(header))
+	copy(first[HeaderV3LenBytes:], rootBytes)
+	if _, err := s.outfile.WriteAt(first, 0); err != nil {
+		return header, fmt.Errorf("Failed to write header to outfile, %w", err)
+	}
+	return header, s.outfile.commit()
+}
+
+func (s *tileSink) close() error {
+	if s.outfile != nil {
+		return s.outfile.Close()
+	}
+	return nil
+}
+
+// convertTmpDir returns the directory of tmpfile for other temporary files of a conversion,
+// or the default directory for temporary files if tmpfile is not a file.
+func convertTmpDir(tmpfile io.ReadWriteSeeker) string {
+	if f, ok := tmpfile.(*os.File); ok && f != nil {
+		return filepath.Dir(f.Name())
+	}
+	return ""
+}
+
 func v2ToHeaderJSON(v2JsonMetadata map[string]interface{}, first4 []byte) (HeaderV3, map[string]interface{}, error) {
 	header := HeaderV3{}
 
@@ -469,6 +2338,8 @@ func v2ToHeaderJSON(v2JsonMetadata map[string]interface{}, first4 []byte) (Heade
 		switch val.(string) {
 		case "gzip":
 			header.TileCompression = Gzip
+		case "brotli":
+			header.TileCompression = Brotli
 		default:
 			return header, v2JsonMetadata, errors.New("Unknown compression type")
 		}
@@ -525,44 +2396,203 @@ func v2ToHeaderJSON(v2JsonMetadata map[string]interface{}, first4 []byte) (Heade
 	return header, v2JsonMetadata, nil
 }
 
-func parseBounds(bounds string) (int32, int32, int32, int32, error) {
-	parts := strings.Split(bounds, ",")
-	E7 := 10000000.0
-	minLon, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+// LonToE7 converts a longitude or latitude in degrees to the fixed-point E7 integer of an archive header.
+func LonToE7(degrees float64) int32 {
+	return int32(degrees * 10000000)
+}
+
+// E7ToLon converts a longitude or latitude from the fixed-point E7 integer of an archive header to degrees.
+func E7ToLon(e7 int32) float64 {
+	return float64(e7) / 10000000
+}
+
+// ParseBoundsString parses bounds in the minlon,minlat,maxlon,maxlat form of MBTiles metadata.
+func ParseBoundsString(s string) (minLon, minLat, maxLon, maxLat float64, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return 0, 0, 0, 0, fmt.Errorf("bounds %q must be minlon,minlat,maxlon,maxlat", s)
+	}
+	var values [4]float64
+	for i, part := range parts {
+		values[i], err = strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+	}
+	return values[0], values[1], values[2], values[3], nil
+}
+
+// ParseCenterString parses a center in the lon,lat,zoom form of MBTiles metadata.
+func ParseCenterString(s string) (lon, lat float64, zoom uint8, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 3 {
+		return 0, 0, 0, fmt.Errorf("center %q must be lon,lat,zoom", s)
+	}
+	lon, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, err
 	}
-	minLat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	lat, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, err
 	}
-	maxLon, err := strconv.ParseFloat(strings.TrimSpace(parts[2]), 64)
+	centerZoom, err := strconv.ParseInt(strings.TrimSpace(parts[2]), 10, 8)
 	if err != nil {
-		return 0, 0, 0, 0, err
+		return 0, 0, 0, err
 	}
-	maxLat, err := strconv.ParseFloat(strings.TrimSpace(parts[3]), 64)
+	return lon, lat, uint8(centerZoom), nil
+}
+
+// FormatBoundsString formats bounds as minlon,minlat,maxlon,maxlat, the inverse of ParseBoundsString.
+func FormatBoundsString(minLon, minLat, maxLon, maxLat float64) string {
+	return fmt.Sprintf("%v,%v,%v,%v", minLon, minLat, maxLon, maxLat)
+}
+
+// FormatCenterString formats a center as lon,lat,zoom, the inverse of ParseCenterString.
+func FormatCenterString(lon, lat float64, zoom uint8) string {
+	return fmt.Sprintf("%v,%v,%d", lon, lat, zoom)
+}
+
+func parseBounds(bounds string) (int32, int32, int32, int32, error) {
+	minLon, minLat, maxLon, maxLat, err := ParseBoundsString(bounds)
 	if err != nil {
 		return 0, 0, 0, 0, err
 	}
-	return int32(minLon * E7), int32(minLat * E7), int32(maxLon * E7), int32(maxLat * E7), nil
+	return LonToE7(minLon), LonToE7(minLat), LonToE7(maxLon), LonToE7(maxLat), nil
 }
 
 func parseCenter(center string) (int32, int32, uint8, error) {
-	parts := strings.Split(center, ",")
-	E7 := 10000000.0
-	centerLon, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	lon, lat, zoom, err := ParseCenterString(center)
 	if err != nil {
 		return 0, 0, 0, err
 	}
-	centerLat, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
-	if err != nil {
-		return 0, 0, 0, err
+	return LonToE7(lon), LonToE7(lat), zoom, nil
+}
+
+// ParseMetadataOverrides reads the keys of ConvertOptions.Metadata from a JSON object in jsonPath, if not empty,
+// and from key=value pairs in set, which take precedence.
+func ParseMetadataOverrides(jsonPath string, set []string) (map[string]interface{}, error) {
+	overrides := make(map[string]interface{})
+	if jsonPath != "" {
+		data, err := os.ReadFile(jsonPath)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s, %w", jsonPath, err)
+		}
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return nil, fmt.Errorf("Failed to parse %s, it must contain a JSON object, %w", jsonPath, err)
+		}
 	}
-	centerZoom, err := strconv.ParseInt(strings.TrimSpace(parts[2]), 10, 8)
-	if err != nil {
-		return 0, 0, 0, err
+	for _, pair := range set {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("metadata %q must be key=value", pair)
+		}
+		overrides[key] = value
+	}
+	return overrides, nil
+}
+
+// metadataList formats a bounds or center override given as a JSON array as a comma-separated string.
+func metadataList(key string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i, part := range v {
+			number, ok := part.(float64)
+			if !ok {
+				return "", fmt.Errorf("metadata %s must only contain numbers", key)
+			}
+			parts[i] = strconv.FormatFloat(number, 'f', -1, 64)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("metadata %s must be a string or an array", key)
+	}
+}
+
+// metadataZoom parses a minzoom or maxzoom override given as a number or a string.
+func metadataZoom(key string, value interface{}) (int8, error) {
+	var zoom float64
+	switch v := value.(type) {
+	case float64:
+		zoom = v
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 0, fmt.Errorf("metadata %s %q is not a number", key, v)
+		}
+		zoom = parsed
+	default:
+		return 0, fmt.Errorf("metadata %s must be a number", key)
+	}
+	if zoom != math.Trunc(zoom) || zoom < 0 || zoom > 31 {
+		return 0, fmt.Errorf("metadata %s %v must be a zoom level between 0 and 31", key, value)
+	}
+	return int8(zoom), nil
+}
+
+// applyMetadataOverrides merges overrides into jsonMetadata, setting the header bounds and center
+// from the bounds and center keys instead.
+func applyMetadataOverrides(header *HeaderV3, jsonMetadata map[string]interface{}, overrides map[string]interface{}) error {
+	for key, value := range overrides {
+		switch key {
+		case "bounds":
+			bounds, err := metadataList(key, value)
+			if err != nil {
+				return err
+			}
+			minLon, minLat, maxLon, maxLat, err := parseBounds(bounds)
+			if err != nil {
+				return fmt.Errorf("Failed to parse metadata bounds, %w", err)
+			}
+			if minLon >= maxLon || minLat >= maxLat {
+				return fmt.Errorf("zero-area bounds in metadata")
+			}
+			header.MinLonE7 = minLon
+			header.MinLatE7 = minLat
+			header.MaxLonE7 = maxLon
+			header.MaxLatE7 = maxLat
+		case "center":
+			center, err := metadataList(key, value)
+			if err != nil {
+				return err
+			}
+			centerLon, centerLat, centerZoom, err := parseCenter(center)
+			if err != nil {
+				return fmt.Errorf("Failed to parse metadata center, %w", err)
+			}
+			header.CenterLonE7 = centerLon
+			header.CenterLatE7 = centerLat
+			header.CenterZoom = centerZoom
+		case "minzoom", "maxzoom":
+			if _, err := metadataZoom(key, value); err != nil {
+				return err
+			}
+			jsonMetadata[key] = value
+		default:
+			jsonMetadata[key] = value
+		}
+	}
+	return nil
+}
+
+// overrideZoomRange limits the zoom range of opts to the minzoom and maxzoom keys of its metadata,
+// where no zoom limit is set.
+func overrideZoomRange(opts *ConvertOptions) error {
+	for key, limit := range map[string]*int8{"minzoom": &opts.MinZoom, "maxzoom": &opts.MaxZoom} {
+		value, ok := opts.Metadata[key]
+		if !ok || *limit >= 0 {
+			continue
+		}
+		zoom, err := metadataZoom(key, value)
+		if err != nil {
+			return err
+		}
+		*limit = zoom
 	}
-	return int32(centerLon * E7), int32(centerLat * E7), uint8(centerZoom), nil
+	return nil
 }
 
 func mbtilesMetadataHasFormat(mbtilesMetadata []string) bool {
@@ -635,39 +2665,517 @@ func mbtilesToHeaderJSON(mbtilesMetadata []string) (HeaderV3, map[string]interfa
 				} else {
 					header.TileCompression = NoCompression
 				}
+			case "brotli":
+				if header.TileType == Mvt {
+					header.TileCompression = Brotli
+				} else {
+					header.TileCompression = NoCompression
+				}
+			}
+			jsonResult["compression"] = value
+		// name, attribution, description, type, version
+		default:
+			jsonResult[key] = value
+		}
+	}
+
+	E7 := 10000000.0
+	if !boundsSet {
+		header.MinLonE7 = int32(-180 * E7)
+		header.MinLatE7 = int32(-85 * E7)
+		header.MaxLonE7 = int32(180 * E7)
+		header.MaxLatE7 = int32(85 * E7)
+	}
+
+	return header, jsonResult, nil
+}
+
+// extensionToTileType infers the tile type from a tile file extension, without the leading dot.
+func extensionToTileType(ext string) TileType {
+	switch ext {
+	case "mvt", "pbf":
+		return Mvt
+	case "png":
+		return Png
+	case "jpg", "jpeg":
+		return Jpeg
+	case "webp":
+		return Webp
+	case "avif":
+		return Avif
+	default:
+		return UnknownTileType
+	}
+}
+
+// tileFormatSamples is the number of non-empty tiles whose magic bytes are compared with the declared format.
+const tileFormatSamples = 16
+
+// sniffTileType detects the tile type of data from its magic bytes, and its compression if it is compressed,
+// which implies vector tiles. Zlib compressed tiles have UnknownCompression.
+// Data without known magic bytes is UnknownTileType.
+func sniffTileType(data []byte) (TileType, Compression) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a}):
+		return Png, NoCompression
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff}):
+		return Jpeg, NoCompression
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WEBP")):
+		return Webp, NoCompression
+	case len(data) >= 12 && bytes.Equal(data[4:8], []byte("ftyp")) && (bytes.Equal(data[8:12], []byte("avif")) || bytes.Equal(data[8:12], []byte("avis"))):
+		return Avif, NoCompression
+	case detectCompression(data) != NoCompression:
+		return Mvt, detectCompression(data)
+	case len(data) >= 2 && data[0] == 0x78 && (uint16(data[0])<<8|uint16(data[1]))%31 == 0:
+		return Mvt, UnknownCompression
+	}
+	return UnknownTileType, NoCompression
+}
+
+// checkTileFormat compares the declared tile type of header with the magic bytes of the first non-empty tiles of tileset.
+// On a mismatch it fails, or with trust sets the header and the format in jsonMetadata to the detected type.
+// Uncompressed vector tiles that are not valid protocol buffers are only logged.
+func checkTileFormat(logger *log.Logger, header *HeaderV3, jsonMetadata map[string]interface{}, tileset *roaring64.Bitmap, newReader func() (tileReader, error), trust bool) error {
+	reader, err := newReader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	i := tileset.Iterator()
+	for sampled := 0; sampled < tileFormatSamples && i.HasNext(); {
+		id := i.Next()
+		data, err := reader.ReadTile(EntryV3{TileID: id, RunLength: 1})
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			continue
+		}
+		sampled++
+		z, x, y := IDToZxy(id)
+
+		tileType, compression := sniffTileType(data)
+		if tileType == UnknownTileType {
+			if header.TileType == Mvt && header.TileCompression != Brotli && protoFields(data, func(uint64, uint64, []byte) error { return nil }) != nil {
+				logger.Printf("WARNING: tile %d/%d/%d of format pbf is not gzip or zlib compressed and not a valid protocol buffer\n", z, x, y)
+			}
+			continue
+		}
+		if tileType == header.TileType {
+			continue
+		}
+		// the format as declared, such as pbf for mvt
+		declared, ok := jsonMetadata["format"].(string)
+		if !ok {
+			declared = tileTypeToString(header.TileType)
+		}
+		if !trust {
+			if header.TileType == UnknownTileType {
+				// the missing format was already logged
+				return nil
+			}
+			return fmt.Errorf("tile %d/%d/%d is %s but the metadata format is %s, trust the tile data to convert it as %s",
+				z, x, y, tileTypeToString(tileType), declared, tileTypeToString(tileType))
+		}
+		logger.Printf("WARNING: tile %d/%d/%d is %s, overriding the metadata format %s\n", z, x, y, tileTypeToString(tileType), declared)
+		header.TileType = tileType
+		header.TileCompression = compression
+		format := tileTypeToString(tileType)
+		if tileType == Mvt {
+			format = "pbf"
+		}
+		jsonMetadata["format"] = format
+		return nil
+	}
+	return nil
+}
+
+// readNumericDir lists the entries of dir whose names, minus suffix, parse as integers.
+func readNumericDir(dir string, suffix string, wantDir bool) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() != wantDir || !strings.HasSuffix(entry.Name(), suffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), suffix), 10, 32)
+		if err != nil {
+			continue
+		}
+		result = append(result, n)
+	}
+	return result, nil
+}
+
+// scanTileDirectory walks a {z}/{x}/{y}.{ext} directory, returning the set of TileIDs found
+// and the tile file extension. Only one directory is listed at a time, so the memory used
+// is bounded by the largest single directory rather than the total number of tiles.
+// Files with an extension that is not a known tile type are skipped unless anyExt is set.
+func scanTileDirectory(input string, tms bool, anyExt bool) (*roaring64.Bitmap, string, error) {
+	tileset := roaring64.New()
+	ext := ""
+
+	zooms, err := readNumericDir(input, "", true)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, z := range zooms {
+		if z > MaxTileZoom {
+			continue
+		}
+		zDir := filepath.Join(input, strconv.FormatUint(z, 10))
+		columns, err := readNumericDir(zDir, "", true)
+		if err != nil {
+			return nil, "", err
+		}
+		for _, x := range columns {
+			xDir := filepath.Join(zDir, strconv.FormatUint(x, 10))
+			files, err := os.ReadDir(xDir)
+			if err != nil {
+				return nil, "", err
+			}
+			for _, file := range files {
+				if file.IsDir() {
+					continue
+				}
+				name := file.Name()
+				dot := strings.IndexByte(name, '.')
+				if dot <= 0 {
+					continue
+				}
+				y, err := strconv.ParseUint(name[:dot], 10, 32)
+				if err != nil {
+					continue
+				}
+				fileExt := name[dot+1:]
+				if !anyExt && extensionToTileType(fileExt) == UnknownTileType {
+					continue
+				}
+				if ext == "" {
+					ext = fileExt
+				} else if ext != fileExt {
+					return nil, "", fmt.Errorf("mixed tile extensions in directory: .%s and .%s", ext, fileExt)
+				}
+				if x >= 1<<z || y >= 1<<z {
+					return nil, "", fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+				}
+				if tms {
+					y = (1 << z) - 1 - y
+				}
+				tileset.Add(ZxyToID(uint8(z), uint32(x), uint32(y)))
+			}
+		}
+	}
+
+	return tileset, ext, nil
+}
+
+// directoryToHeaderJSON creates a header from the optional metadata.json of a tile directory,
+// lifting bounds, center and format into the header like mbtilesToHeaderJSON.
+func directoryToHeaderJSON(metadata map[string]interface{}, tileType TileType) (HeaderV3, map[string]interface{}, error) {
+	header := HeaderV3{TileType: tileType}
+	if tileType != Mvt {
+		header.TileCompression = NoCompression
+	}
+
+	E7 := 10000000.0
+	header.MinLonE7 = int32(-180 * E7)
+	header.MinLatE7 = int32(-85 * E7)
+	header.MaxLonE7 = int32(180 * E7)
+	header.MaxLatE7 = int32(85 * E7)
+
+	if val, ok := metadata["bounds"]; ok {
+		bounds, ok := coordinatesToString(val)
+		if !ok {
+			return header, metadata, fmt.Errorf("invalid bounds in metadata.json")
+		}
+		minLon, minLat, maxLon, maxLat, err := parseBounds(bounds)
+		if err != nil {
+			return header, metadata, err
+		}
+		header.MinLonE7 = minLon
+		header.MinLatE7 = minLat
+		header.MaxLonE7 = maxLon
+		header.MaxLatE7 = maxLat
+		delete(metadata, "bounds")
+	}
+
+	if val, ok := metadata["center"]; ok {
+		center, ok := coordinatesToString(val)
+		if !ok {
+			return header, metadata, fmt.Errorf("invalid center in metadata.json")
+		}
+		centerLon, centerLat, centerZoom, err := parseCenter(center)
+		if err != nil {
+			return header, metadata, err
+		}
+		header.CenterLonE7 = centerLon
+		header.CenterLatE7 = centerLat
+		header.CenterZoom = centerZoom
+		delete(metadata, "center")
+	}
+
+	return header, metadata, nil
+}
+
+// coordinatesToString accepts a comma-separated string (MBTiles style)
+// or a JSON array of numbers (TileJSON style).
+func coordinatesToString(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, p := range v {
+			f, ok := p.(float64)
+			if !ok {
+				return "", false
+			}
+			parts = append(parts, strconv.FormatFloat(f, 'f', -1, 64))
+		}
+		return strings.Join(parts, ","), true
+	default:
+		return "", false
+	}
+}
+
+// ConvertFromDirectory creates an archive from a {z}/{x}/{y}.{ext} tile directory, such as one
+// extracted by Convert, with an optional metadata.json at its root merged into the archive metadata.
+// The tile type is detected from file extensions unless tileType is set,
+// and tms means rows are numbered from the bottom instead of the top.
+// Vector tiles are gzip compressed; use Convert for other options.
+func ConvertFromDirectory(logger *log.Logger, input string, output string, deduplicate bool, tileType TileType, tms bool, tmpfile *os.File, progress ...ProgressReporter) error {
+	if info, err := os.Stat(input); err != nil {
+		return fmt.Errorf("Failed to open %s, %w", input, err)
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", input)
+	}
+	scheme := "xyz"
+	if tms {
+		scheme = "tms"
+	}
+	return Convert(logger, input, output, ConvertOptions{
+		Deduplicate:      deduplicate,
+		TileType:         tileType,
+		Scheme:           scheme,
+		MinZoom:          -1,
+		MaxZoom:          -1,
+		ProgressReporter: firstReporter(progress),
+	}, tmpfile)
+}
+
+// convertDirectory creates an archive from a {z}/{x}/{y}.{ext} tile directory,
+// with an optional metadata.json at its root. The scheme is "xyz" or "tms".
+func convertDirectory(logger *log.Logger, input string, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
+	start := time.Now()
+	if opts.Resume {
+		return fmt.Errorf("resume is only supported for MBTiles input")
+	}
+
+	if opts.Scheme != "xyz" && opts.Scheme != "tms" {
+		return fmt.Errorf("scheme must be xyz or tms")
+	}
+	tms := opts.Scheme == "tms"
+
+	logger.Println("Pass 1: Assembling TileID set")
+	tileset, ext, err := scanTileDirectory(input, tms, opts.TileType != UnknownTileType)
+	if err != nil {
+		return fmt.Errorf("Failed to scan directory, %w", err)
+	}
+	if err := opts.context().Err(); err != nil {
+		return err
+	}
+
+	if tileset.GetCardinality() == 0 {
+		return fmt.Errorf("no tiles in directory")
+	}
+
+	metadata := make(map[string]interface{})
+	metadataBytes, err := os.ReadFile(filepath.Join(input, "metadata.json"))
+	if err == nil {
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			return fmt.Errorf("Failed to parse metadata.json, %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read metadata.json, %w", err)
+	}
+
+	tileType := opts.TileType
+	if tileType == UnknownTileType {
+		tileType = extensionToTileType(ext)
+	}
+	header, jsonMetadata, err := directoryToHeaderJSON(metadata, tileType)
+	if err != nil {
+		return fmt.Errorf("Failed to convert metadata.json to header JSON, %w", err)
+	}
+	if err := applyMetadataOverrides(&header, jsonMetadata, opts.Metadata); err != nil {
+		return err
+	}
+
+	if err := filterTileset(opts, tileset, &header, jsonMetadata); err != nil {
+		return err
+	}
+
+	tileFile := func(id uint64) string {
+		z, x, y := IDToZxy(id)
+		if tms {
+			y = (1 << z) - 1 - y
+		}
+		return filepath.Join(input, strconv.Itoa(int(z)), strconv.Itoa(int(x)), strconv.Itoa(int(y))+"."+ext)
+	}
+
+	logger.Println("Pass 2: writing tiles")
+	if opts.InferVectorLayers && header.TileType == Mvt {
+		minZoom, _, _ := IDToZxy(tileset.Minimum())
+		maxZoom, _, _ := IDToZxy(tileset.Maximum())
+		err := inferVectorLayers(logger, jsonMetadata, header.TileCompression, minZoom, maxZoom,
+			sampleTileset(tileset, vectorLayerSamples), func(e EntryV3) ([]byte, error) {
+				return os.ReadFile(tileFile(e.TileID))
+			})
+		if err != nil {
+			return err
+		}
+	}
+	header.InternalCompression = opts.InternalCompression
+	resolve, err := newConvertResolver(opts, header, convertTmpDir(tmpfile))
+	if err != nil {
+		return err
+	}
+	defer resolve.close()
+	sink, err := newTileSink(opts, tmpfile, output, header.InternalCompression, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	defer sink.close()
+	tileErrors := newTileErrorHandler(logger, opts, output)
+	defer tileErrors.close()
+	{
+		bar := newProgress(opts, "tiles", int64(tileset.GetCardinality()))
+		i := tileset.Iterator()
+
+		for i.HasNext() {
+			if err := opts.context().Err(); err != nil {
+				return err
+			}
+			id := i.Next()
+			data, err := os.ReadFile(tileFile(id))
+			if err != nil {
+				if err := tileErrors.handle(EntryV3{TileID: id, RunLength: 1}, err); err != nil {
+					return err
+				}
+				bar.Add(1)
+				continue
+			}
+
+			if resolve.stats != nil {
+				resolve.stats.inputBytes += uint64(len(data))
+			}
+			if len(data) > 0 {
+				isNew, newData, err := resolve.AddTileIsNew(id, data, 1)
+				if err != nil {
+					return tileOrderError(id, err)
+				}
+				if isNew {
+					_, err := sink.Write(newData)
+					if err != nil {
+						return fmt.Errorf("Failed to write to tempfile: %s", err)
+					}
+				}
 			}
-			jsonResult["compression"] = value
-		// name, attribution, description, type, version
-		default:
-			jsonResult[key] = value
+			bar.Add(1)
 		}
+		bar.Finish()
+	}
+	if err := tileErrors.close(); err != nil {
+		return err
 	}
 
-	E7 := 10000000.0
-	if !boundsSet {
-		header.MinLonE7 = int32(-180 * E7)
-		header.MinLatE7 = int32(-85 * E7)
-		header.MaxLonE7 = int32(180 * E7)
-		header.MaxLatE7 = int32(85 * E7)
+	header, err = sink.finalize(logger, resolve, header, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	if opts.StatsOut != "" {
+		if err := writeConvertReport(opts.StatsOut, resolve, header); err != nil {
+			return err
+		}
 	}
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, archiveSummary(header, output), start)
+}
 
-	return header, jsonResult, nil
+// headerToMbtilesMetadata creates the name/value rows of an MBTiles metadata table from
+// an archive header and JSON metadata. Non-string values such as vector_layers are
+// nested under the "json" row, as the MBTiles specification requires.
+func headerToMbtilesMetadata(header HeaderV3, jsonMetadata map[string]interface{}) ([]string, error) {
+	format := tileTypeToString(header.TileType)
+	if header.TileType == Mvt {
+		format = "pbf"
+	}
+
+	result := []string{
+		"format", format,
+		"bounds", FormatBoundsString(E7ToLon(header.MinLonE7), E7ToLon(header.MinLatE7), E7ToLon(header.MaxLonE7), E7ToLon(header.MaxLatE7)),
+		"center", FormatCenterString(E7ToLon(header.CenterLonE7), E7ToLon(header.CenterLatE7), header.CenterZoom),
+		"minzoom", strconv.Itoa(int(header.MinZoom)),
+		"maxzoom", strconv.Itoa(int(header.MaxZoom)),
+	}
+
+	nested := make(map[string]interface{})
+	keys := make([]string, 0, len(jsonMetadata))
+	for k := range jsonMetadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		switch k {
+		case "format", "bounds", "center", "minzoom", "maxzoom":
+			continue
+		}
+		if v, ok := jsonMetadata[k].(string); ok {
+			result = append(result, k, v)
+		} else {
+			nested[k] = jsonMetadata[k]
+		}
+	}
+
+	if len(nested) > 0 {
+		nestedBytes, err := json.Marshal(nested)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, "json", string(nestedBytes))
+	}
+	return result, nil
+}
+
+// number of tile rows inserted per transaction by ConvertToMbtiles
+const mbtilesBatchSize = 5000
+
+// ConvertToMbtiles converts a PMTiles specification version 3 archive to an MBTiles database.
+// Tiles are written as stored in the archive unless decompress is set,
+// in which case compressed tiles are decompressed before insertion.
+func ConvertToMbtiles(logger *log.Logger, input string, output string, decompress bool, progress ...ProgressReporter) error {
+	return convertToMbtiles(logger, input, output, decompress, ConvertOptions{ProgressReporter: firstReporter(progress)})
 }
 
-// ConvertToDirectory extracts a PMTiles file to a standard Z/X/Y directory structure with optimizations
-func convertToDirectory(logger *log.Logger, input string, output string) error {
+// convertToMbtiles is ConvertToMbtiles reporting progress according to opts.
+func convertToMbtiles(logger *log.Logger, input string, output string, decompress bool, opts ConvertOptions) error {
 	start := time.Now()
 
-	// Open and read the PMTiles file
 	file, err := os.Open(input)
 	if err != nil {
 		return fmt.Errorf("Failed to open file: %w", err)
 	}
 	defer file.Close()
 
-	// Read and parse the header
 	headerBytes := make([]byte, HeaderV3LenBytes)
-	_, err = file.Read(headerBytes)
+	_, err = io.ReadFull(file, headerBytes)
 	if err != nil {
 		return fmt.Errorf("Failed to read header: %w", err)
 	}
@@ -677,54 +3185,150 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 		return fmt.Errorf("Failed to parse header: %w", err)
 	}
 
-	// Create the output directory if it doesn't exist
-	err = generateDirectoryStructure(logger, output, header.MaxZoom)
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	jsonMetadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
 	if err != nil {
-		return fmt.Errorf(("Failed to create directory structure"))
+		return fmt.Errorf("Failed to read metadata: %w", err)
 	}
 
-	// Save metadata.json if present
-	if header.MetadataLength > 0 {
-		metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
-		metadataBytes, err := DeserializeMetadataBytes(metadataReader, header.InternalCompression)
-		if err != nil {
-			return fmt.Errorf("Failed to read metadata: %w", err)
+	if checkFileExists(output) {
+		return fmt.Errorf("%s already exists", output)
+	}
+
+	conn, err := sqlite.OpenConn(output, sqlite.OpenReadWrite|sqlite.OpenCreate)
+	if err != nil {
+		return fmt.Errorf("Failed to create database connection, %w", err)
+	}
+	// remove a partial database once its connection is closed
+	completed := false
+	defer func() {
+		if !completed {
+			os.Remove(output)
 		}
+	}()
+	defer conn.Close()
 
-		metadataPath := filepath.Join(output, "metadata.json")
-		err = os.WriteFile(metadataPath, metadataBytes, 0644)
-		if err != nil {
-			return fmt.Errorf("Failed to write metadata.json: %w", err)
+	err = sqlitex.ExecuteScript(conn, `
+		CREATE TABLE metadata (name TEXT, value TEXT);
+		CREATE UNIQUE INDEX name ON metadata (name);
+		CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+	`, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create MBTiles schema, %w", err)
+	}
+
+	mbtilesMetadata, err := headerToMbtilesMetadata(header, jsonMetadata)
+	if err != nil {
+		return fmt.Errorf("Failed to convert metadata, %w", err)
+	}
+
+	{
+		stmt := conn.Prep("INSERT INTO metadata (name, value) VALUES (?, ?)")
+		for i := 0; i < len(mbtilesMetadata); i += 2 {
+			stmt.BindText(1, mbtilesMetadata[i])
+			stmt.BindText(2, mbtilesMetadata[i+1])
+			if _, err := stmt.Step(); err != nil {
+				return fmt.Errorf("Failed to insert metadata, %w", err)
+			}
+			stmt.Reset()
 		}
+	}
 
-		logger.Printf("Wrote metadata.json to %s", metadataPath)
+	bar := newProgress(opts, "tiles", int64(header.AddressedTilesCount))
+	stmt := conn.Prep("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	var insertErr error
+
+	if err := sqlitex.ExecuteTransient(conn, "BEGIN", nil); err != nil {
+		return fmt.Errorf("Failed to begin transaction, %w", err)
 	}
+	batchRows := 0
 
-	// Get the tile file extension based on the tile type
-	var extension string
-	switch header.TileType {
-	case Mvt:
-		extension = ".mvt"
-	case Png:
-		extension = ".png"
-	case Jpeg:
-		extension = ".jpg"
-	case Webp:
-		extension = ".webp"
-	case Avif:
-		extension = ".avif"
-	default:
-		extension = ""
+	err = IterateEntries(header,
+		ReaderAtFetcher(file),
+		func(e EntryV3) {
+			if insertErr != nil {
+				return
+			}
+			if err := opts.context().Err(); err != nil {
+				insertErr = err
+				return
+			}
+			data, err := io.ReadAll(io.NewSectionReader(file, int64(header.TileDataOffset+e.Offset), int64(e.Length)))
+			if err != nil {
+				insertErr = fmt.Errorf("Failed to read tile data, %w", err)
+				return
+			}
+			if decompress && header.TileCompression != NoCompression {
+				data, err = decompressBytes(data, header.TileCompression)
+				if err != nil {
+					insertErr = fmt.Errorf("Failed to decompress tile %d, %w", e.TileID, err)
+					return
+				}
+			}
+			for i := uint32(0); i < e.RunLength; i++ {
+				z, x, y := IDToZxy(e.TileID + uint64(i))
+				flippedY := (1 << z) - 1 - y
+				stmt.BindInt64(1, int64(z))
+				stmt.BindInt64(2, int64(x))
+				stmt.BindInt64(3, int64(flippedY))
+				stmt.BindBytes(4, data)
+				if _, err := stmt.Step(); err != nil {
+					insertErr = fmt.Errorf("Failed to insert tile, %w", err)
+					return
+				}
+				stmt.Reset()
+				bar.Add(1)
+
+				batchRows++
+				if batchRows == mbtilesBatchSize {
+					if err := sqlitex.ExecuteTransient(conn, "COMMIT", nil); err != nil {
+						insertErr = fmt.Errorf("Failed to commit tiles, %w", err)
+						return
+					}
+					if err := sqlitex.ExecuteTransient(conn, "BEGIN", nil); err != nil {
+						insertErr = fmt.Errorf("Failed to begin transaction, %w", err)
+						return
+					}
+					batchRows = 0
+				}
+			}
+		})
+
+	if err != nil {
+		return fmt.Errorf("Failed to iterate through tiles: %w", err)
+	}
+	if insertErr != nil {
+		return insertErr
+	}
+	if err := sqlitex.ExecuteTransient(conn, "COMMIT", nil); err != nil {
+		return fmt.Errorf("Failed to commit tiles, %w", err)
+	}
+	bar.Finish()
+	completed = true
+
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, progressSummary{Output: output, AddressedTiles: header.AddressedTilesCount}, start)
+}
+
+// ConvertToDirectory extracts a PMTiles file to a standard Z/X/Y directory structure with optimizations,
+// followed by a tilejson.json with tile URLs under baseURL, or relative to the directory if it is empty.
+func convertToDirectory(logger *log.Logger, input string, output string, baseURL string, opts ConvertOptions) error {
+	start := time.Now()
+
+	// Open the local or remote PMTiles archive
+	source, err := openExtractSource(opts.context(), input, opts)
+	if err != nil {
+		return err
 	}
+	defer source.Close()
+	header := source.header
 
 	// Collect all tile entries
 	logger.Println("Reading all entry headers")
 	allEntries := make([]EntryV3, 0)
 	err = IterateEntries(header,
-		func(offset uint64, length uint64) ([]byte, error) {
-			// This function reads a section of the directory
-			return io.ReadAll(io.NewSectionReader(file, int64(offset), int64(length)))
-		},
+		source.fetcher,
 		func(entry EntryV3) {
 			allEntries = append(allEntries, entry)
 		})
@@ -733,13 +3337,84 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 		return fmt.Errorf("Failed to iterate through tiles: %w", err)
 	}
 
+	var metadataBytes []byte
+	if header.MetadataLength > 0 {
+		metadataReader := io.NewSectionReader(source, int64(header.MetadataOffset), int64(header.MetadataLength))
+		metadataBytes, err = DeserializeMetadataBytes(metadataReader, header.InternalCompression)
+		if err != nil {
+			return fmt.Errorf("Failed to read metadata: %w", err)
+		}
+	}
+
+	filter, err := newExtractFilter(opts)
+	if err != nil {
+		return err
+	}
+	totalTiles := header.AddressedTilesCount
+	if filter != nil {
+		allEntries, totalTiles = filter.entries(allEntries)
+		if totalTiles == 0 {
+			return fmt.Errorf("no tiles in the zoom range and bbox to extract")
+		}
+		if metadataBytes, err = filter.apply(&header, metadataBytes, allEntries); err != nil {
+			return err
+		}
+	}
+
+	if !opts.Overwrite && !opts.SkipExisting && !opts.Resume {
+		if found, err := hasExtractedTiles(output); err != nil {
+			return err
+		} else if found {
+			return fmt.Errorf("output directory %s already contains tiles, use overwrite or skip existing tiles", output)
+		}
+	}
+
+	// Create the output directory if it doesn't exist
+	if opts.PrecreateDirs {
+		err = generateDirectoryStructure(logger, output, header.MinZoom, header.MaxZoom, filter, opts)
+		if err != nil {
+			return fmt.Errorf(("Failed to create directory structure"))
+		}
+	} else if err := os.MkdirAll(output, 0755); err != nil {
+		return fmt.Errorf("Failed to create output directory: %w", err)
+	}
+	// the directories of written tiles, each created once by the first worker needing it
+	var columnDirs sync.Map
+	makeColumnDir := func(dir string) error {
+		mkdir, _ := columnDirs.LoadOrStore(dir, sync.OnceValue(func() error {
+			return os.MkdirAll(dir, 0755)
+		}))
+		return mkdir.(func() error)()
+	}
+
+	// Save metadata.json if present
+	if header.MetadataLength > 0 {
+		metadataPath := filepath.Join(output, "metadata.json")
+		err = os.WriteFile(metadataPath, metadataBytes, 0644)
+		if err != nil {
+			return fmt.Errorf("Failed to write metadata.json: %w", err)
+		}
+
+		logger.Printf("Wrote metadata.json to %s", metadataPath)
+	}
+
+	paths := newTilePaths(header, opts)
+	decompress := opts.Decompress && header.TileCompression != NoCompression && header.TileCompression != UnknownCompression
+
 	// Create a progress bar
-	bar := progressbar.Default(int64(header.TileEntriesCount), "Extracting tiles")
+	bar := newProgress(opts, "tiles", int64(totalTiles), "Extracting tiles")
 	// Use atomic counter for processed tiles
 	var processedTiles uint32 = 0
+	var failedTiles atomic.Uint64
+	// tiles of a resumed extraction already on disk with their size
+	var skippedTiles atomic.Uint64
+	extracted := func(tilePath string, size int) bool {
+		info, err := os.Stat(tilePath)
+		return err == nil && info.Mode().IsRegular() && info.Size() == int64(size)
+	}
 
 	// Number of worker goroutines
-	numWorkers := runtime.NumCPU()
+	numWorkers := extractWorkers(opts)
 
 	// Channel for tile processing tasks
 	type tileTask struct {
@@ -749,7 +3424,7 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 	taskCh := make(chan tileTask, numWorkers*2)
 
 	// Create error group for coordinated error handling
-	g, ctx := errgroup.WithContext(context.Background())
+	g, ctx := errgroup.WithContext(opts.context())
 
 	// Launch writer workers
 	for range numWorkers {
@@ -762,19 +3437,25 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 					case <-ctx.Done():
 						return ctx.Err()
 					default:
-						// Create tile path (directories are already created)
 						z, x, y := IDToZxy(task.entry.TileID + uint64(i))
-						tilePath := filepath.Join(output,
-							fmt.Sprintf("%d", z),
-							fmt.Sprintf("%d", x),
-							fmt.Sprintf("%d%s", y, extension))
-						if _, err := os.Stat(tilePath); os.IsNotExist(err) {
-							err := os.WriteFile(tilePath, task.tileData, 0644)
-
-							if err != nil {
-								logger.Printf("Failed to write tile to %s: %v", tilePath, err)
-								continue
+						tilePath := filepath.Join(output, filepath.FromSlash(paths.path(z, x, y)))
+						if opts.Resume && !opts.Overwrite && extracted(tilePath, len(task.tileData)) {
+							skippedTiles.Add(1)
+							atomic.AddUint32(&processedTiles, 1)
+							continue
+						}
+						columnDir := filepath.Dir(tilePath)
+						if err := makeColumnDir(columnDir); err != nil {
+							return fmt.Errorf("Failed to create directory %s: %w", columnDir, err)
+						}
+						// a resumed extraction replaces the files of tiles with another size, such as partially written ones
+						if err := writeExtractedTile(tilePath, task.tileData, opts.Overwrite || opts.Resume); err != nil {
+							if opts.OnWriteError != "skip" {
+								return fmt.Errorf("Failed to write tile to %s: %w", tilePath, err)
 							}
+							logger.Printf("Failed to write tile to %s: %v", tilePath, err)
+							failedTiles.Add(1)
+							continue
 						}
 
 						// Update the progress bar periodically to reduce contention
@@ -793,20 +3474,29 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 	g.Go(func() error {
 		defer close(taskCh)
 
-		// Open a dedicated file handle for the reader
-		readerFile, err := os.Open(input)
-		if err != nil {
-			return fmt.Errorf("Failed to open file for reading: %w", err)
+		// the size of a decompressed tile is only known once it is read
+		entries := allEntries
+		if opts.Resume && !opts.Overwrite && !decompress {
+			entries = nil
+			for _, entry := range allEntries {
+				done := true
+				for i := uint32(0); i < entry.RunLength && done; i++ {
+					z, x, y := IDToZxy(entry.TileID + uint64(i))
+					done = extracted(filepath.Join(output, filepath.FromSlash(paths.path(z, x, y))), int(entry.Length))
+				}
+				if done {
+					skippedTiles.Add(uint64(entry.RunLength))
+					atomic.AddUint32(&processedTiles, entry.RunLength)
+					continue
+				}
+				entries = append(entries, entry)
+			}
 		}
-		defer readerFile.Close()
 
 		// Read all tiles
-		for _, entry := range allEntries {
-			// Read tile data
-			tileData := make([]byte, entry.Length)
-			_, err := readerFile.ReadAt(tileData, int64(header.TileDataOffset+entry.Offset))
-			if err != nil {
-				return fmt.Errorf("Failed to read tile data: %w", err)
+		return readCoalesced(source, header.TileDataOffset, entries, opts.ReadBuffer, source.threads, func(entry EntryV3, tileData []byte) error {
+			if decompress {
+				tileData = decompressExtractedTile(logger, entry.TileID, tileData, header.TileCompression)
 			}
 
 			select {
@@ -814,9 +3504,9 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 				return ctx.Err()
 			case taskCh <- tileTask{entry: entry, tileData: tileData}:
 				// Task sent successfully
+				return nil
 			}
-		}
-		return nil
+		})
 	})
 
 	// Wait for all workers to finish or for an error to occur
@@ -826,17 +3516,333 @@ func convertToDirectory(logger *log.Logger, input string, output string) error {
 
 	// Ensure progress bar is at 100%
 	bar.Set(int(processedTiles))
+	bar.Finish()
+	if failed := failedTiles.Load(); failed > 0 {
+		return fmt.Errorf("Failed to write %d tiles to %s", failed, output)
+	}
+
+	// the tiles are usable without a TileJSON, so invalid metadata does not fail the extraction
+	tilejsonBytes, err := directoryTileJSON(header, metadataBytes, baseURL, paths)
+	if err != nil {
+		logger.Printf("WARNING: not writing tilejson.json, %v", err)
+	} else if err := os.WriteFile(filepath.Join(output, "tilejson.json"), tilejsonBytes, 0644); err != nil {
+		return fmt.Errorf("Failed to write tilejson.json: %w", err)
+	}
 
+	if opts.Resume {
+		logger.Printf("Skipped %d tiles already extracted, wrote %d", skippedTiles.Load(), uint64(processedTiles)-skippedTiles.Load())
+	}
 	logger.Printf("Extracted %d tiles to %s in %v", processedTiles, output, time.Since(start))
+	if remote, ok := source.ReaderAt.(*RemoteArchive); ok {
+		logger.Printf("Read %s from %s at an average of %s/s", humanize.Bytes(remote.BytesRead()), input, humanize.Bytes(averageThroughput(remote.BytesRead(), start)))
+	}
+	return reportSummary(opts, header, progressSummary{Output: output, AddressedTiles: uint64(processedTiles)}, start)
+}
+
+// defaultDownloadThreads is the DownloadThreads of ConvertOptions if it is not set.
+const defaultDownloadThreads = 4
+
+// defaultReadBuffer is the ReadBuffer of ConvertOptions if it is not set.
+const defaultReadBuffer = 4 << 20
+
+// readCoalesced reads the tile data of entries from the tile section at offset base of r, calling fn with each entry
+// and its data. Entries following the first of a batch whose data ends within window bytes of its start,
+// as the adjacent tiles of a clustered archive do, are fetched with it in a single read and share its buffer,
+// so fn must not modify the data. A window smaller than a tile reads it alone.
+// With more than one thread, that many batches are read at once and fn is called concurrently, in no particular order;
+// otherwise fn is called in the order of entries.
+func readCoalesced(r io.ReaderAt, base uint64, entries []EntryV3, window int64, threads int, fn func(EntryV3, []byte) error) error {
+	read := func(batch []EntryV3) error {
+		start := batch[0].Offset
+		end := start
+		for _, e := range batch {
+			end = max(end, e.Offset+uint64(e.Length))
+		}
+		buf := make([]byte, end-start)
+		if _, err := r.ReadAt(buf, int64(base+start)); err != nil {
+			return fmt.Errorf("Failed to read tile data: %w", err)
+		}
+		for _, e := range batch {
+			if err := fn(e, buf[e.Offset-start:e.Offset-start+uint64(e.Length)]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(max(threads, 1))
+	for i := 0; i < len(entries); {
+		start := entries[i].Offset
+		j := i + 1
+		for ; j < len(entries); j++ {
+			e := entries[j]
+			if e.Offset < start || e.Offset+uint64(e.Length) > start+uint64(max(window, 0)) {
+				break
+			}
+		}
+		batch := entries[i:j]
+		i = j
+		if threads <= 1 {
+			if err := read(batch); err != nil {
+				return err
+			}
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		g.Go(func() error { return read(batch) })
+	}
+	return g.Wait()
+}
+
+// extractWorkers returns the number of goroutines of each phase of an extraction to a directory.
+func extractWorkers(opts ConvertOptions) int {
+	if opts.Workers > 0 {
+		return opts.Workers
+	}
+	return runtime.NumCPU()
+}
+
+// hasExtractedTiles returns whether the directory output contains any file besides metadata.json and tilejson.json,
+// such as the tiles of an earlier extraction. A missing directory has none.
+func hasExtractedTiles(output string) (bool, error) {
+	found := false
+	err := filepath.WalkDir(output, func(path string, d fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == output {
+			return fs.SkipAll
+		}
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || (filepath.Dir(path) == output && (d.Name() == "metadata.json" || d.Name() == "tilejson.json")) {
+			return nil
+		}
+		found = true
+		return fs.SkipAll
+	})
+	if err != nil {
+		return false, fmt.Errorf("Failed to read output directory %s: %w", output, err)
+	}
+	return found, nil
+}
+
+// extractSource is the archive extracted by convertToDirectory: a local file,
+// or an archive on HTTP or bucket storage read with range requests.
+type extractSource struct {
+	io.ReaderAt
+	io.Closer
+	fetcher SectionFetcher
+	header  HeaderV3
+	// threads is the number of tile data reads made at once
+	threads int
+}
+
+// openExtractSource opens the local archive at input, or the remote one at a URL such as https:// or s3://,
+// whose tile data is then read with opts.DownloadThreads range requests at once.
+func openExtractSource(ctx context.Context, input string, opts ConvertOptions) (*extractSource, error) {
+	if !isRemoteInput(input) {
+		file, header, err := openLocalHeader(input)
+		if err != nil {
+			return nil, err
+		}
+		return &extractSource{ReaderAt: file, Closer: file, fetcher: ReaderAtFetcher(file), header: header, threads: 1}, nil
+	}
+	threads := opts.DownloadThreads
+	if threads <= 0 {
+		threads = defaultDownloadThreads
+	}
+	archive, err := OpenRemoteArchive(ctx, "", input, RemoteArchiveOptions{
+		MaxConcurrency: threads,
+		Retries:        opts.Retries,
+		RetryDelay:     opts.RetryDelay,
+		RateLimit:      RateLimit{BytesPerSecond: opts.MaxBandwidth, RequestsPerSecond: opts.MaxRequestRate},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &extractSource{ReaderAt: archive, Closer: archive, fetcher: archive, header: archive.Header(), threads: threads}, nil
+}
+
+// isRemoteInput returns whether input is the URL of an archive on HTTP or bucket storage rather than a local path.
+func isRemoteInput(input string) bool {
+	return strings.Contains(input, "://") && !strings.HasPrefix(input, "file://")
+}
+
+// tileExtension returns the file extension, with its dot, of the tiles of an archive extracted to files:
+// opts.Extension if set, or the extension of the tile type.
+func tileExtension(header HeaderV3, opts ConvertOptions) string {
+	if opts.Extension != "" {
+		return "." + strings.TrimPrefix(opts.Extension, ".")
+	}
+	return headerExt(header)
+}
+
+// extractFilter limits the tiles extracted from an archive to the zoom range and bbox of ConvertOptions.
+type extractFilter struct {
+	zooms zoomRange
+	bbox  *bboxFilter
+}
+
+// newExtractFilter returns the filter of opts, or nil if it limits neither zoom levels nor area.
+func newExtractFilter(opts ConvertOptions) (*extractFilter, error) {
+	f := &extractFilter{zooms: zoomRange{opts.MinZoom, opts.MaxZoom}}
+	if opts.Bbox != "" {
+		bbox, err := parseBboxFilter(opts.Bbox)
+		if err != nil {
+			return nil, err
+		}
+		f.bbox = bbox
+	}
+	if !f.zooms.active() && f.bbox == nil {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// entries returns the parts of entries within the filter, splitting runs that cross its edges,
+// and their number of tiles.
+func (f *extractFilter) entries(entries []EntryV3) ([]EntryV3, uint64) {
+	start, end := f.zooms.tileIDs()
+	var filtered []EntryV3
+	var count uint64
+	for _, e := range entries {
+		first := max(e.TileID, start)
+		last := min(e.TileID+uint64(e.RunLength), end)
+		for id := first; id < last; id++ {
+			if f.bbox != nil && !f.bbox.contains(id) {
+				continue
+			}
+			count++
+			if n := len(filtered); n > 0 && filtered[n-1].Offset == e.Offset && filtered[n-1].TileID+uint64(filtered[n-1].RunLength) == id {
+				filtered[n-1].RunLength++
+				continue
+			}
+			filtered = append(filtered, EntryV3{TileID: id, Offset: e.Offset, Length: e.Length, RunLength: 1})
+		}
+	}
+	return filtered, count
+}
+
+// apply limits the bounds and zoom levels of the header, and those of metadataBytes if present,
+// to the filter and the filtered entries.
+func (f *extractFilter) apply(header *HeaderV3, metadataBytes []byte, entries []EntryV3) ([]byte, error) {
+	if f.bbox != nil {
+		f.bbox.apply(header)
+	}
+	last := entries[len(entries)-1]
+	var metadata map[string]interface{}
+	if len(metadataBytes) > 0 {
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			return nil, fmt.Errorf("Failed to parse metadata, %w", err)
+		}
+	}
+	f.zooms.apply(header, metadata, entries[0].TileID, last.TileID+uint64(last.RunLength)-1)
+	if metadata == nil {
+		return metadataBytes, nil
+	}
+	E7 := 10000000.0
+	bounds := []float64{float64(header.MinLonE7) / E7, float64(header.MinLatE7) / E7, float64(header.MaxLonE7) / E7, float64(header.MaxLatE7) / E7}
+	switch metadata["bounds"].(type) {
+	case nil:
+	case string:
+		metadata["bounds"] = fmt.Sprintf("%g,%g,%g,%g", bounds[0], bounds[1], bounds[2], bounds[3])
+	default:
+		metadata["bounds"] = bounds
+	}
+	return json.Marshal(metadata)
+}
+
+// writeExtractedTile creates the file of an extracted tile, keeping an existing file unless overwrite is set.
+// The file is created exclusively, so that workers writing the same path do not race.
+func writeExtractedTile(path string, data []byte, overwrite bool) error {
+	if overwrite {
+		return os.WriteFile(path, data, 0644)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// tilePaths names the files of tiles extracted from an archive after ConvertOptions.PathTemplate and Scheme.
+type tilePaths struct {
+	template string // with {ext} replaced
+	tms      bool
+}
+
+func newTilePaths(header HeaderV3, opts ConvertOptions) tilePaths {
+	extension := tileExtension(header, opts)
+	if opts.PathTemplate == "" {
+		return tilePaths{"{z}/{x}/{y}" + extension, opts.Scheme == "tms"}
+	}
+	return tilePaths{strings.ReplaceAll(opts.PathTemplate, "{ext}", strings.TrimPrefix(extension, ".")), opts.Scheme == "tms"}
+}
+
+// path returns the slash-separated path of a tile, with its row flipped for the TMS scheme.
+func (p tilePaths) path(z uint8, x uint32, y uint32) string {
+	if p.tms {
+		y = (1 << z) - 1 - y
+	}
+	return strings.NewReplacer("{z}", strconv.Itoa(int(z)), "{x}", strconv.FormatUint(uint64(x), 10), "{y}", strconv.FormatUint(uint64(y), 10)).Replace(p.template)
+}
+
+// validatePathTemplate checks that a ConvertOptions.PathTemplate names every tile differently within the output directory.
+func validatePathTemplate(template string) error {
+	for _, placeholder := range []string{"{z}", "{x}", "{y}"} {
+		if !strings.Contains(template, placeholder) {
+			return fmt.Errorf("path template %s must contain %s", template, placeholder)
+		}
+	}
+	clean := path.Clean(template)
+	if path.IsAbs(template) || filepath.IsAbs(template) || clean == ".." || strings.HasPrefix(clean, "../") || strings.HasSuffix(template, "/") {
+		return fmt.Errorf("path template %s must be a file path within the output directory", template)
+	}
 	return nil
 }
 
-func generateDirectoryStructure(logger *log.Logger, output string, maxZoom uint8) error {
+// decompressExtractedTile returns the decompressed data of a tile extracted with ConvertOptions.Decompress,
+// or data as stored if it fails to decompress.
+func decompressExtractedTile(logger *log.Logger, tileID uint64, data []byte, compression Compression) []byte {
+	decompressed, err := decompressBytes(data, compression)
+	if err != nil {
+		z, x, y := IDToZxy(tileID)
+		logger.Printf("Failed to decompress tile %d/%d/%d, keeping it compressed: %v", z, x, y, err)
+		return data
+	}
+	return decompressed
+}
+
+func generateDirectoryStructure(logger *log.Logger, output string, minZoom uint8, maxZoom uint8, filter *extractFilter, opts ConvertOptions) error {
+	// the columns of each zoom level, limited to the bbox of the filter
+	columns := func(z uint8) (uint32, uint32) {
+		if filter != nil && filter.bbox != nil {
+			if filter.bbox.empty[z] {
+				return 0, 0
+			}
+			r := filter.bbox.ranges[z]
+			return r[0], r[2] + 1
+		}
+		return 0, 1 << z
+	}
 	// Calculate total number of directories to create for progress bar
-	var totalDirs int64 = int64(math.Pow(2, float64(maxZoom+1))) + int64(maxZoom) + 1
+	var totalDirs int64 = 1
+	for z := minZoom; z <= maxZoom; z++ {
+		minX, endX := columns(z)
+		totalDirs += 1 + int64(endX-minX)
+	}
 
 	// Create progress bar for directory creation
-	dirBar := progressbar.Default(totalDirs, "Creating directory structure")
+	dirBar := newProgress(opts, "directories", totalDirs, "Creating directory structure")
 	// Use atomic counter for processed folders
 	var dirsCreated uint32 = 0
 
@@ -848,8 +3854,8 @@ func generateDirectoryStructure(logger *log.Logger, output string, maxZoom uint8
 	atomic.AddUint32(&dirsCreated, 1)
 
 	// Use multiple workers to create directories in parallel
-	dirWorkers := runtime.NumCPU()
-	dirG, dirCtx := errgroup.WithContext(context.Background())
+	dirWorkers := extractWorkers(opts)
+	dirG, dirCtx := errgroup.WithContext(opts.context())
 	dirCh := make(chan string, dirWorkers*2)
 
 	// Launch directory creation workers
@@ -880,7 +3886,7 @@ func generateDirectoryStructure(logger *log.Logger, output string, maxZoom uint8
 	dirG.Go(func() error {
 		defer close(dirCh)
 
-		for z := range maxZoom + 1 {
+		for z := minZoom; z <= maxZoom; z++ {
 			// Create zoom level directory
 			zDir := filepath.Join(output, fmt.Sprintf("%d", z))
 			err := os.MkdirAll(zDir, 0755)
@@ -890,7 +3896,8 @@ func generateDirectoryStructure(logger *log.Logger, output string, maxZoom uint8
 			atomic.AddUint32(&dirsCreated, 1)
 
 			// Queue all X directories at this zoom level
-			for x := range int(math.Pow(2, float64(z))) {
+			minX, endX := columns(z)
+			for x := minX; x < endX; x++ {
 				select {
 				case <-dirCtx.Done():
 					return dirCtx.Err()
@@ -907,6 +3914,7 @@ func generateDirectoryStructure(logger *log.Logger, output string, maxZoom uint8
 		return fmt.Errorf("Failed during directory creation: %w", err)
 	}
 	dirBar.Set(int(dirsCreated))
+	dirBar.Finish()
 
 	logger.Println("Directory structure created.")
 	return nil
@@ -1,17 +1,42 @@
 package pmtiles
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
 	"github.com/stretchr/testify/assert"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
 )
 
 func TestResolver(t *testing.T) {
-	resolver := newResolver(true, true)
+	resolver := newResolver(true, Gzip)
 	resolver.AddTileIsNew(1, []byte{0x1, 0x2}, 1)
 	assert.Equal(t, 1, len(resolver.Entries))
 	resolver.AddTileIsNew(2, []byte{0x1, 0x3}, 1)
 	assert.Equal(t, uint64(52), resolver.Offset)
-	isNew, _ := resolver.AddTileIsNew(3, []byte{0x1, 0x2}, 1)
+	isNew, _, _ := resolver.AddTileIsNew(3, []byte{0x1, 0x2}, 1)
 	assert.False(t, isNew)
 	assert.Equal(t, uint64(52), resolver.Offset)
 	resolver.AddTileIsNew(4, []byte{0x1, 0x2}, 1)
@@ -21,7 +46,7 @@ func TestResolver(t *testing.T) {
 }
 
 func TestResolverRunLength(t *testing.T) {
-	resolver := newResolver(true, true)
+	resolver := newResolver(true, Gzip)
 	resolver.AddTileIsNew(1, []byte{0x1, 0x2}, 2)
 	assert.Equal(t, uint32(2), resolver.Entries[0].RunLength)
 	resolver.AddTileIsNew(3, []byte{0x1, 0x2}, 2)
@@ -30,11 +55,221 @@ func TestResolverRunLength(t *testing.T) {
 }
 
 func TestResolverRunLengthNoDeduplicate(t *testing.T) {
-	resolver := newResolver(false, true)
+	resolver := newResolver(false, Gzip)
 	resolver.AddTileIsNew(1, []byte{0x1, 0x2}, 2)
 	assert.Equal(t, uint32(2), resolver.Entries[0].RunLength)
 }
 
+func TestResolverRunLengthOverflow(t *testing.T) {
+	resolver := newResolver(true, NoCompression)
+	_, _, err := resolver.AddTileIsNew(0, []byte{0x1}, 1)
+	assert.Nil(t, err)
+	// the run continues past the largest 32-bit run length
+	_, _, err = resolver.AddTileIsNew(1, []byte{0x1}, math.MaxUint32)
+	assert.Nil(t, err)
+	assert.Equal(t, []EntryV3{{0, 0, 1, math.MaxUint32}, {math.MaxUint32, 0, 1, 1}}, resolver.Entries)
+	assert.Equal(t, uint64(math.MaxUint32)+1, resolver.AddressedTiles)
+
+	_, _, err = resolver.AddTileIsNew(math.MaxUint32+1, []byte{0x1}, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resolver.Entries))
+	assert.Equal(t, uint32(2), resolver.Entries[1].RunLength)
+	assert.Equal(t, uint64(math.MaxUint32)+2, resolver.AddressedTiles)
+	assert.Equal(t, uint64(1), resolver.NumContents())
+}
+
+func TestResolverOutOfOrder(t *testing.T) {
+	resolver := newResolver(true, Gzip)
+	_, _, err := resolver.AddTileIsNew(5, []byte{0x1, 0x2}, 1)
+	assert.Nil(t, err)
+	_, _, err = resolver.AddTileIsNew(4, []byte{0x1, 0x3}, 1)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(resolver.Entries))
+	assert.Equal(t, uint64(1), resolver.AddressedTiles)
+}
+
+func TestResolverInvalidTileID(t *testing.T) {
+	resolver := newResolver(true, Gzip)
+	_, _, err := resolver.AddTileIsNew(ZxyToID(MaxTileZoom+1, 0, 0), []byte{0x1, 0x2}, 1)
+	assert.Error(t, err)
+	assert.Equal(t, 0, len(resolver.Entries))
+	assert.Contains(t, tileOrderError(math.MaxUint64, err).Error(), "Failed to add tile 18446744073709551615")
+}
+
+func TestResolverDuplicate(t *testing.T) {
+	resolver := newResolver(false, Gzip)
+	_, _, err := resolver.AddTileIsNew(5, []byte{0x1, 0x2}, 1)
+	assert.Nil(t, err)
+	_, _, err = resolver.AddTileIsNew(5, []byte{0x1, 0x2}, 1)
+	assert.Error(t, err)
+	assert.Equal(t, 1, len(resolver.Entries))
+}
+
+func TestResolverRunLengthOverlap(t *testing.T) {
+	resolver := newResolver(true, Gzip)
+	_, _, err := resolver.AddTileIsNew(1, []byte{0x1, 0x2}, 3)
+	assert.Nil(t, err)
+	_, _, err = resolver.AddTileIsNew(3, []byte{0x1, 0x3}, 1)
+	assert.Error(t, err)
+	assert.Error(t, resolver.addExistingTile(2, offsetLen{0, 1}, 1))
+	_, _, err = resolver.AddTileIsNew(4, []byte{0x1, 0x3}, 1)
+	assert.Nil(t, err)
+}
+
+func TestResolverCoalesceEntries(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	resolver := newResolver(true, NoCompression)
+	for tileID := uint64(0); tileID < 10000; {
+		runLength := uint32(1 + r.Intn(3))
+		if r.Intn(4) > 0 {
+			content := uint64(r.Intn(2))
+			resolver.Entries = append(resolver.Entries, EntryV3{tileID, content * 10, 10, runLength})
+		}
+		tileID += uint64(runLength)
+	}
+	lookup := func(entries []EntryV3, tileID uint64) int64 {
+		if e, ok := findTile(entries, tileID); ok {
+			return int64(e.Offset)
+		}
+		return -1
+	}
+	before := append([]EntryV3{}, resolver.Entries...)
+
+	removed := resolver.coalesceEntries()
+	assert.Greater(t, removed, 0)
+	assert.Equal(t, len(before)-removed, len(resolver.Entries))
+	for i := 0; i < 10000; i++ {
+		tileID := uint64(r.Intn(10010))
+		assert.Equal(t, lookup(before, tileID), lookup(resolver.Entries, tileID))
+	}
+	assert.Equal(t, 0, resolver.coalesceEntries())
+}
+
+func TestTileOrderError(t *testing.T) {
+	resolver := newResolver(false, Gzip)
+	resolver.AddTileIsNew(ZxyToID(2, 1, 1), []byte{0x1}, 1)
+	_, _, err := resolver.AddTileIsNew(ZxyToID(1, 0, 1), []byte{0x1}, 1)
+	assert.Error(t, err)
+	assert.Contains(t, tileOrderError(ZxyToID(1, 0, 1), err).Error(), "1/0/1")
+}
+
+func TestResolverHashFunc(t *testing.T) {
+	resolver := newResolverWithHash(true, NoCompression, fnv.New128a())
+	resolver.AddTileIsNew(1, []byte{0x1, 0x2}, 1)
+	isNew, _, _ := resolver.AddTileIsNew(3, []byte{0x1, 0x2}, 1)
+	assert.False(t, isNew)
+	isNew, _, _ = resolver.AddTileIsNew(4, []byte{0x1, 0x3}, 1)
+	assert.True(t, isNew)
+	assert.Equal(t, uint64(2), resolver.NumContents())
+}
+
+// resolverCorpus returns 1M tiles of 16 to 527 bytes, cut from a shared random buffer.
+func resolverCorpus() [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	buf := make([]byte, 1<<16)
+	rng.Read(buf)
+	tiles := make([][]byte, 1<<20)
+	for i := range tiles {
+		length := 16 + rng.Intn(512)
+		offset := rng.Intn(len(buf) - length)
+		tiles[i] = buf[offset : offset+length]
+	}
+	return tiles
+}
+
+func benchmarkResolverHash(b *testing.B, newHash func() hash.Hash) {
+	tiles := resolverCorpus()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		resolver := newResolverWithHash(true, NoCompression, newHash())
+		for i, tile := range tiles {
+			resolver.AddTileIsNew(uint64(i), tile, 1)
+		}
+	}
+}
+
+func BenchmarkResolverFnv128a(b *testing.B) {
+	benchmarkResolverHash(b, func() hash.Hash { return fnv.New128a() })
+}
+
+func BenchmarkResolverXxhash64(b *testing.B) {
+	benchmarkResolverHash(b, func() hash.Hash { return xxhash.New() })
+}
+
+// addTileCorpus returns 64 distinct random tiles of size bytes,
+// incompressible like raster images or gzipped vector tiles.
+func addTileCorpus(size int) [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	tiles := make([][]byte, 64)
+	for i := range tiles {
+		tiles[i] = make([]byte, size)
+		rng.Read(tiles[i])
+	}
+	return tiles
+}
+
+func BenchmarkAddTileIsNew(b *testing.B) {
+	for _, corpus := range []struct {
+		name string
+		size int
+	}{{"raster50KB", 50 << 10}, {"vector120KB", 120 << 10}} {
+		tiles := addTileCorpus(corpus.size)
+		for _, hashName := range []string{"fnv", "xxh3"} {
+			b.Run(corpus.name+"/"+hashName, func(b *testing.B) {
+				resolver := newResolverWithHash(true, NoCompression, newDedupHash(hashName))
+				b.SetBytes(int64(corpus.size))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					resolver.AddTileIsNew(uint64(i), tiles[i%len(tiles)], 1)
+				}
+			})
+		}
+	}
+}
+
+func TestDedupHash(t *testing.T) {
+	for _, name := range []string{"fnv", "xxh3"} {
+		h := newDedupHash(name)
+		assert.Equal(t, 16, h.Size())
+		h.Write([]byte{0x1, 0x2})
+		sum := h.Sum(nil)
+		assert.Equal(t, 16, len(sum))
+		h.Reset()
+		h.Write([]byte{0x1, 0x3})
+		assert.NotEqual(t, sum, h.Sum(nil))
+	}
+}
+
+func TestConvertHash(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x+y)%3, 10))
+	})
+
+	var outputs [][]byte
+	for _, hashName := range []string{"", "xxh3", "fnv"} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out"+hashName+".pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, Hash: hashName}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		archive, err := os.ReadFile(output)
+		assert.Nil(t, err)
+		outputs = append(outputs, archive)
+	}
+	assert.Equal(t, outputs[0], outputs[1])
+	assert.Equal(t, outputs[0], outputs[2])
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{MinZoom: -1, MaxZoom: -1, Hash: "md5"}, tmpfile)
+	assert.Error(t, err)
+}
+
 func TestV2UpgradeBarebones(t *testing.T) {
 	header, jsonMetadata, err := v2ToHeaderJSON(map[string]interface{}{
 		"bounds":      "-180.0,-85,178,83",
@@ -251,3 +486,1527 @@ func TestMbtilesCoordinatesHasSpace(t *testing.T) {
 	assert.Equal(t, int32(-122.1906*10000000), header.CenterLonE7)
 	assert.Equal(t, int32(37.7599*10000000), header.CenterLatE7)
 }
+
+func TestResolverZstd(t *testing.T) {
+	resolver := newResolver(true, Zstd)
+	isNew, data, _ := resolver.AddTileIsNew(1, []byte{0x1, 0x2, 0x3}, 1)
+	assert.True(t, isNew)
+	assert.Equal(t, Compression(Zstd), detectCompression(data))
+	decompressed, err := decompressBytes(data, Zstd)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1, 0x2, 0x3}, decompressed)
+}
+
+func TestResolverRecompressGzipToZstd(t *testing.T) {
+	gzipped, _ := newCompressor(Gzip, 0)
+	gzippedTile, _ := gzipped.Compress([]byte{0x1, 0x2, 0x3})
+
+	resolver := newResolver(false, Zstd)
+	_, data, _ := resolver.AddTileIsNew(1, gzippedTile, 1)
+	assert.Equal(t, Compression(Zstd), detectCompression(data))
+	decompressed, err := decompressBytes(data, Zstd)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1, 0x2, 0x3}, decompressed)
+}
+
+func TestResolverBrotli(t *testing.T) {
+	resolver := newResolver(true, Brotli)
+	isNew, data, _ := resolver.AddTileIsNew(1, []byte{0x1, 0x2, 0x3}, 1)
+	assert.True(t, isNew)
+	decompressed, err := decompressBytes(data, Brotli)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x1, 0x2, 0x3}, decompressed)
+}
+
+func TestConvertMbtilesBrotliInput(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	compressor, err := newCompressor(Brotli, 0)
+	assert.Nil(t, err)
+	writeTestMbtiles(t, input, 1, func(z, x, y int64) []byte {
+		data, _ := compressor.Compress([]byte("tile " + strconv.FormatInt(z*4+x*2+y, 10)))
+		return bytes.Clone(data)
+	})
+	conn, err := sqlite.OpenConn(input, sqlite.OpenReadWrite)
+	assert.Nil(t, err)
+	assert.Nil(t, sqlitex.ExecuteTransient(conn, "INSERT INTO metadata (name, value) VALUES ('compression', 'brotli')", nil))
+	conn.Close()
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "out.pmtiles")
+	err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, TileCompression: Gzip, MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Nil(t, err)
+
+	header, _, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, Compression(Gzip), header.TileCompression)
+	assert.Equal(t, "tile 7", tiles[ZxyToID(1, 1, 0)])
+}
+
+func writeTestTile(t *testing.T, root string, z int, x int, y int, ext string, data []byte) {
+	dir := filepath.Join(root, strconv.Itoa(z), strconv.Itoa(x))
+	assert.Nil(t, os.MkdirAll(dir, 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, strconv.Itoa(y)+ext), data, 0644))
+}
+
+func TestConvertDirectory(t *testing.T) {
+	input := t.TempDir()
+	writeTestTile(t, input, 0, 0, 0, ".png", []byte{0x1})
+	writeTestTile(t, input, 1, 0, 1, ".png", []byte{0x2})
+	writeTestTile(t, input, 1, 1, 0, ".png", []byte{0x2})
+	os.WriteFile(filepath.Join(input, "metadata.json"), []byte(`{"name":"dir","bounds":[-10,-10,10,10]}`), 0644)
+
+	output := filepath.Join(t.TempDir(), "out.pmtiles")
+	tmpfile, _ := os.CreateTemp(t.TempDir(), "pmtiles")
+	err := Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Nil(t, err)
+
+	var b bytes.Buffer
+	err = Show(logger, &b, "", output, true, false, false, "", false, 0, 0, 0)
+	assert.Nil(t, err)
+	var headerJSON map[string]interface{}
+	json.Unmarshal(b.Bytes(), &headerJSON)
+	assert.Equal(t, "png", headerJSON["tile_type"])
+	assert.Equal(t, "none", headerJSON["tile_compression"])
+	assert.Equal(t, []interface{}{-10.0, -10.0, 10.0, 10.0}, headerJSON["bounds"])
+
+	b.Reset()
+	err = Show(logger, &b, "", output, false, false, false, "", true, 1, 0, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x2}, b.Bytes())
+
+	b.Reset()
+	err = Show(logger, &b, "", output, false, true, false, "", false, 0, 0, 0)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"name":"dir"}`, b.String())
+}
+
+func TestConvertFromDirectoryRoundtrip(t *testing.T) {
+	dir := t.TempDir()
+	extracted := filepath.Join(dir, "tiles")
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{}))
+
+	output := filepath.Join(dir, "out.pmtiles")
+	tmpfile, _ := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, ConvertFromDirectory(logger, extracted, output, true, UnknownTileType, false, tmpfile))
+
+	originalHeader, _, original := readTestArchiveTiles(t, "fixtures/test_fixture_1.pmtiles")
+	header, _, roundtrip := readTestArchiveTiles(t, output)
+	assert.Equal(t, originalHeader.TileType, header.TileType)
+	assert.Equal(t, original, roundtrip)
+}
+
+func TestConvertToDirectoryLazyDirs(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	writeTestArchive(t, input, NoCompression, Png, nil, []testTile{{0, 0, 0, "a"}, {3, 5, 2, "b"}})
+
+	extracted := filepath.Join(dir, "lazy")
+	assert.Nil(t, convertToDirectory(logger, input, extracted, "", ConvertOptions{MinZoom: -1, MaxZoom: -1}))
+	data, err := os.ReadFile(filepath.Join(extracted, "3", "5", "2.png"))
+	assert.Nil(t, err)
+	assert.Equal(t, "b", string(data))
+	columns, err := os.ReadDir(filepath.Join(extracted, "3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(columns))
+
+	extracted = filepath.Join(dir, "precreated")
+	assert.Nil(t, convertToDirectory(logger, input, extracted, "", ConvertOptions{MinZoom: -1, MaxZoom: -1, PrecreateDirs: true}))
+	columns, err = os.ReadDir(filepath.Join(extracted, "3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 8, len(columns))
+}
+
+func TestConvertToDirectoryDecompress(t *testing.T) {
+	_, _, tiles := readTestArchiveTiles(t, "fixtures/test_fixture_1.pmtiles")
+	extracted := filepath.Join(t.TempDir(), "tiles")
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{Decompress: true, Extension: ".pbf"}))
+	for tileID, expected := range tiles {
+		z, x, y := IDToZxy(tileID)
+		data, err := os.ReadFile(filepath.Join(extracted, fmt.Sprint(z), fmt.Sprint(x), fmt.Sprintf("%d.pbf", y)))
+		assert.Nil(t, err)
+		assert.Equal(t, Compression(NoCompression), detectCompression(data))
+		assert.Equal(t, expected, string(data))
+	}
+	data, err := os.ReadFile(filepath.Join(extracted, "tilejson.json"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "{z}/{x}/{y}.pbf")
+}
+
+func TestConvertToDirectoryPathTemplate(t *testing.T) {
+	_, _, tiles := readTestArchiveTiles(t, "fixtures/test_fixture_1.pmtiles")
+	extracted := filepath.Join(t.TempDir(), "tiles")
+	opts := ConvertOptions{PathTemplate: "tiles/{z}-{x}-{y}@2x.{ext}", Scheme: "tms", Decompress: true}
+	assert.Nil(t, normalizeConvertOptions(&opts))
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", opts))
+	for tileID, expected := range tiles {
+		z, x, y := IDToZxy(tileID)
+		data, err := os.ReadFile(filepath.Join(extracted, "tiles", fmt.Sprintf("%d-%d-%d@2x.mvt", z, x, (1<<z)-1-y)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	data, err := os.ReadFile(filepath.Join(extracted, "tilejson.json"))
+	assert.Nil(t, err)
+	var tilejson map[string]interface{}
+	assert.Nil(t, json.Unmarshal(data, &tilejson))
+	assert.Equal(t, []interface{}{"tiles/{z}-{x}-{y}@2x.mvt"}, tilejson["tiles"])
+	assert.Equal(t, "tms", tilejson["scheme"])
+
+	for _, template := range []string{"{z}/{x}.png", "/tiles/{z}/{x}/{y}", "../{z}/{x}/{y}", "{z}/{x}/{y}/"} {
+		opts := ConvertOptions{PathTemplate: template}
+		assert.Error(t, normalizeConvertOptions(&opts), template)
+	}
+}
+
+func TestConvertToDirectoryOverwrite(t *testing.T) {
+	extracted := filepath.Join(t.TempDir(), "tiles")
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{}))
+	tilePath := filepath.Join(extracted, "0", "0", "0.mvt")
+	original, err := os.ReadFile(tilePath)
+	assert.Nil(t, err)
+
+	assert.Nil(t, os.WriteFile(tilePath, []byte("changed"), 0644))
+	err = convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{})
+	assert.ErrorContains(t, err, "already contains tiles")
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{SkipExisting: true, Workers: 2}))
+	data, err := os.ReadFile(tilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, "changed", string(data))
+
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{Overwrite: true}))
+	data, err = os.ReadFile(tilePath)
+	assert.Nil(t, err)
+	assert.Equal(t, original, data)
+
+	// a directory in place of a tile cannot be overwritten
+	assert.Nil(t, os.Remove(tilePath))
+	assert.Nil(t, os.Mkdir(tilePath, 0755))
+	err = convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{Overwrite: true})
+	assert.Error(t, err)
+	err = convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{Overwrite: true, OnWriteError: "skip"})
+	assert.ErrorContains(t, err, "Failed to write 1 tiles")
+}
+
+func TestConvertToDirectoryResume(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	writeTestArchive(t, input, NoCompression, Png, nil, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "bb"}, {1, 1, 1, "cc"}, {2, 3, 1, "d"}})
+	extracted := filepath.Join(dir, "tiles")
+	assert.Nil(t, convertToDirectory(logger, input, extracted, "", ConvertOptions{MinZoom: -1, MaxZoom: -1}))
+
+	// an interrupted extraction leaves missing and partially written tiles
+	assert.Nil(t, os.Truncate(filepath.Join(extracted, "1", "0", "0.png"), 1))
+	assert.Nil(t, os.Remove(filepath.Join(extracted, "2", "3", "1.png")))
+
+	var logs bytes.Buffer
+	assert.Nil(t, convertToDirectory(log.New(&logs, "", 0), input, extracted, "", ConvertOptions{MinZoom: -1, MaxZoom: -1, Resume: true}))
+	assert.Contains(t, logs.String(), "Skipped 2 tiles already extracted, wrote 2")
+	for name, expected := range map[string]string{"0/0/0.png": "a", "1/0/0.png": "bb", "1/1/1.png": "cc", "2/3/1.png": "d"} {
+		data, err := os.ReadFile(filepath.Join(extracted, filepath.FromSlash(name)))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+}
+
+func TestConvertToDirectoryFilter(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	var tiles []testTile
+	for z := uint8(0); z <= 3; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tiles = append(tiles, testTile{z, x, y, "same"})
+			}
+		}
+	}
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{"name": "filter", "minzoom": "0", "maxzoom": "3", "bounds": []interface{}{-180.0, -85.0, 180.0, 85.0}}, tiles)
+
+	var events []progressEvent
+	record := func(phase string, done, total int64) {
+		events = append(events, progressEvent{Phase: phase, Done: done, Total: total})
+	}
+	extracted := filepath.Join(dir, "tiles")
+	// the northeastern quarter of the world, with runs of the same tile crossing its edges
+	opts := ConvertOptions{MinZoom: 2, MaxZoom: 3, Bbox: "1,1,179,84", PrecreateDirs: true, ProgressFunc: record, ProgressFuncInterval: time.Hour}
+	assert.Nil(t, convertToDirectory(logger, input, extracted, "", opts))
+
+	var files []string
+	err := filepath.WalkDir(extracted, func(path string, d fs.DirEntry, err error) error {
+		if strings.HasSuffix(path, ".png") {
+			rel, _ := filepath.Rel(extracted, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return err
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 4+16, len(files))
+	assert.Contains(t, files, "2/2/0.png")
+	assert.Contains(t, files, "3/7/3.png")
+	assert.NotContains(t, files, "2/1/0.png")
+	assert.Equal(t, int64(20), events[len(events)-1].Total)
+
+	columns, err := os.ReadDir(filepath.Join(extracted, "3"))
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(columns))
+	_, err = os.Stat(filepath.Join(extracted, "1"))
+	assert.True(t, os.IsNotExist(err))
+
+	data, err := os.ReadFile(filepath.Join(extracted, "metadata.json"))
+	assert.Nil(t, err)
+	var metadata map[string]interface{}
+	assert.Nil(t, json.Unmarshal(data, &metadata))
+	assert.Equal(t, "2", metadata["minzoom"])
+	// the bbox intersected with the header bounds of the input, which are those of writeTestArchive
+	assert.Equal(t, []interface{}{1.0, 1.0, 10.0, 10.0}, metadata["bounds"])
+}
+
+func TestConvertToDirectoryRemote(t *testing.T) {
+	dir := t.TempDir()
+	tiles := []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}, {1, 0, 1, "c"}, {1, 1, 1, "b"}}
+	sortTestTiles(tiles)
+	writeTestArchive(t, filepath.Join(dir, "in.pmtiles"), NoCompression, Png, map[string]interface{}{"name": "remote"}, tiles)
+	server := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	defer server.Close()
+	input := server.URL + "/in.pmtiles"
+
+	extracted := filepath.Join(t.TempDir(), "tiles")
+	// a one byte window reads every tile with a separate request
+	opts := ConvertOptions{MinZoom: -1, MaxZoom: -1, DownloadThreads: 2, ReadBuffer: 1}
+	assert.Nil(t, Convert(logger, input, extracted, opts, nil))
+	for _, tile := range tiles {
+		data, err := os.ReadFile(filepath.Join(extracted, fmt.Sprintf("%d/%d/%d.png", tile.z, tile.x, tile.y)))
+		assert.Nil(t, err)
+		assert.Equal(t, tile.data, string(data))
+	}
+	data, err := os.ReadFile(filepath.Join(extracted, "metadata.json"))
+	assert.Nil(t, err)
+	assert.Contains(t, string(data), "remote")
+
+	assert.Error(t, Convert(logger, input, filepath.Join(t.TempDir(), "out.pmtiles"), opts, nil))
+}
+
+func TestReadCoalesced(t *testing.T) {
+	data := []byte("headeraabbbccccdd")
+	// the fourth entry refers back to the data of the second, as a deduplicated tile does
+	entries := []EntryV3{{0, 0, 2, 1}, {1, 2, 3, 1}, {2, 5, 4, 1}, {3, 2, 3, 1}, {4, 9, 2, 1}}
+	expected := []string{"aa", "bbb", "cccc", "bbb", "dd"}
+
+	for _, tc := range []struct {
+		window int64
+		reads  int
+	}{{-1, 5}, {5, 4}, {9, 2}, {11, 1}} {
+		r := &countingReaderAt{r: bytes.NewReader(data)}
+		var got []string
+		err := readCoalesced(r, 6, entries, tc.window, 1, func(e EntryV3, tileData []byte) error {
+			got = append(got, string(tileData))
+			return nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, got, tc.window)
+		assert.Equal(t, int64(tc.reads), r.reads.Load(), tc.window)
+	}
+
+	err := readCoalesced(bytes.NewReader(data), 6, entries, 4, 1, func(e EntryV3, tileData []byte) error {
+		return fmt.Errorf("stop")
+	})
+	assert.EqualError(t, err, "stop")
+	err = readCoalesced(bytes.NewReader(data), 6, []EntryV3{{0, 10, 4, 1}}, 4, 1, func(e EntryV3, tileData []byte) error { return nil })
+	assert.Error(t, err)
+}
+
+func benchmarkReadCoalesced(b *testing.B, window int64) {
+	// a clustered tile section of small adjacent tiles
+	file, err := os.Create(filepath.Join(b.TempDir(), "tiles"))
+	assert.Nil(b, err)
+	defer file.Close()
+	entries := make([]EntryV3, 50000)
+	tile := bytes.Repeat([]byte{1}, 2000)
+	for i := range entries {
+		entries[i] = EntryV3{uint64(i), uint64(i * len(tile)), uint32(len(tile)), 1}
+		_, err := file.Write(tile)
+		assert.Nil(b, err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := readCoalesced(file, 0, entries, window, 1, func(e EntryV3, tileData []byte) error { return nil })
+		assert.Nil(b, err)
+	}
+}
+
+func BenchmarkReadPerEntry(b *testing.B) {
+	benchmarkReadCoalesced(b, -1)
+}
+
+func BenchmarkReadCoalesced(b *testing.B) {
+	benchmarkReadCoalesced(b, defaultReadBuffer)
+}
+
+func TestConvertToDirectoryTileJSON(t *testing.T) {
+	extracted := filepath.Join(t.TempDir(), "tiles")
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "", ConvertOptions{}))
+	data, err := os.ReadFile(filepath.Join(extracted, "tilejson.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, validateTileJSON(data))
+	var tilejson map[string]interface{}
+	assert.Nil(t, json.Unmarshal(data, &tilejson))
+	assert.Equal(t, "3.0.0", tilejson["tilejson"])
+	assert.Equal(t, []interface{}{"{z}/{x}/{y}.mvt"}, tilejson["tiles"])
+
+	extracted = filepath.Join(t.TempDir(), "tiles")
+	assert.Nil(t, convertToDirectory(logger, "fixtures/test_fixture_1.pmtiles", extracted, "https://example.com/tiles/", ConvertOptions{}))
+	data, err = os.ReadFile(filepath.Join(extracted, "tilejson.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(data, &tilejson))
+	assert.Equal(t, []interface{}{"https://example.com/tiles/{z}/{x}/{y}.mvt"}, tilejson["tiles"])
+}
+
+func TestConvertFromDirectoryTileTypeOverride(t *testing.T) {
+	input := t.TempDir()
+	writeTestTile(t, input, 0, 0, 0, ".bin", []byte{0x1})
+	writeTestTile(t, input, 1, 0, 0, ".bin", []byte{0x2})
+
+	output := filepath.Join(t.TempDir(), "out.pmtiles")
+	tmpfile, _ := os.CreateTemp(t.TempDir(), "pmtiles")
+	assert.Error(t, ConvertFromDirectory(logger, input, output, true, UnknownTileType, false, tmpfile))
+	assert.Nil(t, ConvertFromDirectory(logger, input, output, true, Webp, true, tmpfile))
+
+	header, _, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, TileType(Webp), header.TileType)
+	assert.Equal(t, "\x02", tiles[ZxyToID(1, 0, 1)])
+}
+
+func TestConvertDirectoryTms(t *testing.T) {
+	input := t.TempDir()
+	writeTestTile(t, input, 1, 0, 0, ".mvt", []byte("tms row 0"))
+
+	output := filepath.Join(t.TempDir(), "out.pmtiles")
+	tmpfile, _ := os.CreateTemp(t.TempDir(), "pmtiles")
+	err := Convert(logger, input, output, ConvertOptions{Deduplicate: true, Scheme: "tms", MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Nil(t, err)
+
+	var b bytes.Buffer
+	err = Show(logger, &b, "", output, false, false, false, "", true, 1, 0, 1)
+	assert.Nil(t, err)
+	tile, err := decompressBytes(b.Bytes(), Gzip)
+	assert.Nil(t, err)
+	assert.Equal(t, "tms row 0", string(tile))
+}
+
+func TestConvertDirectoryMixedExtensions(t *testing.T) {
+	input := t.TempDir()
+	writeTestTile(t, input, 0, 0, 0, ".png", []byte{0x1})
+	writeTestTile(t, input, 1, 0, 0, ".jpg", []byte{0x1})
+
+	tmpfile, _ := os.CreateTemp(t.TempDir(), "pmtiles")
+	err := Convert(logger, input, filepath.Join(t.TempDir(), "out.pmtiles"), ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Error(t, err)
+}
+
+func TestConvertToMbtiles(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "out.mbtiles")
+	err := ConvertToMbtiles(logger, "fixtures/test_fixture_1.pmtiles", output, false)
+	assert.Nil(t, err)
+
+	conn, err := sqlite.OpenConn(output, sqlite.OpenReadOnly)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	stmt := conn.Prep("SELECT count(*) FROM tiles")
+	hasRow, err := stmt.Step()
+	assert.Nil(t, err)
+	assert.True(t, hasRow)
+	assert.Greater(t, stmt.ColumnInt64(0), int64(0))
+	stmt.Reset()
+
+	stmt = conn.Prep("SELECT value FROM metadata WHERE name = 'format'")
+	hasRow, err = stmt.Step()
+	assert.Nil(t, err)
+	assert.True(t, hasRow)
+	assert.Equal(t, "pbf", stmt.ColumnText(0))
+	stmt.Reset()
+
+	assert.Error(t, ConvertToMbtiles(logger, "fixtures/test_fixture_1.pmtiles", output, false))
+}
+
+func TestConvertPmtilesToMbtiles(t *testing.T) {
+	dir := t.TempDir()
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Deduplicate: true, TmpDir: dir})
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.AddTile(0, 0, 0, []byte{0x1}))
+	assert.Nil(t, w.AddTile(1, 0, 0, []byte{0x2}))
+	assert.Nil(t, w.AddTile(1, 0, 1, []byte{0x2}))
+	_, err = w.Finalize(HeaderV3{TileType: Png}, map[string]interface{}{"name": "runs"})
+	assert.Nil(t, err)
+
+	input := filepath.Join(dir, "in.pmtiles")
+	assert.Nil(t, os.WriteFile(input, b.Bytes(), 0666))
+	output := filepath.Join(dir, "out.mbtiles")
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{}, nil))
+
+	conn, err := sqlite.OpenConn(output, sqlite.OpenReadOnly)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	tiles := make(map[string][]byte)
+	err = sqlitex.Execute(conn, "SELECT zoom_level, tile_column, tile_row, tile_data FROM tiles", &sqlitex.ExecOptions{
+		ResultFunc: func(stmt *sqlite.Stmt) error {
+			data := make([]byte, stmt.ColumnLen(3))
+			stmt.ColumnBytes(3, data)
+			tiles[fmt.Sprintf("%d/%d/%d", stmt.ColumnInt64(0), stmt.ColumnInt64(1), stmt.ColumnInt64(2))] = data
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	// rows are numbered from the bottom in MBTiles
+	assert.Equal(t, map[string][]byte{"0/0/0": {0x1}, "1/0/1": {0x2}, "1/0/0": {0x2}}, tiles)
+
+	stmt := conn.Prep("SELECT value FROM metadata WHERE name = 'name'")
+	hasRow, err := stmt.Step()
+	assert.Nil(t, err)
+	assert.True(t, hasRow)
+	assert.Equal(t, "runs", stmt.ColumnText(0))
+	stmt.Reset()
+}
+
+func writeTestMbtiles(t testing.TB, path string, maxZoom int64, tileData func(z, x, y int64) []byte) {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadWrite|sqlite.OpenCreate)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	err = sqlitex.ExecuteScript(conn, `
+		CREATE TABLE metadata (name TEXT, value TEXT);
+		CREATE TABLE tiles (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE UNIQUE INDEX tile_index ON tiles (zoom_level, tile_column, tile_row);
+		INSERT INTO metadata (name, value) VALUES ('format', 'pbf'), ('bounds', '-180,-85,180,85'), ('minzoom', '0');
+	`, nil)
+	assert.Nil(t, err)
+	err = sqlitex.Execute(conn, "INSERT INTO metadata (name, value) VALUES ('maxzoom', ?)", &sqlitex.ExecOptions{Args: []interface{}{strconv.FormatInt(maxZoom, 10)}})
+	assert.Nil(t, err)
+
+	// a single transaction instead of a sync per tile
+	assert.Nil(t, sqlitex.ExecuteTransient(conn, "BEGIN", nil))
+	stmt := conn.Prep("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)")
+	for z := int64(0); z <= maxZoom; z++ {
+		for x := int64(0); x < 1<<z; x++ {
+			for y := int64(0); y < 1<<z; y++ {
+				stmt.BindInt64(1, z)
+				stmt.BindInt64(2, x)
+				stmt.BindInt64(3, y)
+				stmt.BindBytes(4, tileData(z, x, y))
+				_, err := stmt.Step()
+				assert.Nil(t, err)
+				stmt.Reset()
+			}
+		}
+	}
+	assert.Nil(t, sqlitex.ExecuteTransient(conn, "COMMIT", nil))
+}
+
+func TestConvertMbtilesWorkers(t *testing.T) {
+	// the parallel path is skipped when GOMAXPROCS is 1
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 3, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x+y)%3, 10))
+	})
+
+	var outputs [][]byte
+	for _, workers := range []int{1, 4} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out"+strconv.Itoa(workers)+".pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, Workers: workers}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		archive, err := os.ReadFile(output)
+		assert.Nil(t, err)
+		outputs = append(outputs, archive)
+	}
+	assert.Equal(t, outputs[0], outputs[1])
+
+	header, err := DeserializeHeader(outputs[1][0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(85), header.AddressedTilesCount)
+	assert.Equal(t, uint64(3), header.TileContentsCount)
+	assert.Equal(t, Compression(Gzip), header.TileCompression)
+}
+
+func TestConvertMbtilesStream(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 4, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x*y)%5, 10))
+	})
+
+	var outputs [][]byte
+	for i, opts := range []ConvertOptions{
+		{},
+		{Stream: true},
+		// spills every few tiles, merging many sorted runs
+		{Stream: true, StreamMemory: 256, Workers: 4},
+	} {
+		opts.Deduplicate = true
+		opts.MinZoom, opts.MaxZoom = 1, 3
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out"+strconv.Itoa(i)+".pmtiles")
+		err = Convert(logger, input, output, opts, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		archive, err := os.ReadFile(output)
+		assert.Nil(t, err)
+		outputs = append(outputs, archive)
+	}
+	assert.Equal(t, outputs[0], outputs[1])
+	assert.Equal(t, outputs[0], outputs[2])
+
+	header, err := DeserializeHeader(outputs[2][0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(84), header.AddressedTilesCount)
+	assert.Equal(t, uint8(1), header.MinZoom)
+	assert.Equal(t, uint8(3), header.MaxZoom)
+
+	// only the tmpfiles are left behind
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	for _, f := range files {
+		assert.NotContains(t, f.Name(), "pmtiles-sort")
+	}
+}
+
+func TestConvertMbtilesWorkersWal(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 3, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt(x*y, 10))
+	})
+	conn, err := sqlite.OpenConn(input, sqlite.OpenReadWrite)
+	assert.Nil(t, err)
+	assert.Nil(t, sqlitex.ExecuteTransient(conn, "PRAGMA journal_mode = WAL", nil))
+	assert.Nil(t, conn.Close())
+
+	var outputs [][]byte
+	for _, workers := range []int{1, 8} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out"+strconv.Itoa(workers)+".pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, Workers: workers}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		archive, err := os.ReadFile(output)
+		assert.Nil(t, err)
+		outputs = append(outputs, archive)
+	}
+	assert.Equal(t, outputs[0], outputs[1])
+}
+
+func TestConvertNoTmpfile(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	// enough distinct tiles for leaf directories
+	writeTestMbtiles(t, input, 7, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt(x*y%1000, 10))
+	})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	buffered := filepath.Join(dir, "buffered.pmtiles")
+	assert.Nil(t, Convert(logger, input, buffered, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile))
+	streamed := filepath.Join(dir, "streamed.pmtiles")
+	assert.Nil(t, Convert(logger, input, streamed, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, NoTmpfile: true}, nil))
+	assert.Nil(t, Verify(logger, streamed))
+
+	bufferedBytes, err := os.ReadFile(buffered)
+	assert.Nil(t, err)
+	streamedBytes, err := os.ReadFile(streamed)
+	assert.Nil(t, err)
+	bufferedHeader, err := DeserializeHeader(bufferedBytes[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	streamedHeader, err := DeserializeHeader(streamedBytes[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(16384), streamedHeader.MetadataOffset)
+	assert.Greater(t, streamedHeader.LeafDirectoryLength, uint64(0))
+	assert.Equal(t,
+		bufferedBytes[bufferedHeader.TileDataOffset:bufferedHeader.TileDataOffset+bufferedHeader.TileDataLength],
+		streamedBytes[streamedHeader.TileDataOffset:streamedHeader.TileDataOffset+streamedHeader.TileDataLength])
+
+	_, bufferedMetadata, bufferedTiles := readTestArchiveTiles(t, buffered)
+	_, streamedMetadata, streamedTiles := readTestArchiveTiles(t, streamed)
+	assert.Equal(t, bufferedMetadata, streamedMetadata)
+	assert.Equal(t, bufferedTiles, streamedTiles)
+}
+
+func TestConvertExistingOutput(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 1, func(z, x, y int64) []byte {
+		return []byte("tile")
+	})
+	output := filepath.Join(dir, "out.pmtiles")
+	assert.Nil(t, os.WriteFile(output, []byte("existing"), 0666))
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Error(t, err)
+	existing, err := os.ReadFile(output)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("existing"), existing)
+
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Force: true}, tmpfile))
+	assert.Nil(t, Verify(logger, output))
+	leftover, err := filepath.Glob(output + ".*.tmp")
+	assert.Nil(t, err)
+	assert.Empty(t, leftover)
+}
+
+func TestConvertStdout(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x+y)%3, 10))
+	})
+	output := filepath.Join(dir, "out.pmtiles")
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile))
+	expected, err := os.ReadFile(output)
+	assert.Nil(t, err)
+
+	// a pipe is not seekable, like stdout piped into another command
+	r, w, err := os.Pipe()
+	assert.Nil(t, err)
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	var piped bytes.Buffer
+	done := make(chan struct{})
+	go func() {
+		piped.ReadFrom(r)
+		close(done)
+	}()
+
+	tmpfile2, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile2.Close()
+	err = Convert(logger, input, "-", ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile2)
+	os.Stdout = stdout
+	w.Close()
+	<-done
+	assert.Nil(t, err)
+	assert.Equal(t, expected, piped.Bytes())
+
+	err = Convert(logger, input, "-", ConvertOptions{NoTmpfile: true, MinZoom: -1, MaxZoom: -1}, nil)
+	assert.Error(t, err)
+}
+
+// memFile is an in-memory io.ReadWriteSeeker.
+type memFile struct {
+	data []byte
+	pos  int
+}
+
+func (m *memFile) Read(p []byte) (int, error) {
+	if m.pos >= len(m.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.pos:])
+	m.pos += n
+	return n, nil
+}
+
+func (m *memFile) Write(p []byte) (int, error) {
+	if end := m.pos + len(p); end > len(m.data) {
+		m.data = append(m.data, make([]byte, end-len(m.data))...)
+	}
+	n := copy(m.data[m.pos:], p)
+	m.pos += n
+	return n, nil
+}
+
+func (m *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += int64(m.pos)
+	case io.SeekEnd:
+		offset += int64(len(m.data))
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position")
+	}
+	m.pos = int(offset)
+	return offset, nil
+}
+
+func TestConvertToWriter(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x+y)%3, 10))
+	})
+	output := filepath.Join(dir, "out.pmtiles")
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile))
+	expected, err := os.ReadFile(output)
+	assert.Nil(t, err)
+
+	for _, dedupIndex := range []string{"memory", "disk"} {
+		var b bytes.Buffer
+		err = ConvertToWriter(logger, input, &b, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, DedupIndex: dedupIndex}, &memFile{})
+		assert.Nil(t, err)
+		assert.Equal(t, expected, b.Bytes())
+
+		archive, err := NewArchive(bytes.NewReader(b.Bytes()))
+		assert.Nil(t, err)
+		data, err := archive.Extract(2, 1, 3, true)
+		assert.Nil(t, err)
+		assert.Equal(t, []byte("tile 1"), data)
+		archive.Close()
+	}
+
+	assert.Error(t, ConvertToWriter(logger, input, io.Discard, ConvertOptions{MinZoom: -1, MaxZoom: -1}, nil))
+	assert.Error(t, ConvertToWriter(logger, input, io.Discard, ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true}, &memFile{}))
+}
+
+func TestParseMetadataOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metadata.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`{"name": "from json", "attribution": "OSM", "maxzoom": 3}`), 0666))
+	overrides, err := ParseMetadataOverrides(path, []string{"name=from flag", "description=a=b"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"name": "from flag", "attribution": "OSM", "maxzoom": 3.0, "description": "a=b"}, overrides)
+
+	_, err = ParseMetadataOverrides("", []string{"name"})
+	assert.Error(t, err)
+	assert.Nil(t, os.WriteFile(path, []byte(`{"name": `), 0666))
+	_, err = ParseMetadataOverrides(path, nil)
+	assert.Error(t, err)
+}
+
+func TestConvertMetadataOverrides(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 3, func(z, x, y int64) []byte {
+		return []byte("tile")
+	})
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "out.pmtiles")
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Metadata: map[string]interface{}{
+		"name":    "renamed",
+		"bounds":  []interface{}{-10.0, -20.0, 10.0, 20.0},
+		"center":  "1,2,1",
+		"maxzoom": "2",
+	}}, tmpfile)
+	assert.Nil(t, err)
+
+	header, metadata, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, "renamed", metadata["name"])
+	assert.Equal(t, "2", metadata["maxzoom"])
+	assert.Equal(t, int32(-10*10000000), header.MinLonE7)
+	assert.Equal(t, int32(20*10000000), header.MaxLatE7)
+	assert.Equal(t, int32(1*10000000), header.CenterLonE7)
+	assert.Equal(t, uint8(1), header.CenterZoom)
+	assert.Equal(t, uint8(2), header.MaxZoom)
+	assert.Equal(t, 21, len(tiles))
+
+	for _, metadata := range []map[string]interface{}{
+		{"bounds": "1,2,3"},
+		{"center": []interface{}{"a", 2.0, 3.0}},
+		{"minzoom": "low"},
+		{"maxzoom": 40.0},
+	} {
+		err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Force: true, Metadata: metadata}, tmpfile)
+		assert.Error(t, err, metadata)
+	}
+}
+
+func TestFinalizeWriteError(t *testing.T) {
+	dir := t.TempDir()
+	resolve := newResolver(false, NoCompression)
+	_, _, err := resolve.AddTileIsNew(0, []byte{0x1, 0x2}, 1)
+	assert.Nil(t, err)
+
+	// the tile data cannot be read back from a write-only tmpfile, failing mid-copy
+	tmpfile, err := os.OpenFile(filepath.Join(dir, "tmp"), os.O_WRONLY|os.O_CREATE, 0666)
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	_, err = tmpfile.Write([]byte{0x1, 0x2})
+	assert.Nil(t, err)
+
+	output := filepath.Join(dir, "out.pmtiles")
+	_, err = finalize(logger, resolve, HeaderV3{TileType: Png}, tmpfile, output, map[string]interface{}{})
+	assert.Error(t, err)
+	_, err = os.Stat(output)
+	assert.True(t, os.IsNotExist(err))
+	leftover, err := filepath.Glob(output + ".*.tmp")
+	assert.Nil(t, err)
+	assert.Empty(t, leftover)
+}
+
+func TestFinalizeWriter(t *testing.T) {
+	dir := t.TempDir()
+	var archives [][]byte
+	for i := 0; i < 2; i++ {
+		resolve := newResolver(true, NoCompression)
+		tmpfile, err := os.CreateTemp(dir, "tmp")
+		assert.Nil(t, err)
+		for id, data := range []string{"a", "b", "a"} {
+			isNew, newData, err := resolve.AddTileIsNew(uint64(id), []byte(data), 1)
+			assert.Nil(t, err)
+			if isNew {
+				_, err = tmpfile.Write(newData)
+				assert.Nil(t, err)
+			}
+		}
+		header := HeaderV3{TileType: Png, InternalCompression: Gzip}
+		metadata := map[string]interface{}{"name": "test"}
+		if i == 0 {
+			output := filepath.Join(dir, "out.pmtiles")
+			_, err = finalize(logger, resolve, header, tmpfile, output, metadata)
+			assert.Nil(t, err)
+			archive, err := os.ReadFile(output)
+			assert.Nil(t, err)
+			archives = append(archives, archive)
+		} else {
+			var b bytes.Buffer
+			header, err = finalizeWriter(logger, resolve, header, tmpfile, &b, metadata)
+			assert.Nil(t, err)
+			assert.Equal(t, uint64(3), header.AddressedTilesCount)
+			archives = append(archives, b.Bytes())
+		}
+		tmpfile.Close()
+	}
+	assert.Equal(t, archives[0], archives[1])
+}
+
+func TestConvertMbtilesGrids(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		var logs bytes.Buffer
+		output := filepath.Join(t.TempDir(), "out.pmtiles")
+		err := Convert(log.New(&logs, "", 0), "fixtures/grids.mbtiles", output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, Workers: workers, NoTmpfile: true}, nil)
+		assert.Nil(t, err)
+		assert.Contains(t, logs.String(), "UTFGrid interaction data in grid_data, grids cannot be represented")
+
+		header, _, tiles := readTestArchiveTiles(t, output)
+		assert.Equal(t, TileType(Png), header.TileType)
+		assert.Equal(t, 4, len(tiles))
+		assert.Equal(t, uint64(3), header.TileContentsCount)
+		assert.Equal(t, string(testPngTile)+"a", tiles[ZxyToID(1, 0, 1)])
+		_, ok := tiles[ZxyToID(1, 1, 0)]
+		assert.False(t, ok)
+	}
+}
+
+func TestConvertMbtilesSplitSchemaGridRows(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	conn, err := sqlite.OpenConn(input, sqlite.OpenReadWrite|sqlite.OpenCreate)
+	assert.Nil(t, err)
+	err = sqlitex.ExecuteScript(conn, `
+		CREATE TABLE metadata (name TEXT, value TEXT);
+		CREATE TABLE map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id TEXT, grid_id TEXT);
+		CREATE TABLE images (tile_data BLOB, tile_id TEXT);
+		CREATE TABLE grid_utfgrid (grid_id TEXT, grid_utfgrid BLOB);
+		INSERT INTO metadata (name, value) VALUES ('format', 'pbf'), ('minzoom', '0'), ('maxzoom', '1');
+		INSERT INTO images (tile_data, tile_id) VALUES ('land', 'a');
+		INSERT INTO grid_utfgrid (grid_id, grid_utfgrid) VALUES ('g', 'grid');
+		INSERT INTO map VALUES (0, 0, 0, 'a', NULL), (1, 0, 0, NULL, 'g'), (1, 1, 0, 'a', 'g');
+	`, nil)
+	assert.Nil(t, err)
+	conn.Close()
+
+	output := filepath.Join(dir, "out.pmtiles")
+	err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, NoTmpfile: true}, nil)
+	assert.Nil(t, err)
+	_, _, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, map[uint64]string{ZxyToID(0, 0, 0): "land", ZxyToID(1, 1, 1): "land"}, tiles)
+}
+
+func TestConvertMbtilesSplitSchema(t *testing.T) {
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	conn, err := sqlite.OpenConn(input, sqlite.OpenReadWrite|sqlite.OpenCreate)
+	assert.Nil(t, err)
+	err = sqlitex.ExecuteScript(conn, `
+		CREATE TABLE metadata (name TEXT, value TEXT);
+		CREATE TABLE map (zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_id TEXT);
+		CREATE UNIQUE INDEX map_index ON map (zoom_level, tile_column, tile_row);
+		CREATE TABLE images (tile_data BLOB, tile_id TEXT);
+		CREATE UNIQUE INDEX images_id ON images (tile_id);
+		CREATE VIEW tiles AS SELECT map.zoom_level AS zoom_level, map.tile_column AS tile_column, map.tile_row AS tile_row, images.tile_data AS tile_data FROM map JOIN images ON images.tile_id = map.tile_id;
+		INSERT INTO metadata (name, value) VALUES ('format', 'pbf'), ('bounds', '-180,-85,180,85'), ('minzoom', '0'), ('maxzoom', '2');
+		INSERT INTO images (tile_data, tile_id) VALUES ('land', 'a'), ('water', 'b');
+	`, nil)
+	assert.Nil(t, err)
+	for z := int64(0); z <= 2; z++ {
+		for x := int64(0); x < 1<<z; x++ {
+			for y := int64(0); y < 1<<z; y++ {
+				key := "a"
+				if (x+y)%2 == 1 {
+					key = "b"
+				}
+				err = sqlitex.Execute(conn, "INSERT INTO map (zoom_level, tile_column, tile_row, tile_id) VALUES (?, ?, ?, ?)", &sqlitex.ExecOptions{Args: []interface{}{z, x, y, key}})
+				assert.Nil(t, err)
+			}
+		}
+	}
+	conn.Close()
+
+	for _, workers := range []int{1, 4} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out"+strconv.Itoa(workers)+".pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, Workers: workers}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		header, _, tiles := readTestArchiveTiles(t, output)
+		assert.Equal(t, uint64(21), header.AddressedTilesCount)
+		assert.Equal(t, uint64(2), header.TileContentsCount)
+		assert.Equal(t, "land", tiles[ZxyToID(0, 0, 0)])
+		assert.Equal(t, "water", tiles[ZxyToID(1, 0, 0)])
+		assert.Equal(t, "land", tiles[ZxyToID(2, 1, 0)])
+		assert.Equal(t, "water", tiles[ZxyToID(2, 1, 1)])
+	}
+}
+
+func TestConvertMbtilesZoomRange(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 3, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x+y)%3, 10))
+	})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "out.pmtiles")
+	err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: 1, MaxZoom: 2}, tmpfile)
+	assert.Nil(t, err)
+
+	header, metadata, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, uint8(1), header.MinZoom)
+	assert.Equal(t, uint8(2), header.MaxZoom)
+	assert.Equal(t, uint64(20), header.AddressedTilesCount)
+	assert.Equal(t, "1", metadata["minzoom"])
+	assert.Equal(t, "2", metadata["maxzoom"])
+	_, ok := tiles[ZxyToID(0, 0, 0)]
+	assert.False(t, ok)
+	_, ok = tiles[ZxyToID(3, 0, 0)]
+	assert.False(t, ok)
+}
+
+func TestConvertZoomRangeEmpty(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 3, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x+y)%3, 10))
+	})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{Deduplicate: true, MinZoom: 5, MaxZoom: 8}, tmpfile)
+	assert.Error(t, err)
+	err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{Deduplicate: true, MinZoom: 3, MaxZoom: 1}, tmpfile)
+	assert.Error(t, err)
+}
+
+func benchmarkConvertMbtiles(b *testing.B, workers int) {
+	dir := b.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(b, input, 6, func(z, x, y int64) []byte {
+		// unique, compressible tiles of a few kilobytes
+		var buf bytes.Buffer
+		for i := int64(0); i < 1000; i++ {
+			buf.WriteString(strconv.FormatInt((z*31+x*17+y*13+i*i)%997, 10))
+		}
+		return buf.Bytes()
+	})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(b, err)
+		err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, Workers: workers, NoTmpfile: true, Force: true}, tmpfile)
+		assert.Nil(b, err)
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+	}
+}
+
+func BenchmarkConvertMbtilesSequential(b *testing.B) {
+	benchmarkConvertMbtiles(b, 1)
+}
+
+func BenchmarkConvertMbtilesParallel(b *testing.B) {
+	benchmarkConvertMbtiles(b, 0)
+}
+
+func TestConvertMbtilesTileCompression(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 1, func(z, x, y int64) []byte {
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		w.Write([]byte("tile " + strconv.FormatInt(z*4+x*2+y, 10)))
+		w.Close()
+		return b.Bytes()
+	})
+
+	for _, tileCompression := range []Compression{NoCompression, Zstd, Brotli} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out.pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, TileCompression: tileCompression, MinZoom: -1, MaxZoom: -1, Force: true}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+		assert.Nil(t, Verify(logger, output))
+
+		header, _, tiles := readTestArchiveTiles(t, output)
+		assert.Equal(t, Compression(Gzip), header.InternalCompression)
+		assert.Equal(t, tileCompression, header.TileCompression)
+		// MBTiles rows are flipped, so 1/1/0 is stored at row 1
+		assert.Equal(t, "tile 7", tiles[ZxyToID(1, 1, 0)])
+		os.Remove(output)
+	}
+}
+
+func TestConvertMbtilesCompressionLevel(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		var b bytes.Buffer
+		for i := int64(0); i < 500; i++ {
+			b.WriteString(strconv.FormatInt((z*31+x*17+y*13+i*i)%97, 10))
+		}
+		return b.Bytes()
+	})
+
+	sizes := make(map[int]uint64)
+	for _, level := range []int{1, 9} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out"+strconv.Itoa(level)+".pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, CompressionLevel: level, MinZoom: -1, MaxZoom: -1}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		header, _, tiles := readTestArchiveTiles(t, output)
+		assert.Equal(t, 21, len(tiles))
+		sizes[level] = header.TileDataLength
+	}
+	assert.NotEqual(t, sizes[1], sizes[9])
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{CompressionLevel: 10, MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Error(t, err)
+}
+
+func TestResolverNoRecompress(t *testing.T) {
+	resolver, err := newConvertResolver(ConvertOptions{TileCompression: Zstd, NoRecompress: true}, HeaderV3{TileType: Mvt}, t.TempDir())
+	assert.Nil(t, err)
+	_, data, _ := resolver.AddTileIsNew(1, []byte{0x1, 0x2}, 1)
+	assert.Equal(t, []byte{0x1, 0x2}, data)
+}
+
+func TestConvertMbtilesRecompress(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	// identical contents compressed at different levels
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		var b bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&b, int(1+(x+y)%9))
+		w.Write(bytes.Repeat([]byte("same tile contents "), 20))
+		w.Close()
+		return b.Bytes()
+	})
+
+	contents := make(map[bool]uint64)
+	for _, recompress := range []bool{false, true} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, "out.pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, Recompress: recompress, MinZoom: -1, MaxZoom: -1, Force: true}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		header, _, tiles := readTestArchiveTiles(t, output)
+		assert.Equal(t, strings.Repeat("same tile contents ", 20), tiles[ZxyToID(2, 1, 1)])
+		contents[recompress] = header.TileContentsCount
+		os.Remove(output)
+	}
+	assert.Greater(t, contents[false], uint64(1))
+	assert.Equal(t, uint64(1), contents[true])
+}
+
+func TestConvertMbtilesRecompressCorrupt(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 0, func(z, x, y int64) []byte {
+		return []byte{0x1f, 0x8b, 0x0, 0x0}
+	})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{Recompress: true, MinZoom: -1, MaxZoom: -1}, tmpfile)
+	assert.Error(t, err)
+}
+
+var (
+	testPngTile  = []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 0x0, 0x0, 0x0, 0x0d}
+	testJpegTile = []byte{0xff, 0xd8, 0xff, 0xe0, 0x0, 0x10, 'J', 'F', 'I', 'F'}
+	testWebpTile = []byte("RIFF\x1a\x00\x00\x00WEBPVP8 ")
+	testAvifTile = []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00")
+)
+
+func testGzipTile() []byte {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	w.Write([]byte("tile"))
+	w.Close()
+	return b.Bytes()
+}
+
+func testZlibTile() []byte {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	w.Write([]byte("tile"))
+	w.Close()
+	return b.Bytes()
+}
+
+func TestSniffTileType(t *testing.T) {
+	for _, c := range []struct {
+		data        []byte
+		tileType    TileType
+		compression Compression
+	}{
+		{testPngTile, Png, NoCompression},
+		{testJpegTile, Jpeg, NoCompression},
+		{testWebpTile, Webp, NoCompression},
+		{testAvifTile, Avif, NoCompression},
+		{testGzipTile(), Mvt, Gzip},
+		{testZlibTile(), Mvt, UnknownCompression},
+		{[]byte("tile"), UnknownTileType, NoCompression},
+		{nil, UnknownTileType, NoCompression},
+	} {
+		tileType, compression := sniffTileType(c.data)
+		assert.Equal(t, c.tileType, tileType, c.data)
+		assert.Equal(t, c.compression, compression, c.data)
+	}
+}
+
+func TestConvertMbtilesMismatchedFormat(t *testing.T) {
+	for _, c := range []struct {
+		format   string
+		data     []byte
+		tileType TileType
+	}{
+		{"png", testJpegTile, Jpeg},
+		{"png", testWebpTile, Webp},
+		{"png", testGzipTile(), Mvt},
+		{"jpg", testPngTile, Png},
+		{"webp", testAvifTile, Avif},
+		{"avif", testPngTile, Png},
+		{"pbf", testPngTile, Png},
+		{"pbf", testJpegTile, Jpeg},
+	} {
+		dir := t.TempDir()
+		input := filepath.Join(dir, "in.mbtiles")
+		writeTestMbtiles(t, input, 1, func(z, x, y int64) []byte {
+			return c.data
+		})
+		conn, err := sqlite.OpenConn(input, sqlite.OpenReadWrite)
+		assert.Nil(t, err)
+		assert.Nil(t, sqlitex.Execute(conn, "UPDATE metadata SET value = ? WHERE name = 'format'", &sqlitex.ExecOptions{Args: []interface{}{c.format}}))
+		assert.Nil(t, conn.Close())
+
+		output := filepath.Join(dir, "out.pmtiles")
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1}, tmpfile)
+		assert.ErrorContains(t, err, "but the metadata format is "+c.format)
+
+		err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Force: true, TrustTileData: true}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+		header, metadata, _ := readTestArchiveTiles(t, output)
+		assert.Equal(t, c.tileType, header.TileType, c.format)
+		if c.tileType == Mvt {
+			assert.Equal(t, "pbf", metadata["format"])
+			assert.Equal(t, Compression(Gzip), header.TileCompression)
+		} else {
+			assert.Equal(t, tileTypeToString(c.tileType), metadata["format"])
+			assert.Equal(t, Compression(NoCompression), header.TileCompression)
+		}
+	}
+}
+
+func TestConvertMbtilesPbfTileData(t *testing.T) {
+	for _, data := range [][]byte{testZlibTile(), []byte("tile")} {
+		dir := t.TempDir()
+		input := filepath.Join(dir, "in.mbtiles")
+		writeTestMbtiles(t, input, 1, func(z, x, y int64) []byte {
+			return data
+		})
+		var logs bytes.Buffer
+		output := filepath.Join(dir, "out.pmtiles")
+		err := Convert(log.New(&logs, "", 0), input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true}, nil)
+		assert.Nil(t, err)
+		header, _, _ := readTestArchiveTiles(t, output)
+		assert.Equal(t, TileType(Mvt), header.TileType)
+		assert.Equal(t, data[0] != 0x78, strings.Contains(logs.String(), "not a valid protocol buffer"))
+	}
+}
+
+func TestConvertOnTileError(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		if z == 2 && x == 1 {
+			// gzip magic bytes without a valid stream
+			return []byte{0x1f, 0x8b, 0x0, 0x0}
+		}
+		return testGzipTile()
+	})
+
+	for _, workers := range []int{1, 4} {
+		output := filepath.Join(dir, "out.pmtiles")
+		opts := ConvertOptions{MinZoom: -1, MaxZoom: -1, Recompress: true, Workers: workers, NoTmpfile: true, Force: true}
+		err := Convert(logger, input, output, opts, nil)
+		assert.ErrorContains(t, err, "Failed to read tile 2/1/")
+
+		opts.OnTileError = "skip"
+		assert.Nil(t, Convert(logger, input, output, opts, nil))
+		header, _, tiles := readTestArchiveTiles(t, output)
+		assert.Equal(t, 17, len(tiles))
+		assert.Equal(t, uint64(17), header.AddressedTilesCount)
+
+		opts.OnTileError = "log"
+		assert.Nil(t, Convert(logger, input, output, opts, nil))
+		logged, err := os.ReadFile(filepath.Join(dir, "errors.jsonl"))
+		assert.Nil(t, err)
+		lines := strings.Split(strings.TrimSpace(string(logged)), "\n")
+		assert.Equal(t, 4, len(lines))
+		var record map[string]interface{}
+		assert.Nil(t, json.Unmarshal([]byte(lines[0]), &record))
+		assert.Equal(t, 2.0, record["z"])
+		assert.Equal(t, 1.0, record["x"])
+		assert.Contains(t, record["error"], "decompress")
+	}
+
+	assert.Error(t, Convert(logger, input, filepath.Join(dir, "other.pmtiles"), ConvertOptions{OnTileError: "ignore"}, nil))
+}
+
+func TestFileTileReaderTruncated(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tiles")
+	assert.Nil(t, os.WriteFile(path, []byte{1, 2, 3, 4}, 0666))
+	f, err := os.Open(path)
+	assert.Nil(t, err)
+	defer f.Close()
+
+	data, err := fileTileReader{f}.ReadTile(EntryV3{Offset: 2, Length: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{3, 4}, data)
+	_, err = fileTileReader{f}.ReadTile(EntryV3{Offset: 2, Length: 4})
+	assert.Error(t, err)
+	_, err = fileTileReader{f}.ReadTile(EntryV3{Offset: 10, Length: 1})
+	assert.Error(t, err)
+}
+
+func TestConvertWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte { return testGzipTile() })
+
+	output := filepath.Join(dir, "out.pmtiles")
+	result, err := ConvertWithOptions(context.Background(), ConvertOptions{Input: input, Output: output, MinZoom: -1, MaxZoom: -1, TmpDir: dir})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(21), result.Header.AddressedTilesCount)
+	assert.Greater(t, result.Elapsed, time.Duration(0))
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries), "the tmpfile is removed")
+
+	var b bytes.Buffer
+	result, err = ConvertWithOptions(context.Background(), ConvertOptions{Input: input, OutputWriter: &b, MinZoom: -1, MaxZoom: -1, Bbox: "0,0,180,85"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(6), result.Header.AddressedTilesCount)
+	assert.Equal(t, int32(0), result.Header.MinLonE7)
+	assert.Equal(t, int32(850000000), result.Header.MaxLatE7)
+	header, err := DeserializeHeader(b.Bytes()[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, result.Header.RootLength, header.RootLength)
+
+	_, err = ConvertWithOptions(context.Background(), ConvertOptions{Input: input, Output: output, Force: true, Bbox: "10,10,0,0"})
+	assert.ErrorContains(t, err, "no area")
+	_, err = ConvertWithOptions(context.Background(), ConvertOptions{Input: input})
+	assert.Error(t, err)
+}
+
+func TestConvertWithOptionsCancel(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte { return testGzipTile() })
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, noTmpfile := range []bool{false, true} {
+		output := filepath.Join(dir, "out.pmtiles")
+		_, err := ConvertWithOptions(ctx, ConvertOptions{Input: input, Output: output, MinZoom: -1, MaxZoom: -1, NoTmpfile: noTmpfile, TmpDir: dir})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.NoFileExists(t, output)
+	}
+
+	archive := filepath.Join(dir, "archive.pmtiles")
+	_, err := ConvertWithOptions(context.Background(), ConvertOptions{Input: input, Output: archive, MinZoom: -1, MaxZoom: -1, NoTmpfile: true})
+	assert.Nil(t, err)
+	output := filepath.Join(dir, "out.mbtiles")
+	_, err = ConvertWithOptions(ctx, ConvertOptions{Input: archive, Output: output, NoTmpfile: true})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.NoFileExists(t, output)
+
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(entries))
+}
+
+func TestBboxFilter(t *testing.T) {
+	f, err := parseBboxFilter("0,0,180,85")
+	assert.Nil(t, err)
+	assert.True(t, f.contains(ZxyToID(0, 0, 0)))
+	assert.True(t, f.contains(ZxyToID(1, 1, 0)))
+	assert.False(t, f.contains(ZxyToID(1, 0, 0)))
+	assert.False(t, f.contains(ZxyToID(1, 1, 1)))
+
+	header := HeaderV3{MinLonE7: -1800000000, MinLatE7: -850000000, MaxLonE7: 1800000000, MaxLatE7: 850000000, CenterLonE7: -100000000, CenterLatE7: -100000000}
+	f.apply(&header)
+	assert.Equal(t, HeaderV3{MaxLonE7: 1800000000, MaxLatE7: 850000000, CenterLonE7: 900000000, CenterLatE7: 425000000}, header)
+
+	_, err = parseBboxFilter("0,0,180")
+	assert.Error(t, err)
+}
+
+func TestConvertDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 3, func(z, x, y int64) []byte {
+		return testMvtTile(testMvtLayer(fmt.Sprintf("layer%d", (x+y)%5), nil, nil))
+	})
+
+	for _, input := range []string{input, "fixtures/grids.mbtiles"} {
+		var sums [][32]byte
+		for _, workers := range []int{1, 4} {
+			output := filepath.Join(dir, fmt.Sprintf("out%d.pmtiles", workers))
+			err := Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Deduplicate: true, Workers: workers, NoTmpfile: true, Force: true}, nil)
+			assert.Nil(t, err)
+			data, err := os.ReadFile(output)
+			assert.Nil(t, err)
+			sums = append(sums, sha256.Sum256(data))
+		}
+		assert.Equal(t, sums[0], sums[1])
+	}
+}
+
+func TestParseBoundsString(t *testing.T) {
+	minLon, minLat, maxLon, maxLat, err := ParseBoundsString("-180, -85.05,180,85.05")
+	assert.Nil(t, err)
+	assert.Equal(t, []float64{-180, -85.05, 180, 85.05}, []float64{minLon, minLat, maxLon, maxLat})
+	assert.Equal(t, "-180,-85.05,180,85.05", FormatBoundsString(minLon, minLat, maxLon, maxLat))
+	_, _, _, _, err = ParseBoundsString("1,2,3")
+	assert.Error(t, err)
+
+	lon, lat, zoom, err := ParseCenterString("-122.4, 37.8, 12")
+	assert.Nil(t, err)
+	assert.Equal(t, -122.4, lon)
+	assert.Equal(t, 37.8, lat)
+	assert.Equal(t, uint8(12), zoom)
+	assert.Equal(t, "-122.4,37.8,12", FormatCenterString(lon, lat, zoom))
+	_, _, _, err = ParseCenterString("1,2,zoom")
+	assert.Error(t, err)
+
+	assert.Equal(t, int32(-15000000), LonToE7(-1.5))
+	assert.Equal(t, 37.8, E7ToLon(378000000))
+}
+
+func FuzzParseBounds(f *testing.F) {
+	for _, seed := range []string{"-180,-85,180,85", " 1.5, 2 ,3,4", "", ",,,", "NaN,Inf,-Inf,1e400", "1,2,3", "9223372036854775807,0,0,0"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, bounds string) {
+		parseBounds(bounds)
+	})
+}
+
+func FuzzParseCenter(f *testing.F) {
+	for _, seed := range []string{"0,0,0", "-122.4, 37.8, 12", "", ",,", "NaN,Inf,255", "1,2,300", "1,2,-1", "1,2"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, center string) {
+		parseCenter(center)
+	})
+}
+
+func TestConvertDirectoryOptions(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 7, func(z, x, y int64) []byte {
+		return testMvtTile(testMvtLayer(fmt.Sprintf("layer%d", x*1000+y), nil, nil))
+	})
+
+	convert := func(output string, opts ConvertOptions) error {
+		opts.Input, opts.Output, opts.MinZoom, opts.MaxZoom, opts.TmpDir, opts.Logger = input, output, -1, -1, dir, logger
+		_, err := ConvertWithOptions(context.Background(), opts)
+		return err
+	}
+
+	output := filepath.Join(dir, "default.pmtiles")
+	assert.Nil(t, convert(output, ConvertOptions{InternalCompression: NoCompression}))
+	header, _, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, Compression(NoCompression), header.InternalCompression)
+	assert.LessOrEqual(t, header.RootLength, uint64(16384-HeaderV3LenBytes))
+	assert.Greater(t, header.LeafDirectoryLength, uint64(0))
+	assert.Equal(t, 21845, len(tiles))
+	assert.Nil(t, Verify(logger, output))
+
+	output = filepath.Join(dir, "noleaves.pmtiles")
+	assert.Nil(t, convert(output, ConvertOptions{InternalCompression: NoCompression, NoLeafDirs: true}))
+	header, _, tiles = readTestArchiveTiles(t, output)
+	assert.Greater(t, header.RootLength, uint64(16384))
+	assert.Equal(t, uint64(0), header.LeafDirectoryLength)
+	assert.Equal(t, 21845, len(tiles))
+	assert.Nil(t, Verify(logger, output))
+
+	output = filepath.Join(dir, "root.pmtiles")
+	assert.Nil(t, convert(output, ConvertOptions{InternalCompression: Zstd, RootDirSize: 1024}))
+	header, _, tiles = readTestArchiveTiles(t, output)
+	assert.Equal(t, Compression(Zstd), header.InternalCompression)
+	assert.LessOrEqual(t, header.RootLength, uint64(1024))
+	assert.Equal(t, 21845, len(tiles))
+	assert.Nil(t, Verify(logger, output))
+
+	assert.Error(t, convert(output, ConvertOptions{Force: true, RootDirSize: 10}))
+	assert.Error(t, convert(output, ConvertOptions{Force: true, NoTmpfile: true, NoLeafDirs: true}))
+}
@@ -0,0 +1,98 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Crop writes the tiles of a local archive that overlap a lon/lat bounding box to a new archive.
+// Tiles that partially overlap the box are included unmodified.
+func Crop(logger *log.Logger, input string, output string, minLon float64, minLat float64, maxLon float64, maxLat float64, tmpfile *os.File, progress ...ProgressReporter) error {
+	start := time.Now()
+	if minLon >= maxLon || minLat >= maxLat {
+		return fmt.Errorf("invalid bounding box %v,%v,%v,%v", minLon, minLat, maxLon, maxLat)
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("Failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	headerBytes := make([]byte, HeaderV3LenBytes)
+	_, err = io.ReadFull(file, headerBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to read header: %w", err)
+	}
+
+	header, err := DeserializeHeader(headerBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse header: %w", err)
+	}
+
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	jsonMetadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata: %w", err)
+	}
+
+	resolve := newResolver(true, NoCompression)
+	bar := newStepProgress(progress, -1)
+	var writeErr error
+
+	addEntry := func(e EntryV3) {
+		data, err := io.ReadAll(io.NewSectionReader(file, int64(header.TileDataOffset+e.Offset), int64(e.Length)))
+		if err != nil {
+			writeErr = fmt.Errorf("Failed to read tile data, %w", err)
+			return
+		}
+		isNew, newData, err := resolve.AddTileIsNew(e.TileID, data, e.RunLength)
+		if err != nil {
+			writeErr = tileOrderError(e.TileID, err)
+			return
+		}
+		if isNew {
+			if _, err := tmpfile.Write(newData); err != nil {
+				writeErr = fmt.Errorf("Failed to write to tempfile, %w", err)
+			}
+		}
+	}
+
+	err = IterateTilesInBbox(header,
+		ReaderAtFetcher(file),
+		minLon, minLat, maxLon, maxLat, header.MinZoom, header.MaxZoom,
+		func(e EntryV3) {
+			bar.Add(1)
+			if writeErr == nil {
+				addEntry(e)
+			}
+		})
+
+	if err != nil {
+		return fmt.Errorf("Failed to iterate through tiles: %w", err)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	if len(resolve.Entries) == 0 {
+		return fmt.Errorf("no tiles intersect the bounding box")
+	}
+
+	header.MinLonE7 = max(header.MinLonE7, int32(minLon*10000000))
+	header.MinLatE7 = max(header.MinLatE7, int32(minLat*10000000))
+	header.MaxLonE7 = min(header.MaxLonE7, int32(maxLon*10000000))
+	header.MaxLatE7 = min(header.MaxLatE7, int32(maxLat*10000000))
+	header.CenterZoom = 0
+	header.CenterLonE7 = 0
+	header.CenterLatE7 = 0
+
+	_, err = finalize(logger, resolve, header, tmpfile, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return nil
+}
@@ -0,0 +1,55 @@
+package pmtiles
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCrop(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.pmtiles")
+	tiles := make([]testTile, 0)
+	for z := uint8(0); z <= 3; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tiles = append(tiles, testTile{z, x, y, fmt.Sprintf("%d/%d/%d", z, x, y)})
+			}
+		}
+	}
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{"name": "crop"}, tiles)
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "output.pmtiles")
+	assert.Nil(t, Crop(logger, input, output, 1, 1, 50, 50, tmpfile))
+
+	header, metadata, result := readTestArchiveTiles(t, output)
+	assert.Equal(t, "crop", metadata["name"])
+	assert.Equal(t, int32(1*10000000), header.MinLonE7)
+	assert.Equal(t, int32(1*10000000), header.MinLatE7)
+	assert.Equal(t, int32(10*10000000), header.MaxLonE7)
+	assert.Equal(t, int32(10*10000000), header.MaxLatE7)
+
+	expected := map[uint64]string{}
+	for _, zxy := range [][3]uint32{{0, 0, 0}, {1, 1, 0}, {2, 2, 1}, {3, 4, 2}, {3, 5, 2}, {3, 4, 3}, {3, 5, 3}} {
+		expected[ZxyToID(uint8(zxy[0]), zxy[1], zxy[2])] = fmt.Sprintf("%d/%d/%d", zxy[0], zxy[1], zxy[2])
+	}
+	assert.Equal(t, expected, result)
+}
+
+func TestCropEmpty(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "input.pmtiles")
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{}, []testTile{{1, 0, 0, "a"}})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	assert.Error(t, Crop(logger, input, filepath.Join(dir, "output.pmtiles"), 1, 1, 50, 50, tmpfile))
+	assert.Error(t, Crop(logger, input, filepath.Join(dir, "output.pmtiles"), 50, 1, 1, 50, tmpfile))
+}
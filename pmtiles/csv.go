@@ -0,0 +1,255 @@
+package pmtiles
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// csvColumns are the columns required in the header row of a CSV input, in any order.
+var csvColumns = []string{"z", "x", "y", "tile_data"}
+
+// ConvertCSV creates an archive from a CSV file with a header row naming the columns z, x, y and tile_data,
+// where tile_data is base64 or hex encoded, as detected from the first row. The input must end in .csv,
+// and is converted as Convert does, with the same options.
+func ConvertCSV(logger *log.Logger, input string, output string, opts ConvertOptions, tmpfile *os.File) error {
+	if !strings.HasSuffix(input, ".csv") {
+		return fmt.Errorf("CSV input %s must end in .csv", input)
+	}
+	return Convert(logger, input, output, opts, tmpfile)
+}
+
+// convertCSV creates an archive from a CSV input.
+// Rows are streamed into a temporary file next to tmpfile, so the input may be larger than memory;
+// an optional metadata.json next to the input is merged into the archive metadata.
+// Unless opts.TileType is set, the tile type is detected from the first tile.
+func convertCSV(logger *log.Logger, input string, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
+	start := time.Now()
+	if opts.Resume {
+		return fmt.Errorf("resume is only supported for MBTiles input")
+	}
+	f, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s, %w", input, err)
+	}
+	defer f.Close()
+
+	spool, err := os.CreateTemp(convertTmpDir(tmpfile), "pmtiles-csv")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file, %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	logger.Println("Pass 1: Reading tiles")
+	entries, err := readCSVTiles(f, spool)
+	if err != nil {
+		return fmt.Errorf("Failed to read %s, %w", input, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no tiles in %s", input)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TileID < entries[j].TileID })
+	tileset := roaring64.New()
+	for i, e := range entries {
+		if i > 0 && e.TileID == entries[i-1].TileID {
+			z, x, y := IDToZxy(e.TileID)
+			return fmt.Errorf("duplicate tile %d/%d/%d in %s", z, x, y, input)
+		}
+		tileset.Add(e.TileID)
+	}
+
+	readSpooled := func(e EntryV3) ([]byte, error) {
+		data := make([]byte, e.Length)
+		if _, err := spool.ReadAt(data, int64(e.Offset)); err != nil {
+			return nil, fmt.Errorf("Failed to read spooled tile, %w", err)
+		}
+		return data, nil
+	}
+
+	metadata := make(map[string]interface{})
+	metadataBytes, err := os.ReadFile(filepath.Join(filepath.Dir(input), "metadata.json"))
+	if err == nil {
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			return fmt.Errorf("Failed to parse metadata.json, %w", err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to read metadata.json, %w", err)
+	}
+
+	tileType := opts.TileType
+	if tileType == UnknownTileType {
+		first, err := readSpooled(entries[0])
+		if err != nil {
+			return err
+		}
+		tileType, _ = sniffTileType(first)
+		if tileType == UnknownTileType {
+			return fmt.Errorf("unknown tile format in %s", input)
+		}
+	}
+	header, jsonMetadata, err := directoryToHeaderJSON(metadata, tileType)
+	if err != nil {
+		return fmt.Errorf("Failed to convert metadata.json to header JSON, %w", err)
+	}
+	if _, ok := jsonMetadata["format"]; !ok {
+		jsonMetadata["format"] = tileTypeToString(tileType)
+	}
+	if err := applyMetadataOverrides(&header, jsonMetadata, opts.Metadata); err != nil {
+		return err
+	}
+
+	if err := filterTileset(opts, tileset, &header, jsonMetadata); err != nil {
+		return err
+	}
+
+	logger.Println("Pass 2: writing tiles")
+	if opts.InferVectorLayers && header.TileType == Mvt {
+		minZoom, _, _ := IDToZxy(tileset.Minimum())
+		maxZoom, _, _ := IDToZxy(tileset.Maximum())
+		spooled := make(map[uint64]EntryV3, len(entries))
+		for _, e := range entries {
+			spooled[e.TileID] = e
+		}
+		err := inferVectorLayers(logger, jsonMetadata, header.TileCompression, minZoom, maxZoom,
+			sampleTileset(tileset, vectorLayerSamples), func(e EntryV3) ([]byte, error) {
+				return readSpooled(spooled[e.TileID])
+			})
+		if err != nil {
+			return err
+		}
+	}
+	header.InternalCompression = opts.InternalCompression
+	resolve, err := newConvertResolver(opts, header, convertTmpDir(tmpfile))
+	if err != nil {
+		return err
+	}
+	defer resolve.close()
+	sink, err := newTileSink(opts, tmpfile, output, header.InternalCompression, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	defer sink.close()
+	bar := newProgress(opts, "tiles", int64(tileset.GetCardinality()))
+	for _, e := range entries {
+		if !tileset.Contains(e.TileID) {
+			continue
+		}
+		if err := opts.context().Err(); err != nil {
+			return err
+		}
+		data, err := readSpooled(e)
+		if err != nil {
+			return err
+		}
+		if resolve.stats != nil {
+			resolve.stats.inputBytes += uint64(len(data))
+		}
+		isNew, newData, err := resolve.AddTileIsNew(e.TileID, data, 1)
+		if err != nil {
+			return tileOrderError(e.TileID, err)
+		}
+		if isNew {
+			if _, err := sink.Write(newData); err != nil {
+				return fmt.Errorf("Failed to write to tempfile, %w", err)
+			}
+		}
+		bar.Add(1)
+	}
+	bar.Finish()
+
+	header, err = sink.finalize(logger, resolve, header, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	if opts.StatsOut != "" {
+		if err := writeConvertReport(opts.StatsOut, resolve, header); err != nil {
+			return err
+		}
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, archiveSummary(header, output), start)
+}
+
+// readCSVTiles decodes the non-empty tiles of the rows of a CSV input into spool,
+// returning their entries with offsets into spool in input order.
+func readCSVTiles(r io.Reader, spool io.Writer) ([]EntryV3, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	names, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read header row, %w", err)
+	}
+	columns := make(map[string]int, len(names))
+	for i, name := range names {
+		columns[strings.TrimSpace(name)] = i
+	}
+	index := make([]int, len(csvColumns))
+	for i, name := range csvColumns {
+		col, ok := columns[name]
+		if !ok {
+			return nil, fmt.Errorf("missing column %s in header row", name)
+		}
+		index[i] = col
+	}
+
+	var entries []EntryV3
+	var offset uint64
+	var decode func(string) ([]byte, error)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		z, err := strconv.ParseUint(record[index[0]], 10, 8)
+		if err != nil || z > MaxTileZoom {
+			return nil, fmt.Errorf("invalid zoom level %q on line %d", record[index[0]], line)
+		}
+		x, err := strconv.ParseUint(record[index[1]], 10, 32)
+		if err != nil || x >= 1<<z {
+			return nil, fmt.Errorf("invalid column %q on line %d", record[index[1]], line)
+		}
+		y, err := strconv.ParseUint(record[index[2]], 10, 32)
+		if err != nil || y >= 1<<z {
+			return nil, fmt.Errorf("invalid row %q on line %d", record[index[2]], line)
+		}
+
+		encoded := record[index[3]]
+		if encoded == "" {
+			continue
+		}
+		if decode == nil {
+			decode = base64.StdEncoding.DecodeString
+			if _, err := hex.DecodeString(encoded); err == nil {
+				decode = hex.DecodeString
+			}
+		}
+		data, err := decode(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decode tile data on line %d, %w", line, err)
+		}
+		if _, err := spool.Write(data); err != nil {
+			return nil, fmt.Errorf("Failed to write to tempfile, %w", err)
+		}
+		entries = append(entries, EntryV3{ZxyToID(uint8(z), uint32(x), uint32(y)), offset, uint32(len(data)), 1})
+		offset += uint64(len(data))
+	}
+	return entries, nil
+}
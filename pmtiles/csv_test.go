@@ -0,0 +1,76 @@
+package pmtiles
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertCSV(t *testing.T) {
+	png := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 1}
+	other := []byte{0x89, 'P', 'N', 'G', 0x0d, 0x0a, 0x1a, 0x0a, 2}
+	for name, encode := range map[string]func([]byte) string{"base64": base64.StdEncoding.EncodeToString, "hex": hex.EncodeToString} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			input := filepath.Join(dir, "tiles.csv")
+			rows := []string{
+				"tile_data,z,x,y",
+				encode(png) + ",1,1,1",
+				encode(other) + ",0,0,0",
+				encode(png) + ",1,0,0",
+				",1,0,1",
+			}
+			assert.Nil(t, os.WriteFile(input, []byte(strings.Join(rows, "\n")+"\n"), 0666))
+			assert.Nil(t, os.WriteFile(filepath.Join(dir, "metadata.json"), []byte(`{"name":"csv","bounds":"-1,-2,3,4"}`), 0666))
+
+			tmpfile, err := os.CreateTemp(dir, "pmtiles")
+			assert.Nil(t, err)
+			defer tmpfile.Close()
+			output := filepath.Join(dir, "out.pmtiles")
+			assert.Nil(t, ConvertCSV(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile))
+
+			header, metadata, tiles := readTestArchiveTiles(t, output)
+			assert.Equal(t, TileType(Png), header.TileType)
+			assert.Equal(t, uint8(0), header.MinZoom)
+			assert.Equal(t, uint8(1), header.MaxZoom)
+			assert.Equal(t, int32(-1*10000000), header.MinLonE7)
+			assert.Equal(t, uint64(3), header.AddressedTilesCount)
+			assert.Equal(t, uint64(2), header.TileContentsCount)
+			assert.Equal(t, "csv", metadata["name"])
+			assert.Equal(t, 3, len(tiles))
+			assert.Equal(t, string(other), tiles[ZxyToID(0, 0, 0)])
+			assert.Equal(t, string(png), tiles[ZxyToID(1, 1, 1)])
+
+			// an existing output is only replaced with Force
+			assert.Error(t, ConvertCSV(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile))
+			assert.Nil(t, ConvertCSV(logger, input, output, ConvertOptions{Force: true, InternalCompression: NoCompression, MinZoom: 1, MaxZoom: -1}, tmpfile))
+			header, _, tiles = readTestArchiveTiles(t, output)
+			assert.Equal(t, Compression(NoCompression), header.InternalCompression)
+			assert.Equal(t, uint8(1), header.MinZoom)
+			assert.Equal(t, uint64(2), header.TileContentsCount)
+			assert.Equal(t, 2, len(tiles))
+		})
+	}
+}
+
+func TestConvertCSVInvalid(t *testing.T) {
+	dir := t.TempDir()
+	for _, content := range []string{
+		"z,x,data\n0,0,00\n",
+		"z,x,y,tile_data\n0,1,0,00\n",
+		"z,x,y,tile_data\n1,0,0,89504e470d0a1a0a\n1,0,0,89504e470d0a1a0a\n",
+		"z,x,y,tile_data\n",
+	} {
+		input := filepath.Join(dir, "tiles.csv")
+		assert.Nil(t, os.WriteFile(input, []byte(content), 0666))
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		assert.Error(t, ConvertCSV(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1}, tmpfile), content)
+		tmpfile.Close()
+	}
+}
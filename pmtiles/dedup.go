@@ -0,0 +1,341 @@
+package pmtiles
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// dedupIndex maps the hash of tile contents to where the contents were written.
+type dedupIndex interface {
+	get(sum contentHash) (offsetLen, bool, error)
+	put(sum contentHash, found offsetLen) error
+	len() uint64
+	close() error
+}
+
+// memoryIndex is the default dedupIndex, holding every unique hash in memory.
+type memoryIndex map[contentHash]offsetLen
+
+func (m memoryIndex) get(sum contentHash) (offsetLen, bool, error) {
+	found, ok := m[sum]
+	return found, ok, nil
+}
+
+func (m memoryIndex) put(sum contentHash, found offsetLen) error {
+	m[sum] = found
+	return nil
+}
+
+func (m memoryIndex) len() uint64 {
+	return uint64(len(m))
+}
+
+func (m memoryIndex) close() error {
+	return nil
+}
+
+const (
+	// dedupRecordSize is the size of a segment record: the hash, offset and length.
+	dedupRecordSize = 16 + 8 + 4
+	// dedupBlockRecords is the number of records read from a segment per lookup.
+	dedupBlockRecords = 512
+	// dedupEntryBytes approximates the memory used by a buffered hash, including map overhead.
+	dedupEntryBytes = 64
+	// dedupBloomBits is the number of bloom filter bits per hash, for a false positive rate near 1%.
+	dedupBloomBits  = 10
+	dedupBloomProbe = 7
+	// DefaultDedupMemory is the default memory budget of the disk deduplication index.
+	DefaultDedupMemory = 256 << 20
+)
+
+// bloomFilter tests whether a hash may have been added to a segment.
+type bloomFilter []uint64
+
+func newBloomFilter(count uint64) bloomFilter {
+	return make(bloomFilter, (count*dedupBloomBits+63)/64+1)
+}
+
+// probes derives the filter positions from the hash itself, which is already uniformly distributed.
+// The second half is mixed with the first, since hashes shorter than 16 bytes are zero-padded.
+func (b bloomFilter) probes(sum contentHash, f func(bit uint64) bool) bool {
+	h1 := binary.LittleEndian.Uint64(sum[0:8])
+	h2 := (binary.LittleEndian.Uint64(sum[8:16]) ^ (h1 * 0x9e3779b97f4a7c15)) | 1
+	n := uint64(len(b)) * 64
+	for i := uint64(0); i < dedupBloomProbe; i++ {
+		if !f((h1 + i*h2) % n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b bloomFilter) add(sum contentHash) {
+	b.probes(sum, func(bit uint64) bool {
+		b[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (b bloomFilter) test(sum contentHash) bool {
+	return b.probes(sum, func(bit uint64) bool {
+		return b[bit/64]&(1<<(bit%64)) != 0
+	})
+}
+
+// dedupSegment is a temporary file of records sorted by hash,
+// with the first hash of every block kept in memory to read a single block per lookup.
+type dedupSegment struct {
+	file   *os.File
+	count  uint64
+	bloom  bloomFilter
+	firsts []contentHash
+}
+
+// dedupSegmentWriter writes sorted records to a new segment.
+type dedupSegmentWriter struct {
+	segment *dedupSegment
+	w       *bufio.Writer
+	record  [dedupRecordSize]byte
+}
+
+func newDedupSegmentWriter(dir string, count uint64) (*dedupSegmentWriter, error) {
+	file, err := os.CreateTemp(dir, "segment")
+	if err != nil {
+		return nil, err
+	}
+	return &dedupSegmentWriter{
+		segment: &dedupSegment{file: file, bloom: newBloomFilter(count)},
+		w:       bufio.NewWriterSize(file, 1<<20),
+	}, nil
+}
+
+func (w *dedupSegmentWriter) write(sum contentHash, found offsetLen) error {
+	s := w.segment
+	if s.count%dedupBlockRecords == 0 {
+		s.firsts = append(s.firsts, sum)
+	}
+	s.bloom.add(sum)
+	s.count++
+	copy(w.record[0:16], sum[:])
+	binary.LittleEndian.PutUint64(w.record[16:24], found.Offset)
+	binary.LittleEndian.PutUint32(w.record[24:28], found.Length)
+	_, err := w.w.Write(w.record[:])
+	return err
+}
+
+func (w *dedupSegmentWriter) finish() (*dedupSegment, error) {
+	if err := w.w.Flush(); err != nil {
+		return nil, err
+	}
+	return w.segment, nil
+}
+
+// get reads the block that may contain sum and binary searches it.
+func (s *dedupSegment) get(sum contentHash, block []byte) (offsetLen, bool, error) {
+	i := sort.Search(len(s.firsts), func(i int) bool {
+		return bytes.Compare(s.firsts[i][:], sum[:]) > 0
+	}) - 1
+	if i < 0 {
+		return offsetLen{}, false, nil
+	}
+	n := min(s.count-uint64(i)*dedupBlockRecords, dedupBlockRecords)
+	block = block[:n*dedupRecordSize]
+	if _, err := s.file.ReadAt(block, int64(i)*dedupBlockRecords*dedupRecordSize); err != nil {
+		return offsetLen{}, false, err
+	}
+	j := sort.Search(int(n), func(j int) bool {
+		return bytes.Compare(block[j*dedupRecordSize:j*dedupRecordSize+16], sum[:]) >= 0
+	})
+	if j == int(n) {
+		return offsetLen{}, false, nil
+	}
+	record := block[j*dedupRecordSize : (j+1)*dedupRecordSize]
+	if !bytes.Equal(record[0:16], sum[:]) {
+		return offsetLen{}, false, nil
+	}
+	return offsetLen{binary.LittleEndian.Uint64(record[16:24]), binary.LittleEndian.Uint32(record[24:28])}, true, nil
+}
+
+func (s *dedupSegment) remove() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// diskIndex is a dedupIndex for archives with too many unique contents to index in memory.
+// New hashes are buffered in memory up to a budget, then written to a sorted segment file.
+// Segments of similar size are merged, so there are only logarithmically many to search;
+// each has a bloom filter in memory, about 1.25 bytes per hash, so most lookups of new contents
+// do not read from disk. Lookups of earlier contents read one block per segment,
+// which makes conversion slower than with the memory index.
+type diskIndex struct {
+	dir        string
+	buffer     map[contentHash]offsetLen
+	bufferSize int
+	segments   []*dedupSegment
+	count      uint64
+	block      []byte
+}
+
+// newDiskIndex creates a diskIndex with temporary files in dir, buffering about memory bytes of hashes.
+func newDiskIndex(dir string, memory int64) (*diskIndex, error) {
+	if memory <= 0 {
+		memory = DefaultDedupMemory
+	}
+	tmpdir, err := os.MkdirTemp(dir, "pmtiles-dedup")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create deduplication index directory, %w", err)
+	}
+	bufferSize := max(int(memory/dedupEntryBytes), 1)
+	return &diskIndex{
+		dir:        tmpdir,
+		buffer:     make(map[contentHash]offsetLen),
+		bufferSize: bufferSize,
+		block:      make([]byte, dedupBlockRecords*dedupRecordSize),
+	}, nil
+}
+
+func (d *diskIndex) get(sum contentHash) (offsetLen, bool, error) {
+	if found, ok := d.buffer[sum]; ok {
+		return found, true, nil
+	}
+	for i := len(d.segments) - 1; i >= 0; i-- {
+		s := d.segments[i]
+		if !s.bloom.test(sum) {
+			continue
+		}
+		found, ok, err := s.get(sum, d.block)
+		if err != nil {
+			return offsetLen{}, false, fmt.Errorf("Failed to read deduplication index, %w", err)
+		}
+		if ok {
+			return found, true, nil
+		}
+	}
+	return offsetLen{}, false, nil
+}
+
+func (d *diskIndex) put(sum contentHash, found offsetLen) error {
+	d.buffer[sum] = found
+	d.count++
+	if len(d.buffer) >= d.bufferSize {
+		if err := d.flush(); err != nil {
+			return fmt.Errorf("Failed to write deduplication index, %w", err)
+		}
+	}
+	return nil
+}
+
+func (d *diskIndex) len() uint64 {
+	return d.count
+}
+
+// flush writes the buffer to a new segment, then merges the newest segments
+// while the last is at least as large as the one before it.
+func (d *diskIndex) flush() error {
+	sums := make([]contentHash, 0, len(d.buffer))
+	for sum := range d.buffer {
+		sums = append(sums, sum)
+	}
+	sort.Slice(sums, func(i, j int) bool { return bytes.Compare(sums[i][:], sums[j][:]) < 0 })
+
+	w, err := newDedupSegmentWriter(d.dir, uint64(len(sums)))
+	if err != nil {
+		return err
+	}
+	for _, sum := range sums {
+		if err := w.write(sum, d.buffer[sum]); err != nil {
+			return err
+		}
+	}
+	segment, err := w.finish()
+	if err != nil {
+		return err
+	}
+	d.segments = append(d.segments, segment)
+	clear(d.buffer)
+
+	for len(d.segments) >= 2 {
+		a, b := d.segments[len(d.segments)-2], d.segments[len(d.segments)-1]
+		if b.count < a.count {
+			break
+		}
+		merged, err := d.merge(a, b)
+		if err != nil {
+			return err
+		}
+		d.segments = append(d.segments[:len(d.segments)-2], merged)
+	}
+	return nil
+}
+
+// merge writes the records of a and b to a new segment and removes them.
+func (d *diskIndex) merge(a *dedupSegment, b *dedupSegment) (*dedupSegment, error) {
+	w, err := newDedupSegmentWriter(d.dir, a.count+b.count)
+	if err != nil {
+		return nil, err
+	}
+	ra := bufio.NewReaderSize(io.NewSectionReader(a.file, 0, int64(a.count)*dedupRecordSize), 1<<20)
+	rb := bufio.NewReaderSize(io.NewSectionReader(b.file, 0, int64(b.count)*dedupRecordSize), 1<<20)
+	var recordA, recordB [dedupRecordSize]byte
+	next := func(r *bufio.Reader, record []byte, remaining *uint64) (bool, error) {
+		if *remaining == 0 {
+			return false, nil
+		}
+		*remaining--
+		_, err := io.ReadFull(r, record)
+		return err == nil, err
+	}
+	write := func(record []byte) error {
+		var sum contentHash
+		copy(sum[:], record[0:16])
+		return w.write(sum, offsetLen{binary.LittleEndian.Uint64(record[16:24]), binary.LittleEndian.Uint32(record[24:28])})
+	}
+
+	remainingA, remainingB := a.count, b.count
+	okA, err := next(ra, recordA[:], &remainingA)
+	if err != nil {
+		return nil, err
+	}
+	okB, err := next(rb, recordB[:], &remainingB)
+	if err != nil {
+		return nil, err
+	}
+	for okA || okB {
+		if okA && (!okB || bytes.Compare(recordA[0:16], recordB[0:16]) < 0) {
+			if err := write(recordA[:]); err != nil {
+				return nil, err
+			}
+			okA, err = next(ra, recordA[:], &remainingA)
+		} else {
+			if err := write(recordB[:]); err != nil {
+				return nil, err
+			}
+			okB, err = next(rb, recordB[:], &remainingB)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	merged, err := w.finish()
+	if err != nil {
+		return nil, err
+	}
+	a.remove()
+	b.remove()
+	return merged, nil
+}
+
+// close removes the temporary files of the index.
+func (d *diskIndex) close() error {
+	for _, s := range d.segments {
+		s.file.Close()
+	}
+	d.segments = nil
+	return os.RemoveAll(d.dir)
+}
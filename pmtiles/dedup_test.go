@@ -0,0 +1,96 @@
+package pmtiles
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContentHash(i int) contentHash {
+	var sum contentHash
+	binary.LittleEndian.PutUint64(sum[:], xxhash.Sum64String(strconv.Itoa(i)))
+	return sum
+}
+
+func TestDiskIndex(t *testing.T) {
+	index, err := newDiskIndex(t.TempDir(), dedupEntryBytes*10)
+	assert.Nil(t, err)
+
+	for i := 0; i < 1000; i++ {
+		assert.Nil(t, index.put(testContentHash(i), offsetLen{uint64(i) * 10, uint32(i)}))
+	}
+	assert.Equal(t, uint64(1000), index.len())
+	// merging keeps the number of segments logarithmic
+	assert.LessOrEqual(t, len(index.segments), 7)
+
+	for i := 0; i < 1000; i++ {
+		found, ok, err := index.get(testContentHash(i))
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, offsetLen{uint64(i) * 10, uint32(i)}, found)
+	}
+	for i := 1000; i < 1100; i++ {
+		_, ok, err := index.get(testContentHash(i))
+		assert.Nil(t, err)
+		assert.False(t, ok)
+	}
+
+	dir := index.dir
+	assert.Nil(t, index.close())
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBloomFilter(t *testing.T) {
+	bloom := newBloomFilter(1000)
+	for i := 0; i < 1000; i++ {
+		bloom.add(testContentHash(i))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		assert.True(t, bloom.test(testContentHash(i%1000)))
+		if bloom.test(testContentHash(i + 1000)) {
+			falsePositives++
+		}
+	}
+	assert.Less(t, falsePositives, 500)
+}
+
+func TestConvertDiskDedupIndex(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 4, func(z, x, y int64) []byte {
+		return []byte("tile " + strconv.FormatInt((x*y)%50, 10))
+	})
+
+	var outputs [][]byte
+	for _, index := range []string{"memory", "disk"} {
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		output := filepath.Join(dir, index+".pmtiles")
+		err = Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, DedupIndex: index, DedupMemory: dedupEntryBytes * 8}, tmpfile)
+		tmpfile.Close()
+		assert.Nil(t, err)
+
+		archive, err := os.ReadFile(output)
+		assert.Nil(t, err)
+		outputs = append(outputs, archive)
+	}
+	assert.Equal(t, outputs[0], outputs[1])
+
+	// the temporary index is removed
+	matches, err := filepath.Glob(filepath.Join(dir, "pmtiles-dedup*"))
+	assert.Nil(t, err)
+	assert.Empty(t, matches)
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	err = Convert(logger, input, filepath.Join(dir, "out.pmtiles"), ConvertOptions{MinZoom: -1, MaxZoom: -1, DedupIndex: "sqlite"}, tmpfile)
+	assert.Error(t, err)
+}
@@ -0,0 +1,204 @@
+package pmtiles
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// DiffOptions configures DiffWithOptions.
+type DiffOptions struct {
+	// Sizes includes the stored sizes of changed tiles in both archives.
+	Sizes bool
+}
+
+// ChangedTile is a tile present in both archives with different contents.
+type ChangedTile struct {
+	TileID     uint64 `json:"tile_id"`
+	BeforeSize uint32 `json:"before_size,omitempty"`
+	AfterSize  uint32 `json:"after_size,omitempty"`
+}
+
+// DiffSummary counts the tiles of a DiffResult.
+type DiffSummary struct {
+	Added     uint64 `json:"added"`
+	Removed   uint64 `json:"removed"`
+	Changed   uint64 `json:"changed"`
+	Unchanged uint64 `json:"unchanged"`
+}
+
+// DiffResult lists the tile IDs that differ between two archives, in increasing order.
+type DiffResult struct {
+	Summary DiffSummary   `json:"summary"`
+	Added   []uint64      `json:"added"`
+	Removed []uint64      `json:"removed"`
+	Changed []ChangedTile `json:"changed"`
+}
+
+// diffArchive is one side of a diff: its entries, and the hashes of contents read so far by offset,
+// so deduplicated contents are only read and hashed once.
+type diffArchive struct {
+	file    *os.File
+	header  HeaderV3
+	entries []EntryV3
+	hashes  map[uint64]uint64
+}
+
+func openDiffArchive(path string) (*diffArchive, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open %s, %w", path, err)
+	}
+	buf := make([]byte, HeaderV3LenBytes)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to read header of %s, %w", path, err)
+	}
+	header, err := DeserializeHeader(buf)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to read %s, %w", path, err)
+	}
+
+	a := &diffArchive{file: file, header: header, hashes: make(map[uint64]uint64)}
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		a.entries = append(a.entries, e)
+	})
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+	return a, nil
+}
+
+func (a *diffArchive) hash(e EntryV3) (uint64, error) {
+	if sum, ok := a.hashes[e.Offset]; ok {
+		return sum, nil
+	}
+	data := make([]byte, e.Length)
+	if _, err := a.file.ReadAt(data, int64(a.header.TileDataOffset+e.Offset)); err != nil {
+		return 0, err
+	}
+	sum := xxhash.Sum64(data)
+	a.hashes[e.Offset] = sum
+	return sum, nil
+}
+
+// Diff compares the tiles of two local archives.
+// Tiles are compared as stored, so archives with different tile compression report every tile as changed.
+func Diff(pathA string, pathB string) (*DiffResult, error) {
+	return DiffWithOptions(pathA, pathB, DiffOptions{})
+}
+
+// DiffWithOptions compares the tiles of two local archives, reporting tiles only in pathA as removed
+// and tiles only in pathB as added. Only the directories are read to find added and removed tiles;
+// tiles in both archives are only read if their stored sizes are the same.
+func DiffWithOptions(pathA string, pathB string, opts DiffOptions) (*DiffResult, error) {
+	a, err := openDiffArchive(pathA)
+	if err != nil {
+		return nil, err
+	}
+	defer a.file.Close()
+	b, err := openDiffArchive(pathB)
+	if err != nil {
+		return nil, err
+	}
+	defer b.file.Close()
+
+	result := &DiffResult{Added: []uint64{}, Removed: []uint64{}, Changed: []ChangedTile{}}
+
+	// walk both entry lists in tile ID order, splitting runs where they partially overlap
+	i, j := 0, 0
+	var idA, idB uint64
+	if len(a.entries) > 0 {
+		idA = a.entries[0].TileID
+	}
+	if len(b.entries) > 0 {
+		idB = b.entries[0].TileID
+	}
+	for i < len(a.entries) || j < len(b.entries) {
+		var endA, endB uint64
+		if i < len(a.entries) {
+			endA = a.entries[i].TileID + uint64(a.entries[i].RunLength)
+		}
+		if j < len(b.entries) {
+			endB = b.entries[j].TileID + uint64(b.entries[j].RunLength)
+		}
+
+		switch {
+		case j == len(b.entries) || (i < len(a.entries) && idA < idB):
+			end := endA
+			if j < len(b.entries) {
+				end = min(end, idB)
+			}
+			for id := idA; id < end; id++ {
+				result.Removed = append(result.Removed, id)
+			}
+			idA = end
+		case i == len(a.entries) || idB < idA:
+			end := endB
+			if i < len(a.entries) {
+				end = min(end, idA)
+			}
+			for id := idB; id < end; id++ {
+				result.Added = append(result.Added, id)
+			}
+			idB = end
+		default:
+			end := min(endA, endB)
+			changed, err := diffContents(a, b, a.entries[i], b.entries[j])
+			if err != nil {
+				z, x, y := IDToZxy(idA)
+				return nil, fmt.Errorf("Failed to compare tile %d/%d/%d, %w", z, x, y, err)
+			}
+			if changed {
+				for id := idA; id < end; id++ {
+					tile := ChangedTile{TileID: id}
+					if opts.Sizes {
+						tile.BeforeSize = a.entries[i].Length
+						tile.AfterSize = b.entries[j].Length
+					}
+					result.Changed = append(result.Changed, tile)
+				}
+			} else {
+				result.Summary.Unchanged += end - idA
+			}
+			idA, idB = end, end
+		}
+
+		if i < len(a.entries) && idA == endA {
+			i++
+			if i < len(a.entries) {
+				idA = a.entries[i].TileID
+			}
+		}
+		if j < len(b.entries) && idB == endB {
+			j++
+			if j < len(b.entries) {
+				idB = b.entries[j].TileID
+			}
+		}
+	}
+
+	result.Summary.Added = uint64(len(result.Added))
+	result.Summary.Removed = uint64(len(result.Removed))
+	result.Summary.Changed = uint64(len(result.Changed))
+	return result, nil
+}
+
+// diffContents returns whether the contents of entries ea of a and eb of b differ.
+func diffContents(a *diffArchive, b *diffArchive, ea EntryV3, eb EntryV3) (bool, error) {
+	if ea.Length != eb.Length {
+		return true, nil
+	}
+	hashA, err := a.hash(ea)
+	if err != nil {
+		return false, err
+	}
+	hashB, err := b.hash(eb)
+	if err != nil {
+		return false, err
+	}
+	return hashA != hashB, nil
+}
@@ -0,0 +1,71 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeDiffArchive(t *testing.T, name string, tiles []Zxy, contents [][]byte) string {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Deduplicate: true, TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+	for i, zxy := range tiles {
+		assert.Nil(t, w.AddTile(zxy.Z, zxy.X, zxy.Y, contents[i]))
+	}
+	_, err = w.Finalize(HeaderV3{TileType: Png}, map[string]interface{}{})
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), name)
+	assert.Nil(t, os.WriteFile(path, b.Bytes(), 0666))
+	return path
+}
+
+func TestDiff(t *testing.T) {
+	// in tile ID order: 0/0/0, 1/0/0, 1/0/1, 1/1/1, 1/1/0
+	before := writeDiffArchive(t, "before.pmtiles",
+		[]Zxy{{0, 0, 0}, {1, 0, 0}, {1, 0, 1}, {1, 1, 1}},
+		[][]byte{{0x1}, {0x2}, {0x3}, {0x3}})
+	after := writeDiffArchive(t, "after.pmtiles",
+		[]Zxy{{0, 0, 0}, {1, 0, 1}, {1, 1, 1}, {1, 1, 0}},
+		[][]byte{{0x1}, {0x3}, {0x4, 0x4}, {0x5}})
+
+	result, err := DiffWithOptions(before, after, DiffOptions{Sizes: true})
+	assert.Nil(t, err)
+	assert.Equal(t, []uint64{ZxyToID(1, 0, 0)}, result.Removed)
+	assert.Equal(t, []uint64{ZxyToID(1, 1, 0)}, result.Added)
+	assert.Equal(t, []ChangedTile{{TileID: ZxyToID(1, 1, 1), BeforeSize: 1, AfterSize: 2}}, result.Changed)
+	assert.Equal(t, DiffSummary{Added: 1, Removed: 1, Changed: 1, Unchanged: 2}, result.Summary)
+
+	_, err = json.Marshal(result)
+	assert.Nil(t, err)
+
+	result, err = Diff(before, after)
+	assert.Nil(t, err)
+	assert.Equal(t, []ChangedTile{{TileID: ZxyToID(1, 1, 1)}}, result.Changed)
+}
+
+func TestDiffSameSize(t *testing.T) {
+	before := writeDiffArchive(t, "before.pmtiles",
+		[]Zxy{{1, 0, 0}, {1, 0, 1}, {1, 1, 1}},
+		[][]byte{{0x2}, {0x2}, {0x2}})
+	after := writeDiffArchive(t, "after.pmtiles",
+		[]Zxy{{1, 0, 0}, {1, 0, 1}, {1, 1, 1}},
+		[][]byte{{0x2}, {0x3}, {0x2}})
+
+	result, err := Diff(before, after)
+	assert.Nil(t, err)
+	assert.Empty(t, result.Added)
+	assert.Empty(t, result.Removed)
+	assert.Equal(t, []ChangedTile{{TileID: ZxyToID(1, 0, 1)}}, result.Changed)
+	assert.Equal(t, uint64(2), result.Summary.Unchanged)
+
+	result, err = Diff(before, before)
+	assert.Nil(t, err)
+	assert.Equal(t, DiffSummary{Unchanged: 3}, result.Summary)
+}
@@ -3,12 +3,12 @@ package pmtiles
 import (
 	"bufio"
 	"bytes"
-	"compress/gzip"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 )
 
 // Compression is the compression algorithm applied to individual tiles (or none)
@@ -82,7 +82,7 @@ type HeaderJson struct {
 func headerContentType(header HeaderV3) (string, bool) {
 	switch header.TileType {
 	case Mvt:
-		return "application/x-protobuf", true
+		return "application/vnd.mapbox-vector-tile", true
 	case Png:
 		return "image/png", true
 	case Jpeg:
@@ -193,55 +193,43 @@ type EntryV3 struct {
 	RunLength uint32
 }
 
-type nopWriteCloser struct {
-	*bytes.Buffer
-}
-
-func (w *nopWriteCloser) Close() error { return nil }
-
 func SerializeMetadata(metadata map[string]interface{}, compression Compression) ([]byte, error) {
-	jsonBytes, err := json.Marshal(metadata)
+	jsonBytes, err := marshalMetadata(metadata)
 	if err != nil {
 		return nil, err
 	}
 
 	if compression == NoCompression {
 		return jsonBytes, nil
-	} else if compression == Gzip {
-		var b bytes.Buffer
-		w, err := gzip.NewWriterLevel(&b, gzip.BestCompression)
-		if err != nil {
-			return nil, err
-		}
-		w.Write(jsonBytes)
-		w.Close()
-		return b.Bytes(), nil
-	} else {
-		return nil, errors.New("compression not supported")
 	}
+
+	var b bytes.Buffer
+	w, err := newCompressWriter(&b, compression)
+	if err != nil {
+		return nil, err
+	}
+	w.Write(jsonBytes)
+	w.Close()
+	return b.Bytes(), nil
+}
+
+// marshalMetadata encodes metadata as JSON with the keys of every object sorted,
+// so equal metadata always serializes to the same bytes.
+func marshalMetadata(metadata map[string]interface{}) ([]byte, error) {
+	// json.Marshal sorts map keys, and struct fields keep their declaration order
+	return json.Marshal(metadata)
 }
 
 func DeserializeMetadataBytes(reader io.Reader, compression Compression) ([]byte, error) {
-	var jsonBytes []byte
-	var err error
+	decompressed, err := newDecompressReader(reader, compression)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
 
-	if compression == NoCompression {
-		jsonBytes, err = io.ReadAll(reader)
-		if err != nil {
-			return nil, err
-		}
-	} else if compression == Gzip {
-		gzipReader, err := gzip.NewReader(reader)
-		if err != nil {
-			return nil, err
-		}
-		jsonBytes, err = io.ReadAll(gzipReader)
-		if err != nil {
-			return nil, err
-		}
-		gzipReader.Close()
-	} else {
-		return nil, errors.New("compression not supported")
+	jsonBytes, err := io.ReadAll(decompressed)
+	if err != nil {
+		return nil, err
 	}
 
 	return jsonBytes, nil
@@ -261,14 +249,10 @@ func DeserializeMetadata(reader io.Reader, compression Compression) (map[string]
 
 func SerializeEntries(entries []EntryV3, compression Compression) []byte {
 	var b bytes.Buffer
-	var w io.WriteCloser
 
 	tmp := make([]byte, binary.MaxVarintLen64)
-	if compression == NoCompression {
-		w = &nopWriteCloser{&b}
-	} else if compression == Gzip {
-		w, _ = gzip.NewWriterLevel(&b, gzip.BestCompression)
-	} else {
+	w, err := newCompressWriter(&b, compression)
+	if err != nil {
 		panic("Compression not supported")
 	}
 
@@ -312,22 +296,25 @@ func SerializeEntries(entries []EntryV3, compression Compression) []byte {
 func DeserializeEntries(data *bytes.Buffer, compression Compression) []EntryV3 {
 	entries := make([]EntryV3, 0)
 
-	var reader io.Reader
-
-	if compression == NoCompression {
-		reader = data
-	} else if compression == Gzip {
-		reader, _ = gzip.NewReader(data)
-	} else {
+	reader, err := newDecompressReader(data, compression)
+	if errors.Is(err, errUnsupportedCompression) {
 		panic("Compression not supported")
+	} else if err != nil {
+		return entries
 	}
+	defer reader.Close()
 	byteReader := bufio.NewReader(reader)
 
 	numEntries, _ := binary.ReadUvarint(byteReader)
 
 	lastID := uint64(0)
 	for i := uint64(0); i < numEntries; i++ {
-		tmp, _ := binary.ReadUvarint(byteReader)
+		tmp, err := binary.ReadUvarint(byteReader)
+		if err != nil {
+			// a truncated or corrupt directory lists fewer entries than it claims
+			numEntries = i
+			break
+		}
 		entries = append(entries, EntryV3{lastID + tmp, 0, 0, 0})
 		lastID = lastID + tmp
 	}
@@ -417,6 +404,9 @@ func SerializeHeader(header HeaderV3) []byte {
 
 func DeserializeHeader(d []byte) (HeaderV3, error) {
 	h := HeaderV3{}
+	if len(d) < HeaderV3LenBytes {
+		return h, fmt.Errorf("header is %d bytes, expected %d", len(d), HeaderV3LenBytes)
+	}
 	magicNumber := d[0:7]
 	if string(magicNumber) != "PMTiles" {
 		return h, fmt.Errorf("magic number not detected. confirm this is a PMTiles archive")
@@ -453,6 +443,11 @@ func DeserializeHeader(d []byte) (HeaderV3, error) {
 	h.CenterLonE7 = int32(binary.LittleEndian.Uint32(d[119 : 119+4]))
 	h.CenterLatE7 = int32(binary.LittleEndian.Uint32(d[123 : 123+4]))
 
+	// tile IDs, and so the zoom levels of tiles, end at MaxTileZoom
+	if zoom := max(h.MinZoom, h.MaxZoom); zoom > MaxTileZoom {
+		return h, fmt.Errorf("header zoom %d is greater than %d", zoom, MaxTileZoom)
+	}
+
 	return h, nil
 }
 
@@ -507,11 +502,34 @@ func optimizeDirectories(entries []EntryV3, targetRootLen int, compression Compr
 	}
 }
 
-func IterateEntries(header HeaderV3, fetch func(uint64, uint64) ([]byte, error), operation func(EntryV3)) error {
-	var CollectEntries func(uint64, uint64) error
+// SectionFetcher reads a byte range of an archive, such as the root or a leaf directory.
+type SectionFetcher interface {
+	FetchSection(offset uint64, length uint64) ([]byte, error)
+}
+
+// FetchSectionFunc adapts an ordinary function to a SectionFetcher.
+type FetchSectionFunc func(offset uint64, length uint64) ([]byte, error)
 
-	CollectEntries = func(dir_offset uint64, dir_length uint64) error {
-		data, err := fetch(dir_offset, dir_length)
+// FetchSection calls f(offset, length).
+func (f FetchSectionFunc) FetchSection(offset uint64, length uint64) ([]byte, error) {
+	return f(offset, length)
+}
+
+// ReaderAtFetcher returns a SectionFetcher that reads sections from r, such as an open archive file.
+func ReaderAtFetcher(r io.ReaderAt) SectionFetcher {
+	return FetchSectionFunc(func(offset uint64, length uint64) ([]byte, error) {
+		return io.ReadAll(io.NewSectionReader(r, int64(offset), int64(length)))
+	})
+}
+
+func IterateEntries(header HeaderV3, fetcher SectionFetcher, operation func(EntryV3)) error {
+	var CollectEntries func(uint64, uint64, int) error
+
+	CollectEntries = func(dir_offset uint64, dir_length uint64, depth int) error {
+		if depth > 3 {
+			return fmt.Errorf("leaf directories are nested more than 3 levels deep")
+		}
+		data, err := fetcher.FetchSection(dir_offset, dir_length)
 		if err != nil {
 			return err
 		}
@@ -521,11 +539,70 @@ func IterateEntries(header HeaderV3, fetch func(uint64, uint64) ([]byte, error),
 			if entry.RunLength > 0 {
 				operation(entry)
 			} else {
-				CollectEntries(header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length))
+				if err := CollectEntries(header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length), depth+1); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	return CollectEntries(header.RootOffset, header.RootLength, 0)
+}
+
+// IterateTilesInBbox calls cb for the tiles between minZoom and maxZoom inclusive that share
+// a non-empty area with a lon/lat rectangle. Entries are clipped to contiguous runs of matching tiles,
+// and leaf directories containing no matching tiles are not fetched.
+func IterateTilesInBbox(header HeaderV3, fetcher SectionFetcher, minLon float64, minLat float64, maxLon float64, maxLat float64, minZoom uint8, maxZoom uint8, cb func(EntryV3)) error {
+	if maxZoom > MaxTileZoom {
+		return fmt.Errorf("maxzoom %d is greater than %d", maxZoom, MaxTileZoom)
+	}
+	tiles := newBboxTiles(minLon, minLat, maxLon, maxLat, minZoom, maxZoom)
+
+	var collect func(uint64, uint64, uint64) error
+	collect = func(dirOffset uint64, dirLength uint64, dirEnd uint64) error {
+		data, err := fetcher.FetchSection(dirOffset, dirLength)
+		if err != nil {
+			return err
+		}
+
+		directory := DeserializeEntries(bytes.NewBuffer(data), header.InternalCompression)
+		for idx, entry := range directory {
+			if entry.RunLength > 0 {
+				// emit each contiguous span of matching tiles in the run
+				var spanStart uint64
+				var spanLength uint32
+				tiles.spans(entry.TileID, entry.TileID+uint64(entry.RunLength), func(first uint64, last uint64) bool {
+					if spanLength > 0 && first == spanStart+uint64(spanLength) {
+						spanLength += uint32(last - first + 1)
+						return true
+					}
+					if spanLength > 0 {
+						cb(EntryV3{spanStart, entry.Offset, entry.Length, spanLength})
+					}
+					spanStart = first
+					spanLength = uint32(last - first + 1)
+					return true
+				})
+				if spanLength > 0 {
+					cb(EntryV3{spanStart, entry.Offset, entry.Length, spanLength})
+				}
+			} else {
+				// a leaf directory spans the tile IDs up to the next entry
+				leafEnd := dirEnd
+				if idx+1 < len(directory) {
+					leafEnd = directory[idx+1].TileID
+				}
+				if !tiles.any(entry.TileID, leafEnd) {
+					continue
+				}
+				if err := collect(header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length), leafEnd); err != nil {
+					return err
+				}
 			}
 		}
 		return nil
 	}
 
-	return CollectEntries(header.RootOffset, header.RootLength)
+	return collect(header.RootOffset, header.RootLength, math.MaxUint64)
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
 	"math/rand"
+	"sort"
 	"testing"
 )
 
@@ -107,6 +108,15 @@ func TestHeaderRoundtrip(t *testing.T) {
 	assert.Equal(t, int32(32000000), result.CenterLatE7)
 }
 
+func TestHeaderZoomOutOfRange(t *testing.T) {
+	_, err := DeserializeHeader(SerializeHeader(HeaderV3{SpecVersion: 3, MaxZoom: MaxTileZoom}))
+	assert.Nil(t, err)
+	_, err = DeserializeHeader(SerializeHeader(HeaderV3{SpecVersion: 3, MaxZoom: MaxTileZoom + 1}))
+	assert.Error(t, err)
+	_, err = DeserializeHeader(SerializeHeader(HeaderV3{SpecVersion: 3, MinZoom: 255}))
+	assert.Error(t, err)
+}
+
 func TestHeaderJsonRoundtrip(t *testing.T) {
 	header := HeaderV3{}
 	header.TileCompression = Brotli
@@ -269,3 +279,148 @@ func TestMetadataRoundtrip(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "bar", newData["foo"])
 }
+
+func TestDirectoryRoundtripZstd(t *testing.T) {
+	entries := make([]EntryV3, 0)
+	entries = append(entries, EntryV3{0, 0, 0, 0})
+	entries = append(entries, EntryV3{1, 1, 1, 1})
+	entries = append(entries, EntryV3{2, 2, 2, 2})
+
+	serialized := SerializeEntries(entries, Zstd)
+	assert.Equal(t, Compression(Zstd), detectCompression(serialized))
+	result := DeserializeEntries(bytes.NewBuffer(serialized), Zstd)
+	assert.Equal(t, entries, result)
+}
+
+func TestMetadataRoundtripZstd(t *testing.T) {
+	data := map[string]interface{}{
+		"foo": "bar",
+	}
+	b, err := SerializeMetadata(data, Zstd)
+	assert.Nil(t, err)
+	newData, err := DeserializeMetadata(bytes.NewReader(b), Zstd)
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", newData["foo"])
+}
+
+func TestDirectoryRoundtripBrotli(t *testing.T) {
+	entries := make([]EntryV3, 0)
+	entries = append(entries, EntryV3{0, 0, 0, 0})
+	entries = append(entries, EntryV3{1, 1, 1, 1})
+	entries = append(entries, EntryV3{2, 2, 2, 2})
+
+	serialized := SerializeEntries(entries, Brotli)
+	result := DeserializeEntries(bytes.NewBuffer(serialized), Brotli)
+	assert.Equal(t, entries, result)
+}
+
+func TestMetadataRoundtripBrotli(t *testing.T) {
+	data := map[string]interface{}{
+		"foo": "bar",
+	}
+	b, err := SerializeMetadata(data, Brotli)
+	assert.Nil(t, err)
+	newData, err := DeserializeMetadata(bytes.NewReader(b), Brotli)
+	assert.Nil(t, err)
+	assert.Equal(t, "bar", newData["foo"])
+}
+
+func TestIterateTilesInBbox(t *testing.T) {
+	entries := make([]EntryV3, 0)
+	for z := uint8(0); z <= 4; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				entries = append(entries, EntryV3{ZxyToID(z, x, y), 0, 1, 1})
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].TileID < entries[j].TileID })
+	// collapse into runs so that entries must be clipped
+	runs := []EntryV3{entries[0]}
+	for _, e := range entries[1:] {
+		last := &runs[len(runs)-1]
+		if e.TileID == last.TileID+uint64(last.RunLength) && last.RunLength < 10 {
+			last.RunLength++
+		} else {
+			runs = append(runs, e)
+		}
+	}
+
+	// force leaf directories with a small root
+	header := HeaderV3{InternalCompression: Gzip}
+	rootBytes, leavesBytes, numLeaves := buildRootsLeaves(runs, 4, Gzip)
+	assert.Greater(t, numLeaves, 0)
+	archive := append(rootBytes, leavesBytes...)
+	header.RootLength = uint64(len(rootBytes))
+	header.LeafDirectoryOffset = uint64(len(rootBytes))
+	header.LeafDirectoryLength = uint64(len(leavesBytes))
+
+	fetches := 0
+	fetch := FetchSectionFunc(func(offset uint64, length uint64) ([]byte, error) {
+		fetches++
+		return archive[offset : offset+length], nil
+	})
+
+	result := make(map[uint64]bool)
+	err := IterateTilesInBbox(header, fetch, 1, 1, 50, 50, 1, 4, func(e EntryV3) {
+		for i := uint32(0); i < e.RunLength; i++ {
+			result[e.TileID+uint64(i)] = true
+		}
+	})
+	assert.Nil(t, err)
+	assert.Less(t, fetches, 1+numLeaves)
+
+	expected := make(map[uint64]bool)
+	for _, zxy := range [][3]uint32{{1, 1, 0}, {2, 2, 1}, {3, 4, 2}, {3, 5, 2}, {3, 4, 3}, {3, 5, 3},
+		{4, 8, 5}, {4, 9, 5}, {4, 10, 5}, {4, 8, 6}, {4, 9, 6}, {4, 10, 6}, {4, 8, 7}, {4, 9, 7}, {4, 10, 7}} {
+		expected[ZxyToID(uint8(zxy[0]), zxy[1], zxy[2])] = true
+	}
+	assert.Equal(t, expected, result)
+
+	assert.Error(t, IterateTilesInBbox(header, fetch, 1, 1, 50, 50, 0, 255, func(e EntryV3) {}))
+}
+
+func TestDeserializeCorrupt(t *testing.T) {
+	_, err := DeserializeHeader([]byte("PMTiles\x03"))
+	assert.Error(t, err)
+
+	// a count larger than the entries present stops at the end of the data, one byte per value
+	data := SerializeEntries([]EntryV3{{0, 0, 10, 1}, {1, 10, 5, 1}}, NoCompression)
+	data[0] = 100
+	assert.Equal(t, 8, len(DeserializeEntries(bytes.NewBuffer(data), NoCompression)))
+
+	// a leaf directory containing itself
+	data = SerializeEntries([]EntryV3{{0, 0, 10, 0}}, NoCompression)
+	header := HeaderV3{RootLength: uint64(len(data)), InternalCompression: NoCompression}
+	err = IterateEntries(header, FetchSectionFunc(func(offset uint64, length uint64) ([]byte, error) {
+		return data, nil
+	}), func(e EntryV3) {})
+	assert.Error(t, err)
+}
+
+func FuzzDeserializeHeader(f *testing.F) {
+	f.Add(SerializeHeader(HeaderV3{SpecVersion: 3, RootOffset: HeaderV3LenBytes, RootLength: 100, TileType: Mvt, MaxZoom: 14, MinLonE7: -1800000000, MaxLonE7: 1800000000}))
+	f.Add([]byte{})
+	f.Add([]byte("PMTiles"))
+	f.Add(make([]byte, HeaderV3LenBytes))
+	f.Add(append([]byte("PMTiles\x03"), bytes.Repeat([]byte{0xff}, HeaderV3LenBytes-8)...))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		DeserializeHeader(data)
+	})
+}
+
+func FuzzIterateEntries(f *testing.F) {
+	f.Add(SerializeEntries([]EntryV3{{0, 0, 10, 1}, {1, 10, 5, 3}, {5, 15, 1, 1}}, NoCompression))
+	f.Add(SerializeEntries([]EntryV3{{0, 0, 10, 0}}, NoCompression))
+	f.Add([]byte{})
+	f.Add(make([]byte, 16))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header := HeaderV3{RootLength: uint64(len(data)), InternalCompression: NoCompression}
+		// every directory, including leaves, has the fuzzed contents
+		fetcher := FetchSectionFunc(func(offset uint64, length uint64) ([]byte, error) {
+			return data, nil
+		})
+		IterateEntries(header, fetcher, func(e EntryV3) {})
+	})
+}
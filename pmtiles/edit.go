@@ -2,18 +2,21 @@ package pmtiles
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/schollz/progressbar/v3"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 // Edit parts of the header or metadata.
 // works in-place if only the header is modified.
-func Edit(_ *log.Logger, inputArchive string, newHeaderJSONFile string, newMetadataFile string) error {
+func Edit(_ *log.Logger, inputArchive string, newHeaderJSONFile string, newMetadataFile string, progress ...ProgressReporter) error {
 	if newHeaderJSONFile == "" && newMetadataFile == "" {
 		return fmt.Errorf("must supply --header-json and/or --metadata to edit")
 	}
@@ -93,9 +96,15 @@ func Edit(_ *log.Logger, inputArchive string, newHeaderJSONFile string, newMetad
 		return err
 	}
 
-	tempFilePath := inputArchive + ".tmp"
+	return rewriteWithMetadata(file, inputArchive, oldHeader, newHeader, metadataBytes, progress)
+}
+
+// rewriteWithMetadata copies the archive in file to a new file with the given header and metadata section,
+// then replaces the archive at path with it, reporting the bytes written to the first of progress or a progress bar.
+func rewriteWithMetadata(file *os.File, path string, oldHeader HeaderV3, newHeader HeaderV3, metadataBytes []byte, progress []ProgressReporter) error {
+	tempFilePath := path + ".tmp"
 
-	if _, err = os.Stat(tempFilePath); err == nil {
+	if _, err := os.Stat(tempFilePath); err == nil {
 		return fmt.Errorf("A file with the same name already exists")
 	}
 
@@ -110,12 +119,12 @@ func Edit(_ *log.Logger, inputArchive string, newHeaderJSONFile string, newMetad
 	newHeader.LeafDirectoryOffset = newHeader.MetadataOffset + newHeader.MetadataLength
 	newHeader.TileDataOffset = newHeader.LeafDirectoryOffset + newHeader.LeafDirectoryLength
 
-	bar := progressbar.DefaultBytes(
+	bar := newBytesProgress(progress,
 		int64(HeaderV3LenBytes+newHeader.RootLength+uint64(len(metadataBytes))+newHeader.LeafDirectoryLength+newHeader.TileDataLength),
 		"writing file",
 	)
 
-	buf = SerializeHeader(newHeader)
+	buf := SerializeHeader(newHeader)
 	io.Copy(io.MultiWriter(outfile, bar), bytes.NewReader(buf))
 
 	rootSection := io.NewSectionReader(file, int64(oldHeader.RootOffset), int64(oldHeader.RootLength))
@@ -140,8 +149,141 @@ func Edit(_ *log.Logger, inputArchive string, newHeaderJSONFile string, newMetad
 	// explicitly close in order to rename
 	file.Close()
 	outfile.Close()
-	if err := os.Rename(tempFilePath, inputArchive); err != nil {
+	if err := os.Rename(tempFilePath, path); err != nil {
 		return err
 	}
 	return nil
 }
+
+// serializeMetadataToLength serializes metadata to exactly length bytes if possible,
+// using padding that readers ignore: JSON whitespace, a gzip header comment or a zstd skippable frame.
+// ok is false if the serialized metadata cannot be made to fit.
+func serializeMetadataToLength(metadata map[string]interface{}, compression Compression, length int) ([]byte, bool, error) {
+	metadataBytes, err := SerializeMetadata(metadata, compression)
+	if err != nil {
+		return nil, false, err
+	}
+	pad := length - len(metadataBytes)
+	if pad == 0 {
+		return metadataBytes, true, nil
+	}
+	if pad < 0 {
+		return metadataBytes, false, nil
+	}
+
+	switch compression {
+	case NoCompression:
+		return append(metadataBytes, bytes.Repeat([]byte(" "), pad)...), true, nil
+	case Gzip:
+		// a header comment takes its length plus a terminating zero byte
+		if pad < 2 {
+			return metadataBytes, false, nil
+		}
+		jsonBytes, err := marshalMetadata(metadata)
+		if err != nil {
+			return nil, false, err
+		}
+		var b bytes.Buffer
+		w, err := newGzipWriter(&b, gzip.BestCompression)
+		if err != nil {
+			return nil, false, err
+		}
+		w.Comment = strings.Repeat(" ", pad-1)
+		w.Write(jsonBytes)
+		w.Close()
+		return b.Bytes(), b.Len() == length, nil
+	case Zstd:
+		// a skippable frame has a 4 byte magic number and a 4 byte length
+		if pad < 8 {
+			return metadataBytes, false, nil
+		}
+		frame := make([]byte, pad)
+		binary.LittleEndian.PutUint32(frame[0:4], 0x184D2A50)
+		binary.LittleEndian.PutUint32(frame[4:8], uint32(pad-8))
+		return append(metadataBytes, frame...), true, nil
+	}
+	return metadataBytes, false, nil
+}
+
+// UpdateMetadata merges updates into the JSON metadata of a local archive; keys with a nil value are removed.
+// The metadata section is rewritten in place if the new metadata fits in it,
+// otherwise the archive is copied with updated offsets.
+func UpdateMetadata(path string, updates map[string]interface{}) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := lockFile(file); err != nil {
+		return fmt.Errorf("Failed to lock %s, %w", path, err)
+	}
+	defer unlockFile(file)
+
+	buf := make([]byte, HeaderV3LenBytes)
+	if _, err := io.ReadFull(file, buf); err != nil {
+		return err
+	}
+	header, err := DeserializeHeader(buf)
+	if err != nil {
+		return err
+	}
+
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata, %w", err)
+	}
+
+	for k, v := range updates {
+		if v == nil {
+			delete(metadata, k)
+		} else {
+			metadata[k] = v
+		}
+	}
+
+	metadataBytes, fits, err := serializeMetadataToLength(metadata, header.InternalCompression, int(header.MetadataLength))
+	if err != nil {
+		return fmt.Errorf("Failed to serialize metadata, %w", err)
+	}
+
+	if fits {
+		if _, err := file.WriteAt(metadataBytes, int64(header.MetadataOffset)); err != nil {
+			return err
+		}
+		return file.Sync()
+	}
+
+	return rewriteWithMetadata(file, path, header, header, metadataBytes, nil)
+}
+
+// ErrMetadataKeyNotFound is returned by GetMetadataKey for a key missing from the metadata of an archive.
+var ErrMetadataKeyNotFound = errors.New("metadata key not found")
+
+// GetMetadataKey returns the JSON value of a key in the metadata of a local archive,
+// or an error wrapping ErrMetadataKeyNotFound if the metadata does not contain it.
+func GetMetadataKey(path string, key string) (interface{}, error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read metadata, %w", err)
+	}
+	value, ok := metadata[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrMetadataKeyNotFound, key)
+	}
+	return value, nil
+}
+
+// SetMetadataKey sets a key in the JSON metadata of a local archive to value, or removes it if value is nil,
+// rewriting the metadata in place like UpdateMetadata when it fits.
+func SetMetadataKey(path string, key string, value interface{}) error {
+	return UpdateMetadata(path, map[string]interface{}{key: value})
+}
@@ -3,12 +3,14 @@ package pmtiles
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -148,3 +150,69 @@ func TestTempfileExists(t *testing.T) {
 	err := Edit(logger, fileToEdit, "", metadataPath)
 	assert.Error(t, err)
 }
+
+func TestUpdateMetadataInPlace(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, Gzip, Zstd} {
+		path := filepath.Join(t.TempDir(), "archive.pmtiles")
+		var b bytes.Buffer
+		w, err := NewWriter(&b, WriterOptions{TmpDir: t.TempDir()})
+		assert.Nil(t, err)
+		assert.Nil(t, w.AddTile(0, 0, 0, []byte("a")))
+		_, err = w.Finalize(HeaderV3{TileType: Png, InternalCompression: compression, MinLonE7: -10 * 10000000, MaxLonE7: 10 * 10000000, MinLatE7: -10 * 10000000, MaxLatE7: 10 * 10000000}, map[string]interface{}{"name": "a long name to be shortened", "attribution": "something"})
+		assert.Nil(t, err)
+		w.Close()
+		assert.Nil(t, os.WriteFile(path, b.Bytes(), 0644))
+
+		err = UpdateMetadata(path, map[string]interface{}{"name": "short", "attribution": nil})
+		assert.Nil(t, err)
+
+		archive, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		assert.Equal(t, b.Len(), len(archive))
+		header, err := DeserializeHeader(archive[0:HeaderV3LenBytes])
+		assert.Nil(t, err)
+		metadata, err := DeserializeMetadata(bytes.NewReader(archive[header.MetadataOffset:header.MetadataOffset+header.MetadataLength]), compression)
+		assert.Nil(t, err)
+		assert.Equal(t, map[string]interface{}{"name": "short"}, metadata)
+		assert.Nil(t, Verify(logger, path))
+	}
+}
+
+func TestUpdateMetadataGrow(t *testing.T) {
+	path := makeFixtureCopy(t, "test_fixture_1", "update_metadata")
+
+	err := UpdateMetadata(path, map[string]interface{}{"description": strings.Repeat("a much longer description ", 100)})
+	assert.Nil(t, err)
+
+	archive, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	header, err := DeserializeHeader(archive[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	metadata, err := DeserializeMetadata(bytes.NewReader(archive[header.MetadataOffset:header.MetadataOffset+header.MetadataLength]), header.InternalCompression)
+	assert.Nil(t, err)
+	assert.Contains(t, metadata["description"], "a much longer description")
+	assert.Contains(t, metadata, "vector_layers")
+}
+
+func TestGetSetMetadataKey(t *testing.T) {
+	path := makeFixtureCopy(t, "test_fixture_1", "metadata_key")
+
+	_, err := GetMetadataKey(path, "missing")
+	assert.True(t, errors.Is(err, ErrMetadataKeyNotFound))
+
+	assert.Nil(t, SetMetadataKey(path, "attribution", "© contributors"))
+	value, err := GetMetadataKey(path, "attribution")
+	assert.Nil(t, err)
+	assert.Equal(t, "© contributors", value)
+	value, err = GetMetadataKey(path, "vector_layers")
+	assert.Nil(t, err)
+	assert.IsType(t, []interface{}{}, value)
+
+	assert.Nil(t, SetMetadataKey(path, "attribution", nil))
+	_, err = GetMetadataKey(path, "attribution")
+	assert.True(t, errors.Is(err, ErrMetadataKeyNotFound))
+
+	_, err = GetMetadataKey(filepath.Join(t.TempDir(), "none.pmtiles"), "name")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrMetadataKeyNotFound))
+}
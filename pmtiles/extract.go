@@ -4,19 +4,19 @@ import (
 	"bytes"
 	"container/list"
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/dustin/go-humanize"
 	"github.com/paulmach/orb"
-	"github.com/schollz/progressbar/v3"
 	"golang.org/x/sync/errgroup"
 	"io"
-	"io/ioutil"
 	"log"
 	"math"
 	"os"
 	"sort"
 	"sync"
+	"text/tabwriter"
 	"time"
 )
 
@@ -122,6 +122,20 @@ func reencodeEntries(dir []EntryV3) ([]EntryV3, []srcDstRange, uint64, uint64, u
 	return reencoded, ranges, dstOffset, addressedTiles, uint64(len(seenOffsets))
 }
 
+// extractMetadata sets the minzoom and maxzoom of the metadata of an extract, stored with the internal compression
+// of header, to the zoom levels of header. Metadata that is not a JSON object is kept unchanged.
+func extractMetadata(metadataBytes []byte, header HeaderV3) ([]byte, error) {
+	if len(metadataBytes) == 0 {
+		return metadataBytes, nil
+	}
+	metadata, err := DeserializeMetadata(bytes.NewReader(metadataBytes), header.InternalCompression)
+	if err != nil || metadata == nil {
+		return metadataBytes, nil
+	}
+	setMetadataZooms(metadata, header.MinZoom, header.MaxZoom)
+	return SerializeMetadata(metadata, header.InternalCompression)
+}
+
 // "want the next N bytes, then discard N bytes"
 type copyDiscard struct {
 	Wanted  uint64
@@ -234,63 +248,44 @@ func MergeRanges(ranges []srcDstRange, overfetch float32) (*list.List, uint64) {
 	return result, totalBytes
 }
 
-// Extract a smaller archive from local or remote archive.
-// 1. Get the root directory (check that it is clustered)
-// 2. Turn the input geometry into a relevance bitmap (using min(maxzoom, headermaxzoom))
-// 3. Get all relevant level 1 directories (if any)
-// 4. Get all relevant level 2 directories (usually none)
-// 5. With the existing directory + relevance bitmap, construct
-//   - a new total directory (root + leaf directories)
-//   - a sorted slice of byte ranges in the old file required
-//
-// 6. Merge requested ranges using an overfetch parametter
-// 7. write the modified header
-// 8. write the root directory.
-// 9. get and write the metadata.
-// 10. write the leaf directories (if any)
-// 11. Get all tiles, and write directly to the output.
-func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom int8, regionFile string, bbox string, output string, downloadThreads int, overfetch float32, dryRun bool) error {
-	// 1. fetch the header
-	start := time.Now()
-	ctx := context.Background()
-
-	bucketURL, key, err := NormalizeBucketKey(bucketURL, "", key)
-
-	if err != nil {
-		return err
-	}
-
-	bucket, err := OpenBucket(ctx, bucketURL, "")
-
-	if err != nil {
-		return err
-	}
-
-	if err != nil {
-		return fmt.Errorf("Failed to open bucket for %s, %w", bucketURL, err)
-	}
-	defer bucket.Close()
+// extractPlan is the selection of an extract, computed from the header and directories of the source archive.
+type extractPlan struct {
+	header         HeaderV3 // the source header, with the zoom levels and bounds of the extract
+	regionTiles    uint64   // tile IDs of the region, whether in the archive or not
+	tileEntries    []EntryV3
+	reencoded      []EntryV3
+	tileParts      []srcDstRange
+	tileDataLength uint64
+	addressedTiles uint64
+	tileContents   uint64
+	leaves         int // relevant leaf directories
+	leafChunks     int
+	leafRequests   int
+}
 
+// planExtract reads the header and the relevant directories of key in bucket,
+// selecting the entries of region, or of all tiles if it is nil, between minzoom and maxzoom as described by Extract.
+func planExtract(ctx context.Context, bucket Bucket, key string, minzoom int8, maxzoom int8, region orb.MultiPolygon, overfetch float32) (extractPlan, error) {
 	r, err := bucket.NewRangeReader(ctx, key, 0, HeaderV3LenBytes)
 
 	if err != nil {
-		return fmt.Errorf("Failed to create range reader for %s, %w", key, err)
+		return extractPlan{}, fmt.Errorf("Failed to create range reader for %s, %w", key, err)
 	}
 	b, err := io.ReadAll(r)
 	if err != nil {
-		return err
+		return extractPlan{}, err
 	}
 	r.Close()
 
 	header, err := DeserializeHeader(b[0:HeaderV3LenBytes])
+	if err != nil {
+		return extractPlan{}, err
+	}
 
 	if !header.Clustered {
-		return fmt.Errorf("source archive must be clustered for extracts")
+		return extractPlan{}, fmt.Errorf("source archive must be clustered for extracts")
 	}
 
-	sourceMetadataOffset := header.MetadataOffset
-	sourceTileDataOffset := header.TileDataOffset
-
 	if minzoom == -1 || int8(header.MinZoom) > minzoom {
 		minzoom = int8(header.MinZoom)
 	}
@@ -300,36 +295,16 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 	}
 
 	if minzoom > maxzoom {
-		return fmt.Errorf("minzoom cannot be greater than maxzoom")
+		return extractPlan{}, fmt.Errorf("minzoom cannot be greater than maxzoom")
 	}
 
 	var relevantSet *roaring64.Bitmap
-	if regionFile != "" || bbox != "" {
-		if regionFile != "" && bbox != "" {
-			return fmt.Errorf("only one of region and bbox can be specified")
-		}
-
-		var multipolygon orb.MultiPolygon
-
-		if regionFile != "" {
-			dat, _ := ioutil.ReadFile(regionFile)
-			multipolygon, err = UnmarshalRegion(dat)
-
-			if err != nil {
-				return err
-			}
-		} else {
-			multipolygon, err = BboxRegion(bbox)
-			if err != nil {
-				return err
-			}
-		}
-
+	if region != nil {
 		// 2. construct a relevance bitmap
 
-		bound := multipolygon.Bound()
+		bound := region.Bound()
 
-		boundarySet, interiorSet := bitmapMultiPolygon(uint8(maxzoom), multipolygon)
+		boundarySet, interiorSet := bitmapMultiPolygon(uint8(maxzoom), region)
 		relevantSet = boundarySet
 		relevantSet.Or(interiorSet)
 		generalizeOr(relevantSet, uint8(minzoom))
@@ -351,12 +326,12 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 
 	rootReader, err := bucket.NewRangeReader(ctx, key, int64(dirOffset), int64(dirLength))
 	if err != nil {
-		return err
+		return extractPlan{}, err
 	}
 	defer rootReader.Close()
 	rootBytes, err := io.ReadAll(rootReader)
 	if err != nil {
-		return err
+		return extractPlan{}, err
 	}
 
 	rootDir := DeserializeEntries(bytes.NewBuffer(rootBytes), header.InternalCompression)
@@ -372,7 +347,6 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 
 	overfetchLeaves, _ := MergeRanges(leafRanges, overfetch)
 	numOverfetchLeaves := overfetchLeaves.Len()
-	fmt.Printf("fetching %d dirs, %d chunks, %d requests\n", len(leaves), len(leafRanges), overfetchLeaves.Len())
 
 	for {
 		if overfetchLeaves.Len() == 0 {
@@ -382,7 +356,7 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 
 		chunkReader, err := bucket.NewRangeReader(ctx, key, int64(or.Rng.SrcOffset), int64(or.Rng.Length))
 		if err != nil {
-			return err
+			return extractPlan{}, err
 		}
 
 		for _, cd := range or.CopyDiscards {
@@ -390,7 +364,7 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 			leafBytes := make([]byte, cd.Wanted)
 			_, err := io.ReadFull(chunkReader, leafBytes)
 			if err != nil {
-				return err
+				return extractPlan{}, err
 			}
 			leafdir := DeserializeEntries(bytes.NewBuffer(leafBytes), header.InternalCompression)
 			newEntries, newLeaves := RelevantEntries(relevantSet, uint8(maxzoom), leafdir)
@@ -402,7 +376,7 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 
 			_, err = io.CopyN(io.Discard, chunkReader, int64(cd.Discard))
 			if err != nil {
-				return err
+				return extractPlan{}, err
 			}
 		}
 		chunkReader.Close()
@@ -412,17 +386,174 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 		return tileEntries[i].TileID < tileEntries[j].TileID
 	})
 
-	fmt.Printf("Region tiles %d, result tile entries %d\n", relevantSet.GetCardinality(), len(tileEntries))
-
-	// 6. create the new header and chunk list
+	// 6. create the new chunk list
 	// we now need to re-encode this entry list using cumulative offsets
 	reencoded, tileParts, tiledataLength, addressedTiles, tileContents := reencodeEntries(tileEntries)
 
+	header.MaxZoom = uint8(maxzoom)
+	header.MinZoom = uint8(minzoom)
+	header.CenterZoom = min(max(header.CenterZoom, header.MinZoom), header.MaxZoom)
+
+	return extractPlan{
+		header:         header,
+		regionTiles:    relevantSet.GetCardinality(),
+		tileEntries:    tileEntries,
+		reencoded:      reencoded,
+		tileParts:      tileParts,
+		tileDataLength: tiledataLength,
+		addressedTiles: addressedTiles,
+		tileContents:   tileContents,
+		leaves:         len(leaves),
+		leafChunks:     len(leafRanges),
+		leafRequests:   numOverfetchLeaves,
+	}, nil
+}
+
+// extractRequests is the number of range requests of an extract: the header, root directory,
+// leaf directories, metadata and tile data.
+func extractRequests(leafRequests int, tileRequests int) int {
+	return 2 + leafRequests + 1 + tileRequests
+}
+
+// ExtractEstimate is what Extract transfers for an area and zoom levels.
+type ExtractEstimate struct {
+	AddressedTiles uint64 `json:"addressed_tiles"`
+	TileEntries    int    `json:"tile_entries"`
+	TileContents   uint64 `json:"tile_contents"`
+	// TileDataBytes is the length of the tile data of the extract.
+	TileDataBytes uint64 `json:"tile_data_bytes"`
+	// TransferBytes is the tile data fetched from the source, including overfetch.
+	TransferBytes uint64 `json:"transfer_bytes"`
+	// Requests counts all range requests, including those for the header, directories and metadata.
+	Requests int `json:"requests"`
+}
+
+// EstimateExtract computes the ExtractEstimate of an ExtractGeometry with the same arguments
+// from the header and directories of the source archive, without fetching any tile data.
+func EstimateExtract(bucketURL string, key string, minzoom int8, maxzoom int8, region orb.MultiPolygon, overfetch float32, retry RetryOptions, limit RateLimit) (ExtractEstimate, error) {
+	ctx := context.Background()
+	bucketURL, key, err := NormalizeBucketKey(bucketURL, "", key)
+	if err != nil {
+		return ExtractEstimate{}, err
+	}
+	bucket, err := OpenBucket(ctx, bucketURL, "")
+	if err != nil {
+		return ExtractEstimate{}, fmt.Errorf("Failed to open bucket for %s, %w", bucketURL, err)
+	}
+	defer bucket.Close()
+	bucket = NewRetryBucket(NewRateLimitBucket(bucket, limit), retry)
+
+	plan, err := planExtract(ctx, bucket, key, minzoom, maxzoom, region, overfetch)
+	if err != nil {
+		return ExtractEstimate{}, err
+	}
+	overfetchRanges, transferBytes := MergeRanges(plan.tileParts, overfetch)
+	return ExtractEstimate{
+		AddressedTiles: plan.addressedTiles,
+		TileEntries:    len(plan.reencoded),
+		TileContents:   plan.tileContents,
+		TileDataBytes:  plan.tileDataLength,
+		TransferBytes:  transferBytes,
+		Requests:       extractRequests(plan.leafRequests, overfetchRanges.Len()),
+	}, nil
+}
+
+// WriteExtractEstimate writes estimate to w as a table, or as JSON if format is "json".
+func WriteExtractEstimate(w io.Writer, estimate ExtractEstimate, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(estimate)
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "addressed tiles\t%d\n", estimate.AddressedTiles)
+	fmt.Fprintf(tw, "tile entries\t%d\n", estimate.TileEntries)
+	fmt.Fprintf(tw, "tile contents\t%d\n", estimate.TileContents)
+	fmt.Fprintf(tw, "tile data\t%s\n", humanize.Bytes(estimate.TileDataBytes))
+	fmt.Fprintf(tw, "transferred tile data\t%s\n", humanize.Bytes(estimate.TransferBytes))
+	fmt.Fprintf(tw, "requests\t%d\n", estimate.Requests)
+	return tw.Flush()
+}
+
+// Extract a smaller archive from local or remote archive.
+// 1. Get the root directory (check that it is clustered)
+// 2. Turn the input geometry into a relevance bitmap (using min(maxzoom, headermaxzoom))
+// 3. Get all relevant level 1 directories (if any)
+// 4. Get all relevant level 2 directories (usually none)
+// 5. With the existing directory + relevance bitmap, construct
+//   - a new total directory (root + leaf directories)
+//   - a sorted slice of byte ranges in the old file required
+//
+// 6. Merge requested ranges using an overfetch parametter
+// 7. write the modified header
+// 8. write the root directory.
+// 9. get and write the metadata.
+// 10. write the leaf directories (if any)
+// 11. Get all tiles, and write directly to the output.
+//
+// Steps 1 to 6 are shared with EstimateExtract.
+func Extract(logger *log.Logger, bucketURL string, key string, minzoom int8, maxzoom int8, regionFile string, bbox string, output string, downloadThreads int, overfetch float32, dryRun bool, progress ...ProgressReporter) error {
+	region, err := LoadRegion(regionFile, bbox)
+	if err != nil {
+		return err
+	}
+	return ExtractGeometry(logger, bucketURL, key, minzoom, maxzoom, region, output, downloadThreads, overfetch, RetryOptions{}, RateLimit{}, dryRun, progress...)
+}
+
+// ExtractGeometry extracts an archive like Extract for the area of region, or all tiles if it is nil.
+// Failed reads of the source archive are retried as configured by retry, and all reads are paced to limit.
+func ExtractGeometry(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom int8, region orb.MultiPolygon, output string, downloadThreads int, overfetch float32, retry RetryOptions, limit RateLimit, dryRun bool, progress ...ProgressReporter) error {
+	start := time.Now()
+	ctx := context.Background()
+
+	bucketURL, key, err := NormalizeBucketKey(bucketURL, "", key)
+
+	if err != nil {
+		return err
+	}
+
+	bucket, err := OpenBucket(ctx, bucketURL, "")
+
+	if err != nil {
+		return fmt.Errorf("Failed to open bucket for %s, %w", bucketURL, err)
+	}
+	defer bucket.Close()
+	limited := NewRateLimitBucket(bucket, limit)
+	bucket = NewRetryBucket(limited, retry)
+
+	plan, err := planExtract(ctx, bucket, key, minzoom, maxzoom, region, overfetch)
+	if err != nil {
+		return err
+	}
+	header := plan.header
+	sourceMetadataOffset := header.MetadataOffset
+	sourceTileDataOffset := header.TileDataOffset
+	tileEntries, reencoded, tileParts := plan.tileEntries, plan.reencoded, plan.tileParts
+	numOverfetchLeaves := plan.leafRequests
+	fmt.Printf("fetching %d dirs, %d chunks, %d requests\n", plan.leaves, plan.leafChunks, numOverfetchLeaves)
+	fmt.Printf("Region tiles %d, result tile entries %d\n", plan.regionTiles, len(tileEntries))
+
 	overfetchRanges, totalBytes := MergeRanges(tileParts, overfetch)
 
 	numOverfetchRanges := overfetchRanges.Len()
 	fmt.Printf("fetching %d tiles, %d chunks, %d requests\n", len(reencoded), len(tileParts), overfetchRanges.Len())
 
+	// 9. get the metadata, with the zoom levels of the extract
+	metadataReader, err := bucket.NewRangeReader(ctx, key, int64(sourceMetadataOffset), int64(header.MetadataLength))
+	if err != nil {
+		return err
+	}
+	metadataBytes, err := io.ReadAll(metadataReader)
+	metadataReader.Close()
+	if err != nil {
+		return err
+	}
+	metadataBytes, err = extractMetadata(metadataBytes, header)
+	if err != nil {
+		return err
+	}
+	header.MetadataLength = uint64(len(metadataBytes))
+
 	// TODO: takes up too much RAM
 	// construct the directories
 	newRootBytes, newLeavesBytes, _ := optimizeDirectories(reencoded, 16384-HeaderV3LenBytes, Gzip)
@@ -435,13 +566,10 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 	header.LeafDirectoryLength = uint64(len(newLeavesBytes))
 	header.TileDataOffset = header.LeafDirectoryOffset + header.LeafDirectoryLength
 
-	header.TileDataLength = tiledataLength
-	header.AddressedTilesCount = addressedTiles
+	header.TileDataLength = plan.tileDataLength
+	header.AddressedTilesCount = plan.addressedTiles
 	header.TileEntriesCount = uint64(len(tileEntries))
-	header.TileContentsCount = tileContents
-
-	header.MaxZoom = uint8(maxzoom)
-	header.MinZoom = uint8(minzoom)
+	header.TileContentsCount = plan.tileContents
 
 	headerBytes := SerializeHeader(header)
 
@@ -472,17 +600,7 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 			return err
 		}
 
-		// 9. get and write the metadata
-		metadataReader, err := bucket.NewRangeReader(ctx, key, int64(sourceMetadataOffset), int64(header.MetadataLength))
-		if err != nil {
-			return err
-		}
-		metadataBytes, err := io.ReadAll(metadataReader)
-		defer metadataReader.Close()
-		if err != nil {
-			return err
-		}
-
+		// 9. write the metadata
 		outfile.Write(metadataBytes)
 
 		// 10. write the leaf directories
@@ -491,7 +609,7 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 			return err
 		}
 
-		bar := progressbar.DefaultBytes(
+		bar := newBytesProgress(progress,
 			int64(totalBytes),
 			"fetching chunks",
 		)
@@ -558,12 +676,9 @@ func Extract(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom
 	}
 
 	fmt.Printf("Completed in %v with %v download threads (%v tiles/s).\n", time.Since(start), downloadThreads, float64(len(reencoded))/float64(time.Since(start).Seconds()))
-	totalRequests := 2                  // header + root
-	totalRequests += numOverfetchLeaves // leaves
-	totalRequests++                     // metadata
-	totalRequests += numOverfetchRanges
-	fmt.Printf("Extract required %d total requests.\n", totalRequests)
+	fmt.Printf("Extract required %d total requests.\n", extractRequests(numOverfetchLeaves, numOverfetchRanges))
 	fmt.Printf("Extract transferred %s (overfetch %v) for an archive size of %s\n", humanize.Bytes(totalBytes), overfetch, humanize.Bytes(totalActualBytes))
+	fmt.Printf("Read %s from the source archive at an average of %s/s.\n", humanize.Bytes(limited.BytesRead()), humanize.Bytes(averageThroughput(limited.BytesRead(), start)))
 
 	return nil
 }
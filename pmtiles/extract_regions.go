@@ -0,0 +1,375 @@
+package pmtiles
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/dustin/go-humanize"
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+	"golang.org/x/sync/errgroup"
+)
+
+// Region is an area of interest of ExtractRegions, whose ID names its output.
+type Region struct {
+	ID       string
+	Geometry orb.MultiPolygon
+}
+
+// RegionExtract describes the archive extracted for one region by ExtractRegions.
+type RegionExtract struct {
+	ID     string
+	Output string
+	// AddressedTiles is the number of tiles in the archive, and TileDataLength the length of their contents.
+	AddressedTiles uint64
+	TileDataLength uint64
+}
+
+// UnmarshalRegions parses a GeoJSON FeatureCollection into a region for each Polygon or MultiPolygon feature,
+// identified by its idProperty property, or by its feature id if idProperty is empty. IDs must be unique
+// and usable in a file name.
+func UnmarshalRegions(data []byte, idProperty string) ([]Region, error) {
+	fc, err := geojson.UnmarshalFeatureCollection(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse regions, %w", err)
+	}
+	seen := make(map[string]bool)
+	regions := make([]Region, 0, len(fc.Features))
+	for i, f := range fc.Features {
+		var geometry orb.MultiPolygon
+		switch v := f.Geometry.(type) {
+		case orb.Polygon:
+			geometry = orb.MultiPolygon{v}
+		case orb.MultiPolygon:
+			geometry = v
+		default:
+			continue
+		}
+		id := f.ID
+		if idProperty != "" {
+			id = f.Properties[idProperty]
+		}
+		if id == nil {
+			return nil, fmt.Errorf("feature %d has no id", i)
+		}
+		idString := fmt.Sprint(id)
+		if idString == "" || strings.ContainsAny(idString, `/\`) || strings.Contains(idString, "..") {
+			return nil, fmt.Errorf("feature %d has id %q, which cannot be used in a file name", i, idString)
+		}
+		if seen[idString] {
+			return nil, fmt.Errorf("features share the id %q", idString)
+		}
+		seen[idString] = true
+		regions = append(regions, Region{idString, geometry})
+	}
+	if len(regions) == 0 {
+		return nil, fmt.Errorf("no Polygon or MultiPolygon features")
+	}
+	return regions, nil
+}
+
+// regionOutput is an archive being written by ExtractRegions.
+type regionOutput struct {
+	file           *os.File
+	tileDataOffset uint64
+	// parts are the ranges of source tile data copied into the archive, sorted by source offset
+	parts []srcDstRange
+}
+
+// ExtractRegions extracts an archive for every Polygon or MultiPolygon feature of the GeoJSON FeatureCollection
+// in regionFile from a local or remote archive, as Extract does for a single region, named by replacing {id}
+// in outputTemplate with the feature's idProperty property, or its feature id if idProperty is empty.
+// The directories and tile data of the source archive are read once for all regions, so each byte range
+// is fetched a single time however many regions share its tiles. Reads are retried and paced as ExtractGeometry does.
+func ExtractRegions(_ *log.Logger, bucketURL string, key string, minzoom int8, maxzoom int8, regionFile string, idProperty string, outputTemplate string, downloadThreads int, overfetch float32, retry RetryOptions, limit RateLimit, dryRun bool, progress ...ProgressReporter) ([]RegionExtract, error) {
+	start := time.Now()
+	ctx := context.Background()
+
+	if !strings.Contains(outputTemplate, "{id}") {
+		return nil, fmt.Errorf("output template %s must contain {id}", outputTemplate)
+	}
+	data, err := os.ReadFile(regionFile)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, %w", regionFile, err)
+	}
+	regions, err := UnmarshalRegions(data, idProperty)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketURL, key, err = NormalizeBucketKey(bucketURL, "", key)
+	if err != nil {
+		return nil, err
+	}
+	bucket, err := OpenBucket(ctx, bucketURL, "")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open bucket for %s, %w", bucketURL, err)
+	}
+	defer bucket.Close()
+	limited := NewRateLimitBucket(bucket, limit)
+	bucket = NewRetryBucket(limited, retry)
+	fetch := func(offset uint64, length uint64) ([]byte, error) {
+		r, err := bucket.NewRangeReader(ctx, key, int64(offset), int64(length))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create range reader for %s, %w", key, err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+
+	b, err := fetch(0, HeaderV3LenBytes)
+	if err != nil {
+		return nil, err
+	}
+	header, err := DeserializeHeader(b)
+	if err != nil {
+		return nil, err
+	}
+	if !header.Clustered {
+		return nil, fmt.Errorf("source archive must be clustered for extracts")
+	}
+	if minzoom == -1 || int8(header.MinZoom) > minzoom {
+		minzoom = int8(header.MinZoom)
+	}
+	if maxzoom == -1 || int8(header.MaxZoom) < maxzoom {
+		maxzoom = int8(header.MaxZoom)
+	}
+	if minzoom > maxzoom {
+		return nil, fmt.Errorf("minzoom cannot be greater than maxzoom")
+	}
+
+	// the tiles of each region, and of all of them
+	relevantSets := make([]*roaring64.Bitmap, len(regions))
+	unionSet := roaring64.New()
+	for i, region := range regions {
+		boundarySet, interiorSet := bitmapMultiPolygon(uint8(maxzoom), region.Geometry)
+		boundarySet.Or(interiorSet)
+		generalizeOr(boundarySet, uint8(minzoom))
+		relevantSets[i] = boundarySet
+		unionSet.Or(boundarySet)
+	}
+
+	rootBytes, err := fetch(header.RootOffset, header.RootLength)
+	if err != nil {
+		return nil, err
+	}
+	rootDir := DeserializeEntries(bytes.NewBuffer(rootBytes), header.InternalCompression)
+	tileEntries, leaves := RelevantEntries(unionSet, uint8(maxzoom), rootDir)
+
+	leafRanges := make([]srcDstRange, 0, len(leaves))
+	for _, leaf := range leaves {
+		leafRanges = append(leafRanges, srcDstRange{header.LeafDirectoryOffset + leaf.Offset, 0, uint64(leaf.Length)})
+	}
+	overfetchLeaves, _ := MergeRanges(leafRanges, overfetch)
+	for overfetchLeaves.Len() > 0 {
+		or := overfetchLeaves.Remove(overfetchLeaves.Front()).(overfetchRange)
+		chunk, err := fetch(or.Rng.SrcOffset, or.Rng.Length)
+		if err != nil {
+			return nil, err
+		}
+		for _, cd := range or.CopyDiscards {
+			if uint64(len(chunk)) < cd.Wanted+cd.Discard {
+				return nil, fmt.Errorf("Failed to read leaf directories of %s", key)
+			}
+			leafdir := DeserializeEntries(bytes.NewBuffer(chunk[:cd.Wanted]), header.InternalCompression)
+			newEntries, newLeaves := RelevantEntries(unionSet, uint8(maxzoom), leafdir)
+			if len(newLeaves) > 0 {
+				return nil, fmt.Errorf("leaf directories nested more than one level deep are not supported")
+			}
+			tileEntries = append(tileEntries, newEntries...)
+			chunk = chunk[cd.Wanted+cd.Discard:]
+		}
+	}
+	sort.Slice(tileEntries, func(i, j int) bool {
+		return tileEntries[i].TileID < tileEntries[j].TileID
+	})
+
+	var metadataBytes []byte
+	if header.MetadataLength > 0 {
+		metadataBytes, err = fetch(header.MetadataOffset, header.MetadataLength)
+		if err != nil {
+			return nil, err
+		}
+	}
+	header.MinZoom = uint8(minzoom)
+	header.MaxZoom = uint8(maxzoom)
+	if metadataBytes, err = extractMetadata(metadataBytes, header); err != nil {
+		return nil, err
+	}
+	header.MetadataLength = uint64(len(metadataBytes))
+
+	// the tile data of all regions, each range of it fetched once
+	_, unionParts, _, _, _ := reencodeEntries(tileEntries)
+	sort.Slice(unionParts, func(i, j int) bool { return unionParts[i].SrcOffset < unionParts[j].SrcOffset })
+	chunks, downloadBytes := MergeRanges(unionParts, overfetch)
+
+	results := make([]RegionExtract, len(regions))
+	outputs := make([]*regionOutput, 0, len(regions))
+	defer func() {
+		for _, out := range outputs {
+			out.file.Close()
+		}
+	}()
+	var separateBytes uint64
+	for i, region := range regions {
+		entries, _ := RelevantEntries(relevantSets[i], uint8(maxzoom), tileEntries)
+		reencoded, parts, tileDataLength, addressedTiles, tileContents := reencodeEntries(entries)
+		_, regionBytes := MergeRanges(parts, overfetch)
+		separateBytes += regionBytes
+
+		newRootBytes, newLeavesBytes, _ := optimizeDirectories(reencoded, 16384-HeaderV3LenBytes, header.InternalCompression)
+		regionHeader := header
+		regionHeader.RootOffset = HeaderV3LenBytes
+		regionHeader.RootLength = uint64(len(newRootBytes))
+		regionHeader.MetadataOffset = regionHeader.RootOffset + regionHeader.RootLength
+		regionHeader.LeafDirectoryOffset = regionHeader.MetadataOffset + regionHeader.MetadataLength
+		regionHeader.LeafDirectoryLength = uint64(len(newLeavesBytes))
+		regionHeader.TileDataOffset = regionHeader.LeafDirectoryOffset + regionHeader.LeafDirectoryLength
+		regionHeader.TileDataLength = tileDataLength
+		regionHeader.AddressedTilesCount = addressedTiles
+		regionHeader.TileEntriesCount = uint64(len(entries))
+		regionHeader.TileContentsCount = tileContents
+		bound := region.Geometry.Bound()
+		regionHeader.MinLonE7 = int32(bound.Left() * 10000000)
+		regionHeader.MinLatE7 = int32(bound.Bottom() * 10000000)
+		regionHeader.MaxLonE7 = int32(bound.Right() * 10000000)
+		regionHeader.MaxLatE7 = int32(bound.Top() * 10000000)
+		regionHeader.CenterLonE7 = int32(bound.Center().X() * 10000000)
+		regionHeader.CenterLatE7 = int32(bound.Center().Y() * 10000000)
+
+		output := strings.ReplaceAll(outputTemplate, "{id}", region.ID)
+		results[i] = RegionExtract{ID: region.ID, Output: output, AddressedTiles: addressedTiles, TileDataLength: tileDataLength}
+		if dryRun {
+			continue
+		}
+
+		file, err := os.Create(output)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create %s, %w", output, err)
+		}
+		out := &regionOutput{file: file, tileDataOffset: regionHeader.TileDataOffset, parts: parts}
+		outputs = append(outputs, out)
+		sort.Slice(out.parts, func(i, j int) bool { return out.parts[i].SrcOffset < out.parts[j].SrcOffset })
+		for _, section := range []struct {
+			data   []byte
+			offset uint64
+		}{
+			{SerializeHeader(regionHeader), 0},
+			{newRootBytes, regionHeader.RootOffset},
+			{metadataBytes, regionHeader.MetadataOffset},
+			{newLeavesBytes, regionHeader.LeafDirectoryOffset},
+		} {
+			if _, err := file.WriteAt(section.data, int64(section.offset)); err != nil {
+				return nil, fmt.Errorf("Failed to write %s, %w", output, err)
+			}
+		}
+	}
+
+	if !dryRun {
+		bar := newBytesProgress(progress, int64(downloadBytes), "fetching chunks")
+		var mu sync.Mutex
+		g, gctx := errgroup.WithContext(ctx)
+		for range max(downloadThreads, 1) {
+			g.Go(func() error {
+				for gctx.Err() == nil {
+					mu.Lock()
+					if chunks.Len() == 0 {
+						mu.Unlock()
+						return nil
+					}
+					or := chunks.Remove(chunks.Front()).(overfetchRange)
+					mu.Unlock()
+
+					r, err := bucket.NewRangeReader(gctx, key, int64(header.TileDataOffset+or.Rng.SrcOffset), int64(or.Rng.Length))
+					if err != nil {
+						return err
+					}
+					err = writeRegionChunk(io.TeeReader(r, bar), or.Rng, outputs)
+					r.Close()
+					if err != nil {
+						return err
+					}
+				}
+				return gctx.Err()
+			})
+		}
+		if err := g.Wait(); err != nil {
+			return nil, err
+		}
+		for _, out := range outputs {
+			if err := out.file.Close(); err != nil {
+				return nil, fmt.Errorf("Failed to write %s, %w", out.file.Name(), err)
+			}
+		}
+	}
+
+	for _, result := range results {
+		fmt.Printf("%s: %d tiles, %s of tile data\n", result.Output, result.AddressedTiles, humanize.Bytes(result.TileDataLength))
+	}
+	fmt.Printf("Extracts of %d regions transfer %s of tile data, instead of %s extracted one at a time (overfetch %v).\n", len(regions), humanize.Bytes(downloadBytes), humanize.Bytes(separateBytes), overfetch)
+	fmt.Printf("Completed in %v with %v download threads.\n", time.Since(start), downloadThreads)
+	fmt.Printf("Read %s from the source archive at an average of %s/s.\n", humanize.Bytes(limited.BytesRead()), humanize.Bytes(averageThroughput(limited.BytesRead(), start)))
+	return results, nil
+}
+
+// writeRegionChunk reads the source tile data of chunk from r and writes the parts of it needed by each output,
+// so a range shared by several regions is copied into each of their archives.
+func writeRegionChunk(r io.Reader, chunk srcDstRange, outputs []*regionOutput) error {
+	type segment struct {
+		out  *regionOutput
+		part srcDstRange
+	}
+	end := chunk.SrcOffset + chunk.Length
+	var segments []segment
+	for _, out := range outputs {
+		i := sort.Search(len(out.parts), func(i int) bool {
+			return out.parts[i].SrcOffset+out.parts[i].Length > chunk.SrcOffset
+		})
+		for ; i < len(out.parts) && out.parts[i].SrcOffset < end; i++ {
+			segments = append(segments, segment{out, out.parts[i]})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].part.SrcOffset < segments[j].part.SrcOffset })
+
+	// the chunk is copied a block at a time to the segments overlapping the block
+	buf := make([]byte, min(chunk.Length, 1<<20))
+	var active []segment
+	next := 0
+	for offset := chunk.SrcOffset; offset < end; {
+		blockEnd := min(offset+uint64(len(buf)), end)
+		block := buf[:blockEnd-offset]
+		if _, err := io.ReadFull(r, block); err != nil {
+			return fmt.Errorf("Failed to read tile data, %w", err)
+		}
+		for next < len(segments) && segments[next].part.SrcOffset < blockEnd {
+			active = append(active, segments[next])
+			next++
+		}
+		kept := active[:0]
+		for _, s := range active {
+			from := max(s.part.SrcOffset, offset)
+			to := min(s.part.SrcOffset+s.part.Length, blockEnd)
+			if from < to {
+				dst := s.out.tileDataOffset + s.part.DstOffset + from - s.part.SrcOffset
+				if _, err := s.out.file.WriteAt(block[from-offset:to-offset], int64(dst)); err != nil {
+					return fmt.Errorf("Failed to write %s, %w", s.out.file.Name(), err)
+				}
+			}
+			if s.part.SrcOffset+s.part.Length > blockEnd {
+				kept = append(kept, s)
+			}
+		}
+		active = kept
+		offset = blockEnd
+	}
+	return nil
+}
@@ -1,9 +1,18 @@
 package pmtiles
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"github.com/RoaringBitmap/roaring/roaring64"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestRelevantEntries(t *testing.T) {
@@ -164,3 +173,199 @@ func TestMergeRangesMultiple(t *testing.T) {
 	assert.Equal(t, srcDstRange{0, 0, 90}, front.Rng)
 	assert.Equal(t, 3, len(front.CopyDiscards))
 }
+
+func TestUnmarshalRegions(t *testing.T) {
+	regions, err := UnmarshalRegions([]byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"iso":"FR"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}},
+		{"type":"Feature","properties":{"iso":"XX"},"geometry":{"type":"Point","coordinates":[0,0]}},
+		{"type":"Feature","properties":{"iso":"DE"},"geometry":{"type":"MultiPolygon","coordinates":[[[[0,0],[1,0],[1,1],[0,0]]]]}}
+	]}`), "iso")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(regions))
+	assert.Equal(t, "FR", regions[0].ID)
+	assert.Equal(t, "DE", regions[1].ID)
+
+	_, err = UnmarshalRegions([]byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"iso":"../x"},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}
+	]}`), "iso")
+	assert.Error(t, err)
+	_, err = UnmarshalRegions([]byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{},"geometry":{"type":"Polygon","coordinates":[[[0,0],[1,0],[1,1],[0,0]]]}}
+	]}`), "iso")
+	assert.Error(t, err)
+}
+
+func TestExtractRegions(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	var tiles []testTile
+	for z := uint8(0); z <= 2; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tiles = append(tiles, testTile{z, x, y, fmt.Sprintf("tile %d/%d/%d", z, x, y)})
+			}
+		}
+	}
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{"name": "regions"}, tiles)
+	_, _, sourceTiles := readTestArchiveTiles(t, input)
+
+	// the regions overlap in the column of zoom 2 west of the antimeridian
+	regionFile := filepath.Join(dir, "regions.geojson")
+	assert.Nil(t, os.WriteFile(regionFile, []byte(`{"type":"FeatureCollection","features":[
+		{"type":"Feature","properties":{"name":"west"},"geometry":{"type":"Polygon","coordinates":[[[-170,-60],[-10,-60],[-10,60],[-170,60],[-170,-60]]]}},
+		{"type":"Feature","properties":{"name":"middle"},"geometry":{"type":"Polygon","coordinates":[[[-20,-60],[20,-60],[20,60],[-20,60],[-20,-60]]]}}
+	]}`), 0644))
+
+	results, err := ExtractRegions(logger, "", input, -1, -1, regionFile, "name", filepath.Join(dir, "out-{id}.pmtiles"), 2, 0.05, RetryOptions{}, RateLimit{}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(results))
+	assert.Equal(t, uint64(7), results[0].AddressedTiles)
+	assert.Equal(t, uint64(9), results[1].AddressedTiles)
+
+	for _, result := range results {
+		header, metadata, extracted := readTestArchiveTiles(t, result.Output)
+		assert.Equal(t, result.AddressedTiles, header.AddressedTilesCount)
+		assert.Equal(t, "regions", metadata["name"])
+		assert.Equal(t, int(result.AddressedTiles), len(extracted))
+		for id, data := range extracted {
+			assert.Equal(t, sourceTiles[id], data)
+		}
+		assert.Contains(t, extracted, ZxyToID(2, 1, 1))
+	}
+	assert.Nil(t, Verify(logger, filepath.Join(dir, "out-west.pmtiles")))
+	_, err = os.Stat(filepath.Join(dir, "out-middle.pmtiles"))
+	assert.Nil(t, err)
+
+	_, err = ExtractRegions(logger, "", input, -1, -1, regionFile, "name", filepath.Join(dir, "out.pmtiles"), 2, 0.05, RetryOptions{}, RateLimit{}, true)
+	assert.Error(t, err)
+}
+
+func TestExtractZoomRange(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := []testTile{{0, 0, 0, "a"}}
+	for z := uint8(1); z <= 2; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				tiles = append(tiles, testTile{z, x, y, fmt.Sprintf("tile %d/%d/%d", z, x, y)})
+			}
+		}
+	}
+	// the same contents for all of zoom 1 and the first tile of zoom 2 make a run across the zoom levels
+	for i := range tiles {
+		if tiles[i].z == 1 || (tiles[i].z == 2 && tiles[i].x == 0 && tiles[i].y == 0) {
+			tiles[i].data = "b"
+		}
+	}
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{"minzoom": "0", "maxzoom": 2.0}, tiles)
+
+	output := filepath.Join(dir, "low.pmtiles")
+	assert.Nil(t, Extract(logger, "", input, -1, 1, "", "", output, 1, 0.05, false))
+	header, metadata, extracted := readTestArchiveTiles(t, output)
+	assert.Equal(t, uint8(1), header.MaxZoom)
+	assert.Equal(t, uint64(5), header.AddressedTilesCount)
+	assert.Equal(t, uint64(2), header.TileEntriesCount)
+	assert.Equal(t, uint64(2), header.TileContentsCount)
+	assert.Equal(t, 5, len(extracted))
+	assert.NotContains(t, extracted, ZxyToID(2, 0, 0))
+	assert.Equal(t, "0", metadata["minzoom"])
+	assert.Equal(t, 1.0, metadata["maxzoom"])
+	assert.Nil(t, Verify(logger, output))
+
+	output = filepath.Join(dir, "high.pmtiles")
+	assert.Nil(t, Extract(logger, "", input, 1, -1, "", "", output, 1, 0.05, false))
+	header, metadata, extracted = readTestArchiveTiles(t, output)
+	assert.Equal(t, uint8(1), header.MinZoom)
+	assert.Equal(t, uint8(1), header.CenterZoom)
+	assert.Equal(t, uint64(20), header.AddressedTilesCount)
+	assert.Equal(t, 20, len(extracted))
+	assert.Equal(t, "b", extracted[ZxyToID(2, 0, 0)])
+	assert.Equal(t, "1", metadata["minzoom"])
+	assert.Equal(t, 2.0, metadata["maxzoom"])
+	assert.Nil(t, Verify(logger, output))
+}
+
+func TestEstimateExtract(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := []testTile{{0, 0, 0, "a"}}
+	for x := uint32(0); x < 2; x++ {
+		for y := uint32(0); y < 2; y++ {
+			tiles = append(tiles, testTile{1, x, y, "bb"})
+		}
+	}
+	tiles = append(tiles, testTile{2, 0, 0, "ccc"})
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{}, tiles)
+
+	estimate, err := EstimateExtract("", input, -1, 1, nil, 0, RetryOptions{}, RateLimit{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), estimate.AddressedTiles)
+	assert.Equal(t, 2, estimate.TileEntries)
+	assert.Equal(t, uint64(2), estimate.TileContents)
+	assert.Equal(t, uint64(3), estimate.TileDataBytes)
+	assert.Equal(t, uint64(3), estimate.TransferBytes)
+	assert.Equal(t, 4, estimate.Requests)
+
+	var buf bytes.Buffer
+	assert.Nil(t, WriteExtractEstimate(&buf, estimate, "json"))
+	var decoded ExtractEstimate
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, estimate, decoded)
+
+	buf.Reset()
+	assert.Nil(t, WriteExtractEstimate(&buf, estimate, "table"))
+	assert.Contains(t, buf.String(), "transferred tile data  3 B\n")
+}
+
+func TestExtractRetries(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := []testTile{{0, 0, 0, "a"}, {1, 0, 0, "bb"}, {1, 1, 1, "ccc"}}
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{}, tiles)
+	data, err := os.ReadFile(input)
+	assert.Nil(t, err)
+
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 3:
+			// the response breaks off halfway through the range
+			rec := httptest.NewRecorder()
+			http.ServeContent(rec, r, "in.pmtiles", time.Time{}, bytes.NewReader(data))
+			w.WriteHeader(rec.Code)
+			w.Write(rec.Body.Bytes()[:rec.Body.Len()/2])
+		default:
+			http.ServeContent(w, r, "in.pmtiles", time.Time{}, bytes.NewReader(data))
+		}
+	}))
+	defer server.Close()
+
+	output := filepath.Join(dir, "out.pmtiles")
+	err = ExtractGeometry(logger, "", server.URL+"/in.pmtiles", -1, -1, nil, output, 2, 0, RetryOptions{BaseDelay: time.Millisecond}, RateLimit{}, false)
+	assert.Nil(t, err)
+	_, _, extracted := readTestArchiveTiles(t, output)
+	assert.Equal(t, map[uint64]string{0: "a", 1: "bb", 3: "ccc"}, extracted)
+}
+
+func TestExtractNoRetryOnNotFound(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "out.pmtiles")
+	err := ExtractGeometry(logger, "", server.URL+"/missing.pmtiles", -1, -1, nil, output, 2, 0, RetryOptions{BaseDelay: time.Millisecond}, RateLimit{}, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, int32(1), requests.Load())
+}
@@ -0,0 +1,198 @@
+package pmtiles
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// defaultStreamMemory is the memory budget of ConvertOptions.Stream if StreamMemory is not set.
+const defaultStreamMemory = 512 << 20
+
+// sortedTileOverhead approximates the memory used by a buffered tile besides its data.
+const sortedTileOverhead = 48
+
+// tileSorter sorts tiles added in any order by tile ID within a memory budget.
+// Tiles are buffered and sorted in memory, and spilled as sorted runs to a temporary file
+// whenever the buffer exceeds the budget; reading merges the runs.
+type tileSorter struct {
+	tmpdir   string
+	budget   int64
+	buffered int64
+	tiles    []sortedTile
+	file     *os.File
+	w        *bufio.Writer
+	runs     [][2]int64 // offset and length of each run in file
+	offset   int64
+}
+
+type sortedTile struct {
+	id   uint64
+	data []byte
+}
+
+func newTileSorter(tmpdir string, budget int64) *tileSorter {
+	return &tileSorter{tmpdir: tmpdir, budget: budget}
+}
+
+// add buffers a tile, spilling the buffer to the temporary file if it is full.
+func (s *tileSorter) add(id uint64, data []byte) error {
+	s.tiles = append(s.tiles, sortedTile{id, data})
+	s.buffered += int64(len(data)) + sortedTileOverhead
+	if s.buffered >= s.budget {
+		return s.spill()
+	}
+	return nil
+}
+
+func (s *tileSorter) sortBuffer() {
+	sort.SliceStable(s.tiles, func(i, j int) bool { return s.tiles[i].id < s.tiles[j].id })
+}
+
+// spill writes the sorted buffer as a run of uvarint tile ID, uvarint length and data records.
+func (s *tileSorter) spill() error {
+	if len(s.tiles) == 0 {
+		return nil
+	}
+	if s.file == nil {
+		file, err := os.CreateTemp(s.tmpdir, "pmtiles-sort")
+		if err != nil {
+			return fmt.Errorf("Failed to create temp file, %w", err)
+		}
+		s.file = file
+		s.w = bufio.NewWriterSize(file, 1<<20)
+	}
+	s.sortBuffer()
+	start := s.offset
+	var buf [2 * binary.MaxVarintLen64]byte
+	for _, t := range s.tiles {
+		n := binary.PutUvarint(buf[:], t.id)
+		n += binary.PutUvarint(buf[n:], uint64(len(t.data)))
+		if _, err := s.w.Write(buf[:n]); err != nil {
+			return fmt.Errorf("Failed to write to temp file, %w", err)
+		}
+		if _, err := s.w.Write(t.data); err != nil {
+			return fmt.Errorf("Failed to write to temp file, %w", err)
+		}
+		s.offset += int64(n + len(t.data))
+	}
+	if err := s.w.Flush(); err != nil {
+		return fmt.Errorf("Failed to write to temp file, %w", err)
+	}
+	s.runs = append(s.runs, [2]int64{start, s.offset - start})
+	s.tiles = nil
+	s.buffered = 0
+	return nil
+}
+
+// sorted returns an iterator over all added tiles in tile ID order. No tiles may be added afterwards.
+func (s *tileSorter) sorted() (*sortedTiles, error) {
+	if len(s.runs) == 0 {
+		s.sortBuffer()
+		return &sortedTiles{memory: s.tiles}, nil
+	}
+	if err := s.spill(); err != nil {
+		return nil, err
+	}
+	// the read buffers of all runs share the budget
+	bufSize := int(max(s.budget/int64(len(s.runs)), 4096))
+	it := &sortedTiles{}
+	for _, run := range s.runs {
+		r := &sortedRun{r: bufio.NewReaderSize(io.NewSectionReader(s.file, run[0], run[1]), bufSize)}
+		ok, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			it.runs = append(it.runs, r)
+		}
+	}
+	heap.Init(&it.runs)
+	return it, nil
+}
+
+// close removes the temporary file.
+func (s *tileSorter) close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// sortedRun reads the records of one run, holding the current one.
+type sortedRun struct {
+	r       *bufio.Reader
+	current sortedTile
+}
+
+func (r *sortedRun) next() (bool, error) {
+	id, err := binary.ReadUvarint(r.r)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("Failed to read sorted tiles, %w", err)
+	}
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return false, fmt.Errorf("Failed to read sorted tiles, %w", err)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return false, fmt.Errorf("Failed to read sorted tiles, %w", err)
+	}
+	r.current = sortedTile{id, data}
+	return true, nil
+}
+
+// sortedRunHeap orders runs by their current tile ID.
+type sortedRunHeap []*sortedRun
+
+func (h sortedRunHeap) Len() int           { return len(h) }
+func (h sortedRunHeap) Less(i, j int) bool { return h[i].current.id < h[j].current.id }
+func (h sortedRunHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sortedRunHeap) Push(x any)        { *h = append(*h, x.(*sortedRun)) }
+func (h *sortedRunHeap) Pop() any {
+	old := *h
+	r := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return r
+}
+
+// sortedTiles iterates over the tiles of a tileSorter in tile ID order.
+type sortedTiles struct {
+	memory []sortedTile
+	runs   sortedRunHeap
+}
+
+// next returns the next tile, or false after the last one.
+func (it *sortedTiles) next() (uint64, []byte, bool, error) {
+	if it.runs == nil {
+		if len(it.memory) == 0 {
+			return 0, nil, false, nil
+		}
+		t := it.memory[0]
+		it.memory = it.memory[1:]
+		return t.id, t.data, true, nil
+	}
+	if it.runs.Len() == 0 {
+		return 0, nil, false, nil
+	}
+	r := it.runs[0]
+	t := r.current
+	ok, err := r.next()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	if ok {
+		heap.Fix(&it.runs, 0)
+	} else {
+		heap.Pop(&it.runs)
+	}
+	return t.id, t.data, true, nil
+}
@@ -0,0 +1,32 @@
+package pmtiles
+
+import (
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTileSorter(t *testing.T) {
+	for _, budget := range []int64{1 << 20, 100} {
+		sorter := newTileSorter(t.TempDir(), budget)
+		ids := rand.Perm(1000)
+		for _, id := range ids {
+			assert.Nil(t, sorter.add(uint64(id), []byte(strconv.Itoa(id))))
+		}
+		tiles, err := sorter.sorted()
+		assert.Nil(t, err)
+		for want := 0; want < len(ids); want++ {
+			id, data, ok, err := tiles.next()
+			assert.Nil(t, err)
+			assert.True(t, ok)
+			assert.Equal(t, uint64(want), id)
+			assert.Equal(t, strconv.Itoa(want), string(data))
+		}
+		_, _, ok, err := tiles.next()
+		assert.Nil(t, err)
+		assert.False(t, ok)
+		assert.Nil(t, sorter.close())
+	}
+}
@@ -0,0 +1,196 @@
+package pmtiles
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"reflect"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/paulmach/orb/maptile"
+)
+
+// FixHeader recomputes the tile counts and zoom levels in the header of a local archive from its directories,
+// and with recomputeBounds the bounds from the extent of the tiles at the maximum zoom level.
+// Unless dryRun is set, the header is rewritten in place, leaving directories, metadata and tile data untouched.
+// It returns the header before and after; use HeaderChanges to list their differences.
+func FixHeader(path string, recomputeBounds bool, dryRun bool) (HeaderV3, HeaderV3, error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return HeaderV3{}, HeaderV3{}, err
+	}
+	defer file.Close()
+
+	var entries []EntryV3
+	contents := roaring64.New()
+	fixed := header
+	fixed.AddressedTilesCount = 0
+	var entryErr error
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		if entryErr != nil {
+			return
+		}
+		if entryErr = checkEntryTileIDs(e); entryErr != nil {
+			return
+		}
+		fixed.AddressedTilesCount += uint64(e.RunLength)
+		contents.Add(e.Offset)
+		entries = append(entries, e)
+	})
+	if err == nil {
+		err = entryErr
+	}
+	if err != nil {
+		return header, header, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+	if len(entries) == 0 {
+		return header, header, fmt.Errorf("no tiles in %s", path)
+	}
+	fixed.TileEntriesCount = uint64(len(entries))
+	fixed.TileContentsCount = contents.GetCardinality()
+	last := entries[len(entries)-1]
+	fixed.MinZoom, _, _ = IDToZxy(entries[0].TileID)
+	fixed.MaxZoom, _, _ = IDToZxy(last.TileID + uint64(last.RunLength) - 1)
+
+	if recomputeBounds {
+		setTileExtentBounds(&fixed, entries)
+	}
+
+	if dryRun || fixed == header {
+		return header, fixed, nil
+	}
+	out, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		return header, fixed, fmt.Errorf("Failed to open %s, %w", path, err)
+	}
+	defer out.Close()
+	if _, err := out.WriteAt(SerializeHeader(fixed), 0); err != nil {
+		return header, fixed, fmt.Errorf("Failed to write header of %s, %w", path, err)
+	}
+	return header, fixed, out.Close()
+}
+
+// setTileExtentBounds sets the bounds of header to the extent of the tiles of entries at header.MaxZoom.
+func setTileExtentBounds(header *HeaderV3, entries []EntryV3) {
+	first := ZxyToID(header.MaxZoom, 0, 0)
+	minX, minY := uint32(math.MaxUint32), uint32(math.MaxUint32)
+	maxX, maxY := uint32(0), uint32(0)
+	for _, e := range entries {
+		for id := max(e.TileID, first); id < e.TileID+uint64(e.RunLength); id++ {
+			_, x, y := IDToZxy(id)
+			minX, minY = min(minX, x), min(minY, y)
+			maxX, maxY = max(maxX, x), max(maxY, y)
+		}
+	}
+	z := maptile.Zoom(header.MaxZoom)
+	topLeft := maptile.New(minX, minY, z).Bound()
+	bottomRight := maptile.New(maxX, maxY, z).Bound()
+	E7 := 10000000.0
+	header.MinLonE7 = int32(math.Round(topLeft.Min.Lon() * E7))
+	header.MaxLatE7 = int32(math.Round(topLeft.Max.Lat() * E7))
+	header.MaxLonE7 = int32(math.Round(bottomRight.Max.Lon() * E7))
+	header.MinLatE7 = int32(math.Round(bottomRight.Min.Lat() * E7))
+}
+
+// HeaderChanges describes the fields that differ between two headers, one "Field: before -> after" line each.
+func HeaderChanges(before HeaderV3, after HeaderV3) []string {
+	var changes []string
+	b, a := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < b.NumField(); i++ {
+		if b.Field(i).Interface() != a.Field(i).Interface() {
+			changes = append(changes, fmt.Sprintf("%s: %v -> %v", b.Type().Field(i).Name, b.Field(i).Interface(), a.Field(i).Interface()))
+		}
+	}
+	return changes
+}
+
+// CalculateBounds returns the union of the extents of all tiles of a local archive at every zoom level,
+// in degrees, which may differ from the bounds in its header.
+func CalculateBounds(path string) (minLon, minLat, maxLon, maxLat float64, err error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	defer file.Close()
+
+	// the extent of the tiles of each zoom level, as min x, min y, max x, max y
+	var extents [MaxTileZoom + 1][4]uint32
+	var present [MaxTileZoom + 1]bool
+	var entryErr error
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		if entryErr != nil {
+			return
+		}
+		if entryErr = checkEntryTileIDs(e); entryErr != nil {
+			return
+		}
+		for id := e.TileID; id < e.TileID+uint64(e.RunLength); id++ {
+			z, x, y := IDToZxy(id)
+			if !present[z] {
+				extents[z] = [4]uint32{x, y, x, y}
+				present[z] = true
+				continue
+			}
+			extent := &extents[z]
+			extent[0], extent[1] = min(extent[0], x), min(extent[1], y)
+			extent[2], extent[3] = max(extent[2], x), max(extent[3], y)
+		}
+	})
+	if err == nil {
+		err = entryErr
+	}
+	if err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+
+	minLon, minLat, maxLon, maxLat = 180, 90, -180, -90
+	found := false
+	for z, extent := range extents {
+		if !present[z] {
+			continue
+		}
+		found = true
+		topLeft := maptile.New(extent[0], extent[1], maptile.Zoom(z)).Bound()
+		bottomRight := maptile.New(extent[2], extent[3], maptile.Zoom(z)).Bound()
+		minLon, maxLat = min(minLon, topLeft.Min.Lon()), max(maxLat, topLeft.Max.Lat())
+		maxLon, minLat = max(maxLon, bottomRight.Max.Lon()), min(minLat, bottomRight.Min.Lat())
+	}
+	if !found {
+		return 0, 0, 0, 0, fmt.Errorf("no tiles in %s", path)
+	}
+	return minLon, minLat, maxLon, maxLat, nil
+}
+
+// SetBounds rewrites the bounds in the header of a local archive in place, moving the center to the middle
+// of the new bounds if it falls outside them. It returns the header before and after.
+func SetBounds(path string, minLon, minLat, maxLon, maxLat float64) (HeaderV3, HeaderV3, error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return HeaderV3{}, HeaderV3{}, err
+	}
+	file.Close()
+
+	E7 := 10000000.0
+	fixed := header
+	fixed.MinLonE7 = int32(math.Round(minLon * E7))
+	fixed.MinLatE7 = int32(math.Round(minLat * E7))
+	fixed.MaxLonE7 = int32(math.Round(maxLon * E7))
+	fixed.MaxLatE7 = int32(math.Round(maxLat * E7))
+	if fixed.CenterLonE7 < fixed.MinLonE7 || fixed.CenterLonE7 > fixed.MaxLonE7 || fixed.CenterLatE7 < fixed.MinLatE7 || fixed.CenterLatE7 > fixed.MaxLatE7 {
+		fixed.CenterLonE7 = int32((int64(fixed.MinLonE7) + int64(fixed.MaxLonE7)) / 2)
+		fixed.CenterLatE7 = int32((int64(fixed.MinLatE7) + int64(fixed.MaxLatE7)) / 2)
+	}
+	if fixed == header {
+		return header, fixed, nil
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	if err != nil {
+		return header, fixed, fmt.Errorf("Failed to open %s, %w", path, err)
+	}
+	defer out.Close()
+	if _, err := out.WriteAt(SerializeHeader(fixed), 0); err != nil {
+		return header, fixed, fmt.Errorf("Failed to write header of %s, %w", path, err)
+	}
+	return header, fixed, out.Close()
+}
@@ -0,0 +1,76 @@
+package pmtiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFixHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "fix.pmtiles")
+	tiles := []testTile{{0, 0, 0, "a"}, {2, 1, 1, "b"}, {2, 1, 2, "b"}, {2, 2, 2, "c"}}
+	sortTestTiles(tiles)
+	writeTestArchive(t, path, NoCompression, Png, nil, tiles)
+	original, _, _ := readTestArchiveTiles(t, path)
+
+	broken := original
+	broken.AddressedTilesCount = 1
+	broken.TileContentsCount = 0
+	broken.MaxZoom = 5
+	f, err := os.OpenFile(path, os.O_WRONLY, 0666)
+	assert.Nil(t, err)
+	_, err = f.WriteAt(SerializeHeader(broken), 0)
+	assert.Nil(t, err)
+	f.Close()
+
+	before, after, err := FixHeader(path, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, broken, before)
+	assert.Equal(t, uint64(4), after.AddressedTilesCount)
+	assert.Equal(t, uint64(3), after.TileContentsCount)
+	assert.Equal(t, uint8(2), after.MaxZoom)
+	// tiles 1 and 2 of zoom 2 span the middle half of the world
+	assert.Equal(t, int32(-900000000), after.MinLonE7)
+	assert.Equal(t, int32(900000000), after.MaxLonE7)
+	assert.Contains(t, HeaderChanges(before, after), "MaxZoom: 5 -> 2")
+	header, _, _ := readTestArchiveTiles(t, path)
+	assert.Equal(t, broken, header)
+
+	_, after, err = FixHeader(path, false, false)
+	assert.Nil(t, err)
+	header, _, _ = readTestArchiveTiles(t, path)
+	assert.Equal(t, after, header)
+	assert.Equal(t, original.AddressedTilesCount, header.AddressedTilesCount)
+	assert.Equal(t, original.MinLonE7, header.MinLonE7)
+	assert.Nil(t, Verify(logger, path))
+}
+
+func TestCalculateBounds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bounds.pmtiles")
+	// the z1 tile covers the north west quarter, the z2 tile reaches further east
+	tiles := []testTile{{1, 0, 0, "a"}, {2, 2, 1, "b"}}
+	sortTestTiles(tiles)
+	writeTestArchive(t, path, NoCompression, Png, nil, tiles)
+
+	minLon, minLat, maxLon, maxLat, err := CalculateBounds(path)
+	assert.Nil(t, err)
+	assert.InDelta(t, -180.0, minLon, 1e-9)
+	assert.InDelta(t, 0.0, minLat, 1e-9)
+	assert.InDelta(t, 90.0, maxLon, 1e-9)
+	assert.InDelta(t, 85.0511287, maxLat, 1e-6)
+
+	before, after, err := SetBounds(path, minLon, minLat, maxLon, maxLat)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(900000000), after.MaxLonE7)
+	assert.Equal(t, int32(0), after.MinLatE7)
+	assert.Equal(t, before.TileDataOffset, after.TileDataOffset)
+	header, _, read := readTestArchiveTiles(t, path)
+	assert.Equal(t, after, header)
+	assert.Len(t, read, 2)
+	assert.GreaterOrEqual(t, header.CenterLatE7, header.MinLatE7)
+
+	_, _, _, _, err = CalculateBounds(filepath.Join(t.TempDir(), "missing.pmtiles"))
+	assert.NotNil(t, err)
+}
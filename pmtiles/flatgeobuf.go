@@ -0,0 +1,371 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/paulmach/orb"
+	"github.com/paulmach/orb/geojson"
+)
+
+// flatgeobufMagic starts a FlatGeobuf file of major version 3, and is followed by a patch version byte.
+var flatgeobufMagic = []byte{'f', 'g', 'b', 3, 'f', 'g', 'b'}
+
+// FlatGeobuf geometry types read as regions.
+const (
+	fgbPolygon      = 3
+	fgbMultiPolygon = 6
+)
+
+// fgbBinary is the column type of byte values; the other types after those of fgbColumnSizes are text.
+const fgbBinary = 14
+
+// fgbColumnSizes are the value sizes of the fixed-size column types Byte, UByte, Bool, Short, UShort,
+// Int, UInt, Long, ULong, Float and Double. Values of later types are prefixed by their length.
+var fgbColumnSizes = []int{1, 1, 1, 2, 2, 4, 4, 8, 8, 4, 8}
+
+type fgbColumn struct {
+	name       string
+	columnType uint8
+}
+
+func isFlatGeobuf(data []byte) bool {
+	return len(data) >= 8 && bytes.Equal(data[0:7], flatgeobufMagic)
+}
+
+// fbReader reads FlatBuffers tables from buf. An out of range offset sets err,
+// after which reads return zero values.
+type fbReader struct {
+	buf []byte
+	err error
+}
+
+// fbTable is the position of a table and of its vtable.
+type fbTable struct {
+	pos    int
+	vtable int
+}
+
+func (r *fbReader) bytes(pos int, n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if pos < 0 || n < 0 || pos > len(r.buf) || n > len(r.buf)-pos {
+		r.err = fmt.Errorf("offset %d out of range", pos)
+		return nil
+	}
+	return r.buf[pos : pos+n]
+}
+
+func (r *fbReader) u16(pos int) uint16 {
+	if b := r.bytes(pos, 2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *fbReader) u32(pos int) uint32 {
+	if b := r.bytes(pos, 4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *fbReader) root() fbTable {
+	return r.table(int(r.u32(0)))
+}
+
+func (r *fbReader) table(pos int) fbTable {
+	return fbTable{pos, pos - int(int32(r.u32(pos)))}
+}
+
+// field returns the position of field i of t, or 0 if it is not set.
+func (r *fbReader) field(t fbTable, i int) int {
+	entry := 4 + 2*i
+	if entry+2 > int(r.u16(t.vtable)) {
+		return 0
+	}
+	offset := int(r.u16(t.vtable + entry))
+	if offset == 0 {
+		return 0
+	}
+	return t.pos + offset
+}
+
+// ref follows the offset at pos, returning 0 if pos is 0.
+func (r *fbReader) ref(pos int) int {
+	if pos == 0 {
+		return 0
+	}
+	return pos + int(r.u32(pos))
+}
+
+func (r *fbReader) uint8Field(t fbTable, i int, def uint8) uint8 {
+	pos := r.field(t, i)
+	if pos == 0 {
+		return def
+	}
+	if b := r.bytes(pos, 1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *fbReader) uint16Field(t fbTable, i int, def uint16) uint16 {
+	pos := r.field(t, i)
+	if pos == 0 {
+		return def
+	}
+	return r.u16(pos)
+}
+
+func (r *fbReader) uint64Field(t fbTable, i int) uint64 {
+	pos := r.field(t, i)
+	if pos == 0 {
+		return 0
+	}
+	if b := r.bytes(pos, 8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// vector returns the bytes of the elements of the vector field i of t, of elementSize bytes each.
+func (r *fbReader) vector(t fbTable, i int, elementSize int) []byte {
+	pos := r.ref(r.field(t, i))
+	if pos == 0 {
+		return nil
+	}
+	n := int(r.u32(pos))
+	return r.bytes(pos+4, n*elementSize)
+}
+
+// tables returns the tables of the vector field i of t.
+func (r *fbReader) tables(t fbTable, i int) []fbTable {
+	pos := r.ref(r.field(t, i))
+	if pos == 0 {
+		return nil
+	}
+	n := int(r.u32(pos))
+	if r.bytes(pos+4, n*4) == nil {
+		return nil
+	}
+	tables := make([]fbTable, n)
+	for j := range tables {
+		tables[j] = r.table(r.ref(pos + 4 + 4*j))
+	}
+	return tables
+}
+
+func (r *fbReader) string(t fbTable, i int) string {
+	return string(r.vector(t, i, 1))
+}
+
+// readFlatGeobuf reads the features of a FlatGeobuf file with their properties.
+// Only Polygon and MultiPolygon geometries are read; features of other types have a nil geometry.
+func readFlatGeobuf(data []byte) ([]*geojson.Feature, error) {
+	if !isFlatGeobuf(data) {
+		return nil, fmt.Errorf("not a FlatGeobuf file")
+	}
+	if len(data) < 12 {
+		return nil, fmt.Errorf("truncated FlatGeobuf header")
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data[8:12]))
+	if headerSize > len(data)-12 {
+		return nil, fmt.Errorf("truncated FlatGeobuf header")
+	}
+	r := &fbReader{buf: data[12 : 12+headerSize]}
+	header := r.root()
+	geometryType := r.uint8Field(header, 2, 0)
+	columns := r.columns(header, 7)
+	featuresCount := r.uint64Field(header, 8)
+	indexNodeSize := r.uint16Field(header, 9, 16)
+	if r.err != nil {
+		return nil, fmt.Errorf("Failed to read FlatGeobuf header, %w", r.err)
+	}
+
+	offset := uint64(12 + headerSize)
+	if indexNodeSize > 0 && featuresCount > 0 {
+		// the packed R-tree index is skipped, as every feature is read
+		offset += fgbIndexSize(featuresCount, indexNodeSize)
+		if offset > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated FlatGeobuf index")
+		}
+	}
+	var features []*geojson.Feature
+	for offset < uint64(len(data)) {
+		if offset+4 > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated FlatGeobuf feature %d", len(features))
+		}
+		size := uint64(binary.LittleEndian.Uint32(data[offset:]))
+		if offset+4+size > uint64(len(data)) {
+			return nil, fmt.Errorf("truncated FlatGeobuf feature %d", len(features))
+		}
+		feature, err := readFlatGeobufFeature(data[offset+4:offset+4+size], geometryType, columns)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read FlatGeobuf feature %d, %w", len(features), err)
+		}
+		features = append(features, feature)
+		offset += 4 + size
+	}
+	return features, nil
+}
+
+// fgbIndexSize is the length of the packed Hilbert R-tree index of features with nodeSize children per node.
+func fgbIndexSize(features uint64, nodeSize uint16) uint64 {
+	size := uint64(max(nodeSize, 2))
+	n, nodes := features, features
+	for {
+		n = (n + size - 1) / size
+		nodes += n
+		if n == 1 {
+			break
+		}
+	}
+	// a node is its bounding box and offset
+	return nodes * 40
+}
+
+func (r *fbReader) columns(t fbTable, i int) []fgbColumn {
+	tables := r.tables(t, i)
+	columns := make([]fgbColumn, len(tables))
+	for j, column := range tables {
+		columns[j] = fgbColumn{r.string(column, 0), r.uint8Field(column, 1, 0)}
+	}
+	return columns
+}
+
+func readFlatGeobufFeature(buf []byte, geometryType uint8, columns []fgbColumn) (*geojson.Feature, error) {
+	r := &fbReader{buf: buf}
+	feature := r.root()
+	var geometry orb.Geometry
+	if pos := r.ref(r.field(feature, 0)); pos != 0 {
+		geometry = r.geometry(r.table(pos), geometryType)
+	}
+	if featureColumns := r.columns(feature, 2); len(featureColumns) > 0 {
+		columns = featureColumns
+	}
+	data := r.vector(feature, 1, 1)
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	f := geojson.NewFeature(geometry)
+	for len(data) > 0 {
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated properties")
+		}
+		column := int(binary.LittleEndian.Uint16(data))
+		if column >= len(columns) {
+			return nil, fmt.Errorf("property of unknown column %d", column)
+		}
+		value, n, err := fgbValue(columns[column].columnType, data[2:])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read property %s, %w", columns[column].name, err)
+		}
+		f.Properties[columns[column].name] = value
+		data = data[2+n:]
+	}
+	return f, nil
+}
+
+// geometry reads a Polygon or MultiPolygon geometry, returning nil for other types.
+// geometryType is that of all features in the header, or 0 if each geometry has its own.
+func (r *fbReader) geometry(t fbTable, geometryType uint8) orb.Geometry {
+	if geometryType == 0 {
+		geometryType = r.uint8Field(t, 6, 0)
+	}
+	switch geometryType {
+	case fgbPolygon:
+		return r.polygon(t)
+	case fgbMultiPolygon:
+		parts := r.tables(t, 7)
+		multipolygon := make(orb.MultiPolygon, len(parts))
+		for i, part := range parts {
+			multipolygon[i] = r.polygon(part)
+		}
+		return multipolygon
+	}
+	return nil
+}
+
+// polygon reads the rings of a polygon from its flat coordinates and the end of each ring;
+// without ends, all coordinates are a single ring.
+func (r *fbReader) polygon(t fbTable) orb.Polygon {
+	xy := r.vector(t, 1, 8)
+	points := len(xy) / 16
+	ends := r.vector(t, 0, 4)
+	if len(ends) == 0 {
+		ends = binary.LittleEndian.AppendUint32(nil, uint32(points))
+	}
+	polygon := make(orb.Polygon, 0, len(ends)/4)
+	start := 0
+	for i := 0; i+4 <= len(ends); i += 4 {
+		end := int(binary.LittleEndian.Uint32(ends[i:]))
+		if end < start || end > points {
+			r.err = fmt.Errorf("ring end %d out of range", end)
+			return nil
+		}
+		ring := make(orb.Ring, end-start)
+		for j := range ring {
+			k := 16 * (start + j)
+			ring[j] = orb.Point{
+				math.Float64frombits(binary.LittleEndian.Uint64(xy[k:])),
+				math.Float64frombits(binary.LittleEndian.Uint64(xy[k+8:])),
+			}
+		}
+		polygon = append(polygon, ring)
+		start = end
+	}
+	return polygon
+}
+
+// fgbValue decodes a property value of columnType at the start of data, returning its length.
+func fgbValue(columnType uint8, data []byte) (interface{}, int, error) {
+	if int(columnType) < len(fgbColumnSizes) {
+		size := fgbColumnSizes[columnType]
+		if len(data) < size {
+			return nil, 0, fmt.Errorf("truncated value")
+		}
+		var value interface{}
+		switch columnType {
+		case 0:
+			value = int8(data[0])
+		case 1:
+			value = data[0]
+		case 2:
+			value = data[0] != 0
+		case 3:
+			value = int16(binary.LittleEndian.Uint16(data))
+		case 4:
+			value = binary.LittleEndian.Uint16(data)
+		case 5:
+			value = int32(binary.LittleEndian.Uint32(data))
+		case 6:
+			value = binary.LittleEndian.Uint32(data)
+		case 7:
+			value = int64(binary.LittleEndian.Uint64(data))
+		case 8:
+			value = binary.LittleEndian.Uint64(data)
+		case 9:
+			value = math.Float32frombits(binary.LittleEndian.Uint32(data))
+		case 10:
+			value = math.Float64frombits(binary.LittleEndian.Uint64(data))
+		}
+		return value, size, nil
+	}
+	if len(data) < 4 {
+		return nil, 0, fmt.Errorf("truncated value")
+	}
+	n := uint64(binary.LittleEndian.Uint32(data))
+	if n > uint64(len(data)-4) {
+		return nil, 0, fmt.Errorf("truncated value")
+	}
+	value := data[4 : 4+n]
+	if columnType == fgbBinary {
+		return append([]byte{}, value...), 4 + int(n), nil
+	}
+	return string(value), 4 + int(n), nil
+}
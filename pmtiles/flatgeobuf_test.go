@@ -0,0 +1,138 @@
+package pmtiles
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/paulmach/orb"
+	"github.com/stretchr/testify/assert"
+)
+
+// fbObject is a position independent FlatBuffers object for building test files, starting at entry in data.
+type fbObject struct {
+	data  []byte
+	entry int
+}
+
+// fbTestTable builds a table of fields which are nil if not set, the little endian bytes of a scalar,
+// or an fbObject stored after the table.
+func fbTestTable(fields ...interface{}) fbObject {
+	vtableSize := 4 + 2*len(fields)
+	table := make([]byte, 4)
+	offsets := make([]uint16, len(fields))
+	refs := make(map[int]fbObject)
+	for i, field := range fields {
+		switch v := field.(type) {
+		case []byte:
+			offsets[i] = uint16(len(table))
+			table = append(table, v...)
+		case fbObject:
+			offsets[i] = uint16(len(table))
+			refs[vtableSize+len(table)] = v
+			table = append(table, 0, 0, 0, 0)
+		}
+	}
+	binary.LittleEndian.PutUint32(table, uint32(vtableSize))
+	data := binary.LittleEndian.AppendUint16(nil, uint16(vtableSize))
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(table)))
+	for _, offset := range offsets {
+		data = binary.LittleEndian.AppendUint16(data, offset)
+	}
+	data = append(data, table...)
+	for i := range fields {
+		pos := vtableSize + int(offsets[i])
+		if obj, ok := refs[pos]; ok {
+			binary.LittleEndian.PutUint32(data[pos:], uint32(len(data)+obj.entry-pos))
+			data = append(data, obj.data...)
+		}
+	}
+	return fbObject{data, vtableSize}
+}
+
+func fbTestVector(n int, elements []byte) fbObject {
+	return fbObject{append(binary.LittleEndian.AppendUint32(nil, uint32(n)), elements...), 0}
+}
+
+func fbTestString(s string) fbObject {
+	return fbTestVector(len(s), []byte(s))
+}
+
+func fbTestDoubles(values ...float64) fbObject {
+	var b []byte
+	for _, v := range values {
+		b = binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+	}
+	return fbTestVector(len(values), b)
+}
+
+func fbTestTables(tables ...fbObject) fbObject {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(tables)))
+	data = append(data, make([]byte, 4*len(tables))...)
+	for i, table := range tables {
+		pos := 4 + 4*i
+		binary.LittleEndian.PutUint32(data[pos:], uint32(len(data)+table.entry-pos))
+		data = append(data, table.data...)
+	}
+	return fbObject{data, 0}
+}
+
+func fbTestRoot(obj fbObject) []byte {
+	return append(binary.LittleEndian.AppendUint32(nil, uint32(4+obj.entry)), obj.data...)
+}
+
+// testFlatGeobuf is a FlatGeobuf file with a Polygon feature named Germany and a MultiPolygon feature named France,
+// with an index.
+func testFlatGeobuf() []byte {
+	column := func(name string, columnType uint8) fbObject {
+		return fbTestTable(fbTestString(name), []byte{columnType})
+	}
+	header := fbTestRoot(fbTestTable(
+		nil, nil, nil, nil, nil, nil, nil,
+		fbTestTables(column("name", 11), column("pop", 7)),
+		binary.LittleEndian.AppendUint64(nil, 2),
+	))
+	properties := func(name string, pop int64) fbObject {
+		b := binary.LittleEndian.AppendUint16(nil, 0)
+		b = binary.LittleEndian.AppendUint32(b, uint32(len(name)))
+		b = append(b, name...)
+		b = binary.LittleEndian.AppendUint16(b, 1)
+		b = binary.LittleEndian.AppendUint64(b, uint64(pop))
+		return fbTestVector(len(b), b)
+	}
+	square := []float64{0, 0, 1, 0, 1, 1, 0, 0}
+	polygon := fbTestTable(nil, fbTestDoubles(square...), nil, nil, nil, nil, []byte{fgbPolygon})
+	withHole := fbTestTable(fbTestVector(2, binary.LittleEndian.AppendUint32(binary.LittleEndian.AppendUint32(nil, 4), 8)), fbTestDoubles(append(square, square...)...))
+	multipolygon := fbTestTable(nil, nil, nil, nil, nil, nil, []byte{fgbMultiPolygon}, fbTestTables(withHole, polygon))
+
+	data := append(append([]byte{}, flatgeobufMagic...), 0)
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(header)))
+	data = append(data, header...)
+	data = append(data, make([]byte, fgbIndexSize(2, 16))...)
+	for _, feature := range [][]byte{
+		fbTestRoot(fbTestTable(polygon, properties("Germany", 83))),
+		fbTestRoot(fbTestTable(multipolygon, properties("France", 68))),
+	} {
+		data = binary.LittleEndian.AppendUint32(data, uint32(len(feature)))
+		data = append(data, feature...)
+	}
+	return data
+}
+
+func TestReadFlatGeobuf(t *testing.T) {
+	data := testFlatGeobuf()
+	features, err := readFlatGeobuf(data)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(features))
+	square := orb.Ring{{0, 0}, {1, 0}, {1, 1}, {0, 0}}
+	assert.Equal(t, orb.Polygon{square}, features[0].Geometry)
+	assert.Equal(t, "Germany", features[0].Properties["name"])
+	assert.Equal(t, int64(83), features[0].Properties["pop"])
+	assert.Equal(t, orb.MultiPolygon{{square, square}, {square}}, features[1].Geometry)
+	assert.Equal(t, "France", features[1].Properties["name"])
+
+	_, err = readFlatGeobuf(data[:len(data)-3])
+	assert.Error(t, err)
+	_, err = readFlatGeobuf([]byte(`{"type":"FeatureCollection"}`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,470 @@
+package pmtiles
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"zombiezen.com/go/sqlite"
+)
+
+// webMercatorHalfWorld is half the width of the EPSG:3857 world in meters.
+const webMercatorHalfWorld = 20037508.342789244
+
+// gpkgMatrix maps the tiles of one GeoPackage tile matrix to a Web Mercator zoom level.
+// The columns and rows of a tile matrix start at the top left corner of its tile matrix set,
+// which is at column col0 and row row0 of the zoom level.
+type gpkgMatrix struct {
+	zoomLevel int64
+	col0      int64
+	row0      int64
+}
+
+// gpkgLayer is a tile pyramid layer of a GeoPackage.
+type gpkgLayer struct {
+	table       string
+	identifier  string
+	description string
+	matrices    map[uint8]gpkgMatrix // by Web Mercator zoom level
+	levels      map[int64]uint8      // Web Mercator zoom level by GeoPackage zoom level
+	bounds      [4]float64           // min lon, min lat, max lon, max lat
+}
+
+// quoteIdentifier quotes name for use as an SQL table or column name.
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// ConvertGPKG creates an archive from the tile pyramid of a GeoPackage with a single tile layer
+// in Web Mercator (EPSG:3857), whose zoom levels must align with the standard tile grid.
+// Use Convert with ConvertOptions.Layer to select a layer of a GeoPackage with several.
+func ConvertGPKG(logger *log.Logger, input string, output string, deduplicate bool, tmpfile *os.File, progress ...ProgressReporter) error {
+	opts := ConvertOptions{Deduplicate: deduplicate, MinZoom: -1, MaxZoom: -1, ProgressReporter: firstReporter(progress)}
+	if err := normalizeConvertOptions(&opts); err != nil {
+		return err
+	}
+	if _, err := os.Stat(output); err == nil {
+		return fmt.Errorf("output %s already exists", output)
+	}
+	// a nil *os.File is not a nil io.ReadWriteSeeker
+	var tmp io.ReadWriteSeeker
+	if tmpfile != nil {
+		tmp = tmpfile
+	}
+	return convertGpkg(logger, input, convertOutput{path: output}, opts, tmp)
+}
+
+// isGpkg reports whether input is named like a GeoPackage.
+func isGpkg(input string) bool {
+	return strings.HasSuffix(strings.ToLower(input), ".gpkg")
+}
+
+// gpkgTileLayers lists the tile tables of a GeoPackage.
+func gpkgTileLayers(conn *sqlite.Conn) ([]string, error) {
+	stmt, _, err := conn.PrepareTransient("SELECT table_name FROM gpkg_contents WHERE data_type = 'tiles' ORDER BY table_name")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create statement, %w", err)
+	}
+	defer stmt.Finalize()
+
+	var layers []string
+	for {
+		row, err := stmt.Step()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to step statement, %w", err)
+		}
+		if !row {
+			return layers, nil
+		}
+		layers = append(layers, stmt.ColumnText(0))
+	}
+}
+
+// selectGpkgLayer returns the tile table named layer, or the only one if layer is empty.
+func selectGpkgLayer(conn *sqlite.Conn, layer string) (string, error) {
+	layers, err := gpkgTileLayers(conn)
+	if err != nil {
+		return "", err
+	}
+	if len(layers) == 0 {
+		return "", fmt.Errorf("no tile layers in GeoPackage")
+	}
+	if layer == "" {
+		if len(layers) > 1 {
+			return "", fmt.Errorf("GeoPackage has several tile layers, choose one of %s", strings.Join(layers, ", "))
+		}
+		return layers[0], nil
+	}
+	for _, l := range layers {
+		if l == layer {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("no tile layer %s in GeoPackage, choose one of %s", layer, strings.Join(layers, ", "))
+}
+
+// gpkgSrs returns the organization and code of the spatial reference system srsID.
+func gpkgSrs(conn *sqlite.Conn, srsID int64) (string, int64, error) {
+	stmt, _, err := conn.PrepareTransient("SELECT organization, organization_coordsys_id FROM gpkg_spatial_ref_sys WHERE srs_id = ?")
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to create statement, %w", err)
+	}
+	defer stmt.Finalize()
+	stmt.BindInt64(1, srsID)
+	row, err := stmt.Step()
+	if err != nil {
+		return "", 0, fmt.Errorf("Failed to step statement, %w", err)
+	}
+	if !row {
+		return "", 0, fmt.Errorf("unknown spatial reference system %d", srsID)
+	}
+	return strings.ToUpper(stmt.ColumnText(0)), stmt.ColumnInt64(1), nil
+}
+
+// isWebMercator reports whether the organization and code name EPSG:3857 or one of its former codes.
+func isWebMercator(organization string, code int64) bool {
+	return organization == "EPSG" && (code == 3857 || code == 900913 || code == 3785)
+}
+
+// webMercatorToLonLat converts EPSG:3857 meters to degrees.
+func webMercatorToLonLat(x float64, y float64) (float64, float64) {
+	lon := x / webMercatorHalfWorld * 180
+	lat := (2*math.Atan(math.Exp(y/webMercatorHalfWorld*math.Pi)) - math.Pi/2) * 180 / math.Pi
+	return lon, lat
+}
+
+// alignedInt returns v rounded to an integer, and whether v is that integer up to rounding errors.
+func alignedInt(v float64) (int64, bool) {
+	r := math.Round(v)
+	return int64(r), math.Abs(v-r) < 1e-3
+}
+
+// readGpkgLayer reads the tile matrices and bounds of the tile table of a GeoPackage.
+func readGpkgLayer(conn *sqlite.Conn, table string) (gpkgLayer, error) {
+	layer := gpkgLayer{table: table, matrices: make(map[uint8]gpkgMatrix), levels: make(map[int64]uint8)}
+
+	var minX, minY, maxX, maxY float64
+	{
+		stmt, _, err := conn.PrepareTransient("SELECT srs_id, min_x, min_y, max_x, max_y FROM gpkg_tile_matrix_set WHERE table_name = ?")
+		if err != nil {
+			return layer, fmt.Errorf("Failed to create statement, %w", err)
+		}
+		defer stmt.Finalize()
+		stmt.BindText(1, table)
+		row, err := stmt.Step()
+		if err != nil {
+			return layer, fmt.Errorf("Failed to step statement, %w", err)
+		}
+		if !row {
+			return layer, fmt.Errorf("no tile matrix set for layer %s", table)
+		}
+		organization, code, err := gpkgSrs(conn, stmt.ColumnInt64(0))
+		if err != nil {
+			return layer, err
+		}
+		if !isWebMercator(organization, code) {
+			return layer, fmt.Errorf("tile matrix set of layer %s is in %s:%d, only EPSG:3857 is supported", table, organization, code)
+		}
+		minX, minY, maxX, maxY = stmt.ColumnFloat(1), stmt.ColumnFloat(2), stmt.ColumnFloat(3), stmt.ColumnFloat(4)
+	}
+
+	{
+		stmt, _, err := conn.PrepareTransient("SELECT zoom_level, matrix_width FROM gpkg_tile_matrix WHERE table_name = ?")
+		if err != nil {
+			return layer, fmt.Errorf("Failed to create statement, %w", err)
+		}
+		defer stmt.Finalize()
+		stmt.BindText(1, table)
+		for {
+			row, err := stmt.Step()
+			if err != nil {
+				return layer, fmt.Errorf("Failed to step statement, %w", err)
+			}
+			if !row {
+				break
+			}
+			zoomLevel := stmt.ColumnInt64(0)
+			tileSize := (maxX - minX) / float64(stmt.ColumnInt64(1))
+			z, ok := alignedInt(math.Log2(2 * webMercatorHalfWorld / tileSize))
+			if !ok || z < 0 || z > int64(MaxTileZoom) {
+				return layer, fmt.Errorf("zoom level %d of layer %s does not match a Web Mercator zoom level", zoomLevel, table)
+			}
+			tileSize = 2 * webMercatorHalfWorld / float64(int64(1)<<z)
+			col0, okCol := alignedInt((minX + webMercatorHalfWorld) / tileSize)
+			row0, okRow := alignedInt((webMercatorHalfWorld - maxY) / tileSize)
+			if !okCol || !okRow {
+				return layer, fmt.Errorf("tile matrix set of layer %s is not aligned with the tiles of zoom level %d", table, z)
+			}
+			if _, ok := layer.matrices[uint8(z)]; ok {
+				return layer, fmt.Errorf("several zoom levels of layer %s match Web Mercator zoom level %d", table, z)
+			}
+			layer.matrices[uint8(z)] = gpkgMatrix{zoomLevel, col0, row0}
+			layer.levels[zoomLevel] = uint8(z)
+		}
+	}
+	if len(layer.matrices) == 0 {
+		return layer, fmt.Errorf("no tile matrices for layer %s", table)
+	}
+
+	stmt, _, err := conn.PrepareTransient("SELECT identifier, description, srs_id, min_x, min_y, max_x, max_y FROM gpkg_contents WHERE table_name = ?")
+	if err != nil {
+		return layer, fmt.Errorf("Failed to create statement, %w", err)
+	}
+	defer stmt.Finalize()
+	stmt.BindText(1, table)
+	if _, err := stmt.Step(); err != nil {
+		return layer, fmt.Errorf("Failed to step statement, %w", err)
+	}
+	layer.identifier = stmt.ColumnText(0)
+	layer.description = stmt.ColumnText(1)
+
+	// the contents bounds are optional and may be in another spatial reference system
+	// than the tile matrix set; they default to the extent of the tile matrix set
+	minLon, minLat := webMercatorToLonLat(minX, minY)
+	maxLon, maxLat := webMercatorToLonLat(maxX, maxY)
+	if stmt.ColumnType(3) != sqlite.TypeNull && stmt.ColumnType(4) != sqlite.TypeNull && stmt.ColumnType(5) != sqlite.TypeNull && stmt.ColumnType(6) != sqlite.TypeNull {
+		organization, code, err := gpkgSrs(conn, stmt.ColumnInt64(2))
+		if err != nil {
+			return layer, err
+		}
+		switch {
+		case isWebMercator(organization, code):
+			minLon, minLat = webMercatorToLonLat(stmt.ColumnFloat(3), stmt.ColumnFloat(4))
+			maxLon, maxLat = webMercatorToLonLat(stmt.ColumnFloat(5), stmt.ColumnFloat(6))
+		case organization == "EPSG" && code == 4326:
+			minLon, minLat, maxLon, maxLat = stmt.ColumnFloat(3), stmt.ColumnFloat(4), stmt.ColumnFloat(5), stmt.ColumnFloat(6)
+		}
+	}
+	layer.bounds = [4]float64{
+		math.Max(minLon, -180), math.Max(minLat, -85.0511287798066),
+		math.Min(maxLon, 180), math.Min(maxLat, 85.0511287798066),
+	}
+	return layer, nil
+}
+
+// tileID returns the tile ID of a tile at zoomLevel, column and row of the layer.
+func (l gpkgLayer) tileID(zoomLevel int64, column int64, row int64) (uint64, error) {
+	z, ok := l.levels[zoomLevel]
+	if !ok {
+		return 0, fmt.Errorf("tile %d/%d/%d of layer %s has no tile matrix", zoomLevel, column, row, l.table)
+	}
+	m := l.matrices[z]
+	x, y := m.col0+column, m.row0+row
+	if x < 0 || y < 0 || x > math.MaxUint32 || y > math.MaxUint32 {
+		return 0, fmt.Errorf("tile %d/%d/%d of layer %s is outside of zoom level %d", zoomLevel, column, row, l.table, z)
+	}
+	if err := ValidateTileCoord(z, uint32(x), uint32(y)); err != nil {
+		return 0, err
+	}
+	return ZxyToID(z, uint32(x), uint32(y)), nil
+}
+
+// gpkgTileReader reads tiles from a GeoPackage tile table with its own connection.
+type gpkgTileReader struct {
+	conn  *sqlite.Conn
+	stmt  *sqlite.Stmt
+	layer gpkgLayer
+}
+
+func newGpkgTileReader(input string, layer gpkgLayer) (tileReader, error) {
+	conn, err := openMbtilesReader(input)
+	if err != nil {
+		return nil, err
+	}
+	stmt := conn.Prep("SELECT tile_data FROM " + quoteIdentifier(layer.table) + " WHERE zoom_level = ? AND tile_column = ? AND tile_row = ?")
+	return &gpkgTileReader{conn, stmt, layer}, nil
+}
+
+func (g *gpkgTileReader) ReadTile(entry EntryV3) ([]byte, error) {
+	z, x, y := IDToZxy(entry.TileID)
+	m := g.layer.matrices[z]
+
+	g.stmt.BindInt64(1, m.zoomLevel)
+	g.stmt.BindInt64(2, int64(x)-m.col0)
+	g.stmt.BindInt64(3, int64(y)-m.row0)
+	defer g.stmt.Reset()
+	defer g.stmt.ClearBindings()
+
+	hasRow, err := g.stmt.Step()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to step statement, %w", err)
+	}
+	if !hasRow {
+		return nil, fmt.Errorf("Missing row")
+	}
+
+	var rawTile bytes.Buffer
+	rawTile.ReadFrom(g.stmt.ColumnReader(0))
+	return rawTile.Bytes(), nil
+}
+
+func (g *gpkgTileReader) Close() error {
+	return g.conn.Close()
+}
+
+// convertGpkg creates an archive from the tile table opts.Layer of a GeoPackage, or its only tile table.
+// GeoPackage rows count down from the top of the tile matrix set like XYZ rows, so they are offset
+// by the position of the tile matrix set in the Web Mercator grid instead of flipped like MBTiles rows.
+func convertGpkg(logger *log.Logger, input string, output convertOutput, opts ConvertOptions, tmpfile io.ReadWriteSeeker) error {
+	start := time.Now()
+	if opts.Resume {
+		return fmt.Errorf("resume is only supported for MBTiles input")
+	}
+	conn, err := openMbtilesReader(input)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	table, err := selectGpkgLayer(conn, opts.Layer)
+	if err != nil {
+		return err
+	}
+	layer, err := readGpkgLayer(conn, table)
+	if err != nil {
+		return err
+	}
+
+	logger.Println("Pass 1: Assembling TileID set")
+	tileset := roaring64.New()
+	{
+		stmt, _, err := conn.PrepareTransient("SELECT zoom_level, tile_column, tile_row FROM " + quoteIdentifier(table))
+		if err != nil {
+			return fmt.Errorf("Failed to create statement, %w", err)
+		}
+		defer stmt.Finalize()
+
+		for {
+			row, err := stmt.Step()
+			if err != nil {
+				return fmt.Errorf("Failed to step statement, %w", err)
+			}
+			if !row {
+				break
+			}
+			if err := opts.context().Err(); err != nil {
+				return err
+			}
+			id, err := layer.tileID(stmt.ColumnInt64(0), stmt.ColumnInt64(1), stmt.ColumnInt64(2))
+			if err != nil {
+				return err
+			}
+			tileset.Add(id)
+		}
+	}
+
+	if tileset.GetCardinality() == 0 {
+		return fmt.Errorf("no tiles in layer %s", table)
+	}
+
+	newReader := func() (tileReader, error) {
+		return newGpkgTileReader(input, layer)
+	}
+
+	// GeoPackage has no tile format metadata, so the first tile sets it
+	tileType := UnknownTileType
+	{
+		reader, err := newReader()
+		if err != nil {
+			return err
+		}
+		data, err := reader.ReadTile(EntryV3{TileID: tileset.Minimum(), RunLength: 1})
+		reader.Close()
+		if err != nil {
+			return err
+		}
+		tileType, _ = sniffTileType(data)
+		if tileType == UnknownTileType {
+			return fmt.Errorf("unknown tile format in layer %s", table)
+		}
+	}
+
+	// rounded, as bounds converted from meters are rarely whole degrees
+	E7 := 10000000.0
+	header := HeaderV3{
+		TileType:        tileType,
+		TileCompression: NoCompression,
+		MinLonE7:        int32(math.Round(layer.bounds[0] * E7)),
+		MinLatE7:        int32(math.Round(layer.bounds[1] * E7)),
+		MaxLonE7:        int32(math.Round(layer.bounds[2] * E7)),
+		MaxLatE7:        int32(math.Round(layer.bounds[3] * E7)),
+	}
+	header.MinZoom, _, _ = IDToZxy(tileset.Minimum())
+	header.MaxZoom, _, _ = IDToZxy(tileset.Maximum())
+	header.CenterZoom = header.MinZoom
+	header.CenterLonE7 = (header.MinLonE7 + header.MaxLonE7) / 2
+	header.CenterLatE7 = (header.MinLatE7 + header.MaxLatE7) / 2
+	format := tileTypeToString(tileType)
+	if tileType == Mvt {
+		format = "pbf"
+		header.TileCompression = UnknownCompression
+	}
+	name := layer.identifier
+	if name == "" {
+		name = table
+	}
+	jsonMetadata := map[string]interface{}{"name": name, "format": format}
+	if layer.description != "" {
+		jsonMetadata["description"] = layer.description
+	}
+	if err := applyMetadataOverrides(&header, jsonMetadata, opts.Metadata); err != nil {
+		return err
+	}
+
+	if err := filterTileset(opts, tileset, &header, jsonMetadata); err != nil {
+		return err
+	}
+
+	logger.Println("Pass 2: writing tiles")
+	if err := checkTileFormat(logger, &header, jsonMetadata, tileset, newReader, opts.TrustTileData); err != nil {
+		return err
+	}
+	header.InternalCompression = opts.Compression
+	resolve, err := newConvertResolver(opts, header, convertTmpDir(tmpfile))
+	if err != nil {
+		return err
+	}
+	defer resolve.close()
+	sink, err := newTileSink(opts, tmpfile, output, header.InternalCompression, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	defer sink.close()
+	tileErrors := newTileErrorHandler(logger, opts, output)
+	defer tileErrors.close()
+	i := tileset.Iterator()
+	bar := newProgress(opts, "tiles", int64(tileset.GetCardinality()))
+	err = addTiles(opts.context(), resolve, sink, opts.Workers, bar,
+		func() (EntryV3, bool) {
+			if !i.HasNext() {
+				return EntryV3{}, false
+			}
+			return EntryV3{TileID: i.Next()}, true
+		},
+		newReader,
+		tileErrors.handle, nil)
+	if err != nil {
+		return err
+	}
+	bar.Finish()
+	if err := tileErrors.close(); err != nil {
+		return err
+	}
+	header, err = sink.finalize(logger, resolve, header, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	if opts.StatsOut != "" {
+		if err := writeConvertReport(opts.StatsOut, resolve, header); err != nil {
+			return err
+		}
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return reportSummary(opts, header, archiveSummary(header, output), start)
+}
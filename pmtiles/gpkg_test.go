@@ -0,0 +1,109 @@
+package pmtiles
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"zombiezen.com/go/sqlite"
+	"zombiezen.com/go/sqlite/sqlitex"
+)
+
+func writeTestGpkg(t *testing.T, path string) {
+	conn, err := sqlite.OpenConn(path, sqlite.OpenReadWrite|sqlite.OpenCreate)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	err = sqlitex.ExecuteScript(conn, `
+		CREATE TABLE gpkg_spatial_ref_sys (srs_name TEXT, srs_id INTEGER PRIMARY KEY, organization TEXT, organization_coordsys_id INTEGER, definition TEXT, description TEXT);
+		CREATE TABLE gpkg_contents (table_name TEXT PRIMARY KEY, data_type TEXT, identifier TEXT, description TEXT, last_change TEXT, min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE, srs_id INTEGER);
+		CREATE TABLE gpkg_tile_matrix_set (table_name TEXT PRIMARY KEY, srs_id INTEGER, min_x DOUBLE, min_y DOUBLE, max_x DOUBLE, max_y DOUBLE);
+		CREATE TABLE gpkg_tile_matrix (table_name TEXT, zoom_level INTEGER, matrix_width INTEGER, matrix_height INTEGER, tile_width INTEGER, tile_height INTEGER, pixel_x_size DOUBLE, pixel_y_size DOUBLE);
+		INSERT INTO gpkg_spatial_ref_sys VALUES ('WGS 84', 4326, 'EPSG', 4326, '', ''), ('Pseudo-Mercator', 3857, 'epsg', 3857, '', '');
+		INSERT INTO gpkg_contents VALUES
+			('world', 'tiles', 'World', 'A world map', '', NULL, NULL, NULL, NULL, 3857),
+			('quadrant', 'tiles', '', '', '', 0, 0, 180, 80, 4326),
+			('geographic', 'tiles', '', '', '', -180, -90, 180, 90, 4326),
+			('places', 'features', '', '', '', NULL, NULL, NULL, NULL, 4326);
+		INSERT INTO gpkg_tile_matrix_set VALUES
+			('world', 3857, -20037508.3427892, -20037508.3427892, 20037508.3427892, 20037508.3427892),
+			('quadrant', 3857, 0, 0, 20037508.3427892, 20037508.3427892),
+			('geographic', 4326, -180, -90, 180, 90);
+		INSERT INTO gpkg_tile_matrix VALUES
+			('world', 0, 1, 1, 256, 256, 156543.033928, 156543.033928),
+			('world', 1, 2, 2, 256, 256, 78271.516964, 78271.516964),
+			('quadrant', 0, 1, 1, 256, 256, 78271.516964, 78271.516964),
+			('quadrant', 1, 2, 2, 256, 256, 39135.758482, 39135.758482),
+			('geographic', 0, 2, 1, 256, 256, 0.703125, 0.703125);
+		CREATE TABLE world (id INTEGER PRIMARY KEY, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE TABLE quadrant (id INTEGER PRIMARY KEY, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+		CREATE TABLE geographic (id INTEGER PRIMARY KEY, zoom_level INTEGER, tile_column INTEGER, tile_row INTEGER, tile_data BLOB);
+	`, nil)
+	assert.Nil(t, err)
+
+	for _, tile := range []struct {
+		table          string
+		z, column, row int64
+		data           string
+	}{
+		{"world", 0, 0, 0, "0"},
+		{"world", 1, 0, 0, "a"},
+		{"world", 1, 1, 1, "a"},
+		{"world", 1, 1, 0, "b"},
+		{"quadrant", 0, 0, 0, "0"},
+		{"quadrant", 1, 1, 1, "b"},
+		{"geographic", 0, 0, 0, "0"},
+	} {
+		err = sqlitex.Execute(conn, "INSERT INTO "+tile.table+" (zoom_level, tile_column, tile_row, tile_data) VALUES (?, ?, ?, ?)",
+			&sqlitex.ExecOptions{Args: []interface{}{tile.z, tile.column, tile.row, append(append([]byte{}, testPngTile...), tile.data...)}})
+		assert.Nil(t, err)
+	}
+}
+
+func TestConvertGpkg(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.gpkg")
+	writeTestGpkg(t, input)
+
+	output := filepath.Join(dir, "world.pmtiles")
+	err := Convert(logger, input, output, ConvertOptions{Deduplicate: true, MinZoom: -1, MaxZoom: -1, NoTmpfile: true, Layer: "world"}, nil)
+	assert.Nil(t, err)
+	header, metadata, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, TileType(Png), header.TileType)
+	assert.Equal(t, uint64(3), header.TileContentsCount)
+	assert.Equal(t, uint8(0), header.MinZoom)
+	assert.Equal(t, uint8(1), header.MaxZoom)
+	assert.Equal(t, int32(-1800000000), header.MinLonE7)
+	assert.Equal(t, int32(850511288), header.MaxLatE7)
+	assert.Equal(t, "World", metadata["name"])
+	assert.Equal(t, "A world map", metadata["description"])
+	assert.Equal(t, "png", metadata["format"])
+	assert.Equal(t, map[uint64]string{
+		ZxyToID(0, 0, 0): string(testPngTile) + "0",
+		ZxyToID(1, 0, 0): string(testPngTile) + "a",
+		ZxyToID(1, 1, 1): string(testPngTile) + "a",
+		ZxyToID(1, 1, 0): string(testPngTile) + "b",
+	}, tiles)
+
+	output = filepath.Join(dir, "quadrant.pmtiles")
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true, Layer: "quadrant"}, nil)
+	assert.Nil(t, err)
+	header, metadata, tiles = readTestArchiveTiles(t, output)
+	assert.Equal(t, uint8(1), header.MinZoom)
+	assert.Equal(t, uint8(2), header.MaxZoom)
+	assert.Equal(t, int32(0), header.MinLonE7)
+	assert.Equal(t, int32(800000000), header.MaxLatE7)
+	assert.Equal(t, "quadrant", metadata["name"])
+	assert.Equal(t, map[uint64]string{
+		ZxyToID(1, 1, 0): string(testPngTile) + "0",
+		ZxyToID(2, 3, 1): string(testPngTile) + "b",
+	}, tiles)
+
+	output = filepath.Join(dir, "error.pmtiles")
+	err = ConvertGPKG(logger, input, output, true, nil)
+	assert.ErrorContains(t, err, "choose one of geographic, quadrant, world")
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true, Layer: "places"}, nil)
+	assert.ErrorContains(t, err, "no tile layer places")
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true, Layer: "geographic"}, nil)
+	assert.ErrorContains(t, err, "only EPSG:3857 is supported")
+}
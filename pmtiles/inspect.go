@@ -0,0 +1,272 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// TileInspection describes the contents of a single tile.
+// Layers is set for vector tiles and Image for raster tiles.
+type TileInspection struct {
+	Z                uint8             `json:"z"`
+	X                uint32            `json:"x"`
+	Y                uint32            `json:"y"`
+	TileType         string            `json:"tile_type"`
+	Compression      string            `json:"compression"`
+	Size             int               `json:"size"`
+	DecompressedSize int               `json:"decompressed_size"`
+	Layers           []LayerInspection `json:"layers,omitempty"`
+	Image            *ImageInspection  `json:"image,omitempty"`
+}
+
+// LayerInspection describes one layer of a vector tile.
+// GeometryTypes counts the features of each geometry type: Unknown, Point, LineString or Polygon.
+type LayerInspection struct {
+	Name          string         `json:"name"`
+	Version       uint64         `json:"version"`
+	Extent        uint64         `json:"extent"`
+	Features      int            `json:"features"`
+	GeometryTypes map[string]int `json:"geometry_types"`
+	Keys          int            `json:"keys"`
+	Values        int            `json:"values"`
+}
+
+// ImageInspection describes a raster tile. ColorMode is empty if it is not recorded in the image header.
+// Brand is the major brand of the file type box of AVIF images.
+type ImageInspection struct {
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	ColorMode string `json:"color_mode,omitempty"`
+	Brand     string `json:"brand,omitempty"`
+}
+
+var mvtGeometryTypes = []string{"Unknown", "Point", "LineString", "Polygon"}
+
+// InspectTile writes a JSON description of the tile at z, x, y of the local archive at path to w:
+// the layers, feature counts and geometry types of vector tiles,
+// or the dimensions and color mode of raster tiles.
+// The tile is decompressed with the tile compression of the archive first.
+func InspectTile(path string, z uint8, x uint32, y uint32, w io.Writer) error {
+	a, err := OpenArchive(path)
+	if err != nil {
+		return err
+	}
+	defer a.Close()
+	data, err := a.Extract(z, x, y, false)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		return fmt.Errorf("tile %d/%d/%d not found in %s", z, x, y, path)
+	}
+
+	inspection, err := inspectTile(a.Header(), data)
+	if err != nil {
+		return fmt.Errorf("Failed to inspect tile %d/%d/%d, %w", z, x, y, err)
+	}
+	inspection.Z, inspection.X, inspection.Y = z, x, y
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(inspection)
+}
+
+// inspectTile decodes data, a tile as stored in an archive with header.
+func inspectTile(header HeaderV3, data []byte) (*TileInspection, error) {
+	compression := header.TileCompression
+	if compression == UnknownCompression {
+		compression = detectCompression(data)
+	}
+	compressionName, _ := compressionToString(compression)
+	inspection := &TileInspection{
+		TileType:    tileTypeToString(header.TileType),
+		Compression: compressionName,
+		Size:        len(data),
+	}
+	if compression != NoCompression {
+		var err error
+		data, err = decompressBytes(data, compression)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to decompress, %w", err)
+		}
+	}
+	inspection.DecompressedSize = len(data)
+
+	var err error
+	switch header.TileType {
+	case Mvt:
+		inspection.Layers, err = inspectMvt(data)
+	case Png, Jpeg:
+		inspection.Image, err = inspectStdImage(data)
+	case Webp:
+		inspection.Image, err = inspectWebp(data)
+	case Avif:
+		inspection.Image, err = inspectAvif(data)
+	default:
+		err = fmt.Errorf("unknown tile type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return inspection, nil
+}
+
+// inspectMvt lists the layers of an uncompressed MVT tile.
+func inspectMvt(tile []byte) ([]LayerInspection, error) {
+	layers := make([]LayerInspection, 0)
+	err := protoFields(tile, func(field uint64, _ uint64, layer []byte) error {
+		if field != 3 {
+			return nil
+		}
+		// version 1 is the default of the MVT protocol buffer
+		inspection := LayerInspection{Version: 1, Extent: 4096, GeometryTypes: make(map[string]int)}
+		err := protoFields(layer, func(field uint64, value uint64, bytes []byte) error {
+			switch field {
+			case 1:
+				inspection.Name = string(bytes)
+			case 2:
+				inspection.Features++
+				geomType := uint64(0)
+				err := protoFields(bytes, func(field uint64, value uint64, _ []byte) error {
+					if field == 3 {
+						geomType = value
+					}
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if geomType >= uint64(len(mvtGeometryTypes)) {
+					geomType = 0
+				}
+				inspection.GeometryTypes[mvtGeometryTypes[geomType]]++
+			case 3:
+				inspection.Keys++
+			case 4:
+				inspection.Values++
+			case 5:
+				inspection.Extent = value
+			case 15:
+				inspection.Version = value
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		layers = append(layers, inspection)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid vector tile, %w", err)
+	}
+	return layers, nil
+}
+
+// inspectStdImage reads the dimensions and color mode of a PNG or JPEG image.
+func inspectStdImage(data []byte) (*ImageInspection, error) {
+	var config image.Config
+	var err error
+	if bytes.HasPrefix(data, []byte{0x89, 'P', 'N', 'G'}) {
+		config, err = png.DecodeConfig(bytes.NewReader(data))
+	} else {
+		config, err = jpeg.DecodeConfig(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid image, %w", err)
+	}
+	colorMode := ""
+	switch config.ColorModel {
+	case color.GrayModel, color.Gray16Model:
+		colorMode = "grayscale"
+	case color.RGBAModel, color.RGBA64Model, color.NRGBAModel, color.NRGBA64Model:
+		colorMode = "rgba"
+	case color.YCbCrModel:
+		colorMode = "ycbcr"
+	case color.CMYKModel:
+		colorMode = "cmyk"
+	default:
+		if _, ok := config.ColorModel.(color.Palette); ok {
+			colorMode = "indexed"
+		}
+	}
+	return &ImageInspection{Width: config.Width, Height: config.Height, ColorMode: colorMode}, nil
+}
+
+// inspectWebp reads the dimensions of a WebP image from its first chunk: VP8X, VP8L or VP8.
+func inspectWebp(data []byte) (*ImageInspection, error) {
+	if len(data) < 30 || !bytes.Equal(data[0:4], []byte("RIFF")) || !bytes.Equal(data[8:12], []byte("WEBP")) {
+		return nil, fmt.Errorf("invalid WebP image")
+	}
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		colorMode := "rgb"
+		if chunk[0]&0x10 != 0 {
+			colorMode = "rgba"
+		}
+		return &ImageInspection{
+			Width:     int(uint32(chunk[4])|uint32(chunk[5])<<8|uint32(chunk[6])<<16) + 1,
+			Height:    int(uint32(chunk[7])|uint32(chunk[8])<<8|uint32(chunk[9])<<16) + 1,
+			ColorMode: colorMode,
+		}, nil
+	case "VP8L":
+		if chunk[0] != 0x2f {
+			return nil, fmt.Errorf("invalid lossless WebP image")
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:5])
+		colorMode := "rgb"
+		if bits&(1<<28) != 0 {
+			colorMode = "rgba"
+		}
+		return &ImageInspection{Width: int(bits&0x3fff) + 1, Height: int(bits>>14&0x3fff) + 1, ColorMode: colorMode}, nil
+	case "VP8 ":
+		if !bytes.Equal(chunk[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return nil, fmt.Errorf("invalid lossy WebP image")
+		}
+		return &ImageInspection{
+			Width:     int(binary.LittleEndian.Uint16(chunk[6:8]) & 0x3fff),
+			Height:    int(binary.LittleEndian.Uint16(chunk[8:10]) & 0x3fff),
+			ColorMode: "ycbcr",
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown WebP chunk %q", data[12:16])
+}
+
+// inspectAvif reads the brand, and the dimensions from the image spatial extents property, of an AVIF image.
+func inspectAvif(data []byte) (*ImageInspection, error) {
+	if len(data) < 12 || !bytes.Equal(data[4:8], []byte("ftyp")) {
+		return nil, fmt.Errorf("invalid AVIF image")
+	}
+	inspection := &ImageInspection{Brand: string(data[8:12])}
+	// boxes containing other boxes on the way to ispe, with the length of their header fields
+	containers := map[string]int{"meta": 4, "iprp": 0, "ipco": 0}
+	var walk func(boxes []byte)
+	walk = func(boxes []byte) {
+		for len(boxes) >= 8 {
+			size := int(binary.BigEndian.Uint32(boxes[0:4]))
+			if size < 8 || size > len(boxes) {
+				return
+			}
+			boxType, body := string(boxes[4:8]), boxes[8:size]
+			if skip, ok := containers[boxType]; ok && len(body) >= skip {
+				walk(body[skip:])
+			} else if boxType == "ispe" && len(body) >= 12 && inspection.Width == 0 {
+				inspection.Width = int(binary.BigEndian.Uint32(body[4:8]))
+				inspection.Height = int(binary.BigEndian.Uint32(body[8:12]))
+			}
+			boxes = boxes[size:]
+		}
+	}
+	walk(data)
+	if inspection.Width == 0 {
+		return nil, fmt.Errorf("no image spatial extents in AVIF image")
+	}
+	return inspection, nil
+}
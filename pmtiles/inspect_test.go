@@ -0,0 +1,113 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"image"
+	"image/png"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInspectTileMvt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	tile := testMvtTile(
+		testMvtLayer("roads", []string{"name", "lanes"}, []interface{}{"Main", 2.0}),
+		testMvtLayer("water", nil, nil),
+	)
+	writeTestArchive(t, path, Gzip, Mvt, nil, []testTile{{1, 0, 1, string(tile)}})
+
+	var b bytes.Buffer
+	assert.Nil(t, InspectTile(path, 1, 0, 1, &b))
+	var inspection TileInspection
+	assert.Nil(t, json.Unmarshal(b.Bytes(), &inspection))
+	assert.Equal(t, uint8(1), inspection.Z)
+	assert.Equal(t, uint32(1), inspection.Y)
+	assert.Equal(t, "mvt", inspection.TileType)
+	assert.Equal(t, len(tile), inspection.DecompressedSize)
+	assert.Equal(t, []LayerInspection{
+		{Name: "roads", Version: 2, Extent: 4096, Features: 1, GeometryTypes: map[string]int{"Unknown": 1}, Keys: 2, Values: 2},
+		{Name: "water", Version: 2, Extent: 4096, Features: 1, GeometryTypes: map[string]int{"Unknown": 1}},
+	}, inspection.Layers)
+
+	assert.ErrorContains(t, InspectTile(path, 1, 1, 1, &b), "not found")
+}
+
+func TestInspectMvtGeometryTypes(t *testing.T) {
+	var layer []byte
+	layer = appendProtoBytes(layer, 1, []byte("buildings"))
+	layer = appendProtoBytes(layer, 2, appendProtoVarint(nil, 3, 3))
+	layer = appendProtoBytes(layer, 2, appendProtoVarint(nil, 3, 3))
+	layer = appendProtoBytes(layer, 2, appendProtoVarint(nil, 3, 1))
+	layer = appendProtoVarint(layer, 5, 512)
+	layers, err := inspectMvt(testMvtTile(layer))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(layers))
+	assert.Equal(t, 3, layers[0].Features)
+	assert.Equal(t, uint64(512), layers[0].Extent)
+	assert.Equal(t, uint64(1), layers[0].Version)
+	assert.Equal(t, map[string]int{"Polygon": 2, "Point": 1}, layers[0].GeometryTypes)
+
+	_, err = inspectMvt([]byte{0x1a, 0x10, 0x0})
+	assert.Error(t, err)
+}
+
+func TestInspectTilePng(t *testing.T) {
+	var b bytes.Buffer
+	assert.Nil(t, png.Encode(&b, image.NewGray(image.Rect(0, 0, 256, 128))))
+	path := filepath.Join(t.TempDir(), "test.pmtiles")
+	writeTestArchive(t, path, NoCompression, Png, nil, []testTile{{0, 0, 0, b.String()}})
+
+	var out bytes.Buffer
+	assert.Nil(t, InspectTile(path, 0, 0, 0, &out))
+	var inspection TileInspection
+	assert.Nil(t, json.Unmarshal(out.Bytes(), &inspection))
+	assert.Equal(t, "png", inspection.TileType)
+	assert.Equal(t, &ImageInspection{Width: 256, Height: 128, ColorMode: "grayscale"}, inspection.Image)
+	assert.Nil(t, inspection.Layers)
+}
+
+func TestInspectWebp(t *testing.T) {
+	riff := func(chunk string, data []byte) []byte {
+		b := append([]byte("RIFF\x00\x00\x00\x00WEBP"+chunk), binary.LittleEndian.AppendUint32(nil, uint32(len(data)))...)
+		return append(b, data...)
+	}
+
+	lossy := []byte{0x0, 0x0, 0x0, 0x9d, 0x01, 0x2a}
+	lossy = binary.LittleEndian.AppendUint16(lossy, 300)
+	lossy = binary.LittleEndian.AppendUint16(lossy, 200)
+	inspection, err := inspectWebp(riff("VP8 ", lossy))
+	assert.Nil(t, err)
+	assert.Equal(t, &ImageInspection{Width: 300, Height: 200, ColorMode: "ycbcr"}, inspection)
+
+	lossless := binary.LittleEndian.AppendUint32([]byte{0x2f}, 255|511<<14|1<<28)
+	inspection, err = inspectWebp(riff("VP8L", append(lossless, 0, 0, 0, 0, 0)))
+	assert.Nil(t, err)
+	assert.Equal(t, &ImageInspection{Width: 256, Height: 512, ColorMode: "rgba"}, inspection)
+
+	extended := []byte{0x10, 0, 0, 0, 255, 0, 0, 127, 0, 0}
+	inspection, err = inspectWebp(riff("VP8X", extended))
+	assert.Nil(t, err)
+	assert.Equal(t, &ImageInspection{Width: 256, Height: 128, ColorMode: "rgba"}, inspection)
+
+	_, err = inspectWebp(testWebpTile)
+	assert.Error(t, err)
+}
+
+func TestInspectAvif(t *testing.T) {
+	box := func(boxType string, body []byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(8+len(body))), append([]byte(boxType), body...)...)
+	}
+	ispe := binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(make([]byte, 4), 512), 256)
+	data := append(box("ftyp", []byte("avif\x00\x00\x00\x00")),
+		box("meta", append(make([]byte, 4), box("iprp", box("ipco", box("ispe", ispe)))...))...)
+	inspection, err := inspectAvif(data)
+	assert.Nil(t, err)
+	assert.Equal(t, &ImageInspection{Width: 512, Height: 256, Brand: "avif"}, inspection)
+
+	_, err = inspectAvif(testAvifTile)
+	assert.Error(t, err)
+}
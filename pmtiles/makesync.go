@@ -10,7 +10,6 @@ import (
 	"fmt"
 	"github.com/cespare/xxhash/v2"
 	"github.com/dustin/go-humanize"
-	"github.com/schollz/progressbar/v3"
 	"golang.org/x/sync/errgroup"
 	"io"
 	"log"
@@ -84,7 +83,7 @@ func deserializeSyncBlocks(numBlocks int, reader *bufio.Reader) []syncBlock {
 	return blocks
 }
 
-func Makesync(logger *log.Logger, cliVersion string, file string, blockSizeKb int, checksum string) error {
+func Makesync(logger *log.Logger, cliVersion string, file string, blockSizeKb int, checksum string, progress ...ProgressReporter) error {
 	ctx := context.Background()
 	start := time.Now()
 
@@ -164,7 +163,7 @@ func Makesync(logger *log.Logger, cliVersion string, file string, blockSizeKb in
 		fmt.Printf("md5=%x\n", md5checksum)
 	}
 
-	bar := progressbar.Default(
+	bar := newStepProgress(progress,
 		int64(header.TileEntriesCount),
 		"writing syncfile",
 	)
@@ -257,7 +256,7 @@ func Makesync(logger *log.Logger, cliVersion string, file string, blockSizeKb in
 	return nil
 }
 
-func Sync(logger *log.Logger, oldVersion string, newVersion string, dryRun bool) error {
+func Sync(logger *log.Logger, oldVersion string, newVersion string, dryRun bool, progress ...ProgressReporter) error {
 	start := time.Now()
 
 	client := &http.Client{}
@@ -275,7 +274,7 @@ func Sync(logger *log.Logger, oldVersion string, newVersion string, dryRun bool)
 		if err != nil {
 			return err
 		}
-		bar := progressbar.DefaultBytes(
+		bar := newBytesProgress(progress,
 			resp.ContentLength,
 			"downloading syncfile",
 		)
@@ -351,7 +350,7 @@ func Sync(logger *log.Logger, oldVersion string, newVersion string, dryRun bool)
 		}
 	}
 
-	bar := progressbar.Default(
+	bar := newStepProgress(progress,
 		int64(len(blocks)),
 		"calculating diff",
 	)
@@ -0,0 +1,296 @@
+package pmtiles
+
+import (
+	"bytes"
+	"container/heap"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// MergeOptions configures how Merge combines archives.
+type MergeOptions struct {
+	// Deduplicate identical tile contents so they are stored only once.
+	Deduplicate bool
+	// OnConflict is what to do when a tile exists in several inputs: keep the tile of the "first" or "last" input,
+	// or fail with "error" unless all of them are identical; empty means "last".
+	OnConflict string
+	// Metadata is applied on top of the merged metadata of the inputs,
+	// where later inputs overwrite keys of earlier ones.
+	Metadata map[string]interface{}
+}
+
+type mergeInput struct {
+	file    *os.File
+	header  HeaderV3
+	entries []EntryV3
+}
+
+// mergeCursor walks the tiles of one input, one run-length segment at a time.
+type mergeCursor struct {
+	input int
+	// index of the current entry and the position inside its run
+	idx     int
+	pos     uint32
+	entries []EntryV3
+}
+
+func (c *mergeCursor) tileID() uint64 {
+	return c.entries[c.idx].TileID + uint64(c.pos)
+}
+
+func (c *mergeCursor) remaining() uint32 {
+	return c.entries[c.idx].RunLength - c.pos
+}
+
+func (c *mergeCursor) advance(n uint32) {
+	c.pos += n
+	if c.pos >= c.entries[c.idx].RunLength {
+		c.idx++
+		c.pos = 0
+	}
+}
+
+func (c *mergeCursor) done() bool {
+	return c.idx >= len(c.entries)
+}
+
+type mergeHeap []*mergeCursor
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].tileID() == h[j].tileID() {
+		return h[i].input < h[j].input
+	}
+	return h[i].tileID() < h[j].tileID()
+}
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeCursor)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	c := old[n-1]
+	*h = old[0 : n-1]
+	return c
+}
+
+// Merge combines several PMTiles archives into a single archive.
+// When a tile exists in more than one input, the tile from the last input is kept.
+func Merge(logger *log.Logger, inputs []string, output string, deduplicate bool, tmpfile *os.File) error {
+	return MergeWithOptions(logger, inputs, output, tmpfile, MergeOptions{Deduplicate: deduplicate})
+}
+
+// MergeWithOptions combines several PMTiles archives into a single archive.
+// All inputs must have the same tile type; tiles are transcoded to the tile compression of the first input.
+func MergeWithOptions(logger *log.Logger, inputs []string, output string, tmpfile *os.File, opts MergeOptions) error {
+	start := time.Now()
+	if len(inputs) == 0 {
+		return fmt.Errorf("no input archives to merge")
+	}
+	onConflict := opts.OnConflict
+	if onConflict == "" {
+		onConflict = "last"
+	}
+	if onConflict != "first" && onConflict != "last" && onConflict != "error" {
+		return fmt.Errorf("on conflict must be first, last or error")
+	}
+
+	sources := make([]mergeInput, 0, len(inputs))
+	defer func() {
+		for _, s := range sources {
+			s.file.Close()
+		}
+	}()
+
+	jsonMetadata := make(map[string]interface{})
+
+	for _, input := range inputs {
+		file, err := os.Open(input)
+		if err != nil {
+			return fmt.Errorf("Failed to open %s, %w", input, err)
+		}
+
+		headerBytes := make([]byte, HeaderV3LenBytes)
+		if _, err := io.ReadFull(file, headerBytes); err != nil {
+			file.Close()
+			return fmt.Errorf("Failed to read header of %s, %w", input, err)
+		}
+		header, err := DeserializeHeader(headerBytes)
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("Failed to parse header of %s, %w", input, err)
+		}
+		sources = append(sources, mergeInput{file: file, header: header})
+
+		first := sources[0].header
+		if header.TileType != first.TileType {
+			return fmt.Errorf("tile type of %s (%s) does not match %s (%s)", input, tileTypeToString(header.TileType), inputs[0], tileTypeToString(first.TileType))
+		}
+		if header.TileCompression != first.TileCompression && (header.TileCompression == UnknownCompression || first.TileCompression == UnknownCompression) {
+			return fmt.Errorf("cannot transcode tiles of %s with unknown compression", input)
+		}
+
+		metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+		metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+		if err != nil {
+			return fmt.Errorf("Failed to read metadata of %s, %w", input, err)
+		}
+		for k, v := range metadata {
+			jsonMetadata[k] = v
+		}
+
+		entries := make([]EntryV3, 0, header.TileEntriesCount)
+		err = IterateEntries(header,
+			ReaderAtFetcher(file),
+			func(e EntryV3) {
+				entries = append(entries, e)
+			})
+		if err != nil {
+			return fmt.Errorf("Failed to iterate through tiles of %s, %w", input, err)
+		}
+		sources[len(sources)-1].entries = entries
+	}
+
+	for k, v := range opts.Metadata {
+		jsonMetadata[k] = v
+	}
+
+	header := sources[0].header
+	for _, s := range sources[1:] {
+		header.MinLonE7 = min(header.MinLonE7, s.header.MinLonE7)
+		header.MinLatE7 = min(header.MinLatE7, s.header.MinLatE7)
+		header.MaxLonE7 = max(header.MaxLonE7, s.header.MaxLonE7)
+		header.MaxLatE7 = max(header.MaxLatE7, s.header.MaxLatE7)
+	}
+	header.CenterZoom = 0
+	header.CenterLonE7 = 0
+	header.CenterLatE7 = 0
+
+	tileCompression := header.TileCompression
+	if tileCompression == UnknownCompression {
+		tileCompression = NoCompression
+	}
+	resolve := newResolver(opts.Deduplicate, tileCompression)
+
+	h := make(mergeHeap, 0, len(sources))
+	for i, s := range sources {
+		if len(s.entries) > 0 {
+			h = append(h, &mergeCursor{input: i, entries: s.entries})
+		}
+	}
+	heap.Init(&h)
+
+	read := func(c *mergeCursor) ([]byte, error) {
+		s := sources[c.input]
+		entry := c.entries[c.idx]
+		data := make([]byte, entry.Length)
+		if _, err := s.file.ReadAt(data, int64(s.header.TileDataOffset+entry.Offset)); err != nil {
+			return nil, fmt.Errorf("Failed to read tile data, %w", err)
+		}
+		return data, nil
+	}
+
+	emit := func(c *mergeCursor, tileID uint64, runLength uint32) error {
+		s := sources[c.input]
+		data, err := read(c)
+		if err != nil {
+			return err
+		}
+		if s.header.TileCompression != header.TileCompression && s.header.TileCompression != NoCompression {
+			decompressed, err := decompressBytes(data, s.header.TileCompression)
+			if err != nil {
+				return fmt.Errorf("Failed to decompress tile %d, %w", tileID, err)
+			}
+			data = decompressed
+		}
+		if len(data) == 0 {
+			return nil
+		}
+		isNew, newData, err := resolve.AddTileIsNew(tileID, data, runLength)
+		if err != nil {
+			return tileOrderError(tileID, err)
+		}
+		if isNew {
+			if _, err := tmpfile.Write(newData); err != nil {
+				return fmt.Errorf("Failed to write to tempfile, %w", err)
+			}
+		}
+		return nil
+	}
+
+	for h.Len() > 0 {
+		tileID := h[0].tileID()
+		group := []*mergeCursor{heap.Pop(&h).(*mergeCursor)}
+		for h.Len() > 0 && h[0].tileID() == tileID {
+			group = append(group, heap.Pop(&h).(*mergeCursor))
+		}
+
+		if len(group) == 1 {
+			// emit as much of the run as possible without overlapping another input
+			c := group[0]
+			n := c.remaining()
+			if h.Len() > 0 && h[0].tileID()-tileID < uint64(n) {
+				n = uint32(h[0].tileID() - tileID)
+			}
+			if err := emit(c, tileID, n); err != nil {
+				return err
+			}
+			c.advance(n)
+		} else {
+			// the group is ordered by input index
+			winner := group[len(group)-1]
+			switch onConflict {
+			case "first":
+				winner = group[0]
+			case "error":
+				if err := checkMergeConflict(group, sources, inputs, read, tileID); err != nil {
+					return err
+				}
+			}
+			if err := emit(winner, tileID, 1); err != nil {
+				return err
+			}
+			for _, c := range group {
+				c.advance(1)
+			}
+		}
+
+		for _, c := range group {
+			if !c.done() {
+				heap.Push(&h, c)
+			}
+		}
+	}
+
+	if len(resolve.Entries) == 0 {
+		return fmt.Errorf("no tiles in input archives")
+	}
+
+	_, err := finalize(logger, resolve, header, tmpfile, output, jsonMetadata)
+	if err != nil {
+		return err
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return nil
+}
+
+// checkMergeConflict returns an error unless the inputs of group store the same bytes for tileID.
+func checkMergeConflict(group []*mergeCursor, sources []mergeInput, inputs []string, read func(*mergeCursor) ([]byte, error), tileID uint64) error {
+	first, err := read(group[0])
+	if err != nil {
+		return err
+	}
+	for _, c := range group[1:] {
+		data, err := read(c)
+		if err != nil {
+			return err
+		}
+		if sources[c.input].header.TileCompression != sources[group[0].input].header.TileCompression || !bytes.Equal(first, data) {
+			z, x, y := IDToZxy(tileID)
+			return fmt.Errorf("tile %d/%d/%d is different in %s and %s", z, x, y, inputs[group[0].input], inputs[c.input])
+		}
+	}
+	return nil
+}
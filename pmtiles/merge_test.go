@@ -0,0 +1,152 @@
+package pmtiles
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+type testTile struct {
+	z    uint8
+	x, y uint32
+	data string
+}
+
+func writeTestArchive(t *testing.T, path string, compression Compression, tileType TileType, metadata map[string]interface{}, tiles []testTile) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Deduplicate: true, Compression: compression, TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+	for _, tile := range tiles {
+		assert.Nil(t, w.AddTile(tile.z, tile.x, tile.y, []byte(tile.data)))
+	}
+	_, err = w.Finalize(HeaderV3{TileType: tileType, MinLonE7: -10 * 10000000, MaxLonE7: 10 * 10000000, MinLatE7: -10 * 10000000, MaxLatE7: 10 * 10000000}, metadata)
+	assert.Nil(t, err)
+	assert.Nil(t, os.WriteFile(path, b.Bytes(), 0644))
+}
+
+func readTestArchiveTiles(t *testing.T, path string) (HeaderV3, map[string]interface{}, map[uint64]string) {
+	archive, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	header, err := DeserializeHeader(archive[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	metadata, err := DeserializeMetadata(bytes.NewReader(archive[header.MetadataOffset:header.MetadataOffset+header.MetadataLength]), header.InternalCompression)
+	assert.Nil(t, err)
+
+	tiles := make(map[uint64]string)
+	err = IterateEntries(header,
+		FetchSectionFunc(func(offset uint64, length uint64) ([]byte, error) {
+			return archive[offset : offset+length], nil
+		}),
+		func(e EntryV3) {
+			start := header.TileDataOffset + e.Offset
+			data := archive[start : start+uint64(e.Length)]
+			if header.TileCompression != NoCompression {
+				data, err = decompressBytes(data, header.TileCompression)
+				assert.Nil(t, err)
+			}
+			for i := uint32(0); i < e.RunLength; i++ {
+				tiles[e.TileID+uint64(i)] = string(data)
+			}
+		})
+	assert.Nil(t, err)
+	return header, metadata, tiles
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.pmtiles")
+	b := filepath.Join(dir, "b.pmtiles")
+	writeTestArchive(t, a, Gzip, Mvt, map[string]interface{}{"name": "a", "attribution": "A"}, []testTile{
+		{0, 0, 0, "a"}, {1, 0, 0, "a"}, {1, 0, 1, "a"}, {1, 1, 1, "a"},
+	})
+	writeTestArchive(t, b, Zstd, Mvt, map[string]interface{}{"name": "b"}, []testTile{
+		{1, 0, 1, "b"}, {2, 0, 0, "b"},
+	})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "merged.pmtiles")
+	assert.Nil(t, Merge(logger, []string{a, b}, output, true, tmpfile))
+
+	header, metadata, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, Compression(Gzip), header.TileCompression)
+	assert.Equal(t, uint8(2), header.MaxZoom)
+	assert.Equal(t, "b", metadata["name"])
+	assert.Equal(t, "A", metadata["attribution"])
+	assert.Equal(t, 5, len(tiles))
+	assert.Equal(t, "a", tiles[ZxyToID(1, 0, 0)])
+	assert.Equal(t, "b", tiles[ZxyToID(1, 0, 1)])
+	assert.Equal(t, "a", tiles[ZxyToID(1, 1, 1)])
+	assert.Equal(t, "b", tiles[ZxyToID(2, 0, 0)])
+}
+
+func TestMergeOnConflictFirst(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.pmtiles")
+	b := filepath.Join(dir, "b.pmtiles")
+	writeTestArchive(t, a, NoCompression, Png, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "a"}})
+	writeTestArchive(t, b, NoCompression, Png, map[string]interface{}{}, []testTile{{1, 0, 0, "b"}, {1, 0, 1, "b"}})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "merged.pmtiles")
+	err = MergeWithOptions(logger, []string{a, b}, output, tmpfile, MergeOptions{OnConflict: "first", Metadata: map[string]interface{}{"name": "merged"}})
+	assert.Nil(t, err)
+
+	_, metadata, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, "merged", metadata["name"])
+	assert.Equal(t, "a", tiles[ZxyToID(1, 0, 0)])
+	assert.Equal(t, "b", tiles[ZxyToID(1, 0, 1)])
+}
+
+func TestMergeOnConflictError(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.pmtiles")
+	b := filepath.Join(dir, "b.pmtiles")
+	c := filepath.Join(dir, "c.pmtiles")
+	writeTestArchive(t, a, NoCompression, Png, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "same"}})
+	writeTestArchive(t, b, NoCompression, Png, map[string]interface{}{}, []testTile{{1, 0, 0, "same"}, {1, 0, 1, "b"}})
+	writeTestArchive(t, c, NoCompression, Png, map[string]interface{}{}, []testTile{{1, 0, 1, "c"}})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "merged.pmtiles")
+	err = MergeWithOptions(logger, []string{a, b}, output, tmpfile, MergeOptions{OnConflict: "error"})
+	assert.Nil(t, err)
+	_, _, tiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, 3, len(tiles))
+	assert.Equal(t, "same", tiles[ZxyToID(1, 0, 0)])
+
+	conflictTmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer conflictTmpfile.Close()
+	err = MergeWithOptions(logger, []string{a, b, c}, filepath.Join(dir, "conflict.pmtiles"), conflictTmpfile, MergeOptions{OnConflict: "error"})
+	assert.ErrorContains(t, err, "tile 1/0/1")
+	assert.Error(t, MergeWithOptions(logger, []string{a}, output, conflictTmpfile, MergeOptions{OnConflict: "middle"}))
+}
+
+func TestMergeMismatchedTileType(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.pmtiles")
+	b := filepath.Join(dir, "b.pmtiles")
+	writeTestArchive(t, a, NoCompression, Png, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}})
+	writeTestArchive(t, b, NoCompression, Jpeg, map[string]interface{}{}, []testTile{{0, 0, 0, "b"}})
+
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	assert.Error(t, Merge(logger, []string{a, b}, filepath.Join(dir, "merged.pmtiles"), true, tmpfile))
+}
+
+func sortTestTiles(tiles []testTile) {
+	sort.Slice(tiles, func(i, j int) bool {
+		return ZxyToID(tiles[i].z, tiles[i].x, tiles[i].y) < ZxyToID(tiles[j].z, tiles[j].x, tiles[j].y)
+	})
+}
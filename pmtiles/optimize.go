@@ -0,0 +1,68 @@
+package pmtiles
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+)
+
+// OptimizeDirectory copies the local archive at input to output with its directories rebuilt
+// for a root directory of at most rootTargetBytes, such as a larger root to save leaf fetches from object storage.
+// Metadata and tile data are copied unchanged, in the same order, so clustering and counts are kept.
+func OptimizeDirectory(logger *log.Logger, input, output string, rootTargetBytes int) error {
+	if rootTargetBytes < minRootDirSize {
+		return fmt.Errorf("root directory target must be at least %d bytes", minRootDirSize)
+	}
+	file, header, err := openLocalHeader(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	entries := make([]EntryV3, 0, header.TileEntriesCount)
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		entries = append(entries, e)
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to read directories of %s, %w", input, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("no tiles in %s", input)
+	}
+
+	// optimizeDirectories only considers a root directory without leaves for fewer than 16384 entries,
+	// while a larger target may fit many more
+	rootBytes, leavesBytes, numLeaves := SerializeEntries(entries, header.InternalCompression), []byte{}, 0
+	if len(rootBytes) > rootTargetBytes {
+		rootBytes, leavesBytes, numLeaves = optimizeDirectories(entries, rootTargetBytes, header.InternalCompression)
+	}
+	logger.Printf("Root dir bytes: %d (was %d), leaf dir bytes: %d (was %d), %d leaf dirs\n",
+		len(rootBytes), header.RootLength, len(leavesBytes), header.LeafDirectoryLength, numLeaves)
+
+	newHeader := header
+	newHeader.RootOffset = HeaderV3LenBytes
+	newHeader.RootLength = uint64(len(rootBytes))
+	newHeader.MetadataOffset = newHeader.RootOffset + newHeader.RootLength
+	newHeader.LeafDirectoryOffset = newHeader.MetadataOffset + newHeader.MetadataLength
+	newHeader.LeafDirectoryLength = uint64(len(leavesBytes))
+	newHeader.TileDataOffset = newHeader.LeafDirectoryOffset + newHeader.LeafDirectoryLength
+
+	outfile, err := createAtomic(output)
+	if err != nil {
+		return err
+	}
+	defer outfile.Close()
+
+	sections := []io.Reader{
+		bytes.NewReader(SerializeHeader(newHeader)),
+		bytes.NewReader(rootBytes),
+		io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength)),
+		bytes.NewReader(leavesBytes),
+		io.NewSectionReader(file, int64(header.TileDataOffset), int64(header.TileDataLength)),
+	}
+	if _, err := io.Copy(outfile, io.MultiReader(sections...)); err != nil {
+		return fmt.Errorf("Failed to write %s, %w", output, err)
+	}
+	return outfile.commit()
+}
@@ -0,0 +1,35 @@
+package pmtiles
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOptimizeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	var tiles []testTile
+	for i := ZxyToID(7, 0, 0); i < ZxyToID(8, 0, 0); i++ {
+		z, x, y := IDToZxy(i)
+		tiles = append(tiles, testTile{z, x, y, fmt.Sprint(i)})
+	}
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{"name": "in"}, tiles)
+	header, _, inputTiles := readTestArchiveTiles(t, input)
+	assert.Greater(t, header.LeafDirectoryLength, uint64(0))
+
+	output := filepath.Join(dir, "out.pmtiles")
+	assert.Nil(t, OptimizeDirectory(logger, input, output, 1<<20))
+	newHeader, metadata, outputTiles := readTestArchiveTiles(t, output)
+	assert.Equal(t, uint64(0), newHeader.LeafDirectoryLength)
+	assert.Greater(t, newHeader.RootLength, header.RootLength)
+	assert.Equal(t, header.TileDataLength, newHeader.TileDataLength)
+	assert.Equal(t, header.AddressedTilesCount, newHeader.AddressedTilesCount)
+	assert.Equal(t, "in", metadata["name"])
+	assert.Equal(t, inputTiles, outputTiles)
+	assert.Nil(t, Verify(logger, output))
+
+	assert.Error(t, OptimizeDirectory(logger, input, output, 100))
+}
@@ -0,0 +1,350 @@
+package pmtiles
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// defaultProgressInterval is the time between JSON progress events when ConvertOptions.ProgressInterval is unset.
+const defaultProgressInterval = 10 * time.Second
+
+// defaultProgressFuncInterval is the least time between calls of ConvertOptions.ProgressFunc when
+// ConvertOptions.ProgressFuncInterval is unset.
+const defaultProgressFuncInterval = 250 * time.Millisecond
+
+// progressOutput receives the JSON progress events and summaries of conversions.
+var progressOutput io.Writer = os.Stderr
+
+// ProgressReporter receives the progress of long-running operations, such as the tiles of a conversion
+// or the bytes of an upload, in place of a progress bar on standard error.
+// Its methods may be called from several goroutines.
+type ProgressReporter interface {
+	// SetTotal starts a phase of the operation with total steps, -1 if unknown.
+	SetTotal(total int64)
+	// Add reports n more steps done in the current phase.
+	Add(n int)
+	// Finish ends the current phase.
+	Finish()
+}
+
+// ProgressFunc receives the progress of a phase of a conversion, such as "tiles": the steps done of total, -1 if unknown.
+// Calls are rate-limited and made from one goroutine at a time.
+type ProgressFunc func(phase string, done, total int64)
+
+// NewProgressBarReporter returns a ProgressReporter showing a progress bar on standard error.
+func NewProgressBarReporter() ProgressReporter {
+	return &barReporter{}
+}
+
+// NewNoOpReporter returns a ProgressReporter that ignores progress.
+func NewNoOpReporter() ProgressReporter {
+	return noOpReporter{}
+}
+
+type barReporter struct {
+	mu  sync.Mutex
+	bar *progressbar.ProgressBar
+}
+
+func (r *barReporter) SetTotal(total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.bar = progressbar.Default(total)
+}
+
+func (r *barReporter) Add(n int) {
+	r.mu.Lock()
+	bar := r.bar
+	r.mu.Unlock()
+	if bar != nil {
+		bar.Add(n)
+	}
+}
+
+func (r *barReporter) Finish() {
+	r.mu.Lock()
+	bar := r.bar
+	r.mu.Unlock()
+	if bar != nil {
+		bar.Finish()
+	}
+}
+
+type noOpReporter struct{}
+
+func (noOpReporter) SetTotal(int64) {}
+func (noOpReporter) Add(int)        {}
+func (noOpReporter) Finish()        {}
+
+// firstReporter returns the first of the optional reporters of a function, or nil.
+func firstReporter(reporters []ProgressReporter) ProgressReporter {
+	if len(reporters) > 0 {
+		return reporters[0]
+	}
+	return nil
+}
+
+// reporterProgress is a progressTracker forwarding to a ProgressReporter.
+type reporterProgress struct {
+	reporter ProgressReporter
+	mu       sync.Mutex
+	done     int64
+}
+
+// newReporterProgress starts a phase of total steps on reporter.
+func newReporterProgress(reporter ProgressReporter, total int64) *reporterProgress {
+	reporter.SetTotal(total)
+	return &reporterProgress{reporter: reporter}
+}
+
+func (p *reporterProgress) Add(n int) error {
+	p.mu.Lock()
+	p.done += int64(n)
+	p.mu.Unlock()
+	p.reporter.Add(n)
+	return nil
+}
+
+// Set reports the steps done since the last call, as a ProgressReporter only counts up.
+func (p *reporterProgress) Set(n int) error {
+	p.mu.Lock()
+	delta := int64(n) - p.done
+	if delta > 0 {
+		p.done = int64(n)
+	}
+	p.mu.Unlock()
+	if delta > 0 {
+		p.reporter.Add(int(delta))
+	}
+	return nil
+}
+
+func (p *reporterProgress) Finish() error {
+	p.reporter.Finish()
+	return nil
+}
+
+// Write counts the bytes of p as steps, to report the progress of a copy.
+func (p *reporterProgress) Write(b []byte) (int, error) {
+	return len(b), p.Add(len(b))
+}
+
+// newStepProgress returns the tracker of total steps of an operation outside of Convert: the first of reporters,
+// or a progress bar with description if there is none.
+func newStepProgress(reporters []ProgressReporter, total int64, description ...string) progressTracker {
+	if reporter := firstReporter(reporters); reporter != nil {
+		return newReporterProgress(reporter, total)
+	}
+	return progressbar.Default(total, description...)
+}
+
+// newBytesProgress returns a writer counting the total bytes of an operation outside of Convert: the first of reporters,
+// or a progress bar of bytes with description if there is none.
+func newBytesProgress(reporters []ProgressReporter, total int64, description ...string) io.Writer {
+	if reporter := firstReporter(reporters); reporter != nil {
+		return newReporterProgress(reporter, total)
+	}
+	return progressbar.DefaultBytes(total, description...)
+}
+
+// progressTracker counts the work done in one phase of a conversion.
+// *progressbar.ProgressBar is a progressTracker.
+type progressTracker interface {
+	Add(n int) error
+	Set(n int) error
+	Finish() error
+}
+
+// newProgress returns the tracker of a phase of a conversion with total steps, -1 if unknown,
+// reporting to opts.ProgressReporter or opts.ProgressFunc if either is set, or according to opts.Progress: a progress bar, JSON events, or nothing.
+// An empty Progress shows a bar only if standard error is a terminal.
+func newProgress(opts ConvertOptions, phase string, total int64, description ...string) progressTracker {
+	if opts.ProgressReporter != nil {
+		return newReporterProgress(opts.ProgressReporter, total)
+	}
+	if opts.ProgressFunc != nil {
+		interval := opts.ProgressFuncInterval
+		if interval <= 0 {
+			interval = defaultProgressFuncInterval
+		}
+		return &funcProgress{fn: opts.ProgressFunc, phase: phase, total: total, interval: interval, last: time.Now()}
+	}
+	switch progressMode(opts.Progress) {
+	case "json":
+		interval := opts.ProgressInterval
+		if interval <= 0 {
+			interval = defaultProgressInterval
+		}
+		return &jsonProgress{w: progressOutput, phase: phase, total: total, interval: interval, start: time.Now(), last: time.Now()}
+	case "bar":
+		return progressbar.Default(total, description...)
+	}
+	return noProgress{}
+}
+
+// progressMode resolves an empty progress mode to bar if standard error is a terminal, or none otherwise.
+func progressMode(mode string) string {
+	if mode != "" {
+		return mode
+	}
+	if info, err := os.Stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		return "bar"
+	}
+	return "none"
+}
+
+type noProgress struct{}
+
+func (noProgress) Add(int) error { return nil }
+func (noProgress) Set(int) error { return nil }
+func (noProgress) Finish() error { return nil }
+
+// progressEvent is a line of JSON progress output.
+type progressEvent struct {
+	Phase    string  `json:"phase"`
+	Done     int64   `json:"done"`
+	Total    int64   `json:"total"`
+	Elapsed  float64 `json:"elapsed_s"`
+	Finished bool    `json:"finished,omitempty"`
+}
+
+// jsonProgress writes a progressEvent to w at most once per interval, and when the phase is finished.
+// It is safe for concurrent use.
+type jsonProgress struct {
+	w        io.Writer
+	phase    string
+	total    int64
+	interval time.Duration
+	start    time.Time
+	done     atomic.Int64
+
+	mu       sync.Mutex
+	last     time.Time
+	finished bool
+}
+
+func (p *jsonProgress) Add(n int) error {
+	return p.report(p.done.Add(int64(n)), false)
+}
+
+func (p *jsonProgress) Set(n int) error {
+	p.done.Store(int64(n))
+	return p.report(int64(n), false)
+}
+
+func (p *jsonProgress) Finish() error {
+	return p.report(p.done.Load(), true)
+}
+
+func (p *jsonProgress) report(done int64, finish bool) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished || (!finish && time.Since(p.last) < p.interval) {
+		return nil
+	}
+	p.last = time.Now()
+	p.finished = finish
+	return writeProgressJSON(p.w, progressEvent{
+		Phase:    p.phase,
+		Done:     done,
+		Total:    p.total,
+		Elapsed:  elapsedSeconds(p.start),
+		Finished: finish,
+	})
+}
+
+// funcProgress calls fn at most once per interval, and when the phase is finished.
+// It is safe for concurrent use.
+type funcProgress struct {
+	fn       ProgressFunc
+	phase    string
+	total    int64
+	interval time.Duration
+	done     atomic.Int64
+
+	mu       sync.Mutex
+	last     time.Time
+	finished bool
+}
+
+func (p *funcProgress) Add(n int) error {
+	p.report(p.done.Add(int64(n)), false)
+	return nil
+}
+
+func (p *funcProgress) Set(n int) error {
+	p.done.Store(int64(n))
+	p.report(int64(n), false)
+	return nil
+}
+
+func (p *funcProgress) Finish() error {
+	p.report(p.done.Load(), true)
+	return nil
+}
+
+func (p *funcProgress) report(done int64, finish bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished || (!finish && time.Since(p.last) < p.interval) {
+		return
+	}
+	p.last = time.Now()
+	p.finished = finish
+	p.fn(p.phase, done, p.total)
+}
+
+// progressSummary is the final JSON line of a conversion with Progress "json".
+type progressSummary struct {
+	Phase          string  `json:"phase"`
+	Output         string  `json:"output,omitempty"`
+	AddressedTiles uint64  `json:"addressed_tiles"`
+	TileEntries    uint64  `json:"tile_entries,omitempty"`
+	TileContents   uint64  `json:"tile_contents,omitempty"`
+	Elapsed        float64 `json:"elapsed_s"`
+}
+
+// archiveSummary returns the summary of a conversion that wrote the archive with header to output.
+func archiveSummary(header HeaderV3, output convertOutput) progressSummary {
+	return progressSummary{
+		Output:         output.path,
+		AddressedTiles: header.AddressedTilesCount,
+		TileEntries:    header.TileEntriesCount,
+		TileContents:   header.TileContentsCount,
+	}
+}
+
+// reportSummary records the header of a completed conversion in its ConvertResult, if any,
+// and writes its counts to output as JSON if opts.Progress is "json".
+func reportSummary(opts ConvertOptions, header HeaderV3, summary progressSummary, start time.Time) error {
+	if opts.result != nil {
+		opts.result.Header = header
+		opts.result.Elapsed = time.Since(start)
+	}
+	if progressMode(opts.Progress) != "json" {
+		return nil
+	}
+	summary.Phase = "summary"
+	summary.Elapsed = elapsedSeconds(start)
+	return writeProgressJSON(progressOutput, summary)
+}
+
+func writeProgressJSON(w io.Writer, v interface{}) error {
+	line, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+func elapsedSeconds(start time.Time) float64 {
+	return math.Round(time.Since(start).Seconds()*1000) / 1000
+}
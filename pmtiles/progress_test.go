@@ -0,0 +1,159 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONProgress(t *testing.T) {
+	var b bytes.Buffer
+	p := &jsonProgress{w: &b, phase: "tiles", total: 10, interval: time.Hour, start: time.Now(), last: time.Now()}
+	for i := 0; i < 10; i++ {
+		assert.Nil(t, p.Add(1))
+	}
+	assert.Equal(t, 0, b.Len())
+	assert.Nil(t, p.Finish())
+	assert.Nil(t, p.Finish())
+
+	var event progressEvent
+	assert.Nil(t, json.Unmarshal(b.Bytes(), &event))
+	assert.Equal(t, progressEvent{Phase: "tiles", Done: 10, Total: 10, Elapsed: event.Elapsed, Finished: true}, event)
+
+	b.Reset()
+	p = &jsonProgress{w: &b, phase: "tiles", total: 10, interval: time.Nanosecond, start: time.Now()}
+	assert.Nil(t, p.Set(4))
+	var next progressEvent
+	assert.Nil(t, json.Unmarshal(b.Bytes(), &next))
+	assert.Equal(t, int64(4), next.Done)
+	assert.False(t, next.Finished)
+}
+
+func TestConvertProgressJSON(t *testing.T) {
+	var b bytes.Buffer
+	progressOutput = &b
+	defer func() { progressOutput = os.Stderr }()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte { return testGzipTile() })
+	output := filepath.Join(dir, "out.pmtiles")
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Deduplicate: true, NoTmpfile: true, Progress: "json"}, nil))
+
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	var event progressEvent
+	assert.Nil(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, "tiles", event.Phase)
+	assert.Equal(t, int64(21), event.Done)
+	assert.Equal(t, int64(21), event.Total)
+	var summary progressSummary
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &summary))
+	assert.Equal(t, "summary", summary.Phase)
+	assert.Equal(t, output, summary.Output)
+	assert.Equal(t, uint64(21), summary.AddressedTiles)
+	assert.Equal(t, uint64(1), summary.TileContents)
+
+	b.Reset()
+	extracted := filepath.Join(dir, "tiles")
+	assert.Nil(t, convertToDirectory(logger, output, extracted, "", ConvertOptions{MinZoom: -1, MaxZoom: -1, PrecreateDirs: true, Progress: "json"}))
+	lines = strings.Split(strings.TrimSpace(b.String()), "\n")
+	assert.Equal(t, 3, len(lines))
+	assert.Contains(t, lines[0], `"phase":"directories"`)
+	assert.Contains(t, lines[1], `"phase":"tiles"`)
+	assert.Contains(t, lines[2], `"addressed_tiles":21`)
+
+	b.Reset()
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Force: true, NoTmpfile: true, Progress: "none"}, nil))
+	assert.Equal(t, 0, b.Len())
+
+	assert.Error(t, Convert(logger, input, output, ConvertOptions{Force: true, Progress: "fancy"}, nil))
+}
+
+type recordingReporter struct {
+	mu       sync.Mutex
+	totals   []int64
+	done     int64
+	finished int
+}
+
+func (r *recordingReporter) SetTotal(total int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.totals = append(r.totals, total)
+}
+
+func (r *recordingReporter) Add(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.done += int64(n)
+}
+
+func (r *recordingReporter) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.finished++
+}
+
+func TestReporterProgress(t *testing.T) {
+	r := &recordingReporter{}
+	p := newReporterProgress(r, 10)
+	assert.Nil(t, p.Set(4))
+	assert.Nil(t, p.Set(3))
+	assert.Nil(t, p.Add(2))
+	n, err := p.Write([]byte("abc"))
+	assert.Nil(t, err)
+	assert.Equal(t, 3, n)
+	assert.Nil(t, p.Finish())
+	assert.Equal(t, []int64{10}, r.totals)
+	assert.Equal(t, int64(9), r.done)
+	assert.Equal(t, 1, r.finished)
+
+	NewNoOpReporter().SetTotal(1)
+}
+
+func TestConvertProgressReporter(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte { return testGzipTile() })
+	output := filepath.Join(dir, "out.pmtiles")
+	r := &recordingReporter{}
+	assert.Nil(t, Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true, ProgressReporter: r}, nil))
+	assert.Equal(t, []int64{21}, r.totals)
+	assert.Equal(t, int64(21), r.done)
+	assert.Equal(t, 1, r.finished)
+
+	r = &recordingReporter{}
+	assert.Nil(t, ConvertToMbtiles(logger, output, filepath.Join(dir, "out.mbtiles"), false, r))
+	assert.Equal(t, []int64{21}, r.totals)
+	assert.Equal(t, int64(21), r.done)
+}
+
+func TestConvertProgressFunc(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte { return testGzipTile() })
+	output := filepath.Join(dir, "out.pmtiles")
+
+	var events []progressEvent
+	record := func(phase string, done, total int64) {
+		events = append(events, progressEvent{Phase: phase, Done: done, Total: total})
+	}
+	opts := ConvertOptions{MinZoom: -1, MaxZoom: -1, NoTmpfile: true, ProgressFunc: record, ProgressFuncInterval: time.Hour}
+	assert.Nil(t, Convert(logger, input, output, opts, nil))
+	assert.Equal(t, []progressEvent{{Phase: "tiles", Done: 21, Total: 21}}, events)
+
+	events = nil
+	assert.Nil(t, convertToDirectory(logger, output, filepath.Join(dir, "tiles"), "", ConvertOptions{MinZoom: -1, MaxZoom: -1, PrecreateDirs: true, ProgressFunc: record, ProgressFuncInterval: time.Hour}))
+	assert.Equal(t, 2, len(events))
+	assert.Equal(t, "directories", events[0].Phase)
+	assert.Equal(t, "tiles", events[1].Phase)
+	assert.Equal(t, int64(21), events[1].Total)
+}
@@ -0,0 +1,120 @@
+package pmtiles
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RateLimit caps the reads from remote storage made by all goroutines of an operation.
+type RateLimit struct {
+	// BytesPerSecond is the largest average rate of bytes read, counting all bytes of every response; 0 means no limit.
+	BytesPerSecond int64
+	// RequestsPerSecond is the largest average rate of requests started, including retries; 0 means no limit.
+	RequestsPerSecond float64
+}
+
+// tokenBucket paces takers to rate tokens per second, with bursts of up to a tenth of a second of tokens.
+// Taking more tokens than are available leaves the bucket in debt, which the taker and later takers wait out.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newTokenBucket returns a tokenBucket of rate tokens per second, or nil, which never waits, if rate is not positive.
+func newTokenBucket(rate float64) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	burst := max(rate/10, 1)
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait takes n tokens, returning once the bucket is out of debt or when ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n float64) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= n
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	return sleepContext(ctx, wait)
+}
+
+// RateLimitBucket paces the range reads of a Bucket to a RateLimit and counts the bytes read.
+// A RateLimitBucket is safe for concurrent use, sharing its limit between all readers.
+type RateLimitBucket struct {
+	Bucket
+	requests  *tokenBucket
+	bytes     *tokenBucket
+	bytesRead atomic.Uint64
+}
+
+// NewRateLimitBucket wraps bucket to pace its range reads to limit.
+func NewRateLimitBucket(bucket Bucket, limit RateLimit) *RateLimitBucket {
+	return &RateLimitBucket{
+		Bucket:   bucket,
+		requests: newTokenBucket(limit.RequestsPerSecond),
+		bytes:    newTokenBucket(float64(limit.BytesPerSecond)),
+	}
+}
+
+// BytesRead returns the number of bytes read through the bucket so far.
+func (b *RateLimitBucket) BytesRead() uint64 {
+	return b.bytesRead.Load()
+}
+
+func (b *RateLimitBucket) NewRangeReader(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	r, _, _, err := b.NewRangeReaderEtag(ctx, key, offset, length, "")
+	return r, err
+}
+
+func (b *RateLimitBucket) NewRangeReaderEtag(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, string, int, error) {
+	if err := b.requests.wait(ctx, 1); err != nil {
+		return nil, "", 0, err
+	}
+	body, newEtag, status, err := b.Bucket.NewRangeReaderEtag(ctx, key, offset, length, etag)
+	if err != nil {
+		return nil, newEtag, status, err
+	}
+	return &rateLimitReader{body, b, ctx}, newEtag, status, nil
+}
+
+// rateLimitReader counts the bytes read from a response body against the limit of its bucket.
+type rateLimitReader struct {
+	io.ReadCloser
+	bucket *RateLimitBucket
+	ctx    context.Context
+}
+
+func (r *rateLimitReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.bucket.bytesRead.Add(uint64(n))
+		if waitErr := r.bucket.bytes.wait(r.ctx, float64(n)); waitErr != nil && err == nil {
+			err = waitErr
+		}
+	}
+	return n, err
+}
+
+// averageThroughput returns the bytes read per second since start.
+func averageThroughput(bytes uint64, start time.Time) uint64 {
+	seconds := time.Since(start).Seconds()
+	if seconds <= 0 {
+		return 0
+	}
+	return uint64(float64(bytes) / seconds)
+}
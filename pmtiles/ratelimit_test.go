@@ -0,0 +1,66 @@
+package pmtiles
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimitBucketBytes(t *testing.T) {
+	bucket := mockBucket{map[string][]byte{"a": make([]byte, 300)}}
+	limited := NewRateLimitBucket(bucket, RateLimit{BytesPerSecond: 1000})
+
+	start := time.Now()
+	r, err := limited.NewRangeReader(context.Background(), "a", 0, 300)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(r)
+	assert.Nil(t, err)
+	assert.Equal(t, 300, len(data))
+	// a burst of 100 bytes, then 200 bytes at 1000 per second
+	assert.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	assert.Equal(t, uint64(300), limited.BytesRead())
+}
+
+func TestRateLimitBucketRequests(t *testing.T) {
+	bucket := mockBucket{map[string][]byte{"a": []byte("abc")}}
+	limited := NewRateLimitBucket(bucket, RateLimit{RequestsPerSecond: 20})
+
+	start := time.Now()
+	for range 5 {
+		r, err := limited.NewRangeReader(context.Background(), "a", 0, 3)
+		assert.Nil(t, err)
+		r.Close()
+	}
+	// a burst of 2 requests, then 3 at 20 per second
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+func TestRateLimitBucketUnlimited(t *testing.T) {
+	bucket := mockBucket{map[string][]byte{"a": make([]byte, 1<<20)}}
+	limited := NewRateLimitBucket(bucket, RateLimit{})
+
+	start := time.Now()
+	for range 100 {
+		r, err := limited.NewRangeReader(context.Background(), "a", 0, 1<<20)
+		assert.Nil(t, err)
+		_, err = io.Copy(io.Discard, r)
+		assert.Nil(t, err)
+	}
+	assert.Less(t, time.Since(start), time.Second)
+	assert.Equal(t, uint64(100<<20), limited.BytesRead())
+}
+
+func TestRateLimitBucketCanceled(t *testing.T) {
+	bucket := mockBucket{map[string][]byte{"a": []byte("abc")}}
+	limited := NewRateLimitBucket(bucket, RateLimit{RequestsPerSecond: 0.01})
+	ctx, cancel := context.WithCancel(context.Background())
+	r, err := limited.NewRangeReader(ctx, "a", 0, 3)
+	assert.Nil(t, err)
+	r.Close()
+	cancel()
+	_, err = limited.NewRangeReader(ctx, "a", 0, 3)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -87,10 +87,9 @@ func parseHeaderV2(reader io.Reader) ([]byte, directoryV2) {
 	rootDirLenBytes := make([]byte, 2)
 	io.ReadFull(reader, rootDirLenBytes)
 	rootDirLen := int(binary.LittleEndian.Uint16(rootDirLenBytes))
-	metadataBytes := make([]byte, metadataLen)
-	io.ReadFull(reader, metadataBytes)
-	dirBytes := make([]byte, rootDirLen*17)
-	io.ReadFull(reader, dirBytes)
+	// the lengths may be corrupt, so only allocate for the bytes actually read
+	metadataBytes, _ := io.ReadAll(io.LimitReader(reader, int64(metadataLen)))
+	dirBytes, _ := io.ReadAll(io.LimitReader(reader, int64(rootDirLen*17)))
 	theDir := parseDirectoryV2(dirBytes)
 	return metadataBytes, theDir
 }
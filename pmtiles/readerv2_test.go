@@ -1,6 +1,7 @@
 package pmtiles
 
 import (
+	"bytes"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -23,3 +24,16 @@ func TestGetParentTile(t *testing.T) {
 	a := Zxy{Z: 8, X: 125, Y: 69}
 	assert.Equal(t, Zxy{Z: 7, X: 62, Y: 34}, getParentTile(a, 7))
 }
+
+func FuzzParseHeaderV2(f *testing.F) {
+	entry := make([]byte, 17)
+	entry[0] = 1
+	f.Add(append([]byte("PM\x02\x00\x02\x00\x00\x00\x01\x00{}"), entry...))
+	f.Add([]byte{})
+	f.Add([]byte("PM\x02\x00"))
+	f.Add(make([]byte, 64))
+	f.Add([]byte("PM\x02\x00\xff\xff\xff\xff\xff\xff"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		parseHeaderV2(bytes.NewReader(data))
+	})
+}
@@ -0,0 +1,127 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Recompress writes a local archive to output with its tiles compressed with targetCompression,
+// NoCompression, Gzip, Zstd or Brotli. Directories and metadata are also compressed with targetCompression,
+// unless it is NoCompression, in which case they keep the compression of the input.
+// Each distinct content is decompressed and recompressed once, so tiles sharing contents in the input
+// still share them in the output.
+func Recompress(logger *log.Logger, input string, output string, targetCompression Compression, tmpfile *os.File, progress ...ProgressReporter) error {
+	start := time.Now()
+	if targetCompression != NoCompression && targetCompression != Gzip && targetCompression != Zstd && targetCompression != Brotli {
+		return fmt.Errorf("compression must be none, gzip, zstd or brotli")
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s, %w", input, err)
+	}
+	defer file.Close()
+
+	headerBytes := make([]byte, HeaderV3LenBytes)
+	if _, err := io.ReadFull(file, headerBytes); err != nil {
+		return fmt.Errorf("Failed to read header of %s, %w", input, err)
+	}
+	header, err := DeserializeHeader(headerBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse header of %s, %w", input, err)
+	}
+	if header.TileType != Mvt && targetCompression != NoCompression {
+		return fmt.Errorf("only vector tiles can be compressed, %s is %s", input, tileTypeToString(header.TileType))
+	}
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata of %s, %w", input, err)
+	}
+
+	compressor, err := newCompressor(targetCompression, 0)
+	if err != nil {
+		return err
+	}
+	resolve := newResolver(true, targetCompression)
+	defer resolve.close()
+	// contents already recompressed, by their offset in the input
+	recompressed := make(map[uint64]offsetLen)
+	bar := newStepProgress(progress, int64(header.TileEntriesCount))
+	var addErr error
+
+	err = IterateEntries(header,
+		ReaderAtFetcher(file),
+		func(e EntryV3) {
+			bar.Add(1)
+			if addErr != nil {
+				return
+			}
+			if found, ok := recompressed[e.Offset]; ok {
+				if err := resolve.addExistingTile(e.TileID, found, e.RunLength); err != nil {
+					addErr = tileOrderError(e.TileID, err)
+				}
+				return
+			}
+			data := make([]byte, e.Length)
+			if _, err := file.ReadAt(data, int64(header.TileDataOffset+e.Offset)); err != nil {
+				addErr = fmt.Errorf("Failed to read tile data, %w", err)
+				return
+			}
+			source := header.TileCompression
+			if source == UnknownCompression {
+				source = detectCompression(data)
+			}
+			if source != NoCompression {
+				decompressed, err := decompressBytes(data, source)
+				if err != nil {
+					z, x, y := IDToZxy(e.TileID)
+					addErr = fmt.Errorf("Failed to decompress tile %d/%d/%d, %w", z, x, y, err)
+					return
+				}
+				data = decompressed
+			}
+			var compressErr error
+			isNew, newData, err := resolve.addTile(e.TileID, data, e.RunLength, func() []byte {
+				var compressed []byte
+				compressed, compressErr = compressor.Compress(data)
+				return compressed
+			})
+			if err != nil {
+				addErr = tileOrderError(e.TileID, err)
+				return
+			}
+			if compressErr != nil {
+				addErr = fmt.Errorf("Failed to compress tile, %w", compressErr)
+				return
+			}
+			if isNew {
+				if _, err := tmpfile.Write(newData); err != nil {
+					addErr = fmt.Errorf("Failed to write to tempfile, %w", err)
+					return
+				}
+			}
+			added := resolve.Entries[len(resolve.Entries)-1]
+			recompressed[e.Offset] = offsetLen{added.Offset, added.Length}
+		})
+	if err != nil {
+		return fmt.Errorf("Failed to iterate through tiles of %s, %w", input, err)
+	}
+	if addErr != nil {
+		return addErr
+	}
+
+	header.TileCompression = targetCompression
+	if targetCompression != NoCompression {
+		header.InternalCompression = targetCompression
+	}
+	_, err = finalize(logger, resolve, header, tmpfile, output, metadata)
+	if err != nil {
+		return err
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return nil
+}
@@ -0,0 +1,48 @@
+package pmtiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecompress(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := []testTile{{0, 0, 0, "root"}, {1, 0, 0, "same"}, {1, 0, 1, "same"}, {1, 1, 1, "other"}, {1, 1, 0, "same"}}
+	writeTestArchive(t, input, Gzip, Mvt, map[string]interface{}{"name": "recompressed"}, tiles)
+	_, _, expected := readTestArchiveTiles(t, input)
+
+	for _, target := range []Compression{Zstd, NoCompression, Brotli, Gzip} {
+		output := filepath.Join(dir, "out.pmtiles")
+		tmpfile, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		assert.Nil(t, Recompress(logger, input, output, target, tmpfile))
+		tmpfile.Close()
+
+		header, metadata, recompressed := readTestArchiveTiles(t, output)
+		assert.Equal(t, target, header.TileCompression)
+		if target == NoCompression {
+			assert.Equal(t, Compression(Gzip), header.InternalCompression)
+		} else {
+			assert.Equal(t, target, header.InternalCompression)
+		}
+		assert.Equal(t, "recompressed", metadata["name"])
+		assert.Equal(t, expected, recompressed)
+		assert.Equal(t, uint64(5), header.AddressedTilesCount)
+		assert.Equal(t, uint64(3), header.TileContentsCount)
+		assert.Nil(t, Verify(logger, output))
+	}
+}
+
+func TestRecompressRaster(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{}, []testTile{{0, 0, 0, "png"}})
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	assert.Error(t, Recompress(logger, input, filepath.Join(dir, "out.pmtiles"), Gzip, tmpfile))
+}
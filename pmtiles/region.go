@@ -4,6 +4,10 @@ import (
 	"fmt"
 	"github.com/paulmach/orb"
 	"github.com/paulmach/orb/geojson"
+	"io"
+	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -75,3 +79,169 @@ func UnmarshalRegion(data []byte) (orb.MultiPolygon, error) {
 
 	return nil, fmt.Errorf("No geometry")
 }
+
+// LoadRegion reads the area of interest of an extract from a GeoJSON regionFile or a bbox string,
+// of which at most one may be given. Without either it returns a nil region.
+func LoadRegion(regionFile string, bbox string) (orb.MultiPolygon, error) {
+	if regionFile != "" && bbox != "" {
+		return nil, fmt.Errorf("only one of region and bbox can be specified")
+	}
+	if regionFile != "" {
+		data, err := os.ReadFile(regionFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read %s, %w", regionFile, err)
+		}
+		return UnmarshalRegion(data)
+	}
+	if bbox != "" {
+		return BboxRegion(bbox)
+	}
+	return nil, nil
+}
+
+// ReadBoundaries reads a boundaries file for FindRegion from a local path or an http or https URL.
+func ReadBoundaries(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to fetch %s, %w", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Failed to fetch %s, HTTP error: %d", source, resp.StatusCode)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// maxRegionSuggestions is how many near matches FindRegion suggests for a name without a match.
+const maxRegionSuggestions = 5
+
+// FindRegion returns the geometry of the single Polygon or MultiPolygon feature of boundaries,
+// a GeoJSON FeatureCollection or FlatGeobuf file, whose property equals name ignoring case.
+// The property name itself is matched ignoring case if no feature has it exactly, such as NAME for name.
+// A name matching no feature fails with the most similar values of the property, and a name matching
+// several features fails too.
+func FindRegion(boundaries []byte, property string, name string) (orb.MultiPolygon, error) {
+	var features []*geojson.Feature
+	if isFlatGeobuf(boundaries) {
+		var err error
+		if features, err = readFlatGeobuf(boundaries); err != nil {
+			return nil, err
+		}
+	} else {
+		fc, err := geojson.UnmarshalFeatureCollection(boundaries)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse boundaries, %w", err)
+		}
+		features = fc.Features
+	}
+
+	var matches []orb.MultiPolygon
+	values := make(map[string]bool)
+	for _, f := range features {
+		var geometry orb.MultiPolygon
+		switch v := f.Geometry.(type) {
+		case orb.Polygon:
+			geometry = orb.MultiPolygon{v}
+		case orb.MultiPolygon:
+			geometry = v
+		default:
+			continue
+		}
+		value, ok := featureProperty(f, property)
+		if !ok {
+			continue
+		}
+		if strings.EqualFold(value, name) {
+			matches = append(matches, geometry)
+		}
+		values[value] = true
+	}
+
+	switch len(matches) {
+	case 0:
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no Polygon or MultiPolygon features with property %s", property)
+		}
+		if suggestions := similarNames(name, values); len(suggestions) > 0 {
+			return nil, fmt.Errorf("no region with %s %q, did you mean %s?", property, name, strings.Join(suggestions, ", "))
+		}
+		return nil, fmt.Errorf("no region with %s %q", property, name)
+	case 1:
+		return matches[0], nil
+	}
+	return nil, fmt.Errorf("%d regions have %s %q, select one by a property unique to it", len(matches), property, name)
+}
+
+// featureProperty returns the property of f as a string, looking it up ignoring case if it is not set exactly.
+func featureProperty(f *geojson.Feature, property string) (string, bool) {
+	value, ok := f.Properties[property]
+	if !ok {
+		for key, v := range f.Properties {
+			if strings.EqualFold(key, property) {
+				value, ok = v, true
+				break
+			}
+		}
+	}
+	if !ok || value == nil {
+		return "", false
+	}
+	return fmt.Sprint(value), true
+}
+
+// similarNames returns up to maxRegionSuggestions of values which contain name or are within a few edits of it,
+// ignoring case, most similar first.
+func similarNames(name string, values map[string]bool) []string {
+	name = strings.ToLower(name)
+	type candidate struct {
+		value    string
+		distance int
+	}
+	var candidates []candidate
+	for value := range values {
+		lower := strings.ToLower(value)
+		if lower == "" {
+			continue
+		}
+		distance := editDistance(name, lower)
+		if distance <= max(2, len(name)/3) || strings.Contains(lower, name) || strings.Contains(name, lower) {
+			candidates = append(candidates, candidate{value, distance})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].distance != candidates[j].distance {
+			return candidates[i].distance < candidates[j].distance
+		}
+		return candidates[i].value < candidates[j].value
+	})
+	suggestions := make([]string, 0, maxRegionSuggestions)
+	for _, c := range candidates[:min(len(candidates), maxRegionSuggestions)] {
+		suggestions = append(suggestions, strconv.Quote(c.value))
+	}
+	return suggestions
+}
+
+// editDistance is the Levenshtein distance between the runes of a and b.
+func editDistance(a string, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	row := make([]int, len(rb)+1)
+	for j := range row {
+		row[j] = j
+	}
+	for i := range ra {
+		prev := row[0]
+		row[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			current := min(row[j+1]+1, row[j]+1, prev+cost)
+			prev, row[j+1] = row[j+1], current
+		}
+	}
+	return row[len(rb)]
+}
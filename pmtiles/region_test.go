@@ -1,6 +1,7 @@
 package pmtiles
 
 import (
+	"github.com/paulmach/orb"
 	"github.com/stretchr/testify/assert"
 	"testing"
 )
@@ -88,3 +89,33 @@ func TestEmptyFeatureCollectionRegion(t *testing.T) {
 	}`))
 	assert.NotNil(t, err)
 }
+
+func TestFindRegion(t *testing.T) {
+	boundaries := []byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"NAME": "Germany", "ISO_A2": "DE"}, "geometry": {"type": "Polygon", "coordinates": [[[0, 0], [0, 1], [1, 1], [0, 0]]]}},
+		{"type": "Feature", "properties": {"NAME": "Georgia", "ISO_A2": "GE"}, "geometry": {"type": "MultiPolygon", "coordinates": [[[[2, 2], [2, 3], [3, 3], [2, 2]]]]}},
+		{"type": "Feature", "properties": {"NAME": "Georgia", "ISO_A2": "US-GA"}, "geometry": {"type": "Polygon", "coordinates": [[[4, 4], [4, 5], [5, 5], [4, 4]]]}},
+		{"type": "Feature", "properties": {"NAME": "Berlin"}, "geometry": {"type": "Point", "coordinates": [0.5, 0.5]}}
+	]}`)
+
+	region, err := FindRegion(boundaries, "name", "germany")
+	assert.Nil(t, err)
+	assert.Equal(t, orb.MultiPolygon{{{{0, 0}, {0, 1}, {1, 1}, {0, 0}}}}, region)
+
+	region, err = FindRegion(boundaries, "ISO_A2", "ge")
+	assert.Nil(t, err)
+	assert.Equal(t, orb.Point{2, 2}, region[0][0][0])
+
+	_, err = FindRegion(boundaries, "name", "Georgia")
+	assert.ErrorContains(t, err, "2 regions")
+
+	_, err = FindRegion(boundaries, "name", "Germny")
+	assert.ErrorContains(t, err, `did you mean "Germany"`)
+
+	_, err = FindRegion(boundaries, "name", "Berlin")
+	assert.ErrorContains(t, err, `no region with name "Berlin"`)
+
+	region, err = FindRegion(testFlatGeobuf(), "name", "FRANCE")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(region))
+}
@@ -0,0 +1,318 @@
+package pmtiles
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteArchiveOptions configures how a RemoteArchive fetches byte ranges.
+type RemoteArchiveOptions struct {
+	// Headers are sent with every HTTP request, such as an Authorization header for signed URLs.
+	// They are ignored for cloud storage and local buckets.
+	Headers http.Header
+	// CacheSize is the number of root and leaf directories kept in memory; 0 uses 64.
+	CacheSize int
+	// Retries is the number of times a failed request is attempted again; 0 uses 3 and a negative value disables retries.
+	Retries int
+	// RetryDelay is the wait before the first retry, doubled after every attempt; 0 uses 100 milliseconds.
+	// Each wait is randomized between half and one and a half times the delay, so that clients don't retry in step,
+	// unless the response has a Retry-After header.
+	RetryDelay time.Duration
+	// MaxConcurrency is the largest number of requests in flight at once; 0 means no limit.
+	MaxConcurrency int
+	// RateLimit paces the requests and bytes read by all users of the archive; the zero value means no limit.
+	RateLimit RateLimit
+}
+
+// RemoteArchive reads an archive on HTTP, S3, GCS or other bucket storage with range requests,
+// so it can be used without downloading the whole file.
+// It implements io.ReaderAt for tile data and SectionFetcher for use with IterateEntries.
+// The root directory is kept in memory once fetched,
+// and leaf directories fetched through FetchSection in an in-memory LRU cache.
+// A RemoteArchive is safe for concurrent use.
+type RemoteArchive struct {
+	ctx      context.Context
+	bucket   Bucket
+	limited  *RateLimitBucket
+	key      string
+	etag     string
+	header   HeaderV3
+	retry    RetryOptions
+	requests chan struct{} // a slot per request in flight, nil without a limit
+
+	mu        sync.Mutex
+	root      []byte
+	cacheSize int
+	cache     map[[2]uint64]*list.Element
+	evictList *list.List
+}
+
+type remoteCacheEntry struct {
+	key  [2]uint64
+	data []byte
+}
+
+// headerClient adds fixed headers to every request of the wrapped client.
+type headerClient struct {
+	client  HTTPClient
+	headers http.Header
+}
+
+func (c headerClient) Do(req *http.Request) (*http.Response, error) {
+	for k, v := range c.headers {
+		req.Header[k] = v
+	}
+	return c.client.Do(req)
+}
+
+// OpenRemoteArchive opens the archive key in bucketURL, or the archive at a full URL in key when bucketURL is empty.
+func OpenRemoteArchive(ctx context.Context, bucketURL string, key string, opts RemoteArchiveOptions) (*RemoteArchive, error) {
+	bucketURL, key, err := NormalizeBucketKey(bucketURL, "", key)
+	if err != nil {
+		return nil, err
+	}
+
+	var bucket Bucket
+	if strings.HasPrefix(bucketURL, "http") {
+		bucket = HTTPBucket{bucketURL, headerClient{http.DefaultClient, opts.Headers}}
+	} else {
+		bucket, err = OpenBucket(ctx, bucketURL, "")
+		if err != nil {
+			return nil, fmt.Errorf("Failed to open bucket for %s, %w", bucketURL, err)
+		}
+	}
+
+	archive, err := NewRemoteArchive(ctx, bucket, key, opts)
+	if err != nil {
+		bucket.Close()
+		return nil, err
+	}
+	return archive, nil
+}
+
+// NewRemoteArchive reads the header of the archive key in bucket and returns a RemoteArchive for it.
+// The context is used for every later request made by the archive.
+func NewRemoteArchive(ctx context.Context, bucket Bucket, key string, opts RemoteArchiveOptions) (*RemoteArchive, error) {
+	limited := NewRateLimitBucket(bucket, opts.RateLimit)
+	a := &RemoteArchive{
+		ctx:       ctx,
+		bucket:    limited,
+		limited:   limited,
+		key:       key,
+		retry:     RetryOptions{opts.Retries, opts.RetryDelay}.normalize(),
+		cacheSize: opts.CacheSize,
+		cache:     make(map[[2]uint64]*list.Element),
+		evictList: list.New(),
+	}
+	if a.cacheSize <= 0 {
+		a.cacheSize = 64
+	}
+	if opts.MaxConcurrency > 0 {
+		a.requests = make(chan struct{}, opts.MaxConcurrency)
+	}
+
+	// the header and root directory of a clustered archive fit in the first 16 KiB
+	b, err := a.fetch(0, 16384)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, %w", key, err)
+	}
+	if len(b) < HeaderV3LenBytes {
+		return nil, fmt.Errorf("Failed to read %s, archive is too short", key)
+	}
+
+	a.header, err = DeserializeHeader(b[0:HeaderV3LenBytes])
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read %s, %w", key, err)
+	}
+
+	if a.header.RootOffset+a.header.RootLength <= uint64(len(b)) {
+		a.root = b[a.header.RootOffset : a.header.RootOffset+a.header.RootLength]
+	}
+
+	return a, nil
+}
+
+// Header returns the header of the archive.
+func (a *RemoteArchive) Header() HeaderV3 {
+	return a.header
+}
+
+// Metadata fetches and decompresses the JSON metadata of the archive.
+func (a *RemoteArchive) Metadata() (map[string]interface{}, error) {
+	b, err := a.fetch(a.header.MetadataOffset, a.header.MetadataLength)
+	if err != nil {
+		return nil, err
+	}
+	return DeserializeMetadata(bytes.NewReader(b), a.header.InternalCompression)
+}
+
+// GetTile returns the tile at z, x, y as stored in the archive, without decompressing it.
+// The boolean result is false if the archive does not contain the tile.
+func (a *RemoteArchive) GetTile(z uint8, x uint32, y uint32) ([]byte, bool, error) {
+	if err := ValidateTileCoord(z, x, y); err != nil {
+		return nil, false, err
+	}
+	tileID := ZxyToID(z, x, y)
+	dirOffset := a.header.RootOffset
+	dirLength := a.header.RootLength
+
+	for depth := 0; depth <= 3; depth++ {
+		b, err := a.FetchSection(dirOffset, dirLength)
+		if err != nil {
+			return nil, false, err
+		}
+		directory := DeserializeEntries(bytes.NewBuffer(b), a.header.InternalCompression)
+		entry, ok := findTile(directory, tileID)
+		if !ok {
+			return nil, false, nil
+		}
+		if entry.RunLength > 0 {
+			data, err := a.fetch(a.header.TileDataOffset+entry.Offset, uint64(entry.Length))
+			if err != nil {
+				return nil, false, err
+			}
+			return data, true, nil
+		}
+		dirOffset = a.header.LeafDirectoryOffset + entry.Offset
+		dirLength = uint64(entry.Length)
+	}
+	return nil, false, nil
+}
+
+// FetchSection returns the bytes of a directory, using the cache when possible.
+func (a *RemoteArchive) FetchSection(offset uint64, length uint64) ([]byte, error) {
+	isRoot := offset == a.header.RootOffset && length == a.header.RootLength
+	key := [2]uint64{offset, length}
+	a.mu.Lock()
+	if isRoot && a.root != nil {
+		a.mu.Unlock()
+		return a.root, nil
+	}
+	if elem, ok := a.cache[key]; ok {
+		a.evictList.MoveToFront(elem)
+		a.mu.Unlock()
+		return elem.Value.(*remoteCacheEntry).data, nil
+	}
+	a.mu.Unlock()
+
+	b, err := a.fetch(offset, length)
+	if err != nil {
+		return nil, err
+	}
+	if isRoot {
+		a.mu.Lock()
+		a.root = b
+		a.mu.Unlock()
+		return b, nil
+	}
+	a.put(key, b)
+	return b, nil
+}
+
+// ReadAt reads len(p) bytes of the archive starting at off, without caching.
+func (a *RemoteArchive) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	b, err := a.fetch(uint64(off), uint64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p, b)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes the underlying bucket.
+// BytesRead returns the number of bytes read from the archive so far, including those of retried requests.
+func (a *RemoteArchive) BytesRead() uint64 {
+	return a.limited.BytesRead()
+}
+
+func (a *RemoteArchive) Close() error {
+	return a.bucket.Close()
+}
+
+func (a *RemoteArchive) put(key [2]uint64, data []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if elem, ok := a.cache[key]; ok {
+		a.evictList.MoveToFront(elem)
+		return
+	}
+	a.cache[key] = a.evictList.PushFront(&remoteCacheEntry{key, data})
+	for a.evictList.Len() > a.cacheSize {
+		elem := a.evictList.Back()
+		a.evictList.Remove(elem)
+		delete(a.cache, elem.Value.(*remoteCacheEntry).key)
+	}
+}
+
+// fetch reads a byte range, retrying failed requests with exponential backoff.
+// A response shorter than a range within the tile data of the archive is retried for the remainder,
+// while a range past the end of the archive returns the available bytes.
+func (a *RemoteArchive) fetch(offset uint64, length uint64) ([]byte, error) {
+	var result []byte
+	for attempt := 0; ; attempt++ {
+		b, status, err := a.fetchAttempt(offset+uint64(len(result)), length-uint64(len(result)))
+		if err == nil {
+			result = append(result, b...)
+			end := a.header.TileDataOffset + a.header.TileDataLength
+			if uint64(len(result)) >= length || a.header.TileDataLength == 0 || offset+length > end {
+				return result, nil
+			}
+			status, err = 0, io.ErrUnexpectedEOF
+		}
+		wait, ok := a.retry.backoff(attempt, status, err)
+		if !ok {
+			return nil, err
+		}
+		if err := sleepContext(a.ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (a *RemoteArchive) fetchAttempt(offset uint64, length uint64) ([]byte, int, error) {
+	if a.requests != nil {
+		select {
+		case a.requests <- struct{}{}:
+			defer func() { <-a.requests }()
+		case <-a.ctx.Done():
+			return nil, 0, a.ctx.Err()
+		}
+	}
+
+	a.mu.Lock()
+	expectedEtag := a.etag
+	a.mu.Unlock()
+
+	r, etag, status, err := a.bucket.NewRangeReaderEtag(a.ctx, a.key, int64(offset), int64(length), expectedEtag)
+	if err != nil {
+		return nil, status, err
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+
+	a.mu.Lock()
+	if a.etag == "" {
+		a.etag = etag
+	}
+	a.mu.Unlock()
+	return b, status, nil
+}
@@ -0,0 +1,189 @@
+package pmtiles
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type flakyBucket struct {
+	mockBucket
+	failures int
+	status   int
+	requests int
+}
+
+func (b *flakyBucket) NewRangeReaderEtag(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, string, int, error) {
+	b.requests++
+	if b.failures > 0 {
+		b.failures--
+		return nil, "", b.status, fmt.Errorf("HTTP error: %d", b.status)
+	}
+	return b.mockBucket.NewRangeReaderEtag(ctx, key, offset, length, etag)
+}
+
+func remoteTestArchive(t *testing.T) []byte {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.AddTile(0, 0, 0, []byte{0x1}))
+	assert.Nil(t, w.AddTile(1, 0, 0, []byte{0x2}))
+	assert.Nil(t, w.AddTile(1, 1, 1, []byte{0x3, 0x4}))
+	_, err = w.Finalize(HeaderV3{TileType: Png}, map[string]interface{}{"name": "remote"})
+	assert.Nil(t, err)
+	return b.Bytes()
+}
+
+func TestRemoteArchive(t *testing.T) {
+	bucket := &flakyBucket{mockBucket: mockBucket{items: map[string][]byte{"a.pmtiles": remoteTestArchive(t)}}}
+	archive, err := NewRemoteArchive(context.Background(), bucket, "a.pmtiles", RemoteArchiveOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), archive.Header().AddressedTilesCount)
+	assert.Equal(t, 1, bucket.requests)
+
+	metadata, err := archive.Metadata()
+	assert.Nil(t, err)
+	assert.Equal(t, "remote", metadata["name"])
+
+	data, ok, err := archive.GetTile(1, 1, 1)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0x3, 0x4}, data)
+
+	_, ok, err = archive.GetTile(1, 0, 1)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	// the root directory is cached from the initial request
+	requests := bucket.requests
+	header := archive.Header()
+	tiles := make(map[uint64][]byte)
+	err = IterateEntries(header, archive, func(e EntryV3) {
+		b := make([]byte, e.Length)
+		_, err := archive.ReadAt(b, int64(header.TileDataOffset+e.Offset))
+		assert.Nil(t, err)
+		tiles[e.TileID] = b
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, requests+3, bucket.requests)
+	assert.Equal(t, []byte{0x1}, tiles[ZxyToID(0, 0, 0)])
+	assert.Equal(t, []byte{0x2}, tiles[ZxyToID(1, 0, 0)])
+	assert.Equal(t, []byte{0x3, 0x4}, tiles[ZxyToID(1, 1, 1)])
+}
+
+func TestRemoteArchiveRetries(t *testing.T) {
+	bucket := &flakyBucket{mockBucket: mockBucket{items: map[string][]byte{"a.pmtiles": remoteTestArchive(t)}}, failures: 2, status: 503}
+	archive, err := NewRemoteArchive(context.Background(), bucket, "a.pmtiles", RemoteArchiveOptions{RetryDelay: time.Millisecond})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, bucket.requests)
+
+	bucket.failures = 2
+	_, _, err = archive.GetTile(0, 0, 0)
+	assert.Nil(t, err)
+
+	bucket.failures = 5
+	_, err = archive.Metadata()
+	assert.NotNil(t, err)
+}
+
+func TestRemoteArchiveNoRetryOnClientError(t *testing.T) {
+	bucket := &flakyBucket{mockBucket: mockBucket{items: map[string][]byte{"a.pmtiles": remoteTestArchive(t)}}, failures: 1, status: 403}
+	_, err := NewRemoteArchive(context.Background(), bucket, "a.pmtiles", RemoteArchiveOptions{RetryDelay: time.Millisecond})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, bucket.requests)
+}
+
+func TestRemoteArchiveCacheEviction(t *testing.T) {
+	bucket := &flakyBucket{mockBucket: mockBucket{items: map[string][]byte{"a.pmtiles": remoteTestArchive(t)}}}
+	archive, err := NewRemoteArchive(context.Background(), bucket, "a.pmtiles", RemoteArchiveOptions{CacheSize: 1})
+	assert.Nil(t, err)
+	header := archive.Header()
+
+	_, err = archive.FetchSection(header.MetadataOffset, header.MetadataLength)
+	assert.Nil(t, err)
+	_, err = archive.FetchSection(header.TileDataOffset, header.TileDataLength)
+	assert.Nil(t, err)
+	requests := bucket.requests
+	_, err = archive.FetchSection(header.MetadataOffset, header.MetadataLength)
+	assert.Nil(t, err)
+	assert.Equal(t, requests+1, bucket.requests)
+
+	// the root directory is kept apart from the cache
+	_, err = archive.FetchSection(header.RootOffset, header.RootLength)
+	assert.Nil(t, err)
+	assert.Equal(t, requests+1, bucket.requests)
+}
+
+type slowBucket struct {
+	mockBucket
+	inFlight    atomic.Int32
+	maxInFlight atomic.Int32
+}
+
+func (b *slowBucket) NewRangeReaderEtag(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, string, int, error) {
+	n := b.inFlight.Add(1)
+	defer b.inFlight.Add(-1)
+	for {
+		m := b.maxInFlight.Load()
+		if n <= m || b.maxInFlight.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	time.Sleep(5 * time.Millisecond)
+	return b.mockBucket.NewRangeReaderEtag(ctx, key, offset, length, etag)
+}
+
+func TestRemoteArchiveMaxConcurrency(t *testing.T) {
+	bucket := &slowBucket{mockBucket: mockBucket{items: map[string][]byte{"a.pmtiles": remoteTestArchive(t)}}}
+	archive, err := NewRemoteArchive(context.Background(), bucket, "a.pmtiles", RemoteArchiveOptions{MaxConcurrency: 2})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 1)
+			_, err := archive.ReadAt(b, 0)
+			assert.Nil(t, err)
+		}()
+	}
+	wg.Wait()
+	assert.LessOrEqual(t, bucket.maxInFlight.Load(), int32(2))
+	assert.Greater(t, bucket.maxInFlight.Load(), int32(0))
+}
+
+func TestHeaderClient(t *testing.T) {
+	mock := ClientMock{}
+	mock.response = &http.Response{
+		StatusCode: 206,
+		Body:       io.NopCloser(strings.NewReader("abc")),
+		Header:     http.Header{},
+	}
+	headers := http.Header{}
+	headers.Set("Authorization", "Bearer secret")
+	bucket := HTTPBucket{"http://tiles.example.com/tiles", headerClient{&mock, headers}}
+	_, _, _, err := bucket.NewRangeReaderEtag(context.Background(), "a.pmtiles", 0, 3, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "Bearer secret", mock.request.Header.Get("Authorization"))
+	assert.Equal(t, "bytes=0-2", mock.request.Header.Get("Range"))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, time.Duration(0), parseRetryAfter("", now))
+	assert.Equal(t, 2*time.Second, parseRetryAfter("2", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter("Mon, 01 Jan 2024 00:00:30 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("Sun, 31 Dec 2023 23:59:00 GMT", now))
+	assert.Equal(t, time.Duration(0), parseRetryAfter("soon", now))
+}
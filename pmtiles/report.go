@@ -0,0 +1,133 @@
+package pmtiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// largestTilesCount is the number of largest tile contents listed in a conversion report.
+const largestTilesCount = 10
+
+// zoomCounts accumulates the tiles a resolver added at one zoom level.
+type zoomCounts struct {
+	tiles       uint64
+	contents    uint64
+	bytes       uint64
+	storedBytes uint64
+}
+
+// convertStats accumulates the statistics of a conversion for ConvertOptions.StatsOut while tiles are added.
+type convertStats struct {
+	zooms      []zoomCounts // indexed by zoom level
+	inputBytes uint64
+	largest    []reportTile // sorted by decreasing length
+}
+
+func newConvertStats() *convertStats {
+	return &convertStats{zooms: make([]zoomCounts, MaxTileZoom+1)}
+}
+
+// add records a run of runLength tiles from tileID with contents of length bytes, which are new if isNew.
+// Runs crossing zoom levels are split between them.
+func (s *convertStats) add(tileID uint64, runLength uint32, length uint32, isNew bool) {
+	z, x, y := IDToZxy(tileID)
+	if isNew {
+		s.zooms[z].contents++
+		s.zooms[z].storedBytes += uint64(length)
+		s.addLargest(reportTile{Z: z, X: x, Y: y, Length: length})
+	}
+	for remaining := uint64(runLength); remaining > 0; z++ {
+		count := remaining
+		if z < MaxTileZoom {
+			count = min(remaining, ZxyToID(z+1, 0, 0)-tileID)
+		}
+		s.zooms[z].tiles += count
+		s.zooms[z].bytes += count * uint64(length)
+		tileID += count
+		remaining -= count
+	}
+}
+
+// addLargest keeps tile among the largest contents if it is large enough.
+func (s *convertStats) addLargest(tile reportTile) {
+	if len(s.largest) == largestTilesCount && tile.Length <= s.largest[len(s.largest)-1].Length {
+		return
+	}
+	i := sort.Search(len(s.largest), func(i int) bool { return s.largest[i].Length < tile.Length })
+	s.largest = append(s.largest, reportTile{})
+	copy(s.largest[i+1:], s.largest[i:])
+	s.largest[i] = tile
+	if len(s.largest) > largestTilesCount {
+		s.largest = s.largest[:largestTilesCount]
+	}
+}
+
+// reportTile is a tile content listed in a conversion report, by its first Z/X/Y.
+type reportTile struct {
+	Z      uint8  `json:"z"`
+	X      uint32 `json:"x"`
+	Y      uint32 `json:"y"`
+	Length uint32 `json:"length"`
+}
+
+// reportZoom is the tiles of one zoom level in a conversion report. Bytes counts every addressed tile,
+// while StoredBytes counts the contents first seen at the zoom level once.
+type reportZoom struct {
+	Zoom        uint8  `json:"zoom"`
+	Tiles       uint64 `json:"tiles"`
+	Contents    uint64 `json:"contents"`
+	Bytes       uint64 `json:"bytes"`
+	StoredBytes uint64 `json:"stored_bytes"`
+}
+
+// convertReport is the JSON document written to ConvertOptions.StatsOut.
+// CompressionRatio is the tile bytes read from the input divided by the tile data length of the output.
+type convertReport struct {
+	AddressedTiles       uint64       `json:"addressed_tiles"`
+	TileEntries          uint64       `json:"tile_entries"`
+	TileContents         uint64       `json:"tile_contents"`
+	InputBytes           uint64       `json:"input_bytes"`
+	TileDataBytes        uint64       `json:"tile_data_bytes"`
+	CompressionRatio     float64      `json:"compression_ratio"`
+	RootDirectoryBytes   uint64       `json:"root_directory_bytes"`
+	MetadataBytes        uint64       `json:"metadata_bytes"`
+	LeafDirectoriesBytes uint64       `json:"leaf_directories_bytes"`
+	Zooms                []reportZoom `json:"zooms"`
+	LargestTiles         []reportTile `json:"largest_tiles"`
+}
+
+// writeConvertReport writes the statistics of resolve and the sections of the archive with header to path as JSON.
+func writeConvertReport(path string, resolve *resolver, header HeaderV3) error {
+	s := resolve.stats
+	report := convertReport{
+		AddressedTiles:       header.AddressedTilesCount,
+		TileEntries:          header.TileEntriesCount,
+		TileContents:         header.TileContentsCount,
+		InputBytes:           s.inputBytes,
+		TileDataBytes:        header.TileDataLength,
+		RootDirectoryBytes:   header.RootLength,
+		MetadataBytes:        header.MetadataLength,
+		LeafDirectoriesBytes: header.LeafDirectoryLength,
+		Zooms:                make([]reportZoom, 0),
+		LargestTiles:         append([]reportTile{}, s.largest...),
+	}
+	if header.TileDataLength > 0 {
+		report.CompressionRatio = float64(s.inputBytes) / float64(header.TileDataLength)
+	}
+	for z, counts := range s.zooms {
+		if counts.tiles > 0 {
+			report.Zooms = append(report.Zooms, reportZoom{uint8(z), counts.tiles, counts.contents, counts.bytes, counts.storedBytes})
+		}
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed to marshal conversion report, %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0666); err != nil {
+		return fmt.Errorf("Failed to write conversion report %s, %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package pmtiles
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertStatsAdd(t *testing.T) {
+	s := newConvertStats()
+	s.add(ZxyToID(1, 1, 0), 3, 10, true)
+	s.add(ZxyToID(2, 2, 0), 1, 10, false)
+	assert.Equal(t, zoomCounts{tiles: 1, contents: 1, bytes: 10, storedBytes: 10}, s.zooms[1])
+	assert.Equal(t, zoomCounts{tiles: 3, bytes: 30}, s.zooms[2])
+
+	for i := uint32(0); i < 20; i++ {
+		s.add(ZxyToID(3, i%8, i/8), 1, i*7%20, true)
+	}
+	assert.Equal(t, largestTilesCount, len(s.largest))
+	for i := 1; i < len(s.largest); i++ {
+		assert.GreaterOrEqual(t, s.largest[i-1].Length, s.largest[i].Length)
+	}
+	assert.Equal(t, uint32(19), s.largest[0].Length)
+}
+
+func TestConvertStatsOut(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		if z == 2 && x == 3 {
+			return testMvtTile(testMvtLayer(fmt.Sprintf("layer%d", y), nil, nil))
+		}
+		return testMvtTile(testMvtLayer("ocean", nil, nil))
+	})
+	output := filepath.Join(dir, "out.pmtiles")
+	statsOut := filepath.Join(dir, "report.json")
+	err := Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Deduplicate: true, NoTmpfile: true, StatsOut: statsOut}, nil)
+	assert.Nil(t, err)
+
+	data, err := os.ReadFile(statsOut)
+	assert.Nil(t, err)
+	var report convertReport
+	assert.Nil(t, json.Unmarshal(data, &report))
+	header, _, _ := readTestArchiveTiles(t, output)
+	assert.Equal(t, uint64(21), report.AddressedTiles)
+	assert.Equal(t, header.TileEntriesCount, report.TileEntries)
+	assert.Equal(t, uint64(5), report.TileContents)
+	assert.Equal(t, header.TileDataLength, report.TileDataBytes)
+	assert.Equal(t, header.RootLength, report.RootDirectoryBytes)
+	assert.Equal(t, header.MetadataLength, report.MetadataBytes)
+	assert.Greater(t, report.InputBytes, uint64(0))
+	assert.Greater(t, report.CompressionRatio, 0.0)
+
+	assert.Equal(t, 3, len(report.Zooms))
+	var contents, storedBytes uint64
+	for _, zoom := range report.Zooms {
+		contents += zoom.Contents
+		storedBytes += zoom.StoredBytes
+	}
+	assert.Equal(t, report.TileContents, contents)
+	assert.Equal(t, report.TileDataBytes, storedBytes)
+	assert.Equal(t, reportZoom{Zoom: 2, Tiles: 16, Contents: 4, Bytes: report.Zooms[2].Bytes, StoredBytes: report.Zooms[2].StoredBytes}, report.Zooms[2])
+	assert.Equal(t, 5, len(report.LargestTiles))
+}
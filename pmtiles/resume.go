@@ -0,0 +1,188 @@
+package pmtiles
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// resumeStateVersion is written at the start of a resume state file and must match to resume.
+const resumeStateVersion = 1
+
+var resumeStateMagic = []byte("PMTRESUM")
+
+// resumeCheckpointInterval is the minimum time between checkpoints of a resumable conversion.
+// Each checkpoint writes the whole entry list and deduplication index, so it is not done for every tile.
+var resumeCheckpointInterval = 5 * time.Minute
+
+// resumeState is the progress of a resumable conversion once the tiles up to LastTileID are in the tmpfile.
+type resumeState struct {
+	Fingerprint    [32]byte
+	LastTileID     uint64
+	TmpfileLength  int64
+	Offset         uint64
+	AddressedTiles uint64
+	NextID         uint64
+	Entries        []EntryV3
+	Index          map[contentHash]offsetLen
+}
+
+// resumer saves and restores the state of a resumable conversion in a file next to its tmpfile.
+type resumer struct {
+	path        string
+	tmpfile     *os.File
+	fingerprint [32]byte
+	saved       time.Time
+}
+
+// newResumer creates a resumer for converting input with opts into tmpfile, which must be a file.
+func newResumer(input string, opts ConvertOptions, tmpfile io.ReadWriteSeeker) (*resumer, error) {
+	f, ok := tmpfile.(*os.File)
+	if !ok || f == nil {
+		return nil, fmt.Errorf("resuming a conversion needs a tmpfile on disk")
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to stat %s, %w", input, err)
+	}
+	// options that do not change the output may differ when resuming
+	opts.Resume, opts.Force, opts.Workers, opts.OnTileError, opts.TileErrorLog = false, false, 0, "", ""
+	opts.Progress, opts.ProgressInterval, opts.ProgressReporter, opts.StatsOut = "", 0, nil, ""
+	opts.ProgressFunc, opts.ProgressFuncInterval = nil, 0
+	opts.OutputWriter, opts.TmpDir, opts.Logger, opts.ctx, opts.result = nil, "", nil, nil, nil
+	fingerprint := sha256.Sum256([]byte(fmt.Sprintf("%s %d %d %+v", input, info.Size(), info.ModTime().UnixNano(), opts)))
+	return &resumer{path: f.Name() + ".state", tmpfile: f, fingerprint: fingerprint, saved: time.Now()}, nil
+}
+
+// restore loads the saved state into resolve and truncates the tmpfile to the tile data it covers.
+// It returns the last tile ID written, and false if there is no saved state,
+// in which case the tmpfile is emptied to start over.
+func (r *resumer) restore(resolve *resolver) (uint64, bool, error) {
+	data, err := os.ReadFile(r.path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := r.truncate(0); err != nil {
+			return 0, false, err
+		}
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to read resume state %s, %w", r.path, err)
+	}
+
+	prefix := len(resumeStateMagic) + 4 + sha256.Size
+	if len(data) < prefix || !bytes.Equal(data[:len(resumeStateMagic)], resumeStateMagic) {
+		return 0, false, fmt.Errorf("%s is not a resume state", r.path)
+	}
+	if version := binary.LittleEndian.Uint32(data[len(resumeStateMagic):]); version != resumeStateVersion {
+		return 0, false, fmt.Errorf("resume state %s has version %d instead of %d, remove it to start over", r.path, version, resumeStateVersion)
+	}
+	payload := data[prefix:]
+	if sum := sha256.Sum256(payload); !bytes.Equal(sum[:], data[prefix-sha256.Size:prefix]) {
+		return 0, false, fmt.Errorf("resume state %s is corrupt, remove it to start over", r.path)
+	}
+	var state resumeState
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&state); err != nil {
+		return 0, false, fmt.Errorf("Failed to decode resume state %s, %w", r.path, err)
+	}
+	if state.Fingerprint != r.fingerprint {
+		return 0, false, fmt.Errorf("resume state %s is for a different input or options, remove it to start over", r.path)
+	}
+
+	info, err := r.tmpfile.Stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to stat tmpfile, %w", err)
+	}
+	if info.Size() < state.TmpfileLength {
+		return 0, false, fmt.Errorf("tmpfile has %d bytes but the resume state needs %d", info.Size(), state.TmpfileLength)
+	}
+	if err := r.truncate(state.TmpfileLength); err != nil {
+		return 0, false, err
+	}
+
+	resolve.Entries = state.Entries
+	resolve.Offset = state.Offset
+	resolve.AddressedTiles = state.AddressedTiles
+	resolve.nextID = state.NextID
+	if resolve.deduplicate && state.Index != nil {
+		resolve.index = memoryIndex(state.Index)
+	}
+	return state.LastTileID, true, nil
+}
+
+func (r *resumer) truncate(length int64) error {
+	if err := r.tmpfile.Truncate(length); err != nil {
+		return fmt.Errorf("Failed to truncate tmpfile, %w", err)
+	}
+	if _, err := r.tmpfile.Seek(length, io.SeekStart); err != nil {
+		return fmt.Errorf("Failed to seek tmpfile, %w", err)
+	}
+	return nil
+}
+
+// checkpoint saves the state of resolve after the tile lastID was added,
+// if resumeCheckpointInterval has passed since the last save.
+func (r *resumer) checkpoint(resolve *resolver, lastID uint64) error {
+	if time.Since(r.saved) < resumeCheckpointInterval {
+		return nil
+	}
+	if err := r.save(resolve, lastID); err != nil {
+		return err
+	}
+	r.saved = time.Now()
+	return nil
+}
+
+// save writes the state of resolve once the tmpfile is on disk, replacing the previous state atomically.
+func (r *resumer) save(resolve *resolver, lastID uint64) error {
+	if err := r.tmpfile.Sync(); err != nil {
+		return fmt.Errorf("Failed to sync tmpfile, %w", err)
+	}
+	length, err := r.tmpfile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("Failed to seek tmpfile, %w", err)
+	}
+	state := resumeState{
+		Fingerprint:    r.fingerprint,
+		LastTileID:     lastID,
+		TmpfileLength:  length,
+		Offset:         resolve.Offset,
+		AddressedTiles: resolve.AddressedTiles,
+		NextID:         resolve.nextID,
+		Entries:        resolve.Entries,
+	}
+	if index, ok := resolve.index.(memoryIndex); ok && resolve.deduplicate {
+		state.Index = index
+	}
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(state); err != nil {
+		return fmt.Errorf("Failed to encode resume state, %w", err)
+	}
+
+	file, err := createAtomic(r.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sum := sha256.Sum256(payload.Bytes())
+	header := binary.LittleEndian.AppendUint32(bytes.Clone(resumeStateMagic), resumeStateVersion)
+	for _, b := range [][]byte{header, sum[:], payload.Bytes()} {
+		if _, err := file.Write(b); err != nil {
+			return fmt.Errorf("Failed to write resume state, %w", err)
+		}
+	}
+	return file.commit()
+}
+
+// remove deletes the saved state once the conversion is complete.
+func (r *resumer) remove() error {
+	if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("Failed to remove resume state %s, %w", r.path, err)
+	}
+	return nil
+}
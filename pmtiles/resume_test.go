@@ -0,0 +1,120 @@
+package pmtiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConvertResume(t *testing.T) {
+	interval := resumeCheckpointInterval
+	resumeCheckpointInterval = 0
+	defer func() { resumeCheckpointInterval = interval }()
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		if z == 2 && x == 2 {
+			// gzip magic bytes without a valid stream
+			return []byte{0x1f, 0x8b, 0x0, 0x0}
+		}
+		return testGzipTile()
+	})
+
+	for _, workers := range []int{1, 4} {
+		expected := filepath.Join(dir, "expected.pmtiles")
+		opts := ConvertOptions{MinZoom: -1, MaxZoom: -1, Recompress: true, Workers: workers, OnTileError: "skip", Force: true}
+		uninterrupted, err := os.CreateTemp(dir, "pmtiles")
+		assert.Nil(t, err)
+		defer uninterrupted.Close()
+		assert.Nil(t, Convert(logger, input, expected, opts, uninterrupted))
+
+		output := filepath.Join(dir, "out.pmtiles")
+		tmpfile, err := os.Create(filepath.Join(dir, "out.pmtiles.tmp"))
+		assert.Nil(t, err)
+		defer tmpfile.Close()
+		opts.Resume = true
+		opts.OnTileError = "abort"
+		assert.ErrorContains(t, Convert(logger, input, output, opts, tmpfile), "Failed to read tile 2/2/")
+		_, err = os.Stat(tmpfile.Name() + ".state")
+		assert.Nil(t, err)
+
+		// changed options must not resume from the saved state
+		changed := opts
+		changed.Deduplicate = !opts.Deduplicate
+		assert.ErrorContains(t, Convert(logger, input, output, changed, tmpfile), "different input or options")
+
+		opts.OnTileError = "skip"
+		assert.Nil(t, Convert(logger, input, output, opts, tmpfile))
+		_, err = os.Stat(tmpfile.Name() + ".state")
+		assert.True(t, os.IsNotExist(err))
+
+		expectedBytes, err := os.ReadFile(expected)
+		assert.Nil(t, err)
+		outputBytes, err := os.ReadFile(output)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedBytes, outputBytes)
+	}
+}
+
+func TestResumeCorruptState(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	assert.Nil(t, os.WriteFile(input, []byte("input"), 0666))
+	tmpfile, err := os.Create(filepath.Join(dir, "tmp"))
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	_, err = tmpfile.Write([]byte("tile data"))
+	assert.Nil(t, err)
+
+	r, err := newResumer(input, ConvertOptions{}, tmpfile)
+	assert.Nil(t, err)
+	resolve := newResolver(true, Gzip)
+	lastID, resumed, err := r.restore(resolve)
+	assert.Nil(t, err)
+	assert.False(t, resumed)
+	assert.Equal(t, uint64(0), lastID)
+	info, err := tmpfile.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	_, err = tmpfile.Write([]byte("tile"))
+	assert.Nil(t, err)
+	resolve.Offset = 4
+	resolve.Entries = append(resolve.Entries, EntryV3{TileID: 5, Length: 4, RunLength: 1})
+	assert.Nil(t, r.save(resolve, 5))
+	_, err = tmpfile.Write([]byte("unsaved"))
+	assert.Nil(t, err)
+
+	restored := newResolver(true, Gzip)
+	lastID, resumed, err = r.restore(restored)
+	assert.Nil(t, err)
+	assert.True(t, resumed)
+	assert.Equal(t, uint64(5), lastID)
+	assert.Equal(t, resolve.Entries, restored.Entries)
+	info, err = tmpfile.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), info.Size())
+
+	state, err := os.ReadFile(r.path)
+	assert.Nil(t, err)
+	state[len(state)-1] ^= 0xff
+	assert.Nil(t, os.WriteFile(r.path, state, 0666))
+	_, _, err = r.restore(newResolver(true, Gzip))
+	assert.ErrorContains(t, err, "corrupt")
+
+	assert.Nil(t, os.WriteFile(r.path, []byte("not a state"), 0666))
+	_, _, err = r.restore(newResolver(true, Gzip))
+	assert.ErrorContains(t, err, "not a resume state")
+
+	assert.Nil(t, r.remove())
+	assert.Nil(t, r.remove())
+}
+
+func TestConvertResumeOptions(t *testing.T) {
+	dir := t.TempDir()
+	err := Convert(logger, filepath.Join(dir, "in.mbtiles"), filepath.Join(dir, "out.pmtiles"), ConvertOptions{Resume: true, NoTmpfile: true}, nil)
+	assert.ErrorContains(t, err, "resume")
+}
@@ -0,0 +1,186 @@
+package pmtiles
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultRetries = 3
+
+const defaultRetryDelay = 100 * time.Millisecond
+
+// RetryOptions configures how failed range reads from remote storage are retried.
+type RetryOptions struct {
+	// Retries is the number of times a failed read is attempted again; 0 uses 3 and a negative value disables retries.
+	Retries int
+	// BaseDelay is the wait before the first retry, doubled after every attempt; 0 uses 100 milliseconds.
+	// Each wait is randomized between half and one and a half times the delay, so that clients don't retry in step,
+	// unless the response has a Retry-After header.
+	BaseDelay time.Duration
+}
+
+func (o RetryOptions) normalize() RetryOptions {
+	if o.Retries == 0 {
+		o.Retries = defaultRetries
+	} else if o.Retries < 0 {
+		o.Retries = 0
+	}
+	if o.BaseDelay <= 0 {
+		o.BaseDelay = defaultRetryDelay
+	}
+	return o
+}
+
+// backoff returns the wait before retrying attempt, counted from 0, which failed with err and HTTP status,
+// or 0 if the status is unknown. ok is false if the failure is permanent or no retries are left.
+// o must be normalized.
+func (o RetryOptions) backoff(attempt int, status int, err error) (wait time.Duration, ok bool) {
+	if attempt >= o.Retries || !isRetryable(status, err) {
+		return 0, false
+	}
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.retryAfter > 0 {
+		return statusErr.retryAfter, true
+	}
+	delay := o.BaseDelay << attempt
+	return delay/2 + time.Duration(rand.Int63n(int64(delay)+1)), true
+}
+
+// isRetryable returns whether a read failing with err and HTTP status, or 0 if unknown, may succeed if repeated:
+// server errors, timeouts and broken connections are retried, while client errors such as 403, 404 and 416
+// and a changed archive are not.
+func isRetryable(status int, err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || isRefreshRequiredError(err) {
+		return false
+	}
+	return status == 0 || isRetryableStatus(status)
+}
+
+func isRetryableStatus(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+// sleepContext waits for d, or returns the error of ctx if it is done first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// parseRetryAfter returns the wait of a Retry-After header in seconds or as an HTTP date, or 0 if there is none.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(max(seconds, 0)) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(t.Sub(now), 0)
+	}
+	return 0
+}
+
+// retryBucket retries the failed range reads of a Bucket, including reads of a response body that break off,
+// and requests the remainder of a range whose response ends early.
+type retryBucket struct {
+	Bucket
+	opts RetryOptions
+}
+
+// NewRetryBucket wraps bucket to retry failed range reads as configured by opts.
+// The ranges read must lie within the object, as a response shorter than the range is retried too.
+func NewRetryBucket(bucket Bucket, opts RetryOptions) Bucket {
+	return retryBucket{bucket, opts.normalize()}
+}
+
+func (b retryBucket) NewRangeReader(ctx context.Context, key string, offset int64, length int64) (io.ReadCloser, error) {
+	r, _, _, err := b.NewRangeReaderEtag(ctx, key, offset, length, "")
+	return r, err
+}
+
+func (b retryBucket) NewRangeReaderEtag(ctx context.Context, key string, offset int64, length int64, etag string) (io.ReadCloser, string, int, error) {
+	for attempt := 0; ; attempt++ {
+		body, newEtag, status, err := b.Bucket.NewRangeReaderEtag(ctx, key, offset, length, etag)
+		if err == nil {
+			// the remainder of the range is read from the same version of the object
+			if etag == "" {
+				etag = newEtag
+			}
+			return &retryReader{bucket: b, ctx: ctx, key: key, etag: etag, offset: offset, remaining: length, body: body}, newEtag, status, nil
+		}
+		wait, ok := b.opts.backoff(attempt, status, err)
+		if !ok {
+			return nil, "", status, err
+		}
+		if err := sleepContext(ctx, wait); err != nil {
+			return nil, "", status, err
+		}
+	}
+}
+
+// retryReader reads a range of an object, requesting the unread remainder again when a read fails
+// or the response ends early.
+type retryReader struct {
+	bucket    retryBucket
+	ctx       context.Context
+	key       string
+	etag      string
+	offset    int64
+	remaining int64
+	body      io.ReadCloser // nil after a failed read until the remainder is requested
+}
+
+func (r *retryReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	for attempt := 0; ; attempt++ {
+		var status int
+		var err error
+		if r.body == nil {
+			r.body, _, status, err = r.bucket.Bucket.NewRangeReaderEtag(r.ctx, r.key, r.offset, r.remaining, r.etag)
+		}
+		if err == nil {
+			var n int
+			n, err = r.body.Read(p)
+			r.offset += int64(n)
+			r.remaining -= int64(n)
+			if n > 0 || err == nil {
+				return n, nil
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			r.body.Close()
+			r.body = nil
+		}
+		wait, ok := r.bucket.opts.backoff(attempt, status, err)
+		if !ok {
+			return 0, err
+		}
+		if err := sleepContext(r.ctx, wait); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (r *retryReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	return r.body.Close()
+}
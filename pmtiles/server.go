@@ -6,6 +6,7 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"github.com/cespare/xxhash/v2"
 	"github.com/rs/cors"
 	"io"
 	"log"
@@ -53,6 +54,9 @@ type Server struct {
 	cacheSize int
 	publicURL string
 	metrics   *metrics
+	// DisableTranscoding serves gzip-compressed vector tiles as stored even to clients that do not send
+	// Accept-Encoding: gzip. It must be set before Start.
+	DisableTranscoding bool
 }
 
 // NewServer creates a new pmtiles HTTP server.
@@ -182,8 +186,23 @@ func (server *Server) Start() {
 								return
 							}
 
+							var rootBytes []byte
+							if header.RootOffset+header.RootLength <= uint64(len(b)) {
+								rootBytes = b[header.RootOffset : header.RootOffset+header.RootLength]
+							} else {
+								// a root directory larger than the first read, as in archives for local serving
+								rootBytes, err = server.readRange(ctx, key.name, header.RootOffset, header.RootLength, etag)
+								if err != nil {
+									ok = false
+									status = "error"
+									resps <- response{key: key, value: result}
+									server.logger.Printf("failed to fetch root directory of %s, %v", key.name, err)
+									return
+								}
+							}
+
 							// populate the root first before header
-							rootEntries := DeserializeEntries(bytes.NewBuffer(b[header.RootOffset:header.RootOffset+header.RootLength]), header.InternalCompression)
+							rootEntries := DeserializeEntries(bytes.NewBuffer(rootBytes), header.InternalCompression)
 							result2 := cachedValue{directory: rootEntries, ok: true, etag: etag}
 
 							rootKey := cacheKey{name: key.name, offset: header.RootOffset, length: header.RootLength}
@@ -233,6 +252,16 @@ func (server *Server) Start() {
 	}()
 }
 
+// readRange reads length bytes at offset of the archive name with the given etag.
+func (server *Server) readRange(ctx context.Context, name string, offset, length uint64, etag string) ([]byte, error) {
+	r, _, _, err := server.bucket.NewRangeReaderEtag(ctx, name+".pmtiles", int64(offset), int64(length), etag)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
 func (server *Server) getHeaderMetadata(ctx context.Context, name string) (bool, HeaderV3, []byte, error) {
 	found, header, metadataBytes, purgeEtag, err := server.getHeaderMetadataAttempt(ctx, name, "")
 	if len(purgeEtag) > 0 {
@@ -318,16 +347,20 @@ func (server *Server) getMetadata(ctx context.Context, httpHeaders map[string]st
 	httpHeaders["ETag"] = generateEtag(metadataBytes)
 	return 200, httpHeaders, metadataBytes
 }
-func (server *Server) getTile(ctx context.Context, httpHeaders map[string]string, name string, z uint8, x uint32, y uint32, ext string) (int, map[string]string, []byte) {
-	status, headers, data, purgeEtag := server.getTileAttempt(ctx, httpHeaders, name, z, x, y, ext, "")
+
+// getTile returns the response to a tile request r, or to a tile request without headers if r is nil.
+// The ETag of a tile is derived from the generation of the archive, so a request whose If-None-Match matches it
+// is answered with 304 Not Modified without reading the tile data.
+func (server *Server) getTile(ctx context.Context, r *http.Request, httpHeaders map[string]string, name string, z uint8, x uint32, y uint32, ext string) (int, map[string]string, []byte) {
+	status, headers, data, purgeEtag := server.getTileAttempt(ctx, r, httpHeaders, name, z, x, y, ext, "")
 	if len(purgeEtag) > 0 {
 		// file has new etag, retry once force-purging the etag that is no longer value
-		status, headers, data, _ = server.getTileAttempt(ctx, httpHeaders, name, z, x, y, ext, purgeEtag)
+		status, headers, data, _ = server.getTileAttempt(ctx, r, httpHeaders, name, z, x, y, ext, purgeEtag)
 	}
 	return status, headers, data
 }
 
-func (server *Server) getTileAttempt(ctx context.Context, httpHeaders map[string]string, name string, z uint8, x uint32, y uint32, ext string, purgeEtag string) (int, map[string]string, []byte, string) {
+func (server *Server) getTileAttempt(ctx context.Context, r *http.Request, httpHeaders map[string]string, name string, z uint8, x uint32, y uint32, ext string, purgeEtag string) (int, map[string]string, []byte, string) {
 	rootReq := request{key: cacheKey{name: name, offset: 0, length: 0}, value: make(chan cachedValue, 1), purgeEtag: purgeEtag, compression: UnknownCompression}
 	server.reqs <- rootReq
 
@@ -339,7 +372,7 @@ func (server *Server) getTileAttempt(ctx context.Context, httpHeaders map[string
 		return 404, httpHeaders, []byte("Archive not found"), ""
 	}
 
-	if z < header.MinZoom || z > header.MaxZoom {
+	if z < header.MinZoom || z > header.MaxZoom || ValidateTileCoord(z, x, y) != nil {
 		return 404, httpHeaders, []byte("Tile not found"), ""
 	}
 
@@ -383,6 +416,21 @@ func (server *Server) getTileAttempt(ctx context.Context, httpHeaders map[string
 		}
 
 		if entry.RunLength > 0 {
+			if headerVal, ok := headerContentType(header); ok {
+				httpHeaders["Content-Type"] = headerVal
+			}
+			if headerVal, ok := compressionToString(header.TileCompression); ok {
+				httpHeaders["Content-Encoding"] = headerVal
+			}
+			coding := httpHeaders["Content-Encoding"]
+			if server.decodes(r, httpHeaders) {
+				coding = ""
+			}
+			httpHeaders["ETag"] = tileEtag(archiveGeneration(rootValue), tileID, coding)
+			if r != nil && etagMatches(r.Header.Get("If-None-Match"), httpHeaders["ETag"]) {
+				return 304, httpHeaders, nil, ""
+			}
+
 			status := ""
 			tracker := server.metrics.startBucketRequest(name, "tile")
 			defer func() { tracker.finish(ctx, status) }()
@@ -409,13 +457,6 @@ func (server *Server) getTileAttempt(ctx context.Context, httpHeaders map[string
 				return 500, httpHeaders, []byte("I/O error"), ""
 			}
 
-			httpHeaders["ETag"] = generateEtag(b)
-			if headerVal, ok := headerContentType(header); ok {
-				httpHeaders["Content-Type"] = headerVal
-			}
-			if headerVal, ok := compressionToString(header.TileCompression); ok {
-				httpHeaders["Content-Encoding"] = headerVal
-			}
 			return 200, httpHeaders, b, ""
 		}
 		dirOffset = header.LeafDirectoryOffset + entry.Offset
@@ -424,6 +465,37 @@ func (server *Server) getTileAttempt(ctx context.Context, httpHeaders map[string
 	return 204, httpHeaders, nil, ""
 }
 
+// archiveGeneration identifies the version of an archive whose header and root directory are cached in root:
+// the ETag of the archive in its bucket, or a hash of the header if the bucket has none.
+// It changes when the cache is refreshed after the archive is replaced.
+func archiveGeneration(root cachedValue) string {
+	if root.etag != "" {
+		return root.etag
+	}
+	return generateEtag(SerializeHeader(root.header))
+}
+
+// tileEtag is the strong ETag of tileID in the archive generation, served with the content coding,
+// or none if the tile is decoded for the client.
+func tileEtag(generation string, tileID uint64, coding string) string {
+	hasher := xxhash.New()
+	hasher.WriteString(generation)
+	hasher.Write(uintToBytes(tileID))
+	hasher.WriteString(coding)
+	return hasherToEtag(hasher)
+}
+
+// etagMatches returns whether an If-None-Match header lists etag or is "*", comparing ETags weakly as RFC 9110 requires.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 func isRefreshRequiredError(err error) bool {
 	_, ok := err.(*RefreshRequiredError)
 	return ok
@@ -465,14 +537,15 @@ func parseMetadataPath(path string) (bool, string) {
 	return false, ""
 }
 
-func (server *Server) get(ctx context.Context, unsanitizedPath string) (archive, handler string, status int, headers map[string]string, data []byte) {
+// get returns the response to a request for unsanitizedPath; r is the request served by ServeHTTP, or nil for Get.
+func (server *Server) get(ctx context.Context, r *http.Request, unsanitizedPath string) (archive, handler string, status int, headers map[string]string, data []byte) {
 	handler = ""
 	archive = ""
 	headers = make(map[string]string)
 
 	if ok, key, z, x, y, ext := parseTilePath(unsanitizedPath); ok {
 		archive, handler = key, "tile"
-		status, headers, data = server.getTile(ctx, headers, key, z, x, y, ext)
+		status, headers, data = server.getTile(ctx, r, headers, key, z, x, y, ext)
 	} else if ok, key := parseTilejsonPath(unsanitizedPath); ok {
 		archive, handler = key, "tilejson"
 		status, headers, data = server.getTileJSON(ctx, headers, key)
@@ -492,11 +565,24 @@ func (server *Server) get(ctx context.Context, unsanitizedPath string) (archive,
 // Return status code, HTTP headers, and body.
 func (server *Server) Get(ctx context.Context, path string) (int, map[string]string, []byte) {
 	tracker := server.metrics.startRequest()
-	archive, handler, status, headers, data := server.get(ctx, path)
+	archive, handler, status, headers, data := server.get(ctx, nil, path)
 	tracker.finish(ctx, archive, handler, status, len(data), true)
 	return status, headers, data
 }
 
+// transcodes returns whether ServeHTTP decodes a response with headers for clients not accepting its coding:
+// brotli responses, and gzip vector tiles unless DisableTranscoding is set.
+func (server *Server) transcodes(headers map[string]string) bool {
+	encoding := headers["Content-Encoding"]
+	return encoding == "br" ||
+		(!server.DisableTranscoding && encoding == "gzip" && headers["Content-Type"] == "application/vnd.mapbox-vector-tile")
+}
+
+// decodes returns whether ServeHTTP decodes a response with headers for r, which is nil for Get.
+func (server *Server) decodes(r *http.Request, headers map[string]string) bool {
+	return r != nil && server.transcodes(headers) && !acceptsEncoding(r, headers["Content-Encoding"])
+}
+
 type loggingResponseWriter struct {
 	http.ResponseWriter
 	statusCode int
@@ -517,7 +603,22 @@ func (server *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) int {
 		return 405
 	}
 
-	archive, handler, statusCode, headers, body := server.get(r.Context(), r.URL.Path)
+	archive, handler, statusCode, headers, body := server.get(r.Context(), r, r.URL.Path)
+	if (statusCode == 200 || statusCode == 304) && server.transcodes(headers) {
+		// decode tiles for clients that do not advertise the coding, which for brotli are many
+		headers["Vary"] = "Accept-Encoding"
+		if encoding := headers["Content-Encoding"]; server.decodes(r, headers) {
+			delete(headers, "Content-Encoding")
+			if statusCode == 200 {
+				decoded, err := decompressBytes(body, stringToCompression(encoding))
+				if err != nil {
+					statusCode, body = 500, []byte("I/O error")
+				} else {
+					body = decoded
+				}
+			}
+		}
+	}
 	for k, v := range headers {
 		w.Header().Set(k, v)
 	}
@@ -60,11 +60,12 @@ func fakeArchive(t *testing.T, header HeaderV3, metadata map[string]interface{},
 		keys = append(keys, id)
 	}
 	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
-	resolver := newResolver(false, false)
+	resolver := newResolver(false, NoCompression)
 	tileDataBytes := make([]byte, 0)
 	for _, id := range keys {
 		tileBytes := byTileID[id]
-		resolver.AddTileIsNew(id, tileBytes, 1)
+		_, _, err := resolver.AddTileIsNew(id, tileBytes, 1)
+		assert.Nil(t, err)
 		tileDataBytes = append(tileDataBytes, tileBytes...)
 	}
 
@@ -79,7 +80,7 @@ func fakeArchive(t *testing.T, header HeaderV3, metadata map[string]interface{},
 	}
 
 	header.InternalCompression = internalCompression
-	if header.TileType == Mvt {
+	if header.TileType == Mvt && header.TileCompression == UnknownCompression {
 		header.TileCompression = Gzip
 	}
 
@@ -439,8 +440,8 @@ func TestEtagResponsesFromTile(t *testing.T) {
 	assert.Equal(t, "", headers311v1["ETag"])
 	assert.Equal(t, "", headers311v2["ETag"])
 
-	// 000 and 311 didn't change
-	assert.Equal(t, headers000v1["ETag"], headers000v2["ETag"])
+	// the archive changed, so the etag of 000 did too
+	assert.NotEqual(t, headers000v1["ETag"], headers000v2["ETag"])
 
 	// 412 did change
 	assert.NotEqual(t, headers412v1["ETag"], headers412v2["ETag"])
@@ -490,3 +491,118 @@ func TestCorsOptions(t *testing.T) {
 	assert.Equal(t, 204, res.Code)
 	assert.Equal(t, "*", res.Header().Get("Access-Control-Allow-Origin"))
 }
+
+func TestBrotliTileEncoding(t *testing.T) {
+	mockBucket, server := newServer(t)
+	compressor, err := newCompressor(Brotli, 0)
+	assert.Nil(t, err)
+	compressed, err := compressor.Compress([]byte("tile"))
+	assert.Nil(t, err)
+	tile := append([]byte{}, compressed...)
+	header := HeaderV3{TileType: Mvt, TileCompression: Brotli}
+	mockBucket.items["archive.pmtiles"] = fakeArchive(t, header, map[string]interface{}{}, map[Zxy][]byte{{0, 0, 0}: tile}, false, Gzip)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/archive/0/0/0.mvt", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "br", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header().Get("Vary"))
+	assert.Equal(t, tile, res.Body.Bytes())
+	brEtag := res.Header().Get("ETag")
+
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/archive/0/0/0.mvt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.Empty(t, res.Header().Get("Content-Encoding"))
+	assert.NotEmpty(t, res.Header().Get("ETag"))
+	assert.NotEqual(t, brEtag, res.Header().Get("ETag"))
+	assert.Equal(t, []byte("tile"), res.Body.Bytes())
+}
+
+func TestGzipTileTranscoding(t *testing.T) {
+	mockBucket, server := newServer(t)
+	compressor, err := newCompressor(Gzip, 0)
+	assert.Nil(t, err)
+	compressed, err := compressor.Compress([]byte("tile"))
+	assert.Nil(t, err)
+	tile := append([]byte{}, compressed...)
+	header := HeaderV3{TileType: Mvt, TileCompression: Gzip}
+	mockBucket.items["archive.pmtiles"] = fakeArchive(t, header, map[string]interface{}{}, map[Zxy][]byte{{0, 0, 0}: tile}, false, Gzip)
+
+	res := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/archive/0/0/0.mvt", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "application/vnd.mapbox-vector-tile", res.Header().Get("Content-Type"))
+	assert.Equal(t, tile, res.Body.Bytes())
+
+	res = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", "/archive/0/0/0.mvt", nil)
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.Empty(t, res.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", res.Header().Get("Vary"))
+	assert.Equal(t, []byte("tile"), res.Body.Bytes())
+
+	server.DisableTranscoding = true
+	res = httptest.NewRecorder()
+	server.ServeHTTP(res, req)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, "gzip", res.Header().Get("Content-Encoding"))
+	assert.Equal(t, tile, res.Body.Bytes())
+}
+
+func TestTileIfNoneMatch(t *testing.T) {
+	mockBucket, server := newServer(t)
+	header := HeaderV3{TileType: Png}
+	mockBucket.items["archive.pmtiles"] = fakeArchive(t, header, map[string]interface{}{}, map[Zxy][]byte{
+		{0, 0, 0}: {0, 1, 2, 3},
+	}, false, Gzip)
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/archive/0/0/0.png", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		server.ServeHTTP(res, req)
+		return res
+	}
+
+	res := get("")
+	assert.Equal(t, 200, res.Code)
+	etag := res.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	// hit
+	res = get(etag)
+	assert.Equal(t, 304, res.Code)
+	assert.Equal(t, etag, res.Header().Get("ETag"))
+	assert.Empty(t, res.Body.Bytes())
+	res = get(`"other", W/` + etag)
+	assert.Equal(t, 304, res.Code)
+
+	// miss
+	res = get(`"other"`)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, etag, res.Header().Get("ETag"))
+	assert.Equal(t, []byte{0, 1, 2, 3}, res.Body.Bytes())
+
+	// the same tile in a replaced archive gets a new etag once the cache is refreshed
+	mockBucket.items["archive.pmtiles"] = fakeArchive(t, header, map[string]interface{}{}, map[Zxy][]byte{
+		{0, 0, 0}: {0, 1, 2, 3},
+		{1, 0, 0}: {4},
+	}, false, Gzip)
+	res = get("")
+	assert.Equal(t, 200, res.Code)
+	assert.NotEqual(t, etag, res.Header().Get("ETag"))
+	res = get(etag)
+	assert.Equal(t, 200, res.Code)
+	assert.Equal(t, []byte{0, 1, 2, 3}, res.Body.Bytes())
+}
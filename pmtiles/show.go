@@ -112,6 +112,12 @@ func Show(_ *log.Logger, output io.Writer, bucketURL string, key string, showHea
 		}
 	} else {
 		// write the tile to stdout
+		if z < 0 || x < 0 || y < 0 || z > MaxTileZoom {
+			return fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+		}
+		if err := ValidateTileCoord(uint8(z), uint32(x), uint32(y)); err != nil {
+			return err
+		}
 
 		tileID := ZxyToID(uint8(z), uint32(x), uint32(y))
 
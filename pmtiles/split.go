@@ -0,0 +1,172 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ZoomRange is an inclusive range of zoom levels.
+type ZoomRange struct {
+	Min uint8
+	Max uint8
+}
+
+// ParseZoomRanges parses a comma-separated list of zoom ranges such as "0-8,9-12,13-15";
+// a single zoom level like "14" is a range of one.
+func ParseZoomRanges(s string) ([]ZoomRange, error) {
+	var ranges []ZoomRange
+	for _, part := range strings.Split(s, ",") {
+		minStr, maxStr, found := strings.Cut(strings.TrimSpace(part), "-")
+		if !found {
+			maxStr = minStr
+		}
+		minZoom, err := strconv.ParseUint(minStr, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zoom range %q", part)
+		}
+		maxZoom, err := strconv.ParseUint(maxStr, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid zoom range %q", part)
+		}
+		ranges = append(ranges, ZoomRange{uint8(minZoom), uint8(maxZoom)})
+	}
+	return ranges, nil
+}
+
+// SplitByZoom partitions a local archive into one archive per zoom range, reading the input once.
+// The output path of each range is outputPattern with {min} and {max} replaced by its zoom levels
+// and {range} by both, such as tiles-z{min}-z{max}.pmtiles or tiles-z{range}.pmtiles. Tile contents are copied as stored;
+// ranges without tiles are skipped. Temporary files are created in tmpDir, or the OS default if empty.
+func SplitByZoom(logger *log.Logger, input string, ranges []ZoomRange, outputPattern string, tmpDir string) error {
+	start := time.Now()
+	if len(ranges) == 0 {
+		return fmt.Errorf("no zoom ranges to split into")
+	}
+	sorted := append([]ZoomRange{}, ranges...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Min < sorted[j].Min })
+	for i, r := range sorted {
+		if r.Min > r.Max || r.Max > MaxTileZoom {
+			return fmt.Errorf("invalid zoom range %d-%d", r.Min, r.Max)
+		}
+		if i > 0 && r.Min <= sorted[i-1].Max {
+			return fmt.Errorf("zoom ranges %d-%d and %d-%d overlap", sorted[i-1].Min, sorted[i-1].Max, r.Min, r.Max)
+		}
+	}
+	if len(sorted) > 1 && !strings.Contains(outputPattern, "{min}") && !strings.Contains(outputPattern, "{max}") && !strings.Contains(outputPattern, "{range}") {
+		return fmt.Errorf("output pattern %s must contain {min}, {max} or {range} to name more than one output", outputPattern)
+	}
+
+	file, err := os.Open(input)
+	if err != nil {
+		return fmt.Errorf("Failed to open %s, %w", input, err)
+	}
+	defer file.Close()
+
+	headerBytes := make([]byte, HeaderV3LenBytes)
+	if _, err := io.ReadFull(file, headerBytes); err != nil {
+		return fmt.Errorf("Failed to read header of %s, %w", input, err)
+	}
+	header, err := DeserializeHeader(headerBytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse header of %s, %w", input, err)
+	}
+	metadataReader := io.NewSectionReader(file, int64(header.MetadataOffset), int64(header.MetadataLength))
+	metadata, err := DeserializeMetadata(metadataReader, header.InternalCompression)
+	if err != nil {
+		return fmt.Errorf("Failed to read metadata of %s, %w", input, err)
+	}
+
+	entries := make([]EntryV3, 0, header.TileEntriesCount)
+	err = IterateEntries(header,
+		ReaderAtFetcher(file),
+		func(e EntryV3) {
+			entries = append(entries, e)
+		})
+	if err != nil {
+		return fmt.Errorf("Failed to iterate through tiles of %s, %w", input, err)
+	}
+
+	for _, r := range sorted {
+		minStr, maxStr := strconv.Itoa(int(r.Min)), strconv.Itoa(int(r.Max))
+		output := strings.NewReplacer("{min}", minStr, "{max}", maxStr, "{range}", minStr+"-"+maxStr).Replace(outputPattern)
+		if err := splitShard(logger, file, header, metadata, entries, r, output, tmpDir); err != nil {
+			return err
+		}
+	}
+	logger.Println("Finished in ", time.Since(start))
+	return nil
+}
+
+// splitShard writes the tiles of entries within zoom range r to output,
+// splitting runs that cross the bounds of the range.
+func splitShard(logger *log.Logger, file *os.File, header HeaderV3, metadata map[string]interface{}, entries []EntryV3, r ZoomRange, output string, tmpDir string) error {
+	zooms := zoomRange{int8(r.Min), int8(r.Max)}
+	start, end := zooms.tileIDs()
+
+	tmpfile, err := os.CreateTemp(tmpDir, "pmtiles")
+	if err != nil {
+		return fmt.Errorf("Failed to create temp file, %w", err)
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	resolve := newResolver(true, NoCompression)
+	defer resolve.close()
+	// contents already copied, by their offset in the input
+	copied := make(map[uint64]offsetLen)
+
+	for _, e := range entries {
+		if e.TileID >= end {
+			break
+		}
+		first := max(e.TileID, start)
+		last := min(e.TileID+uint64(e.RunLength), end)
+		if first >= last {
+			continue
+		}
+		runLength := uint32(last - first)
+		if found, ok := copied[e.Offset]; ok {
+			if err := resolve.addExistingTile(first, found, runLength); err != nil {
+				return tileOrderError(first, err)
+			}
+			continue
+		}
+		data := make([]byte, e.Length)
+		if _, err := file.ReadAt(data, int64(header.TileDataOffset+e.Offset)); err != nil {
+			return fmt.Errorf("Failed to read tile data, %w", err)
+		}
+		isNew, newData, err := resolve.AddTileIsNew(first, data, runLength)
+		if err != nil {
+			return tileOrderError(first, err)
+		}
+		if isNew {
+			if _, err := tmpfile.Write(newData); err != nil {
+				return fmt.Errorf("Failed to write to tempfile, %w", err)
+			}
+		}
+		added := resolve.Entries[len(resolve.Entries)-1]
+		copied[e.Offset] = offsetLen{added.Offset, added.Length}
+	}
+
+	if len(resolve.Entries) == 0 {
+		logger.Printf("No tiles in zoom range %d-%d, skipping %s\n", r.Min, r.Max, output)
+		return nil
+	}
+
+	shardMetadata := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		shardMetadata[k] = v
+	}
+	lastEntry := resolve.Entries[len(resolve.Entries)-1]
+	zooms.apply(&header, shardMetadata, resolve.Entries[0].TileID, lastEntry.TileID+uint64(lastEntry.RunLength)-1)
+
+	logger.Printf("Writing zoom range %d-%d to %s\n", r.Min, r.Max, output)
+	_, err = finalize(logger, resolve, header, tmpfile, output, shardMetadata)
+	return err
+}
@@ -0,0 +1,82 @@
+package pmtiles
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitByZoom(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	tiles := []testTile{{0, 0, 0, "a"}}
+	for x := uint32(0); x < 2; x++ {
+		for y := uint32(0); y < 2; y++ {
+			tiles = append(tiles, testTile{1, x, y, "b"})
+		}
+	}
+	for x := uint32(0); x < 4; x++ {
+		for y := uint32(0); y < 4; y++ {
+			tiles = append(tiles, testTile{2, x, y, "b"})
+		}
+	}
+	// in tile ID order, for a run of "b" crossing from zoom 1 into zoom 2
+	sortTestTiles(tiles)
+	writeTestArchive(t, input, Gzip, Mvt, map[string]interface{}{"name": "in", "minzoom": 0.0, "maxzoom": 2.0}, tiles)
+
+	pattern := filepath.Join(dir, "tiles-z{min}-z{max}.pmtiles")
+	assert.Nil(t, SplitByZoom(logger, input, []ZoomRange{{2, 2}, {0, 1}, {5, 6}}, pattern, dir))
+
+	header, metadata, low := readTestArchiveTiles(t, filepath.Join(dir, "tiles-z0-z1.pmtiles"))
+	assert.Equal(t, uint8(0), header.MinZoom)
+	assert.Equal(t, uint8(1), header.MaxZoom)
+	assert.Equal(t, uint64(5), header.AddressedTilesCount)
+	assert.Equal(t, Compression(Gzip), header.TileCompression)
+	assert.Equal(t, 1.0, metadata["maxzoom"])
+	assert.Equal(t, "in", metadata["name"])
+	assert.Equal(t, 5, len(low))
+	assert.Equal(t, "a", low[0])
+
+	header, metadata, high := readTestArchiveTiles(t, filepath.Join(dir, "tiles-z2-z2.pmtiles"))
+	assert.Equal(t, uint8(2), header.MinZoom)
+	assert.Equal(t, uint8(2), header.MaxZoom)
+	assert.Equal(t, uint64(16), header.AddressedTilesCount)
+	assert.Equal(t, uint64(1), header.TileContentsCount)
+	assert.Equal(t, 2.0, metadata["minzoom"])
+	assert.Equal(t, 16, len(high))
+	assert.Nil(t, Verify(logger, filepath.Join(dir, "tiles-z2-z2.pmtiles")))
+
+	_, err := os.Stat(filepath.Join(dir, "tiles-z5-z6.pmtiles"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestSplitByZoomInvalidRanges(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}})
+
+	assert.Error(t, SplitByZoom(logger, input, []ZoomRange{{0, 3}, {3, 5}}, filepath.Join(dir, "{min}.pmtiles"), dir))
+	assert.Error(t, SplitByZoom(logger, input, []ZoomRange{{4, 2}}, filepath.Join(dir, "{min}.pmtiles"), dir))
+	assert.Error(t, SplitByZoom(logger, input, []ZoomRange{{0, 1}, {2, 3}}, filepath.Join(dir, "out.pmtiles"), dir))
+	assert.Error(t, SplitByZoom(logger, input, nil, filepath.Join(dir, "out.pmtiles"), dir))
+}
+
+func TestParseZoomRanges(t *testing.T) {
+	ranges, err := ParseZoomRanges("0-8,9-12, 13-15,16")
+	assert.Nil(t, err)
+	assert.Equal(t, []ZoomRange{{0, 8}, {9, 12}, {13, 15}, {16, 16}}, ranges)
+
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.pmtiles")
+	writeTestArchive(t, input, NoCompression, Png, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}})
+	assert.Nil(t, SplitByZoom(logger, input, ranges[:2], filepath.Join(dir, "out-z{range}.pmtiles"), dir))
+	_, _, tiles := readTestArchiveTiles(t, filepath.Join(dir, "out-z0-8.pmtiles"))
+	assert.Equal(t, 2, len(tiles))
+
+	for _, s := range []string{"", "a-b", "3-", "0-300"} {
+		_, err := ParseZoomRanges(s)
+		assert.Error(t, err, s)
+	}
+}
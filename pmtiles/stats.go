@@ -0,0 +1,411 @@
+package pmtiles
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// ZoomStats summarizes the tiles of a single zoom level.
+// Sizes are the stored, possibly compressed, tile lengths in bytes,
+// and every addressed tile is counted, including repeats of the same contents.
+type ZoomStats struct {
+	Zoom               uint8   `json:"zoom"`
+	TileCount          uint64  `json:"tile_count"`
+	UniqueContents     uint64  `json:"unique_contents"`
+	DeduplicationRatio float64 `json:"deduplication_ratio"`
+	TotalBytes         uint64  `json:"total_bytes"`
+	MinSize            uint32  `json:"min_size"`
+	MaxSize            uint32  `json:"max_size"`
+	AvgSize            float64 `json:"avg_size"`
+	P95Size            uint32  `json:"p95_size"`
+}
+
+// ArchiveStats summarizes the tiles of an archive by zoom level.
+// AddressedTilesCount, TileEntriesCount and TileContentsCount are computed from the directories
+// and can be compared to the values of the same name in Header.
+type ArchiveStats struct {
+	Header              HeaderV3    `json:"header"`
+	AddressedTilesCount uint64      `json:"addressed_tiles_count"`
+	TileEntriesCount    uint64      `json:"tile_entries_count"`
+	TileContentsCount   uint64      `json:"tile_contents_count"`
+	Zooms               []ZoomStats `json:"zooms"`
+}
+
+// zoomAccumulator collects the tile sizes of one zoom level as a histogram,
+// so the memory used grows with the number of distinct sizes instead of tiles.
+type zoomAccumulator struct {
+	tiles    uint64
+	bytes    uint64
+	sizes    map[uint32]uint64
+	contents *roaring64.Bitmap
+}
+
+// Stats computes per-zoom statistics of a local archive.
+// Only the header and directories are read, not the tile data.
+func Stats(path string) (*ArchiveStats, error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	stats := &ArchiveStats{Header: header}
+	zooms := make(map[uint8]*zoomAccumulator)
+	contents := roaring64.New()
+
+	add := func(z uint8, offset uint64, length uint32, count uint64) {
+		acc, ok := zooms[z]
+		if !ok {
+			acc = &zoomAccumulator{sizes: make(map[uint32]uint64), contents: roaring64.New()}
+			zooms[z] = acc
+		}
+		acc.tiles += count
+		acc.bytes += uint64(length) * count
+		acc.sizes[length] += count
+		acc.contents.Add(offset)
+	}
+
+	var entryErr error
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		if entryErr != nil {
+			return
+		}
+		if entryErr = checkEntryTileIDs(e); entryErr != nil {
+			return
+		}
+		stats.AddressedTilesCount += uint64(e.RunLength)
+		stats.TileEntriesCount++
+		contents.Add(e.Offset)
+
+		// a run may continue across the first tile of the next zoom level
+		tileID := e.TileID
+		end := e.TileID + uint64(e.RunLength)
+		for tileID < end {
+			z, _, _ := IDToZxy(tileID)
+			zoomEnd := ZxyToID(z+1, 0, 0)
+			if zoomEnd > end {
+				zoomEnd = end
+			}
+			add(z, e.Offset, e.Length, zoomEnd-tileID)
+			tileID = zoomEnd
+		}
+	})
+	if err == nil {
+		err = entryErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+	stats.TileContentsCount = contents.GetCardinality()
+
+	stats.Zooms = make([]ZoomStats, 0, len(zooms))
+	for z, acc := range zooms {
+		stats.Zooms = append(stats.Zooms, acc.summarize(z))
+	}
+	sort.Slice(stats.Zooms, func(i, j int) bool { return stats.Zooms[i].Zoom < stats.Zooms[j].Zoom })
+
+	return stats, nil
+}
+
+func (acc *zoomAccumulator) summarize(z uint8) ZoomStats {
+	sizes := make([]uint32, 0, len(acc.sizes))
+	for size := range acc.sizes {
+		sizes = append(sizes, size)
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+
+	result := ZoomStats{
+		Zoom:           z,
+		TileCount:      acc.tiles,
+		UniqueContents: acc.contents.GetCardinality(),
+		TotalBytes:     acc.bytes,
+		MinSize:        sizes[0],
+		MaxSize:        sizes[len(sizes)-1],
+		AvgSize:        float64(acc.bytes) / float64(acc.tiles),
+	}
+	result.DeduplicationRatio = float64(result.UniqueContents) / float64(acc.tiles)
+
+	// the smallest size that at least 95% of tiles do not exceed
+	rank := (acc.tiles*95 + 99) / 100
+	var seen uint64
+	for _, size := range sizes {
+		seen += acc.sizes[size]
+		if seen >= rank {
+			result.P95Size = size
+			break
+		}
+	}
+	return result
+}
+
+// CountTiles returns the addressed tiles, tile contents and tile entries counts of a local archive
+// as recorded in its header, without reading directories or tile data.
+// Archives written without the counts have zeros; use RecountTiles to compute them.
+func CountTiles(path string) (addressed, unique, entries uint64, err error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	file.Close()
+	return header.AddressedTilesCount, header.TileContentsCount, header.TileEntriesCount, nil
+}
+
+// RecountTiles computes the counts of CountTiles from the directories of a local archive,
+// without reading tile data. Contents are counted by distinct offset.
+func RecountTiles(path string) (addressed, unique, entries uint64, err error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer file.Close()
+
+	contents := roaring64.New()
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		addressed += uint64(e.RunLength)
+		entries++
+		contents.Add(e.Offset)
+	})
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+	return addressed, contents.GetCardinality(), entries, nil
+}
+
+// SampleDeduplication estimates the deduplication ratio of the contents of a local archive,
+// 1 - unique contents / addressed tiles, by hashing the data of a random sampleFraction of its addressed tiles.
+// Unlike RecountTiles it finds duplicates stored at different offsets, as in archives written without deduplication.
+// Small samples underestimate the ratio when duplicates are spread over many distinct contents.
+func SampleDeduplication(path string, sampleFraction float64) (float64, error) {
+	if sampleFraction <= 0 || sampleFraction > 1 {
+		return 0, fmt.Errorf("sample fraction must be greater than 0 and at most 1")
+	}
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var sampled []EntryV3
+	var addressed uint64
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		n := uint32(0)
+		for i := uint32(0); i < e.RunLength; i++ {
+			if rand.Float64() < sampleFraction {
+				n++
+			}
+		}
+		if n > 0 {
+			e.RunLength = n
+			sampled = append(sampled, e)
+			addressed += uint64(n)
+		}
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+	if addressed == 0 {
+		return 0, nil
+	}
+
+	h := newDedupHash("")
+	hashed := make(map[uint64]bool) // offsets already hashed
+	contents := make(map[string]bool)
+	for _, e := range sampled {
+		if hashed[e.Offset] {
+			continue
+		}
+		hashed[e.Offset] = true
+		data := make([]byte, e.Length)
+		if _, err := file.ReadAt(data, int64(header.TileDataOffset+e.Offset)); err != nil {
+			return 0, fmt.Errorf("Failed to read tile data of %s, %w", path, err)
+		}
+		h.Reset()
+		h.Write(data)
+		contents[string(h.Sum(nil))] = true
+	}
+	return 1 - float64(len(contents))/float64(addressed), nil
+}
+
+// ZoomCompression summarizes the compression of the sampled tile contents of one zoom level.
+// Ratios are decompressed length divided by stored length, so better compressed tiles have higher ratios.
+type ZoomCompression struct {
+	Zoom              uint8   `json:"zoom"`
+	SampledTiles      uint64  `json:"sampled_tiles"`
+	CompressedBytes   uint64  `json:"compressed_bytes"`
+	UncompressedBytes uint64  `json:"uncompressed_bytes"`
+	MinRatio          float64 `json:"min_ratio"`
+	MaxRatio          float64 `json:"max_ratio"`
+	AvgRatio          float64 `json:"avg_ratio"`
+}
+
+// CompressionStats decompresses a random sampleFraction of the tile contents of a local archive
+// and summarizes their compression per zoom level. A content is sampled at most once,
+// at the zoom level of the first entry using it, and empty tiles are skipped.
+func CompressionStats(path string, sampleFraction float64) ([]ZoomCompression, error) {
+	if sampleFraction <= 0 || sampleFraction > 1 {
+		return nil, fmt.Errorf("sample fraction must be greater than 0 and at most 1")
+	}
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if header.TileCompression == UnknownCompression {
+		return nil, fmt.Errorf("unknown tile compression in %s", path)
+	}
+
+	var sampled []EntryV3
+	seen := roaring64.New()
+	var entryErr error
+	err = IterateEntries(header, ReaderAtFetcher(file), func(e EntryV3) {
+		if entryErr != nil {
+			return
+		}
+		if entryErr = checkEntryTileIDs(e); entryErr != nil {
+			return
+		}
+		if e.Length == 0 || seen.Contains(e.Offset) {
+			return
+		}
+		seen.Add(e.Offset)
+		if rand.Float64() < sampleFraction {
+			sampled = append(sampled, e)
+		}
+	})
+	if err == nil {
+		err = entryErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+
+	tileData := io.NewSectionReader(file, int64(header.TileDataOffset), int64(header.TileDataLength))
+	zooms := make(map[uint8]*ZoomCompression)
+	for _, e := range sampled {
+		data := make([]byte, e.Length)
+		if _, err := tileData.ReadAt(data, int64(e.Offset)); err != nil {
+			return nil, fmt.Errorf("Failed to read tile data of %s, %w", path, err)
+		}
+		decompressed := data
+		if header.TileCompression != NoCompression {
+			if decompressed, err = decompressBytes(data, header.TileCompression); err != nil {
+				z, x, y := IDToZxy(e.TileID)
+				return nil, fmt.Errorf("Failed to decompress tile %d/%d/%d, %w", z, x, y, err)
+			}
+		}
+
+		z, _, _ := IDToZxy(e.TileID)
+		ratio := float64(len(decompressed)) / float64(len(data))
+		zoom, ok := zooms[z]
+		if !ok {
+			zoom = &ZoomCompression{Zoom: z, MinRatio: ratio, MaxRatio: ratio}
+			zooms[z] = zoom
+		}
+		zoom.SampledTiles++
+		zoom.CompressedBytes += uint64(len(data))
+		zoom.UncompressedBytes += uint64(len(decompressed))
+		zoom.MinRatio = min(zoom.MinRatio, ratio)
+		zoom.MaxRatio = max(zoom.MaxRatio, ratio)
+		// the sum of ratios until all tiles are sampled
+		zoom.AvgRatio += ratio
+	}
+
+	result := make([]ZoomCompression, 0, len(zooms))
+	for _, zoom := range zooms {
+		zoom.AvgRatio /= float64(zoom.SampledTiles)
+		result = append(result, *zoom)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Zoom < result[j].Zoom })
+	return result, nil
+}
+
+// ListZoomLevels returns the sorted zoom levels with at least one tile in the local archive at path.
+// It only reads the directories, skipping leaf directories whose tile IDs are all of one zoom level.
+func ListZoomLevels(path string) ([]uint8, error) {
+	file, header, err := openLocalHeader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var present [32]bool
+	// addRange marks the zoom levels of the tile IDs from first to last, which are all present in a run
+	addRange := func(first, last uint64) {
+		minZoom, _, _ := IDToZxy(first)
+		maxZoom, _, _ := IDToZxy(last)
+		for z := minZoom; z <= maxZoom; z++ {
+			present[z] = true
+		}
+	}
+
+	fetcher := ReaderAtFetcher(file)
+	var collect func(offset, length uint64) error
+	collect = func(offset, length uint64) error {
+		data, err := fetcher.FetchSection(offset, length)
+		if err != nil {
+			return err
+		}
+		directory := DeserializeEntries(bytes.NewBuffer(data), header.InternalCompression)
+		for i, entry := range directory {
+			if err := checkEntryTileIDs(entry); err != nil {
+				return err
+			}
+			if entry.RunLength > 0 {
+				addRange(entry.TileID, entry.TileID+uint64(entry.RunLength)-1)
+				continue
+			}
+			// a leaf ends before the next entry, so its zoom levels are known if that is at the same level
+			if i+1 < len(directory) && directory[i+1].TileID > entry.TileID {
+				first, _, _ := IDToZxy(entry.TileID)
+				last, _, _, err := idToZxyChecked(directory[i+1].TileID - 1)
+				if err != nil {
+					return err
+				}
+				if first == last {
+					present[first] = true
+					continue
+				}
+			}
+			if err := collect(header.LeafDirectoryOffset+entry.Offset, uint64(entry.Length)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := collect(header.RootOffset, header.RootLength); err != nil {
+		return nil, fmt.Errorf("Failed to read directories of %s, %w", path, err)
+	}
+
+	zooms := make([]uint8, 0)
+	for z, ok := range present {
+		if ok {
+			zooms = append(zooms, uint8(z))
+		}
+	}
+	return zooms, nil
+}
+
+// openLocalHeader opens the local archive at path and reads its header.
+func openLocalHeader(path string) (*os.File, HeaderV3, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, HeaderV3{}, fmt.Errorf("Failed to open %s, %w", path, err)
+	}
+	buf := make([]byte, HeaderV3LenBytes)
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		file.Close()
+		return nil, HeaderV3{}, fmt.Errorf("Failed to read header of %s, %w", path, err)
+	}
+	header, err := DeserializeHeader(buf)
+	if err != nil {
+		file.Close()
+		return nil, HeaderV3{}, fmt.Errorf("Failed to read %s, %w", path, err)
+	}
+	return file, header, nil
+}
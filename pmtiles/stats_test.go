@@ -0,0 +1,194 @@
+package pmtiles
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Deduplicate: true, TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.AddTile(0, 0, 0, []byte{0x1}))
+	assert.Nil(t, w.AddTile(1, 0, 0, []byte{0x2, 0x2}))
+	assert.Nil(t, w.AddTile(1, 0, 1, []byte{0x2, 0x2}))
+	assert.Nil(t, w.AddTile(1, 1, 1, []byte{0x3}))
+	assert.Nil(t, w.AddTile(1, 1, 0, []byte{0x2, 0x2}))
+	header, err := w.Finalize(HeaderV3{TileType: Png}, map[string]interface{}{})
+	assert.Nil(t, err)
+
+	path := filepath.Join(t.TempDir(), "stats.pmtiles")
+	assert.Nil(t, os.WriteFile(path, b.Bytes(), 0666))
+
+	stats, err := Stats(path)
+	assert.Nil(t, err)
+	assert.Equal(t, header.AddressedTilesCount, stats.AddressedTilesCount)
+	assert.Equal(t, header.TileEntriesCount, stats.TileEntriesCount)
+	assert.Equal(t, header.TileContentsCount, stats.TileContentsCount)
+	assert.Equal(t, uint64(5), stats.AddressedTilesCount)
+	assert.Equal(t, uint64(3), stats.TileContentsCount)
+
+	assert.Equal(t, 2, len(stats.Zooms))
+	assert.Equal(t, ZoomStats{Zoom: 0, TileCount: 1, UniqueContents: 1, DeduplicationRatio: 1, TotalBytes: 1, MinSize: 1, MaxSize: 1, AvgSize: 1, P95Size: 1}, stats.Zooms[0])
+	assert.Equal(t, ZoomStats{Zoom: 1, TileCount: 4, UniqueContents: 2, DeduplicationRatio: 0.5, TotalBytes: 7, MinSize: 1, MaxSize: 2, AvgSize: 1.75, P95Size: 2}, stats.Zooms[1])
+
+	_, err = json.Marshal(stats)
+	assert.Nil(t, err)
+}
+
+func TestStatsRunAcrossZooms(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Deduplicate: true, TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+	assert.Nil(t, w.AddTile(0, 0, 0, []byte{0x1}))
+	assert.Nil(t, w.AddTile(1, 0, 0, []byte{0x1}))
+	header, err := w.Finalize(HeaderV3{TileType: Png}, map[string]interface{}{})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), header.TileEntriesCount)
+
+	path := filepath.Join(t.TempDir(), "stats.pmtiles")
+	assert.Nil(t, os.WriteFile(path, b.Bytes(), 0666))
+
+	stats, err := Stats(path)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stats.Zooms))
+	assert.Equal(t, uint64(1), stats.Zooms[0].TileCount)
+	assert.Equal(t, uint64(1), stats.Zooms[1].TileCount)
+	assert.Equal(t, uint64(1), stats.Zooms[1].UniqueContents)
+}
+
+func TestCountTiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "count.pmtiles")
+	writeTestArchive(t, path, NoCompression, Png, nil, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}, {1, 0, 1, "b"}, {1, 1, 1, "c"}})
+
+	addressed, unique, entries, err := CountTiles(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), addressed)
+	assert.Equal(t, uint64(3), unique)
+	recounted, recountedUnique, recountedEntries, err := RecountTiles(path)
+	assert.Nil(t, err)
+	assert.Equal(t, addressed, recounted)
+	assert.Equal(t, unique, recountedUnique)
+	assert.Equal(t, entries, recountedEntries)
+
+	// an archive without counts in its header
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	header, err := DeserializeHeader(data[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	header.AddressedTilesCount, header.TileContentsCount, header.TileEntriesCount = 0, 0, 0
+	copy(data, SerializeHeader(header))
+	assert.Nil(t, os.WriteFile(path, data, 0666))
+	addressed, _, _, err = CountTiles(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), addressed)
+	addressed, unique, _, err = RecountTiles(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4), addressed)
+	assert.Equal(t, uint64(3), unique)
+
+	_, _, _, err = CountTiles(filepath.Join(t.TempDir(), "missing.pmtiles"))
+	assert.Error(t, err)
+}
+
+func TestListZoomLevels(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "zooms.pmtiles")
+	writeTestArchive(t, path, NoCompression, Png, nil, []testTile{{0, 0, 0, "a"}, {2, 0, 0, "b"}, {2, 0, 1, "b"}, {3, 7, 7, "c"}})
+	zooms, err := ListZoomLevels(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{0, 2, 3}, zooms)
+
+	// with leaf directories
+	tiles := []testTile{{0, 0, 0, "a"}}
+	for i := ZxyToID(7, 0, 0); i < ZxyToID(8, 0, 0); i++ {
+		z, x, y := IDToZxy(i)
+		tiles = append(tiles, testTile{z, x, y, fmt.Sprint(i)})
+	}
+	tiles = append(tiles, testTile{9, 0, 0, "b"})
+	writeTestArchive(t, path, NoCompression, Png, nil, tiles)
+	header, _, _ := readTestArchiveTiles(t, path)
+	assert.Greater(t, header.LeafDirectoryLength, uint64(0))
+	zooms, err = ListZoomLevels(path)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint8{0, 7, 9}, zooms)
+}
+
+func TestCorruptTileID(t *testing.T) {
+	root := SerializeEntries([]EntryV3{{tileIDLimit + 5, 0, 1, 1}}, NoCompression)
+	header := HeaderV3{
+		SpecVersion:         3,
+		RootOffset:          HeaderV3LenBytes,
+		RootLength:          uint64(len(root)),
+		MetadataOffset:      HeaderV3LenBytes + uint64(len(root)),
+		TileDataOffset:      HeaderV3LenBytes + uint64(len(root)),
+		TileDataLength:      1,
+		InternalCompression: NoCompression,
+		TileType:            Png,
+		MaxZoom:             MaxTileZoom,
+	}
+	archive := append(SerializeHeader(header), root...)
+	archive = append(archive, 0x1)
+	path := filepath.Join(t.TempDir(), "corrupt.pmtiles")
+	assert.Nil(t, os.WriteFile(path, archive, 0666))
+
+	_, err := Stats(path)
+	assert.Error(t, err)
+	_, err = ListZoomLevels(path)
+	assert.Error(t, err)
+	_, _, err = FixHeader(path, true, true)
+	assert.Error(t, err)
+	_, _, _, _, err = CalculateBounds(path)
+	assert.Error(t, err)
+}
+
+func TestSampleDeduplication(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup.pmtiles")
+	writeTestArchive(t, path, NoCompression, Png, nil, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}, {1, 0, 1, "b"}, {1, 1, 1, "b"}})
+	ratio, err := SampleDeduplication(path, 1)
+	assert.Nil(t, err)
+	assert.InDelta(t, 0.5, ratio, 1e-9)
+
+	_, err = SampleDeduplication(path, 0)
+	assert.Error(t, err)
+
+	resolve := newResolver(true, NoCompression)
+	assert.Equal(t, 0.0, resolve.DeduplicationRatio())
+	for i, data := range []string{"a", "b", "b", "b"} {
+		_, _, err := resolve.AddTileIsNew(uint64(i), []byte(data), 1)
+		assert.Nil(t, err)
+	}
+	assert.InDelta(t, 0.5, resolve.DeduplicationRatio(), 1e-9)
+}
+
+func TestCompressionStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "compression.pmtiles")
+	tiles := []testTile{{0, 0, 0, strings.Repeat("a", 1000)}, {1, 0, 0, strings.Repeat("b", 2000)}, {1, 1, 1, fmt.Sprint(rand.Int63())}}
+	writeTestArchive(t, path, Gzip, Mvt, nil, tiles)
+
+	stats, err := CompressionStats(path, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(stats))
+	assert.Equal(t, uint8(0), stats[0].Zoom)
+	assert.Equal(t, uint64(1), stats[0].SampledTiles)
+	assert.Equal(t, uint64(1000), stats[0].UncompressedBytes)
+	assert.Greater(t, stats[0].MinRatio, 10.0)
+	assert.Equal(t, stats[0].MinRatio, stats[0].AvgRatio)
+
+	assert.Equal(t, uint64(2), stats[1].SampledTiles)
+	assert.Less(t, stats[1].MinRatio, 1.0)
+	assert.Greater(t, stats[1].MaxRatio, 10.0)
+	assert.InDelta(t, (stats[1].MinRatio+stats[1].MaxRatio)/2, stats[1].AvgRatio, 1e-9)
+
+	_, err = CompressionStats(path, 1.5)
+	assert.Error(t, err)
+}
@@ -1,9 +1,29 @@
 package pmtiles
 
 import (
+	"fmt"
+	"math"
 	"math/bits"
+	"sort"
 )
 
+// MaxTileZoom is the deepest zoom level whose tiles have a TileID.
+const MaxTileZoom = 31
+
+// tileIDLimit is the first TileID past the last tile of MaxTileZoom.
+const tileIDLimit = (1<<64 - 1) / 3
+
+// ValidateTileCoord returns an error if z is deeper than MaxTileZoom or x or y are outside of zoom level z.
+func ValidateTileCoord(z uint8, x uint32, y uint32) error {
+	if z > MaxTileZoom {
+		return fmt.Errorf("zoom %d is greater than %d", z, MaxTileZoom)
+	}
+	if x>>z != 0 || y>>z != 0 {
+		return fmt.Errorf("tile %d/%d/%d out of range", z, x, y)
+	}
+	return nil
+}
+
 func rotate(n uint32, x uint32, y uint32, rx uint32, ry uint32) (uint32, uint32) {
 	if ry == 0 {
 		if rx != 0 {
@@ -16,7 +36,12 @@ func rotate(n uint32, x uint32, y uint32, rx uint32, ry uint32) (uint32, uint32)
 }
 
 // ZxyToID converts (Z,X,Y) tile coordinates to a Hilbert TileID.
+// It panics if ValidateTileCoord rejects the coordinates, except that ZxyToID(MaxTileZoom+1, 0, 0)
+// is the TileID following the last tile of MaxTileZoom, so it can end a range of zoom levels.
 func ZxyToID(z uint8, x uint32, y uint32) uint64 {
+	if x>>z != 0 || y>>z != 0 || z > MaxTileZoom && (z > MaxTileZoom+1 || x != 0 || y != 0) {
+		panic(ValidateTileCoord(z, x, y))
+	}
 	var acc uint64 = (1<<(z*2) - 1) / 3
 	n := uint32(z - 1)
 	for s := uint32(1 << n); s > 0; s >>= 1 {
@@ -30,7 +55,11 @@ func ZxyToID(z uint8, x uint32, y uint32) uint64 {
 }
 
 // IDToZxy converts a Hilbert TileID to (Z,X,Y) tile coordinates.
+// It panics if i is past the last tile of MaxTileZoom.
 func IDToZxy(i uint64) (uint8, uint32, uint32) {
+	if i >= tileIDLimit {
+		panic(fmt.Errorf("tile ID %d is past zoom level %d", i, MaxTileZoom))
+	}
 	var z = uint8(bits.Len64(3*i+1)-1) / 2
 	var acc = (uint64(1)<<(z*2) - 1) / 3
 	var t = i - acc
@@ -47,6 +76,25 @@ func IDToZxy(i uint64) (uint8, uint32, uint32) {
 	return uint8(z), tx, ty
 }
 
+// idToZxyChecked converts a Hilbert TileID to (Z,X,Y) tile coordinates like IDToZxy,
+// returning an error instead of panicking if i is past the last tile of MaxTileZoom.
+func idToZxyChecked(i uint64) (uint8, uint32, uint32, error) {
+	if i >= tileIDLimit {
+		return 0, 0, 0, fmt.Errorf("tile ID %d is past zoom level %d", i, MaxTileZoom)
+	}
+	z, x, y := IDToZxy(i)
+	return z, x, y, nil
+}
+
+// checkEntryTileIDs returns an error if the entry, read from a possibly corrupt directory,
+// addresses a TileID past the last tile of MaxTileZoom.
+func checkEntryTileIDs(e EntryV3) error {
+	if e.TileID >= tileIDLimit || uint64(e.RunLength) > tileIDLimit-e.TileID {
+		return fmt.Errorf("entry of tile ID %d and run length %d is past zoom level %d", e.TileID, e.RunLength, MaxTileZoom)
+	}
+	return nil
+}
+
 // ParentID efficiently finds a parent Hilbert TileID without converting to (Z,X,Y).
 func ParentID(i uint64) uint64 {
 	var z = uint8(64-bits.LeadingZeros64(3*i+1)-1) / 2
@@ -54,3 +102,144 @@ func ParentID(i uint64) uint64 {
 	var parentAcc uint64 = (1<<((z-1)*2) - 1) / 3
 	return parentAcc + (i-acc)/4
 }
+
+// IDRange is an inclusive range of TileIDs.
+type IDRange struct {
+	Min uint64
+	Max uint64
+}
+
+// TileIDRange returns the first and last TileIDs of the descendants at zoom targetZ of the tile z/x/y,
+// or of the tile itself if targetZ is z. The Hilbert curve covers a tile entirely before leaving it,
+// so every TileID between minID and maxID is a descendant, and the entries of a tile at targetZ
+// can be found by binary searching a directory for minID.
+// It panics if ValidateTileCoord rejects the coordinates or targetZ is not between z and MaxTileZoom.
+func TileIDRange(z uint8, targetZ uint8, x uint32, y uint32) (minID uint64, maxID uint64) {
+	if targetZ < z || targetZ > MaxTileZoom {
+		panic(fmt.Errorf("target zoom %d is not between %d and %d", targetZ, z, MaxTileZoom))
+	}
+	id := ZxyToID(z, x, y)
+	shift := 2 * (targetZ - z)
+	minID = (uint64(1)<<(targetZ*2)-1)/3 + (id-(uint64(1)<<(z*2)-1)/3)<<shift
+	return minID, minID + 1<<shift - 1
+}
+
+// DescendantIDRanges returns the TileID ranges of the tile z/x/y and of its descendants down to maxZ,
+// one per zoom level, as the tiles of other zoom levels lie between them.
+// It panics like TileIDRange.
+func DescendantIDRanges(z uint8, maxZ uint8, x uint32, y uint32) []IDRange {
+	ranges := make([]IDRange, 0, int(maxZ)-int(z)+1)
+	for targetZ := int(z); targetZ <= int(maxZ); targetZ++ {
+		minID, maxID := TileIDRange(z, uint8(targetZ), x, y)
+		ranges = append(ranges, IDRange{minID, maxID})
+	}
+	return ranges
+}
+
+// bboxTiles are the tiles between two zoom levels that share a non-empty area with a lon/lat rectangle.
+type bboxTiles struct {
+	minZoom uint8
+	maxZoom uint8
+	ranges  [MaxTileZoom + 1]struct {
+		minX, minY, maxX, maxY uint32
+		ok                     bool
+	}
+}
+
+// newBboxTiles returns the tiles between minZoom and maxZoom inclusive sharing a non-empty area with the rectangle.
+// maxZoom must not be greater than MaxTileZoom.
+func newBboxTiles(minLon float64, minLat float64, maxLon float64, maxLat float64, minZoom uint8, maxZoom uint8) *bboxTiles {
+	b := &bboxTiles{minZoom: minZoom, maxZoom: maxZoom}
+	for z := int(minZoom); z <= int(maxZoom); z++ {
+		r := &b.ranges[z]
+		r.minX, r.minY, r.maxX, r.maxY, r.ok = bboxTileRange(uint8(z), minLon, minLat, maxLon, maxLat)
+	}
+	return b
+}
+
+// spans calls emit with the first and last TileID of the spans of tiles between start and end, exclusive,
+// in increasing order, until emit returns false. A span may end where the next one starts.
+// The quadtree of each zoom level is only descended along the edges of the rectangle and the range,
+// as a tile inside both covers a contiguous range of TileIDs at any deeper zoom level.
+func (b *bboxTiles) spans(start uint64, end uint64, emit func(first uint64, last uint64) bool) bool {
+	if end-start == 1 && start < tileIDLimit {
+		// a single tile, as most entries are
+		z, x, y := IDToZxy(start)
+		r := b.ranges[z]
+		if z < b.minZoom || z > b.maxZoom || !r.ok || x < r.minX || x > r.maxX || y < r.minY || y > r.maxY {
+			return true
+		}
+		return emit(start, start)
+	}
+	for z := int(b.minZoom); z <= int(b.maxZoom); z++ {
+		r := b.ranges[z]
+		if !r.ok || end <= ZxyToID(uint8(z), 0, 0) || start >= ZxyToID(uint8(z+1), 0, 0) {
+			continue
+		}
+		var descend func(lz uint8, lx uint32, ly uint32) bool
+		descend = func(lz uint8, lx uint32, ly uint32) bool {
+			minID, maxID := TileIDRange(lz, uint8(z), lx, ly)
+			if maxID < start || minID >= end {
+				return true
+			}
+			shift := uint8(z) - lz
+			x0, y0 := lx<<shift, ly<<shift
+			x1, y1 := x0+(1<<shift-1), y0+(1<<shift-1)
+			if x1 < r.minX || x0 > r.maxX || y1 < r.minY || y0 > r.maxY {
+				return true
+			}
+			if x0 >= r.minX && x1 <= r.maxX && y0 >= r.minY && y1 <= r.maxY {
+				return emit(max(minID, start), min(maxID, end-1))
+			}
+			// visit the children in TileID order
+			children := [4][2]uint32{{2 * lx, 2 * ly}, {2*lx + 1, 2 * ly}, {2 * lx, 2*ly + 1}, {2*lx + 1, 2*ly + 1}}
+			sort.Slice(children[:], func(i, j int) bool {
+				return ZxyToID(lz+1, children[i][0], children[i][1]) < ZxyToID(lz+1, children[j][0], children[j][1])
+			})
+			for _, c := range children {
+				if !descend(lz+1, c[0], c[1]) {
+					return false
+				}
+			}
+			return true
+		}
+		if !descend(0, 0, 0) {
+			return false
+		}
+	}
+	return true
+}
+
+// any reports whether a tile lies between start and end, exclusive.
+func (b *bboxTiles) any(start uint64, end uint64) bool {
+	found := false
+	b.spans(start, end, func(uint64, uint64) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// bboxTileRange returns the inclusive range of tile columns and rows at zoom z that share
+// a non-empty area with the given lon/lat rectangle.
+// ok is false if no tile does.
+func bboxTileRange(z uint8, minLon float64, minLat float64, maxLon float64, maxLat float64) (minX uint32, minY uint32, maxX uint32, maxY uint32, ok bool) {
+	n := float64(uint64(1) << z)
+	lonToX := func(lon float64) float64 {
+		return (lon + 180) / 360 * n
+	}
+	latToY := func(lat float64) float64 {
+		lat = math.Max(-85.0511287798066, math.Min(85.0511287798066, lat)) * math.Pi / 180
+		return (1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n
+	}
+	clamp := func(v float64) float64 {
+		return math.Max(0, math.Min(n-1, v))
+	}
+
+	x0, x1 := lonToX(minLon), lonToX(maxLon)
+	y0, y1 := latToY(maxLat), latToY(minLat)
+	if x1 <= 0 || x0 >= n || y1 <= 0 || y0 >= n || x0 >= x1 || y0 >= y1 {
+		return 0, 0, 0, 0, false
+	}
+	return uint32(clamp(math.Floor(x0))), uint32(clamp(math.Floor(y0))), uint32(clamp(math.Ceil(x1) - 1)), uint32(clamp(math.Ceil(y1) - 1)), true
+}
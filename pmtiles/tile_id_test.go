@@ -1,6 +1,8 @@
 package pmtiles
 
 import (
+	"math"
+	"math/rand"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -34,7 +36,11 @@ func TestManyTileIds(t *testing.T) {
 	var z uint8
 	var x uint32
 	var y uint32
-	for z = 0; z < 10; z++ {
+	maxZoom := uint8(14)
+	if testing.Short() {
+		maxZoom = 9
+	}
+	for z = 0; z <= maxZoom; z++ {
 		for x = 0; x < (1 << z); x++ {
 			for y = 0; y < (1 << z); y++ {
 				id := ZxyToID(z, x, y)
@@ -47,6 +53,44 @@ func TestManyTileIds(t *testing.T) {
 	}
 }
 
+func TestRandomTileIds(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for z := uint8(15); z <= 28; z++ {
+		for i := 0; i < 10000; i++ {
+			x := uint32(r.Int63n(1 << z))
+			y := uint32(r.Int63n(1 << z))
+			rz, rx, ry := IDToZxy(ZxyToID(z, x, y))
+			if !(z == rz && x == rx && y == ry) {
+				t.Fatalf(`fail on %d %d %d`, z, x, y)
+			}
+		}
+	}
+}
+
+func TestValidateTileCoord(t *testing.T) {
+	assert.Nil(t, ValidateTileCoord(0, 0, 0))
+	assert.Nil(t, ValidateTileCoord(3, 7, 7))
+	assert.Nil(t, ValidateTileCoord(31, 1<<31-1, 1<<31-1))
+	assert.Error(t, ValidateTileCoord(0, 1, 0))
+	assert.Error(t, ValidateTileCoord(3, 8, 0))
+	assert.Error(t, ValidateTileCoord(3, 0, 8))
+	assert.Error(t, ValidateTileCoord(32, 0, 0))
+}
+
+func TestInvalidTileIds(t *testing.T) {
+	assert.Panics(t, func() { ZxyToID(1, 2, 0) })
+	assert.Panics(t, func() { ZxyToID(1, 0, 2) })
+	assert.Panics(t, func() { ZxyToID(32, 1, 0) })
+	assert.Panics(t, func() { ZxyToID(33, 0, 0) })
+	assert.Panics(t, func() { IDToZxy(ZxyToID(32, 0, 0)) })
+	assert.Panics(t, func() { IDToZxy(math.MaxUint64) })
+
+	// the end of the last zoom level
+	assert.Equal(t, ZxyToID(31, 0, 0)+1<<62, ZxyToID(32, 0, 0))
+	z, _, _ := IDToZxy(ZxyToID(32, 0, 0) - 1)
+	assert.Equal(t, uint8(31), z)
+}
+
 func TestExtremes(t *testing.T) {
 	var tz uint8
 	for tz = 0; tz < 32; tz++ {
@@ -99,6 +143,43 @@ func TestParent(t *testing.T) {
 	assert.Equal(t, ZxyToID(18, 2, 500), ParentID(ZxyToID(19, 4, 1000)))
 }
 
+func TestTileIDRange(t *testing.T) {
+	minID, maxID := TileIDRange(0, 0, 0, 0)
+	assert.Equal(t, uint64(0), minID)
+	assert.Equal(t, uint64(0), maxID)
+	minID, maxID = TileIDRange(0, 1, 0, 0)
+	assert.Equal(t, uint64(1), minID)
+	assert.Equal(t, uint64(4), maxID)
+
+	for z := uint8(0); z <= 3; z++ {
+		for x := uint32(0); x < 1<<z; x++ {
+			for y := uint32(0); y < 1<<z; y++ {
+				for targetZ := z; targetZ <= 6; targetZ++ {
+					minID, maxID := TileIDRange(z, targetZ, x, y)
+					d := targetZ - z
+					assert.Equal(t, uint64(1)<<(2*d), maxID-minID+1)
+					for cx := uint32(0); cx < 1<<d; cx++ {
+						for cy := uint32(0); cy < 1<<d; cy++ {
+							id := ZxyToID(targetZ, x<<d+cx, y<<d+cy)
+							assert.True(t, id >= minID && id <= maxID)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	minID, maxID = TileIDRange(MaxTileZoom, MaxTileZoom, 1<<MaxTileZoom-1, 0)
+	assert.Equal(t, uint64(tileIDLimit-1), minID)
+	assert.Equal(t, minID, maxID)
+	assert.Panics(t, func() { TileIDRange(2, 1, 0, 0) })
+	assert.Panics(t, func() { TileIDRange(1, 2, 2, 0) })
+}
+
+func TestDescendantIDRanges(t *testing.T) {
+	assert.Equal(t, []IDRange{{2, 2}, {9, 12}, {37, 52}}, DescendantIDRanges(1, 3, 0, 1))
+}
+
 func BenchmarkZxyToId(b *testing.B) {
 	for n := 0; n < b.N; n++ {
 		for z := uint8(0); z < 15; z += 1 {
@@ -122,6 +203,19 @@ func BenchmarkIdToZxy(b *testing.B) {
 	}
 }
 
+func BenchmarkZxyRoundTrip(b *testing.B) {
+	for n := 0; n < b.N; n++ {
+		for z := uint8(0); z < 15; z += 1 {
+			s := uint32(1 << z)
+			for x := uint32(0); x < s; x += 13 {
+				for y := uint32(0); y < s; y += 13 {
+					_, _, _ = IDToZxy(ZxyToID(z, x, y))
+				}
+			}
+		}
+	}
+}
+
 func BenchmarkParentId(b *testing.B) {
 	end := ZxyToID(15, 0, 0)
 	b.ResetTimer()
@@ -131,3 +225,51 @@ func BenchmarkParentId(b *testing.B) {
 		}
 	}
 }
+
+func TestBboxTilesSpans(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		minLon, minLat := r.Float64()*360-180, r.Float64()*170-85
+		maxLon, maxLat := minLon+r.Float64()*90, minLat+r.Float64()*45
+		tiles := newBboxTiles(minLon, minLat, maxLon, maxLat, 1, 6)
+		end := ZxyToID(7, 0, 0)
+		start := uint64(r.Int63n(int64(end)))
+		if i%2 == 1 {
+			// a single tile
+			end = start + 1
+		}
+
+		expected := make(map[uint64]bool)
+		for id := start; id < end; id++ {
+			z, x, y := IDToZxy(id)
+			minX, minY, maxX, maxY, ok := bboxTileRange(z, minLon, minLat, maxLon, maxLat)
+			if z >= 1 && ok && x >= minX && x <= maxX && y >= minY && y <= maxY {
+				expected[id] = true
+			}
+		}
+		result := make(map[uint64]bool)
+		next := uint64(0)
+		tiles.spans(start, end, func(first uint64, last uint64) bool {
+			assert.GreaterOrEqual(t, first, next)
+			assert.LessOrEqual(t, first, last)
+			for id := first; id <= last; id++ {
+				result[id] = true
+			}
+			next = last + 1
+			return true
+		})
+		assert.Equal(t, expected, result)
+		assert.Equal(t, len(expected) > 0, tiles.any(start, end))
+	}
+}
+
+func TestBboxTilesMaxZoom(t *testing.T) {
+	tiles := newBboxTiles(1, 1, 1.0001, 1.0001, MaxTileZoom, MaxTileZoom)
+	count := uint64(0)
+	tiles.spans(0, math.MaxUint64, func(first uint64, last uint64) bool {
+		count += last - first + 1
+		return true
+	})
+	minX, minY, maxX, maxY, _ := bboxTileRange(MaxTileZoom, 1, 1, 1.0001, 1.0001)
+	assert.Equal(t, uint64(maxX-minX+1)*uint64(maxY-minY+1), count)
+}
@@ -2,10 +2,23 @@ package pmtiles
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
 )
 
 // CreateTileJSON returns TileJSON from an archive header+metadata and a given public tileURL.
 func CreateTileJSON(header HeaderV3, metadataBytes []byte, tileURL string) ([]byte, error) {
+	if tileURL == "" {
+		tileURL = "https://example.com"
+	}
+	return json.MarshalIndent(tileJSON(header, metadataBytes, tileURL+"/{z}/{x}/{y}"+headerExt(header)), "", "\t")
+}
+
+// tileJSON returns the fields of the TileJSON of an archive whose tiles are at the URL template tiles.
+func tileJSON(header HeaderV3, metadataBytes []byte, tiles string) map[string]interface{} {
 	var metadataMap map[string]interface{}
 	json.Unmarshal(metadataBytes, &metadataMap)
 
@@ -14,11 +27,7 @@ func CreateTileJSON(header HeaderV3, metadataBytes []byte, tileURL string) ([]by
 	tilejson["tilejson"] = "3.0.0"
 	tilejson["scheme"] = "xyz"
 
-	if tileURL == "" {
-		tileURL = "https://example.com"
-	}
-
-	tilejson["tiles"] = []string{tileURL + "/{z}/{x}/{y}" + headerExt(header)}
+	tilejson["tiles"] = []string{tiles}
 	tilejson["vector_layers"] = metadataMap["vector_layers"]
 
 	if val, ok := metadataMap["attribution"]; ok {
@@ -43,5 +52,221 @@ func CreateTileJSON(header HeaderV3, metadataBytes []byte, tileURL string) ([]by
 	tilejson["minzoom"] = header.MinZoom
 	tilejson["maxzoom"] = header.MaxZoom
 
-	return json.MarshalIndent(tilejson, "", "\t")
+	return tilejson
+}
+
+// directoryTileJSON returns the TileJSON of a tile directory extracted from an archive,
+// with tiles named by paths at baseURL, or relative to the TileJSON if it is empty.
+// vector_layers is omitted if the metadata has none.
+func directoryTileJSON(header HeaderV3, metadataBytes []byte, baseURL string, paths tilePaths) ([]byte, error) {
+	tiles := paths.template
+	if baseURL != "" {
+		tiles = strings.TrimSuffix(baseURL, "/") + "/" + tiles
+	}
+	tilejson := tileJSON(header, metadataBytes, tiles)
+	if paths.tms {
+		tilejson["scheme"] = "tms"
+	}
+	if tilejson["vector_layers"] == nil {
+		delete(tilejson, "vector_layers")
+	}
+	data, err := json.MarshalIndent(tilejson, "", "\t")
+	if err != nil {
+		return nil, err
+	}
+	if err := validateTileJSON(data); err != nil {
+		return nil, fmt.Errorf("Invalid TileJSON, %w", err)
+	}
+	return data, nil
+}
+
+// validateTileJSON checks the fields of a TileJSON document that the 3.0.0 specification requires or constrains.
+func validateTileJSON(data []byte) error {
+	var tilejson map[string]interface{}
+	if err := json.Unmarshal(data, &tilejson); err != nil {
+		return err
+	}
+	if version, ok := tilejson["tilejson"].(string); !ok || !strings.HasPrefix(version, "3.") {
+		return fmt.Errorf("tilejson must be a 3.x.x version string")
+	}
+	tiles, ok := tilejson["tiles"].([]interface{})
+	if !ok || len(tiles) == 0 {
+		return fmt.Errorf("tiles must be a non-empty array")
+	}
+	for _, tile := range tiles {
+		if _, ok := tile.(string); !ok {
+			return fmt.Errorf("tiles must be an array of strings")
+		}
+	}
+	if scheme, ok := tilejson["scheme"]; ok && scheme != "xyz" && scheme != "tms" {
+		return fmt.Errorf("scheme must be xyz or tms")
+	}
+
+	zooms := map[string]float64{"minzoom": 0, "maxzoom": 30}
+	for _, key := range []string{"minzoom", "maxzoom"} {
+		value, ok := tilejson[key]
+		if !ok {
+			continue
+		}
+		zoom, ok := value.(float64)
+		if !ok || zoom < 0 || zoom > 30 || zoom != float64(int(zoom)) {
+			return fmt.Errorf("%s must be an integer from 0 to 30", key)
+		}
+		zooms[key] = zoom
+	}
+	if zooms["minzoom"] > zooms["maxzoom"] {
+		return fmt.Errorf("minzoom must not be greater than maxzoom")
+	}
+
+	if value, ok := tilejson["bounds"]; ok {
+		bounds, ok := jsonNumbers(value, 4)
+		if !ok || bounds[0] < -180 || bounds[2] > 180 || bounds[1] < -90 || bounds[3] > 90 || bounds[1] > bounds[3] {
+			return fmt.Errorf("bounds must be [left, bottom, right, top] in WGS84 degrees")
+		}
+	}
+	if value, ok := tilejson["center"]; ok {
+		center, ok := jsonNumbers(value, 3)
+		if !ok || center[0] < -180 || center[0] > 180 || center[1] < -90 || center[1] > 90 {
+			return fmt.Errorf("center must be [longitude, latitude, zoom] in WGS84 degrees")
+		}
+	}
+	if value, ok := tilejson["vector_layers"]; ok && !validVectorLayers(value) {
+		return fmt.Errorf("vector_layers must be an array of objects with an id")
+	}
+	return nil
+}
+
+// ValidationWarning is a malformed or missing field of archive metadata found by ValidateMetadata.
+type ValidationWarning struct {
+	Key     string
+	Message string
+}
+
+func (w ValidationWarning) String() string {
+	return w.Key + " " + w.Message
+}
+
+// ValidateMetadata checks the fields of archive metadata that TileJSON 3.0.0 and MBTiles describe,
+// returning a warning for each problem: name must be a non-empty string, bounds 4 and center 3 numbers in range,
+// minzoom and maxzoom integers from 0 to 30, vector_layers objects with an id and fields,
+// and format a known tile format. Numbers may also be strings, as MBTiles metadata values are.
+func ValidateMetadata(metadata map[string]interface{}) []ValidationWarning {
+	var warnings []ValidationWarning
+	warn := func(key string, message string) {
+		warnings = append(warnings, ValidationWarning{key, message})
+	}
+
+	if name, ok := metadata["name"].(string); !ok || name == "" {
+		warn("name", "must be a non-empty string")
+	}
+
+	zooms := map[string]float64{"minzoom": 0, "maxzoom": 30}
+	for _, key := range []string{"minzoom", "maxzoom"} {
+		value, ok := metadata[key]
+		if !ok {
+			continue
+		}
+		zoom, ok := metadataNumber(value)
+		if !ok || zoom < 0 || zoom > 30 || zoom != math.Trunc(zoom) {
+			warn(key, "must be an integer from 0 to 30")
+			continue
+		}
+		zooms[key] = zoom
+	}
+	if zooms["minzoom"] > zooms["maxzoom"] {
+		warn("minzoom", "must not be greater than maxzoom")
+	}
+
+	if value, ok := metadata["bounds"]; ok {
+		bounds, ok := metadataNumbers(value, 4)
+		if !ok || bounds[0] < -180 || bounds[2] > 180 || bounds[1] < -90 || bounds[3] > 90 || bounds[0] > bounds[2] || bounds[1] > bounds[3] {
+			warn("bounds", "must be [left, bottom, right, top] in WGS84 degrees")
+		}
+	}
+	if value, ok := metadata["center"]; ok {
+		center, ok := metadataNumbers(value, 3)
+		if !ok || center[0] < -180 || center[0] > 180 || center[1] < -90 || center[1] > 90 {
+			warn("center", "must be [longitude, latitude, zoom] in WGS84 degrees")
+		}
+	}
+
+	if value, ok := metadata["vector_layers"]; ok {
+		layers, ok := value.([]interface{})
+		if !ok {
+			warn("vector_layers", "must be an array")
+		}
+		for i, layer := range layers {
+			object, ok := layer.(map[string]interface{})
+			if !ok {
+				warn(fmt.Sprintf("vector_layers[%d]", i), "must be an object")
+				continue
+			}
+			if id, ok := object["id"].(string); !ok || id == "" {
+				warn(fmt.Sprintf("vector_layers[%d].id", i), "must be a non-empty string")
+			}
+			if _, ok := object["fields"].(map[string]interface{}); !ok {
+				warn(fmt.Sprintf("vector_layers[%d].fields", i), "must be an object")
+			}
+		}
+	}
+
+	if value, ok := metadata["format"]; ok {
+		if format, ok := value.(string); !ok || extensionToTileType(format) == UnknownTileType {
+			warn("format", "must be one of pbf, png, jpg, webp or avif")
+		}
+	}
+	return warnings
+}
+
+// logMetadataWarnings logs the warnings of ValidateMetadata for the metadata of a conversion.
+func logMetadataWarnings(logger *log.Logger, metadata map[string]interface{}) {
+	for _, warning := range ValidateMetadata(metadata) {
+		logger.Printf("WARNING: metadata %s\n", warning)
+	}
+}
+
+// metadataNumber returns a JSON number, or a string holding one, as a float64.
+func metadataNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// metadataNumbers returns value as n numbers if it is a JSON array of n numbers,
+// or a string of n comma-separated numbers.
+func metadataNumbers(value interface{}, n int) ([]float64, bool) {
+	if s, ok := value.(string); ok {
+		parts := strings.Split(s, ",")
+		if len(parts) != n {
+			return nil, false
+		}
+		result := make([]float64, n)
+		for i, part := range parts {
+			if result[i], ok = metadataNumber(part); !ok {
+				return nil, false
+			}
+		}
+		return result, true
+	}
+	return jsonNumbers(value, n)
+}
+
+// jsonNumbers returns value as n numbers if it is a JSON array of n numbers.
+func jsonNumbers(value interface{}, n int) ([]float64, bool) {
+	array, ok := value.([]interface{})
+	if !ok || len(array) != n {
+		return nil, false
+	}
+	result := make([]float64, n)
+	for i, v := range array {
+		if result[i], ok = v.(float64); !ok {
+			return nil, false
+		}
+	}
+	return result, true
 }
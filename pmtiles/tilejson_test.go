@@ -97,3 +97,55 @@ func TestCreateTilejsonOptionalFields(t *testing.T) {
 	assert.NotContains(t, tilejson, "name")
 	assert.NotContains(t, tilejson, "version")
 }
+
+func TestValidateTileJSON(t *testing.T) {
+	assert.Nil(t, validateTileJSON([]byte(`{"tilejson": "3.0.0", "tiles": ["{z}/{x}/{y}.mvt"], "vector_layers": [{"id": "roads"}]}`)))
+	assert.Nil(t, validateTileJSON([]byte(`{"tilejson": "3.0.0", "tiles": ["a"], "minzoom": 2, "maxzoom": 14, "bounds": [-180, -85, 180, 85], "center": [0, 0, 2]}`)))
+
+	for _, invalid := range []string{
+		`{"tiles": ["a"]}`,
+		`{"tilejson": "2.2.0", "tiles": ["a"]}`,
+		`{"tilejson": "3.0.0", "tiles": []}`,
+		`{"tilejson": "3.0.0", "tiles": [1]}`,
+		`{"tilejson": "3.0.0", "tiles": ["a"], "scheme": "quadkey"}`,
+		`{"tilejson": "3.0.0", "tiles": ["a"], "maxzoom": 31}`,
+		`{"tilejson": "3.0.0", "tiles": ["a"], "minzoom": 5, "maxzoom": 4}`,
+		`{"tilejson": "3.0.0", "tiles": ["a"], "bounds": [-190, 0, 0, 10]}`,
+		`{"tilejson": "3.0.0", "tiles": ["a"], "center": [0, 0]}`,
+		`{"tilejson": "3.0.0", "tiles": ["a"], "vector_layers": [{"fields": {}}]}`,
+	} {
+		assert.Error(t, validateTileJSON([]byte(invalid)), invalid)
+	}
+}
+
+func TestValidateMetadata(t *testing.T) {
+	assert.Empty(t, ValidateMetadata(map[string]interface{}{
+		"name":    "test",
+		"format":  "pbf",
+		"minzoom": "0",
+		"maxzoom": float64(14),
+		"bounds":  "-180,-85,180,85",
+		"center":  []interface{}{0.0, 0.0, 2.0},
+		"vector_layers": []interface{}{
+			map[string]interface{}{"id": "water", "fields": map[string]interface{}{}},
+		},
+	}))
+
+	warnings := ValidateMetadata(map[string]interface{}{
+		"format":  "gif",
+		"minzoom": 2.5,
+		"maxzoom": "31",
+		"bounds":  []interface{}{-190.0, 0.0, 10.0, 10.0},
+		"center":  []interface{}{0.0, 0.0},
+		"vector_layers": []interface{}{
+			map[string]interface{}{"id": "water"},
+			"roads",
+		},
+	})
+	var keys []string
+	for _, warning := range warnings {
+		keys = append(keys, warning.Key)
+	}
+	assert.Equal(t, []string{"name", "minzoom", "maxzoom", "bounds", "center", "vector_layers[0].fields", "vector_layers[1]", "format"}, keys)
+	assert.Equal(t, "name must be a non-empty string", warnings[0].String())
+}
@@ -0,0 +1,266 @@
+package pmtiles
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// vectorLayerSamples is the number of tiles at the maximum zoom level decoded to infer vector_layers.
+const vectorLayerSamples = 1000
+
+// protoFields calls fn for each field of the protocol buffers message in data,
+// with the value of varint and fixed-size fields, or the bytes of length-delimited fields.
+func protoFields(data []byte, fn func(field uint64, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("invalid field key")
+		}
+		data = data[n:]
+		var value uint64
+		var bytes []byte
+		switch key & 7 {
+		case 0:
+			value, n = binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("invalid varint")
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("truncated fixed64")
+			}
+			value = binary.LittleEndian.Uint64(data)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return fmt.Errorf("invalid length")
+			}
+			bytes = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("truncated fixed32")
+			}
+			value = uint64(binary.LittleEndian.Uint32(data))
+			data = data[4:]
+		default:
+			return fmt.Errorf("unsupported wire type %d", key&7)
+		}
+		if err := fn(key>>3, value, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mvtValueType returns the vector_layers field type of an MVT value message.
+func mvtValueType(value []byte) (string, error) {
+	valueType := ""
+	err := protoFields(value, func(field uint64, _ uint64, _ []byte) error {
+		switch field {
+		case 1:
+			valueType = "String"
+		case 2, 3, 4, 5, 6:
+			valueType = "Number"
+		case 7:
+			valueType = "Boolean"
+		}
+		return nil
+	})
+	return valueType, err
+}
+
+// addMvtLayers adds the layers of an uncompressed MVT tile, and the types of their attributes, to layers.
+// Attributes with values of several types are "Mixed".
+func addMvtLayers(tile []byte, layers map[string]map[string]string) error {
+	return protoFields(tile, func(field uint64, _ uint64, layer []byte) error {
+		if field != 3 {
+			return nil
+		}
+		var name string
+		var keys, values []string
+		var features [][]byte
+		err := protoFields(layer, func(field uint64, _ uint64, bytes []byte) error {
+			switch field {
+			case 1:
+				name = string(bytes)
+			case 2:
+				features = append(features, bytes)
+			case 3:
+				keys = append(keys, string(bytes))
+			case 4:
+				valueType, err := mvtValueType(bytes)
+				if err != nil {
+					return err
+				}
+				values = append(values, valueType)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		fields, ok := layers[name]
+		if !ok {
+			fields = make(map[string]string)
+			layers[name] = fields
+		}
+		for _, feature := range features {
+			err := protoFields(feature, func(field uint64, _ uint64, tags []byte) error {
+				if field != 2 {
+					return nil
+				}
+				var key string
+				for i := 0; len(tags) > 0; i++ {
+					index, n := binary.Uvarint(tags)
+					if n <= 0 {
+						return fmt.Errorf("invalid tag")
+					}
+					tags = tags[n:]
+					if i%2 == 0 {
+						if index >= uint64(len(keys)) {
+							return fmt.Errorf("tag key %d out of range", index)
+						}
+						key = keys[index]
+						continue
+					}
+					if index >= uint64(len(values)) {
+						return fmt.Errorf("tag value %d out of range", index)
+					}
+					if existing, ok := fields[key]; ok && existing != values[index] {
+						fields[key] = "Mixed"
+					} else {
+						fields[key] = values[index]
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// sampleTileset returns up to n entries for tiles of tileset at its maximum zoom level, spread evenly across them.
+func sampleTileset(tileset *roaring64.Bitmap, n int) []EntryV3 {
+	maxZoom, _, _ := IDToZxy(tileset.Maximum())
+	start := ZxyToID(maxZoom, 0, 0)
+	first := uint64(0)
+	if start > 0 {
+		first = tileset.Rank(start - 1)
+	}
+	total := tileset.GetCardinality() - first
+	count := min(total, uint64(n))
+	samples := make([]EntryV3, 0, count)
+	for i := uint64(0); i < count; i++ {
+		id, err := tileset.Select(first + i*total/count)
+		if err != nil {
+			break
+		}
+		samples = append(samples, EntryV3{TileID: id, RunLength: 1})
+	}
+	return samples
+}
+
+// sampleEntries returns up to n entries with contents at the maximum zoom level of entries, spread evenly across them.
+func sampleEntries(entries []EntryV3, n int) []EntryV3 {
+	var candidates []EntryV3
+	if len(entries) > 0 {
+		maxZoom, _, _ := IDToZxy(entries[len(entries)-1].TileID)
+		start := ZxyToID(maxZoom, 0, 0)
+		for _, e := range entries {
+			if e.TileID >= start && e.Length > 0 {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	count := min(len(candidates), n)
+	samples := make([]EntryV3, 0, count)
+	for i := 0; i < count; i++ {
+		samples = append(samples, candidates[i*len(candidates)/count])
+	}
+	return samples
+}
+
+// validVectorLayers returns whether vectorLayers is an array of objects with an id.
+func validVectorLayers(vectorLayers interface{}) bool {
+	layers, ok := vectorLayers.([]interface{})
+	if !ok {
+		return false
+	}
+	for _, layer := range layers {
+		object, ok := layer.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		if id, ok := object["id"].(string); !ok || id == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// inferVectorLayers sets vector_layers in jsonMetadata from the MVT layers of samples, read with read,
+// unless the metadata already has vector_layers; existing vector_layers are only validated.
+// Tiles are decompressed according to their magic bytes, or with compression if none are recognized.
+func inferVectorLayers(logger *log.Logger, jsonMetadata map[string]interface{}, compression Compression, minZoom uint8, maxZoom uint8, samples []EntryV3, read func(EntryV3) ([]byte, error)) error {
+	if existing, ok := jsonMetadata["vector_layers"]; ok {
+		if !validVectorLayers(existing) {
+			logger.Println("WARNING: vector_layers in metadata is not an array of objects with an id")
+		}
+		return nil
+	}
+
+	layers := make(map[string]map[string]string)
+	for _, entry := range samples {
+		data, err := read(entry)
+		if err != nil {
+			return err
+		}
+		tileCompression := detectCompression(data)
+		if tileCompression == NoCompression && compression == Brotli {
+			tileCompression = Brotli
+		}
+		if tileCompression != NoCompression {
+			data, err = decompressBytes(data, tileCompression)
+			if err != nil {
+				return fmt.Errorf("Failed to decompress tile %d, %w", entry.TileID, err)
+			}
+		}
+		if err := addMvtLayers(data, layers); err != nil {
+			z, x, y := IDToZxy(entry.TileID)
+			logger.Printf("WARNING: skipping tile %d/%d/%d when inferring vector_layers, %v\n", z, x, y, err)
+		}
+	}
+
+	names := make([]string, 0, len(layers))
+	for name := range layers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	vectorLayers := make([]interface{}, 0, len(names))
+	for _, name := range names {
+		fields := make(map[string]interface{}, len(layers[name]))
+		for k, v := range layers[name] {
+			fields[k] = v
+		}
+		vectorLayers = append(vectorLayers, map[string]interface{}{
+			"id":      name,
+			"fields":  fields,
+			"minzoom": float64(minZoom),
+			"maxzoom": float64(maxZoom),
+		})
+	}
+	logger.Printf("Inferred %d vector layers from %d tiles\n", len(vectorLayers), len(samples))
+	jsonMetadata["vector_layers"] = vectorLayers
+	return nil
+}
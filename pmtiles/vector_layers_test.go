@@ -0,0 +1,135 @@
+package pmtiles
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+	"github.com/stretchr/testify/assert"
+)
+
+func appendProtoBytes(b []byte, field uint64, data []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendProtoVarint(b []byte, field uint64, value uint64) []byte {
+	b = binary.AppendUvarint(b, field<<3)
+	return binary.AppendUvarint(b, value)
+}
+
+// testMvtLayer encodes a layer with one feature tagged with each of keys, and values, which are
+// strings, float64 or bool.
+func testMvtLayer(name string, keys []string, values []interface{}) []byte {
+	var layer []byte
+	layer = appendProtoBytes(layer, 1, []byte(name))
+	var tags []byte
+	for i := range keys {
+		tags = binary.AppendUvarint(tags, uint64(i))
+		tags = binary.AppendUvarint(tags, uint64(i))
+	}
+	layer = appendProtoBytes(layer, 2, appendProtoBytes(nil, 2, tags))
+	for _, key := range keys {
+		layer = appendProtoBytes(layer, 3, []byte(key))
+	}
+	for _, value := range values {
+		var encoded []byte
+		switch v := value.(type) {
+		case string:
+			encoded = appendProtoBytes(nil, 1, []byte(v))
+		case float64:
+			encoded = binary.AppendUvarint(nil, 3<<3|1)
+			encoded = binary.LittleEndian.AppendUint64(encoded, math.Float64bits(v))
+		case bool:
+			encoded = appendProtoVarint(nil, 7, 1)
+		}
+		layer = appendProtoBytes(layer, 4, encoded)
+	}
+	return appendProtoVarint(layer, 15, 2)
+}
+
+func testMvtTile(layers ...[]byte) []byte {
+	var tile []byte
+	for _, layer := range layers {
+		tile = appendProtoBytes(tile, 3, layer)
+	}
+	return tile
+}
+
+func TestAddMvtLayers(t *testing.T) {
+	layers := make(map[string]map[string]string)
+	err := addMvtLayers(testMvtTile(
+		testMvtLayer("roads", []string{"name", "lanes", "oneway"}, []interface{}{"Main", 2.0, true}),
+		testMvtLayer("water", nil, nil),
+	), layers)
+	assert.Nil(t, err)
+	err = addMvtLayers(testMvtTile(
+		testMvtLayer("roads", []string{"lanes"}, []interface{}{"two"}),
+	), layers)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]map[string]string{
+		"roads": {"name": "String", "lanes": "Mixed", "oneway": "Boolean"},
+		"water": {},
+	}, layers)
+
+	assert.Error(t, addMvtLayers([]byte{0x1a, 0x10, 0x0}, layers))
+}
+
+func TestValidVectorLayers(t *testing.T) {
+	assert.True(t, validVectorLayers([]interface{}{map[string]interface{}{"id": "roads"}}))
+	assert.False(t, validVectorLayers([]interface{}{map[string]interface{}{"fields": map[string]interface{}{}}}))
+	assert.False(t, validVectorLayers([]interface{}{"roads"}))
+	assert.False(t, validVectorLayers("roads"))
+}
+
+func TestSampleTileset(t *testing.T) {
+	tileset := roaring64.New()
+	tileset.Add(ZxyToID(0, 0, 0))
+	for x := uint32(0); x < 4; x++ {
+		for y := uint32(0); y < 4; y++ {
+			tileset.Add(ZxyToID(2, x, y))
+		}
+	}
+	samples := sampleTileset(tileset, 4)
+	assert.Equal(t, 4, len(samples))
+	for _, s := range samples {
+		z, _, _ := IDToZxy(s.TileID)
+		assert.Equal(t, uint8(2), z)
+	}
+	assert.Equal(t, 16, len(sampleTileset(tileset, 1000)))
+}
+
+func TestConvertInferVectorLayers(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "in.mbtiles")
+	writeTestMbtiles(t, input, 2, func(z, x, y int64) []byte {
+		layer := testMvtLayer("roads", []string{"name"}, []interface{}{"Main"})
+		if z == 2 && x == 1 {
+			return testMvtTile(layer, testMvtLayer("water", []string{"depth"}, []interface{}{1.0}))
+		}
+		return testMvtTile(layer)
+	})
+	tmpfile, err := os.CreateTemp(dir, "pmtiles")
+	assert.Nil(t, err)
+	defer tmpfile.Close()
+	output := filepath.Join(dir, "out.pmtiles")
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, InferVectorLayers: true}, tmpfile)
+	assert.Nil(t, err)
+
+	_, metadata, _ := readTestArchiveTiles(t, output)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"id": "roads", "fields": map[string]interface{}{"name": "String"}, "minzoom": 0.0, "maxzoom": 2.0},
+		map[string]interface{}{"id": "water", "fields": map[string]interface{}{"depth": "Number"}, "minzoom": 0.0, "maxzoom": 2.0},
+	}, metadata["vector_layers"])
+
+	existing := []interface{}{map[string]interface{}{"id": "custom"}}
+	err = Convert(logger, input, output, ConvertOptions{MinZoom: -1, MaxZoom: -1, Force: true, InferVectorLayers: true,
+		Metadata: map[string]interface{}{"vector_layers": existing}}, tmpfile)
+	assert.Nil(t, err)
+	_, metadata, _ = readTestArchiveTiles(t, output)
+	assert.Equal(t, existing, metadata["vector_layers"])
+}
@@ -7,12 +7,29 @@ import (
 	"io"
 	"log"
 	"math"
+	"math/rand"
 	"os"
+	"strings"
 	"time"
 )
 
+// VerificationError lists every problem found by Verify in an archive.
+type VerificationError struct {
+	Violations []string
+}
+
+func (e *VerificationError) Error() string {
+	return fmt.Sprintf("%d problems found: %s", len(e.Violations), strings.Join(e.Violations, "; "))
+}
+
+// number of tiles whose contents are checked to decompress
+const verifySampleSize = 16
+
 // Verify that an archive's header statistics are correct,
-// and that tiles are propertly ordered if clustered=true.
+// that tile IDs are strictly increasing, that every entry is within the tile data section,
+// and that tiles are properly ordered if clustered=true.
+// A sample of tiles is also checked to decompress with the tile compression of the header.
+// Problems with the archive structure are returned together as a *VerificationError.
 func Verify(_ *log.Logger, file string) error {
 	start := time.Now()
 	ctx := context.Background()
@@ -41,51 +58,79 @@ func Verify(_ *log.Logger, file string) error {
 	}
 	r.Close()
 
+	if len(b) < HeaderV3LenBytes {
+		return fmt.Errorf("failed to read %s, archive is shorter than the header", key)
+	}
+
 	header, err := DeserializeHeader(b[0:HeaderV3LenBytes])
 
 	if err != nil {
 		return fmt.Errorf("failed to read %s, %w", key, err)
 	}
 
+	violations := make([]string, 0)
+	violation := func(format string, a ...interface{}) {
+		violations = append(violations, fmt.Sprintf(format, a...))
+	}
+	result := func() error {
+		if len(violations) > 0 {
+			return &VerificationError{violations}
+		}
+		return nil
+	}
+
+	if header.SpecVersion != 3 {
+		violation("spec version %v is not 3", header.SpecVersion)
+	}
+
 	if header.RootOffset == 0 {
-		return fmt.Errorf("Root directory offset=%v must not be 0", header.RootOffset)
+		violation("Root directory offset=%v must not be 0", header.RootOffset)
 	}
 
 	if header.MetadataOffset == 0 {
-		return fmt.Errorf("Metadata offset=%v must not be 0", header.MetadataOffset)
+		violation("Metadata offset=%v must not be 0", header.MetadataOffset)
 	}
 
 	if header.LeafDirectoryOffset == 0 {
-		return fmt.Errorf("Leaf directories offset=%v must not be 0", header.LeafDirectoryOffset)
+		violation("Leaf directories offset=%v must not be 0", header.LeafDirectoryOffset)
 	}
 
 	if header.TileDataOffset == 0 {
-		return fmt.Errorf("Tile data offset=%v must not be 0", header.TileDataOffset)
+		violation("Tile data offset=%v must not be 0", header.TileDataOffset)
 	}
 
-	fileInfo, _ := os.Stat(file)
+	fileInfo, err := os.Stat(file)
+	if err != nil {
+		return fmt.Errorf("failed to stat %s, %w", file, err)
+	}
+	size := uint64(fileInfo.Size())
 
-	if header.RootLength > uint64(fileInfo.Size()) {
-		return fmt.Errorf("Root directory offset=%v length=%v out of bounds", header.RootOffset, header.RootLength)
+	if header.RootOffset+header.RootLength > size {
+		violation("Root directory offset=%v length=%v out of bounds", header.RootOffset, header.RootLength)
 	}
 
-	if header.MetadataLength > uint64(fileInfo.Size()) {
-		return fmt.Errorf("Metadata offset=%v length=%v out of bounds", header.MetadataOffset, header.MetadataLength)
+	if header.MetadataOffset+header.MetadataLength > size {
+		violation("Metadata offset=%v length=%v out of bounds", header.MetadataOffset, header.MetadataLength)
 	}
 
-	if header.LeafDirectoryLength > uint64(fileInfo.Size()) {
-		return fmt.Errorf("Leaf directories offset=%v length=%v out of bounds", header.LeafDirectoryOffset, header.LeafDirectoryLength)
+	if header.LeafDirectoryOffset+header.LeafDirectoryLength > size {
+		violation("Leaf directories offset=%v length=%v out of bounds", header.LeafDirectoryOffset, header.LeafDirectoryLength)
 	}
 
-	if header.TileDataLength > uint64(fileInfo.Size()) {
-		return fmt.Errorf("Tile data offset=%v length=%v out of bounds", header.TileDataOffset, header.TileDataLength)
+	if header.TileDataOffset+header.TileDataLength > size {
+		violation("Tile data offset=%v length=%v out of bounds", header.TileDataOffset, header.TileDataLength)
 	}
 
 	lengthFromHeader := int64(HeaderV3LenBytes + header.RootLength + header.MetadataLength + header.LeafDirectoryLength + header.TileDataLength)
 	lengthFromHeaderWithPadding := int64(16384 + header.MetadataLength + header.LeafDirectoryLength + header.TileDataLength)
 
 	if !(fileInfo.Size() == lengthFromHeader || fileInfo.Size() == lengthFromHeaderWithPadding) {
-		return fmt.Errorf("total length of archive %v does not match header %v or %v (padded)", fileInfo.Size(), lengthFromHeader, lengthFromHeaderWithPadding)
+		violation("total length of archive %v does not match header %v or %v (padded)", fileInfo.Size(), lengthFromHeader, lengthFromHeaderWithPadding)
+	}
+
+	if len(violations) > 0 {
+		// the directories cannot be read reliably
+		return result()
 	}
 
 	var minTileID uint64
@@ -97,9 +142,11 @@ func Verify(_ *log.Logger, file string) error {
 	tileEntries := 0
 	offsets := roaring64.New()
 	var currentOffset uint64
+	var lastEntry *EntryV3
+	samples := make([]EntryV3, 0, verifySampleSize)
 
 	err = IterateEntries(header,
-		func(offset uint64, length uint64) ([]byte, error) {
+		FetchSectionFunc(func(offset uint64, length uint64) ([]byte, error) {
 			reader, err := bucket.NewRangeReader(ctx, key, int64(offset), int64(length))
 			if err != nil {
 				return nil, err
@@ -110,9 +157,8 @@ func Verify(_ *log.Logger, file string) error {
 				return nil, err
 			}
 			return b, nil
-		},
+		}),
 		func(e EntryV3) {
-			offsets.Add(e.Offset)
 			addressedTiles += int(e.RunLength)
 			tileEntries++
 
@@ -123,50 +169,92 @@ func Verify(_ *log.Logger, file string) error {
 				maxTileID = e.TileID
 			}
 
+			if lastEntry != nil && e.TileID < lastEntry.TileID+uint64(lastEntry.RunLength) {
+				violation("entry %v is not after the previous entry %v", e, *lastEntry)
+			}
+			lastEntry = &e
+
 			if e.Offset+uint64(e.Length) > header.TileDataLength {
-				fmt.Printf("Invalid: %v outside of tile data section", e)
+				violation("entry %v outside of tile data section", e)
 			}
 
 			if header.Clustered {
 				if !offsets.Contains(e.Offset) {
 					if e.Offset != currentOffset {
-						fmt.Printf("Invalid: out-of-order entry %v in clustered archive", e)
+						violation("out-of-order entry %v in clustered archive", e)
 					}
-					currentOffset += uint64(e.Length)
+					currentOffset = e.Offset + uint64(e.Length)
 				}
 			}
+			offsets.Add(e.Offset)
+
+			// reservoir sampling of tiles to decompress
+			if len(samples) < verifySampleSize {
+				samples = append(samples, e)
+			} else if i := rand.Intn(tileEntries); i < verifySampleSize {
+				samples[i] = e
+			}
 		})
 
 	if err != nil {
-		return err
+		violation("failed to read directories, %v", err)
+		return result()
+	}
+
+	if header.TileCompression == Gzip || header.TileCompression == Zstd || header.TileCompression == Brotli {
+		for _, e := range samples {
+			if e.Offset+uint64(e.Length) > header.TileDataLength {
+				continue
+			}
+			reader, err := bucket.NewRangeReader(ctx, key, int64(header.TileDataOffset+e.Offset), int64(e.Length))
+			if err != nil {
+				return fmt.Errorf("failed to create range reader for %s, %w", key, err)
+			}
+			data, err := io.ReadAll(reader)
+			reader.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read %s, %w", key, err)
+			}
+			if _, err := decompressBytes(data, header.TileCompression); err != nil {
+				violation("tile %d failed to decompress, %v", e.TileID, err)
+			}
+		}
 	}
 
 	if uint64(addressedTiles) != header.AddressedTilesCount {
-		return fmt.Errorf("invalid: header AddressedTilesCount=%v but %v tiles addressed", header.AddressedTilesCount, addressedTiles)
+		violation("header AddressedTilesCount=%v but %v tiles addressed", header.AddressedTilesCount, addressedTiles)
 	}
 
 	if uint64(tileEntries) != header.TileEntriesCount {
-		return fmt.Errorf("invalid: header TileEntriesCount=%v but %v tile entries", header.TileEntriesCount, tileEntries)
+		violation("header TileEntriesCount=%v but %v tile entries", header.TileEntriesCount, tileEntries)
 	}
 
 	if offsets.GetCardinality() != header.TileContentsCount {
-		return fmt.Errorf("invalid: header TileContentsCount=%v but %v tile contents", header.TileContentsCount, offsets.GetCardinality())
+		violation("header TileContentsCount=%v but %v tile contents", header.TileContentsCount, offsets.GetCardinality())
 	}
 
-	if z, _, _ := IDToZxy(minTileID); z != header.MinZoom {
-		return fmt.Errorf("invalid: header MinZoom=%v does not match min tile z %v", header.MinZoom, z)
-	}
+	if tileEntries > 0 && maxTileID >= tileIDLimit {
+		violation("max tile ID %d is past zoom level %d", maxTileID, MaxTileZoom)
+	} else if tileEntries > 0 {
+		if z, _, _ := IDToZxy(minTileID); z != header.MinZoom {
+			violation("header MinZoom=%v does not match min tile z %v", header.MinZoom, z)
+		}
 
-	if z, _, _ := IDToZxy(maxTileID); z != header.MaxZoom {
-		return fmt.Errorf("invalid: header MaxZoom=%v does not match max tile z %v", header.MaxZoom, z)
+		if z, _, _ := IDToZxy(maxTileID); z != header.MaxZoom {
+			violation("header MaxZoom=%v does not match max tile z %v", header.MaxZoom, z)
+		}
 	}
 
 	if !(header.CenterZoom >= header.MinZoom && header.CenterZoom <= header.MaxZoom) {
-		return fmt.Errorf("invalid: header CenterZoom=%v not within MinZoom/MaxZoom", header.CenterZoom)
+		violation("header CenterZoom=%v not within MinZoom/MaxZoom", header.CenterZoom)
 	}
 
 	if header.MinLonE7 >= header.MaxLonE7 || header.MinLatE7 >= header.MaxLatE7 {
-		return fmt.Errorf("Invalid: bounds has area <= 0: clients may not display tiles correctly")
+		violation("bounds has area <= 0: clients may not display tiles correctly")
+	}
+
+	if err := result(); err != nil {
+		return err
 	}
 
 	fmt.Printf("Completed verify in %v.\n", time.Since(start))
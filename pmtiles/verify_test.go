@@ -0,0 +1,50 @@
+package pmtiles
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.pmtiles")
+	writeTestArchive(t, path, Gzip, Mvt, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}, {1, 0, 1, "b"}})
+	assert.Nil(t, Verify(logger, path))
+}
+
+func TestVerifyViolations(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.pmtiles")
+	writeTestArchive(t, path, Gzip, Mvt, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}, {1, 0, 0, "b"}})
+
+	archive, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	header, err := DeserializeHeader(archive[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	header.AddressedTilesCount = 5
+	header.MaxZoom = 3
+	copy(archive[0:HeaderV3LenBytes], SerializeHeader(header))
+	assert.Nil(t, os.WriteFile(path, archive, 0644))
+
+	err = Verify(logger, path)
+	var verificationError *VerificationError
+	assert.True(t, errors.As(err, &verificationError))
+	assert.Equal(t, 2, len(verificationError.Violations))
+}
+
+func TestVerifyCorruptTile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "archive.pmtiles")
+	writeTestArchive(t, path, Gzip, Mvt, map[string]interface{}{}, []testTile{{0, 0, 0, "a"}})
+
+	archive, err := os.ReadFile(path)
+	assert.Nil(t, err)
+	// corrupt the gzip checksum and size of the only tile
+	archive[len(archive)-1] ^= 0xff
+	archive[len(archive)-5] ^= 0xff
+	assert.Nil(t, os.WriteFile(path, archive, 0644))
+
+	err = Verify(logger, path)
+	var verificationError *VerificationError
+	assert.True(t, errors.As(err, &verificationError))
+}
@@ -0,0 +1,123 @@
+package pmtiles
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// WriterOptions configures how a Writer stores tiles.
+type WriterOptions struct {
+	// Deduplicate identical tile contents so they are stored only once.
+	Deduplicate bool
+	// Compression applied to tiles, Gzip, Zstd or Brotli; gzip or zstd tiles already in that format are stored as-is.
+	// Brotli streams cannot be recognized, so tiles added to a Brotli Writer must be uncompressed.
+	// NoCompression, the default, stores tiles unchanged.
+	Compression Compression
+	// TmpDir is the directory for the temporary tile data file; empty means the OS default.
+	TmpDir string
+	// Logger receives the directory statistics printed on Finalize; nil discards them.
+	Logger *log.Logger
+}
+
+// Writer incrementally builds a clustered PMTiles specification version 3 archive.
+// Tiles must be added in increasing TileID order; tile data is spooled to a
+// temporary file until Finalize writes the complete archive to the output.
+type Writer struct {
+	output      io.Writer
+	logger      *log.Logger
+	compression Compression
+	resolve     *resolver
+	tmpfile     *os.File
+	lastID      uint64
+	finalized   bool
+}
+
+// NewWriter creates a Writer that writes the finished archive to w.
+func NewWriter(w io.Writer, opts WriterOptions) (*Writer, error) {
+	compression := opts.Compression
+	if compression == UnknownCompression {
+		compression = NoCompression
+	}
+	if compression != NoCompression && compression != Gzip && compression != Zstd && compression != Brotli {
+		return nil, fmt.Errorf("tile compression must be none, gzip, zstd or brotli")
+	}
+
+	tmpfile, err := os.CreateTemp(opts.TmpDir, "pmtiles")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create temp file, %w", err)
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.New(io.Discard, "", 0)
+	}
+
+	return &Writer{
+		output:      w,
+		logger:      logger,
+		compression: compression,
+		resolve:     newResolver(opts.Deduplicate, compression),
+		tmpfile:     tmpfile,
+	}, nil
+}
+
+// AddTile adds the contents of the tile at z, x, y.
+// Tiles must be added in strictly increasing TileID order; empty tiles are skipped.
+func (w *Writer) AddTile(z uint8, x uint32, y uint32, data []byte) error {
+	if w.finalized {
+		return fmt.Errorf("cannot add tile to finalized writer")
+	}
+	if err := ValidateTileCoord(z, x, y); err != nil {
+		return err
+	}
+
+	tileID := ZxyToID(z, x, y)
+	if len(w.resolve.Entries) > 0 && tileID <= w.lastID {
+		return fmt.Errorf("tile %d/%d/%d (id %d) added out of order after id %d", z, x, y, tileID, w.lastID)
+	}
+
+	if len(data) == 0 {
+		return nil
+	}
+
+	isNew, newData, err := w.resolve.AddTileIsNew(tileID, data, 1)
+	if err != nil {
+		return err
+	}
+	if isNew {
+		if _, err := w.tmpfile.Write(newData); err != nil {
+			return fmt.Errorf("Failed to write to tempfile, %w", err)
+		}
+	}
+	w.lastID = tileID
+	return nil
+}
+
+// Finalize writes the complete archive to the output.
+// The header supplies the tile type, bounds, center and optionally InternalCompression
+// (default Gzip); offsets, counts, zoom levels and tile compression are computed by the writer.
+func (w *Writer) Finalize(header HeaderV3, metadata map[string]interface{}) (HeaderV3, error) {
+	if w.finalized {
+		return header, fmt.Errorf("writer is already finalized")
+	}
+	if len(w.resolve.Entries) == 0 {
+		return header, fmt.Errorf("cannot finalize an archive with no tiles")
+	}
+	w.finalized = true
+
+	if w.compression != NoCompression {
+		header.TileCompression = w.compression
+	} else if header.TileCompression == UnknownCompression {
+		header.TileCompression = NoCompression
+	}
+
+	return writeArchive(w.logger, w.resolve, header, w.tmpfile, w.output, metadata)
+}
+
+// Close removes the temporary tile data file. It does not close the output.
+func (w *Writer) Close() error {
+	w.tmpfile.Close()
+	return os.Remove(w.tmpfile.Name())
+}
@@ -0,0 +1,94 @@
+package pmtiles
+
+import (
+	"bytes"
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWriterRoundtrip(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Deduplicate: true, TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	assert.Nil(t, w.AddTile(0, 0, 0, []byte{0x1, 0x2}))
+	assert.Nil(t, w.AddTile(1, 0, 0, []byte{0x3}))
+	assert.Nil(t, w.AddTile(1, 0, 1, []byte{0x3}))
+	assert.Nil(t, w.AddTile(1, 1, 1, []byte{0x4, 0x5, 0x6}))
+
+	header, err := w.Finalize(HeaderV3{TileType: Png, MinLonE7: -10 * 10000000, MaxLonE7: 10 * 10000000, MinLatE7: -10 * 10000000, MaxLatE7: 10 * 10000000}, map[string]interface{}{"name": "test"})
+	assert.Nil(t, err)
+
+	archive := b.Bytes()
+	parsed, err := DeserializeHeader(archive[0:HeaderV3LenBytes])
+	assert.Nil(t, err)
+	assert.Equal(t, header, parsed)
+	assert.True(t, parsed.Clustered)
+	assert.Equal(t, uint64(4), parsed.AddressedTilesCount)
+	assert.Equal(t, uint64(3), parsed.TileEntriesCount)
+	assert.Equal(t, uint64(3), parsed.TileContentsCount)
+	assert.Equal(t, uint8(0), parsed.MinZoom)
+	assert.Equal(t, uint8(1), parsed.MaxZoom)
+	assert.Equal(t, uint64(len(archive)), parsed.TileDataOffset+parsed.TileDataLength)
+
+	metadata, err := DeserializeMetadata(bytes.NewReader(archive[parsed.MetadataOffset:parsed.MetadataOffset+parsed.MetadataLength]), parsed.InternalCompression)
+	assert.Nil(t, err)
+	assert.Equal(t, "test", metadata["name"])
+
+	entries := DeserializeEntries(bytes.NewBuffer(archive[parsed.RootOffset:parsed.RootOffset+parsed.RootLength]), parsed.InternalCompression)
+	entry, ok := findTile(entries, ZxyToID(1, 1, 1))
+	assert.True(t, ok)
+	tileStart := parsed.TileDataOffset + entry.Offset
+	assert.Equal(t, []byte{0x4, 0x5, 0x6}, archive[tileStart:tileStart+uint64(entry.Length)])
+}
+
+func TestWriterOutOfOrder(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	assert.Nil(t, w.AddTile(1, 0, 0, []byte{0x1}))
+	assert.Error(t, w.AddTile(0, 0, 0, []byte{0x1}))
+	assert.Error(t, w.AddTile(1, 0, 0, []byte{0x1}))
+	assert.Error(t, w.AddTile(1, 2, 0, []byte{0x1}))
+}
+
+func TestWriterEmpty(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	_, err = w.Finalize(HeaderV3{}, map[string]interface{}{})
+	assert.Error(t, err)
+}
+
+func TestWriterZstd(t *testing.T) {
+	var b bytes.Buffer
+	w, err := NewWriter(&b, WriterOptions{Compression: Zstd, TmpDir: t.TempDir()})
+	assert.Nil(t, err)
+	defer w.Close()
+
+	assert.Nil(t, w.AddTile(0, 0, 0, []byte("a vector tile")))
+	header, err := w.Finalize(HeaderV3{TileType: Mvt, InternalCompression: Zstd, MinLonE7: -10 * 10000000, MaxLonE7: 10 * 10000000, MinLatE7: -10 * 10000000, MaxLatE7: 10 * 10000000}, map[string]interface{}{"name": "zstd"})
+	assert.Nil(t, err)
+	assert.Equal(t, Compression(Zstd), header.TileCompression)
+	assert.Equal(t, Compression(Zstd), header.InternalCompression)
+
+	mockBucket, server := newServer(t)
+	mockBucket.items["archive.pmtiles"] = b.Bytes()
+
+	statusCode, headers, data := server.Get(context.Background(), "/archive/0/0/0.mvt")
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, "zstd", headers["Content-Encoding"])
+	decompressed, err := decompressBytes(data, Zstd)
+	assert.Nil(t, err)
+	assert.Equal(t, "a vector tile", string(decompressed))
+
+	statusCode, _, data = server.Get(context.Background(), "/archive/metadata")
+	assert.Equal(t, 200, statusCode)
+	assert.JSONEq(t, `{"name":"zstd"}`, string(data))
+}